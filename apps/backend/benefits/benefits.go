@@ -0,0 +1,240 @@
+// Package benefits tracks the insurance benefits of the patients: the
+// amounts paid by each coverage and the deductible met in the current
+// benefit year are computed from the insurance claims, and the secondary
+// claims are created from the primary payments (coordination of benefits).
+package benefits
+
+import (
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"zahrawiclinic.com/dates"
+	"zahrawiclinic.com/money"
+)
+
+// Register binds the benefits hooks, routes and the daily benefit year
+// rollover job to the app.
+func Register(app core.App) {
+	app.OnRecordCreate("patient_insurance").BindFunc(computeCoverage)
+	app.OnRecordUpdate("patient_insurance").BindFunc(computeCoverage)
+
+	app.OnRecordCreate("insurance_claims").BindFunc(syncClaim)
+	app.OnRecordUpdate("insurance_claims").BindFunc(syncClaim)
+	app.OnRecordDelete("insurance_claims").BindFunc(syncClaim)
+
+	app.OnRecordCreate("insurance_claims").BindFunc(coordinateClaim)
+	app.OnRecordUpdate("insurance_claims").BindFunc(coordinateClaim)
+
+	app.Cron().MustAdd("insuranceBenefits", "30 0 * * *", func() {
+		if err := RefreshAll(app); err != nil {
+			app.Logger().Error("Failed to refresh the insurance benefits", "error", err)
+		}
+	})
+
+	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
+		g := se.Router.Group("/api/clinic")
+		g.Bind(apis.RequireAuth())
+
+		g.GET("/patients/{id}/benefits", getBenefits)
+		g.GET("/treatment-plans/{id}/benefits", getPlanEstimate)
+
+		return se.Next()
+	})
+}
+
+// Usage holds the benefits of a coverage in a benefit year.
+type Usage struct {
+	Coverage     string `json:"coverage"`
+	Provider     string `json:"provider"`
+	CoverageType string `json:"coverageType"`
+
+	// YearStart and YearEnd are the first and last days of the benefit
+	// year.
+	YearStart types.DateTime `json:"yearStart"`
+	YearEnd   types.DateTime `json:"yearEnd"`
+
+	// AnnualMaximum is 0 when the coverage has no annual maximum, then
+	// RemainingMaximum is nil.
+	AnnualMaximum    money.Money  `json:"annualMaximum"`
+	Used             money.Money  `json:"used"`
+	RemainingMaximum *money.Money `json:"remainingMaximum"`
+
+	Deductible          money.Money `json:"deductible"`
+	DeductibleMet       money.Money `json:"deductibleMet"`
+	DeductibleRemaining money.Money `json:"deductibleRemaining"`
+}
+
+// BenefitYear returns the first day of the coverage benefit year that
+// includes the given date and the first day of the next one.
+func BenefitYear(coverage *core.Record, on time.Time) (time.Time, time.Time) {
+	month := time.Month(coverage.GetInt("benefitYearStartMonth"))
+	if month < time.January {
+		month = time.January
+	}
+
+	on = dates.StartOfDay(on)
+	start := time.Date(on.Year(), month, 1, 0, 0, 0, 0, time.Local)
+	if on.Before(start) {
+		start = start.AddDate(-1, 0, 0)
+	}
+
+	return start, start.AddDate(1, 0, 0)
+}
+
+// ComputeUsage computes the benefits of the coverage in the benefit year
+// that includes the given date.
+//
+// The paid amounts and applied deductibles of the coverage claims count in
+// the benefit year of the service, the invoice date (or the claim date for
+// claims without invoice). They are in the currency of the claim invoice
+// and converted to the clinic currency of the coverage amounts.
+func ComputeUsage(app core.App, coverage *core.Record, on time.Time) (Usage, error) {
+	start, end := BenefitYear(coverage, on)
+
+	usage := Usage{
+		Coverage:      coverage.Id,
+		Provider:      coverage.GetString("provider"),
+		CoverageType:  coverage.GetString("coverageType"),
+		AnnualMaximum: money.Get(coverage, "annualMaximum"),
+		Deductible:    money.Get(coverage, "deductible"),
+	}
+	usage.YearStart, _ = types.ParseDateTime(start)
+	usage.YearEnd, _ = types.ParseDateTime(end.AddDate(0, 0, -1))
+
+	if coverage.Id != "" {
+		claims, err := app.FindAllRecords("insurance_claims", dbx.HashExp{"insurance": coverage.Id})
+		if err != nil {
+			return usage, err
+		}
+
+		var deductibleApplied money.Money
+		for _, claim := range claims {
+			invoice, err := app.FindRecordById("invoices", claim.GetString("invoice"))
+			if err != nil {
+				invoice = nil
+			}
+
+			served := serviceDate(claim, invoice)
+			if served.Before(start) || !served.Before(end) {
+				continue
+			}
+
+			usage.Used += toBase(invoice, money.Get(claim, "paidAmount"))
+			deductibleApplied += toBase(invoice, money.Get(claim, "deductibleApplied"))
+		}
+
+		usage.DeductibleMet = min(deductibleApplied, usage.Deductible)
+	}
+
+	usage.DeductibleRemaining = usage.Deductible - usage.DeductibleMet
+	if usage.AnnualMaximum > 0 {
+		remaining := max(usage.AnnualMaximum-usage.Used, 0)
+		usage.RemainingMaximum = &remaining
+	}
+
+	return usage, nil
+}
+
+// serviceDate returns the date of the services of the claim, given its
+// invoice (nil when it has none).
+func serviceDate(claim *core.Record, invoice *core.Record) time.Time {
+	if invoice != nil && !invoice.GetDateTime("invoiceDate").IsZero() {
+		return dates.StartOfDay(invoice.GetDateTime("invoiceDate").Time())
+	}
+
+	return dates.StartOfDay(claim.GetDateTime("claimDate").Time())
+}
+
+// toBase converts a claim amount of the invoice currency to the clinic
+// currency. The claims without invoice are in the clinic currency.
+func toBase(invoice *core.Record, m money.Money) money.Money {
+	if invoice == nil {
+		return m
+	}
+	return money.ToBase(invoice, m)
+}
+
+// computeCoverage stores the benefits used and the deductible met of the
+// current benefit year on the coverage.
+func computeCoverage(e *core.RecordEvent) error {
+	usage, err := ComputeUsage(e.App, e.Record, time.Now())
+	if err != nil {
+		return err
+	}
+
+	money.Set(e.Record, "benefitsUsed", usage.Used)
+	money.Set(e.Record, "deductibleMet", usage.DeductibleMet)
+
+	return e.Next()
+}
+
+// syncClaim refreshes the benefits of the claim coverage, and of its
+// previous coverage when it was moved, in the same transaction.
+func syncClaim(e *core.RecordEvent) error {
+	return e.App.RunInTransaction(func(txApp core.App) error {
+		e.App = txApp
+
+		if err := e.Next(); err != nil {
+			return err
+		}
+
+		if err := Refresh(txApp, e.Record.GetString("insurance")); err != nil {
+			return err
+		}
+
+		if previous := e.Record.Original().GetString("insurance"); previous != e.Record.GetString("insurance") {
+			return Refresh(txApp, previous)
+		}
+
+		return nil
+	})
+}
+
+// Refresh recomputes and saves the coverage benefits if the stored ones
+// don't match its claims anymore.
+func Refresh(app core.App, coverageId string) error {
+	if coverageId == "" {
+		return nil
+	}
+
+	coverage, err := app.FindRecordById("patient_insurance", coverageId)
+	if err != nil {
+		return nil // deleted together with its claims
+	}
+
+	usage, err := ComputeUsage(app, coverage, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if usage.Used == money.Get(coverage, "benefitsUsed") && usage.DeductibleMet == money.Get(coverage, "deductibleMet") {
+		return nil
+	}
+
+	return app.Save(coverage)
+}
+
+// RefreshAll refreshes the benefits of the active coverages, resetting
+// the ones whose benefit year ended.
+func RefreshAll(app core.App) error {
+	coverages, err := app.FindAllRecords("patient_insurance", dbx.HashExp{"isActive": true})
+	if err != nil {
+		return err
+	}
+
+	for _, coverage := range coverages {
+		if err := Refresh(app, coverage.Id); err != nil {
+			// keep going, one coverage must not block the others
+			app.Logger().Error(
+				"Failed to refresh the insurance benefits",
+				"coverage", coverage.Id,
+				"error", err,
+			)
+		}
+	}
+
+	return nil
+}
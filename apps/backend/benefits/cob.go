@@ -0,0 +1,260 @@
+package benefits
+
+import (
+	"database/sql"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"zahrawiclinic.com/claims"
+	"zahrawiclinic.com/dates"
+	"zahrawiclinic.com/money"
+	"zahrawiclinic.com/pricing"
+)
+
+// Coordination of benefits rules of the secondary coverages.
+const (
+	RuleStandard       = "standard"
+	RuleNonDuplication = "non_duplication"
+	RuleCarveOut       = "carve_out"
+)
+
+// SecondaryBenefit returns what a secondary coverage pays for the charge
+// once the primary coverage paid, given its normal benefit (what it would
+// pay as the primary coverage):
+//
+//   - standard: the normal benefit
+//   - non_duplication: the normal benefit less the primary payment
+//   - carve_out: the normal benefit in proportion of the charge the
+//     primary payment left
+//
+// The benefit never exceeds the charge the primary payment left.
+func SecondaryBenefit(rule string, charge money.Money, normal money.Money, primaryPaid money.Money) money.Money {
+	left := max(charge-primaryPaid, 0)
+
+	var benefit money.Money
+	switch rule {
+	case RuleNonDuplication:
+		benefit = normal - primaryPaid
+	case RuleCarveOut:
+		if charge > 0 {
+			benefit = normal.Mul(float64(left) / float64(charge))
+		}
+	default:
+		benefit = normal
+	}
+
+	return max(min(benefit, left), 0)
+}
+
+// isPaid reports whether the insurer paid the claim, fully or partially.
+func isPaid(claim *core.Record) bool {
+	return slices.Contains([]string{"paid", "partial"}, claim.GetString("status"))
+}
+
+// coordinateClaim coordinates the benefits of the primary claim and its
+// secondary claim whenever either one is saved, in the same transaction.
+func coordinateClaim(e *core.RecordEvent) error {
+	if !isPaid(e.Record) && e.Record.GetString("primaryClaim") == "" {
+		return e.Next()
+	}
+
+	return e.App.RunInTransaction(func(txApp core.App) error {
+		e.App = txApp
+
+		if err := e.Next(); err != nil {
+			return err
+		}
+
+		return Coordinate(txApp, e.Record)
+	})
+}
+
+// Coordinate coordinates the benefits of a paid primary claim, given it or
+// its secondary claim: the secondary claim is created, or its claimed
+// amount follows the primary paid amount while it isn't submitted, and the
+// patient responsibility of both claims is the invoice total left by the
+// primary payment and the secondary benefit (paid, or else claimed).
+//
+// Saving a claim coordinates it again, the claims are reloaded and only
+// saved when their amounts change.
+func Coordinate(app core.App, claim *core.Record) error {
+	primaryId := claim.Id
+	if id := claim.GetString("primaryClaim"); id != "" {
+		primaryId = id
+	}
+
+	primary, err := app.FindRecordById("insurance_claims", primaryId)
+	if err != nil {
+		return nil // deleted primary claim
+	}
+	if !isPaid(primary) {
+		return nil
+	}
+
+	coverage, err := app.FindRecordById("patient_insurance", primary.GetString("insurance"))
+	if err != nil || coverage.GetString("coverageType") != "primary" {
+		return nil
+	}
+
+	invoice, err := app.FindRecordById("invoices", primary.GetString("invoice"))
+	if err != nil {
+		return nil
+	}
+
+	secondary, err := app.FindFirstRecordByFilter(
+		"insurance_claims",
+		"primaryClaim = {:primary} && status != 'denied'",
+		dbx.Params{"primary": primary.Id},
+	)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if secondary, err = CreateSecondaryClaim(app, primary, invoice); err != nil {
+			return err
+		}
+	} else if secondary.GetString("status") == "pending" {
+		benefit, err := secondaryBenefit(app, primary, secondary, invoice)
+		if err != nil {
+			return err
+		}
+		money.Set(secondary, "claimedAmount", benefit)
+	}
+
+	responsibility := money.Get(invoice, "total") - money.Get(primary, "paidAmount")
+	if secondary != nil {
+		if isPaid(secondary) {
+			responsibility -= money.Get(secondary, "paidAmount")
+		} else {
+			responsibility -= money.Get(secondary, "claimedAmount")
+		}
+		money.Set(secondary, "patientResponsibility", max(responsibility, 0))
+	}
+	money.Set(primary, "patientResponsibility", max(responsibility, 0))
+
+	for _, record := range []*core.Record{primary, secondary} {
+		if record == nil || !changed(record, "claimedAmount", "patientResponsibility") {
+			continue
+		}
+		if err := app.Save(record); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// changed reports whether one of the monetary fields of the record differs
+// from its stored value.
+func changed(record *core.Record, fields ...string) bool {
+	for _, field := range fields {
+		if money.Get(record, field) != money.Get(record.Original(), field) {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateSecondaryClaim creates the pending claim of the invoice for the
+// patient's secondary coverage once the primary claim was paid, following
+// the COB rule of the secondary coverage.
+//
+// It returns nil when the patient has no secondary coverage on the invoice
+// date, when the secondary claim already exists or when the secondary
+// coverage has nothing left to pay.
+func CreateSecondaryClaim(app core.App, primary *core.Record, invoice *core.Record) (*core.Record, error) {
+	on := invoice.GetDateTime("invoiceDate").Time()
+	if on.IsZero() {
+		on = primary.GetDateTime("claimDate").Time()
+	}
+
+	secondary, err := pricing.ActiveCoverage(app, invoice.GetString("patient"), "secondary", on)
+	if err != nil || secondary == nil {
+		return nil, err
+	}
+
+	existing, err := app.CountRecords("insurance_claims", dbx.Or(
+		dbx.HashExp{"primaryClaim": primary.Id},
+		dbx.And(
+			dbx.HashExp{"invoice": invoice.Id, "insurance": secondary.Id},
+			dbx.NewExp("[[status]] != 'denied'"),
+		),
+	))
+	if err != nil || existing > 0 {
+		return nil, err
+	}
+
+	benefit, err := coordinatedBenefit(app, primary, secondary, invoice, on)
+	if err != nil || benefit <= 0 {
+		return nil, err
+	}
+
+	collection, err := app.FindCollectionByNameOrId("insurance_claims")
+	if err != nil {
+		return nil, err
+	}
+
+	claim := core.NewRecord(collection)
+	claim.Set("patient", invoice.GetString("patient"))
+	claim.Set("insurance", secondary.Id)
+	claim.Set("invoice", invoice.Id)
+	claim.Set("primaryClaim", primary.Id)
+	claim.Set("claimDate", dates.Today())
+	claim.Set("status", "pending")
+	money.Set(claim, "claimedAmount", benefit)
+	money.Set(claim, "patientResponsibility", max(money.Get(invoice, "total")-money.Get(primary, "paidAmount")-benefit, 0))
+
+	if err := app.Save(claim); err != nil {
+		return nil, err
+	}
+
+	return claim, nil
+}
+
+// secondaryBenefit returns the benefit of the secondary claim for the paid
+// amount of its primary claim.
+func secondaryBenefit(app core.App, primary *core.Record, secondary *core.Record, invoice *core.Record) (money.Money, error) {
+	coverage, err := app.FindRecordById("patient_insurance", secondary.GetString("insurance"))
+	if err != nil {
+		return money.Get(secondary, "claimedAmount"), nil
+	}
+
+	on := invoice.GetDateTime("invoiceDate").Time()
+	if on.IsZero() {
+		on = primary.GetDateTime("claimDate").Time()
+	}
+
+	return coordinatedBenefit(app, primary, coverage, invoice, on)
+}
+
+// coordinatedBenefit returns what the secondary coverage pays of the
+// invoice after the primary claim, following its COB rule and within its
+// remaining annual maximum.
+func coordinatedBenefit(app core.App, primary *core.Record, coverage *core.Record, invoice *core.Record, on time.Time) (money.Money, error) {
+	lines, err := claims.CoveredLines(app, invoice.Id)
+	if err != nil {
+		return 0, err
+	}
+
+	var charge, normal money.Money
+	for _, line := range lines {
+		charge += line.Amount
+		normal += line.Covered
+	}
+
+	benefit := SecondaryBenefit(coverage.GetString("cobRule"), charge, normal, money.Get(primary, "paidAmount"))
+
+	usage, err := ComputeUsage(app, coverage, on)
+	if err != nil {
+		return 0, err
+	}
+	if usage.RemainingMaximum != nil {
+		// the benefits are tracked in the clinic currency
+		benefit = min(benefit, money.FromBase(invoice, *usage.RemainingMaximum))
+	}
+
+	return max(benefit, 0), nil
+}
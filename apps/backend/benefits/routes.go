@@ -0,0 +1,142 @@
+package benefits
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"zahrawiclinic.com/claims"
+	"zahrawiclinic.com/dates"
+	"zahrawiclinic.com/money"
+	"zahrawiclinic.com/pricing"
+)
+
+// getBenefits handles GET /api/clinic/patients/{id}/benefits.
+//
+// It returns the benefits of the patient's active coverages in their
+// current benefit year, primary coverage first.
+func getBenefits(e *core.RequestEvent) error {
+	patient, err := e.App.FindRecordById("patients", e.Request.PathValue("id"))
+	if err != nil {
+		return e.NotFoundError("Patient not found.", err)
+	}
+
+	today := dates.Today().UTC().Format(types.DefaultDateLayout)
+	coverages, err := e.App.FindRecordsByFilter(
+		"patient_insurance",
+		"patient = {:patient} && isActive = true"+
+			" && (effectiveDate = '' || effectiveDate <= {:today})"+
+			" && (expirationDate = '' || expirationDate >= {:today})",
+		"coverageType,-effectiveDate",
+		0,
+		0,
+		dbx.Params{"patient": patient.Id, "today": today},
+	)
+	if err != nil {
+		return e.InternalServerError("Failed to load the coverages.", err)
+	}
+
+	usages := make([]Usage, 0, len(coverages))
+	for _, coverage := range coverages {
+		usage, err := ComputeUsage(e.App, coverage, time.Now())
+		if err != nil {
+			return e.InternalServerError("Failed to compute the benefits.", err)
+		}
+		usages = append(usages, usage)
+	}
+
+	return e.JSON(200, map[string]any{
+		"patient":   patient.Id,
+		"coverages": usages,
+	})
+}
+
+// PlanEstimate compares the insurance portion of a treatment plan with the
+// remaining benefits of the patient's primary coverage.
+type PlanEstimate struct {
+	Plan     string `json:"plan"`
+	Coverage string `json:"coverage"`
+
+	// EstimatedCost is the cost of the plan items still to be done.
+	EstimatedCost money.Money `json:"estimatedCost"`
+
+	// EstimatedInsurance is the part of EstimatedCost covered by the
+	// coverage rates of the procedures.
+	EstimatedInsurance money.Money `json:"estimatedInsurance"`
+
+	RemainingMaximum    *money.Money `json:"remainingMaximum"`
+	DeductibleRemaining money.Money  `json:"deductibleRemaining"`
+
+	ExceedsMaximum bool   `json:"exceedsMaximum"`
+	Warning        string `json:"warning"`
+}
+
+// EstimatePlan estimates the insurance portion of the treatment plan items
+// that aren't completed or cancelled yet and warns when it exceeds the
+// remaining annual maximum of the patient's primary coverage.
+func EstimatePlan(app core.App, plan *core.Record) (PlanEstimate, error) {
+	estimate := PlanEstimate{Plan: plan.Id}
+
+	items, err := app.FindRecordsByFilter(
+		"treatment_plan_items",
+		"treatmentPlan = {:plan} && status != 'completed' && status != 'cancelled'",
+		"",
+		0,
+		0,
+		dbx.Params{"plan": plan.Id},
+	)
+	if err != nil {
+		return estimate, err
+	}
+
+	for _, item := range items {
+		cost := money.Get(item, "estimatedCost")
+		estimate.EstimatedCost += cost
+		estimate.EstimatedInsurance += cost.Percent(claims.ProcedureRate(app, item.GetString("treatmentType")))
+	}
+	if len(items) == 0 {
+		estimate.EstimatedCost = money.Get(plan, "estimatedCost")
+	}
+
+	coverage, err := pricing.ActivePrimaryCoverage(app, plan.GetString("patient"), time.Now())
+	if err != nil || coverage == nil {
+		return estimate, err
+	}
+	estimate.Coverage = coverage.Id
+
+	usage, err := ComputeUsage(app, coverage, time.Now())
+	if err != nil {
+		return estimate, err
+	}
+	estimate.RemainingMaximum = usage.RemainingMaximum
+	estimate.DeductibleRemaining = usage.DeductibleRemaining
+
+	if usage.RemainingMaximum != nil && estimate.EstimatedInsurance > *usage.RemainingMaximum {
+		estimate.ExceedsMaximum = true
+		estimate.Warning = fmt.Sprintf(
+			"The estimated insurance portion of %s exceeds the %s left of the annual maximum, the patient would pay the %s difference.",
+			estimate.EstimatedInsurance,
+			*usage.RemainingMaximum,
+			estimate.EstimatedInsurance-*usage.RemainingMaximum,
+		)
+	}
+
+	return estimate, nil
+}
+
+// getPlanEstimate handles GET /api/clinic/treatment-plans/{id}/benefits.
+func getPlanEstimate(e *core.RequestEvent) error {
+	plan, err := e.App.FindRecordById("treatment_plans", e.Request.PathValue("id"))
+	if err != nil {
+		return e.NotFoundError("Treatment plan not found.", err)
+	}
+
+	estimate, err := EstimatePlan(e.App, plan)
+	if err != nil {
+		return e.InternalServerError("Failed to estimate the treatment plan.", err)
+	}
+
+	return e.JSON(200, estimate)
+}
@@ -0,0 +1,286 @@
+package billing
+
+import (
+	"fmt"
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"zahrawiclinic.com/money"
+	"zahrawiclinic.com/sequences"
+)
+
+// creditNoteSequence is the number_sequences key of the credit note numbers.
+const creditNoteSequence = "credit_note"
+
+// adjustmentCollections are the records that change an invoice balance
+// besides its payments. They only count once posted, and can't be changed
+// or deleted after that: mistakes are corrected with another adjustment.
+var adjustmentCollections = []string{"refunds", "credit_notes", "write_offs"}
+
+var adjustmentLabels = map[string]string{
+	"refunds":      "refunds",
+	"credit_notes": "credit notes",
+	"write_offs":   "write-offs",
+}
+
+// isPosted reports whether the adjustment counts in the invoice balance.
+func isPosted(record *core.Record) bool {
+	return record.GetString("status") == "posted"
+}
+
+// rejectPostedChange rejects changes to a posted adjustment.
+func rejectPostedChange(e *core.RecordEvent) error {
+	if e.Record.IsNew() || !isPosted(e.Record.Original()) {
+		return nil
+	}
+
+	return apis.NewBadRequestError(
+		fmt.Sprintf("Posted %s can't be changed, record another adjustment instead.", adjustmentLabels[e.Record.Collection().Name]),
+		nil,
+	)
+}
+
+// preventPostedDelete only lets drafts be deleted through the API. The
+// cascade deletes of a patient or invoice still remove them.
+func preventPostedDelete(e *core.RecordRequestEvent) error {
+	if isPosted(e.Record) {
+		return apis.NewBadRequestError(
+			fmt.Sprintf("Posted %s can't be deleted, record another adjustment instead.", adjustmentLabels[e.Record.Collection().Name]),
+			nil,
+		)
+	}
+
+	return e.Next()
+}
+
+// syncAdjustment fills the fields derived from the linked records, stamps
+// the posting date and numbers posted credit notes, then refreshes the
+// invoice balance in the same transaction.
+func syncAdjustment(e *core.RecordEvent) error {
+	return e.App.RunInTransaction(func(txApp core.App) error {
+		e.App = txApp
+
+		if e.Record.Collection().Name == "refunds" {
+			payment, err := txApp.FindRecordById("payments", e.Record.GetString("payment"))
+			if err == nil {
+				e.Record.Set("invoice", payment.GetString("invoice"))
+				if e.Record.GetString("patient") == "" {
+					e.Record.Set("patient", payment.GetString("patient"))
+				}
+			}
+		}
+
+		if e.Record.Collection().Name == "credit_notes" || e.Record.Collection().Name == "write_offs" {
+			if e.Record.GetString("patient") == "" {
+				invoice, err := txApp.FindRecordById("invoices", e.Record.GetString("invoice"))
+				if err == nil {
+					e.Record.Set("patient", invoice.GetString("patient"))
+				}
+			}
+		}
+
+		if isPosted(e.Record) && (e.Record.IsNew() || !isPosted(e.Record.Original())) {
+			e.Record.Set("postedAt", types.NowDateTime())
+
+			if e.Record.Collection().Name == "credit_notes" && e.Record.GetString("creditNoteNumber") == "" {
+				on := e.Record.GetDateTime("issueDate").Time().Local()
+				if on.IsZero() {
+					on = time.Now()
+				}
+
+				number, err := sequences.Next(txApp, creditNoteSequence, on)
+				if err != nil {
+					return err
+				}
+				e.Record.Set("creditNoteNumber", number)
+			}
+		}
+
+		if err := e.Next(); err != nil {
+			return err
+		}
+
+		return RefreshInvoice(txApp, e.Record.GetString("invoice"))
+	})
+}
+
+// validateRefund rejects changes to posted refunds and refunds above what
+// is left of the payment.
+func validateRefund(e *core.RecordEvent) error {
+	if err := rejectPostedChange(e); err != nil {
+		return err
+	}
+
+	payment, err := e.App.FindRecordById("payments", e.Record.GetString("payment"))
+	if err != nil {
+		return e.Next() // the relation field validator reports the missing record
+	}
+
+	if e.Record.GetString("patient") != payment.GetString("patient") {
+		return validation.Errors{
+			"payment": validation.NewError("validation_payment_patient", "The payment belongs to a different patient."),
+		}
+	}
+
+	refunded, err := refundedAmount(e.App, payment.Id, e.Record.Id)
+	if err != nil {
+		return err
+	}
+
+	// the refunds are in the invoice currency
+	if refundable := money.Get(payment, "invoiceAmount") - refunded; money.Get(e.Record, "amount") > refundable {
+		return validation.Errors{
+			"amount": validation.NewError(
+				"validation_refund_exceeds_payment",
+				fmt.Sprintf("At most %s of the payment can be refunded.", money.CurrencyOf(e.App, e.Record).Display(max(refundable, 0))),
+			),
+		}
+	}
+
+	return e.Next()
+}
+
+// validateCreditNote rejects changes to posted credit notes, credit notes
+// for invoices that weren't issued and credits above the invoice total.
+func validateCreditNote(e *core.RecordEvent) error {
+	if err := rejectPostedChange(e); err != nil {
+		return err
+	}
+
+	if previous := e.Record.Original().GetString("creditNoteNumber"); previous != "" && e.Record.GetString("creditNoteNumber") != previous {
+		return validation.Errors{
+			"creditNoteNumber": validation.NewError("validation_credit_note_number_locked", "The credit note number can't be changed."),
+		}
+	}
+
+	invoice, err := adjustedInvoice(e)
+	if err != nil || invoice == nil {
+		return err
+	}
+
+	credited, err := postedTotal(e.App, "credit_notes", invoice.Id, e.Record.Id)
+	if err != nil {
+		return err
+	}
+
+	if creditable := money.Get(invoice, "total") - credited; money.Get(e.Record, "amount") > creditable {
+		return validation.Errors{
+			"amount": validation.NewError(
+				"validation_credit_exceeds_invoice",
+				fmt.Sprintf("At most %s of the invoice can still be credited.", money.CurrencyOf(e.App, invoice).Display(max(creditable, 0))),
+			),
+		}
+	}
+
+	return e.Next()
+}
+
+// validateWriteOff rejects changes to posted write-offs, write-offs above
+// the balance due and posting without the approval of a dentist.
+func validateWriteOff(e *core.RecordEvent) error {
+	if err := rejectPostedChange(e); err != nil {
+		return err
+	}
+
+	invoice, err := adjustedInvoice(e)
+	if err != nil || invoice == nil {
+		return err
+	}
+
+	if isPosted(e.Record) {
+		approver, err := e.App.FindRecordById("users", e.Record.GetString("approvedBy"))
+		if err != nil {
+			return validation.Errors{
+				"approvedBy": validation.NewError("validation_required", "Write-offs must be approved before they are posted."),
+			}
+		}
+		if approver.GetString("role") != "Dentist" {
+			return validation.Errors{
+				"approvedBy": validation.NewError("validation_approver_role", "Write-offs must be approved by a dentist."),
+			}
+		}
+	}
+
+	balance, err := ComputeBalance(e.App, invoice, e.Record.Id)
+	if err != nil {
+		return err
+	}
+
+	if money.Get(e.Record, "amount") > balance.BalanceDue {
+		return validation.Errors{
+			"amount": validation.NewError(
+				"validation_write_off_exceeds_balance",
+				fmt.Sprintf("The outstanding balance is %s.", money.CurrencyOf(e.App, invoice).Display(max(balance.BalanceDue, 0))),
+			),
+		}
+	}
+
+	return e.Next()
+}
+
+// approveWriteOff stamps the dentist posting a write-off through the API
+// as its approver: the approval can't be claimed on behalf of another
+// user. Superusers may still set the approver.
+func approveWriteOff(e *core.RecordRequestEvent) error {
+	if !isPosted(e.Record) || (!e.Record.IsNew() && isPosted(e.Record.Original())) || e.HasSuperuserAuth() {
+		return e.Next()
+	}
+
+	if e.Auth == nil || e.Auth.Collection().Name != "users" || e.Auth.GetString("role") != "Dentist" {
+		return validation.Errors{
+			"approvedBy": validation.NewError("validation_approver_role", "Write-offs must be posted by the approving dentist."),
+		}
+	}
+	e.Record.Set("approvedBy", e.Auth.Id)
+
+	return e.Next()
+}
+
+// adjustedInvoice loads the invoice of a credit note or write-off and
+// checks that it belongs to the same patient and was issued. It returns a
+// nil invoice when the relation field validator reports the error.
+func adjustedInvoice(e *core.RecordEvent) (*core.Record, error) {
+	invoice, err := e.App.FindRecordById("invoices", e.Record.GetString("invoice"))
+	if err != nil {
+		return nil, e.Next()
+	}
+
+	if e.Record.GetString("patient") != invoice.GetString("patient") {
+		return nil, validation.Errors{
+			"invoice": validation.NewError("validation_invoice_patient", "The invoice belongs to a different patient."),
+		}
+	}
+
+	if status := invoice.GetString("status"); status == "draft" || status == "cancelled" {
+		return nil, validation.Errors{
+			"invoice": validation.NewError("validation_invoice_not_issued", "The invoice is a draft or cancelled."),
+		}
+	}
+
+	return invoice, nil
+}
+
+// refundedAmount sums the posted refunds of a payment, ignoring the refund
+// with the given id (if any).
+func refundedAmount(app core.App, paymentId string, exclude string) (money.Money, error) {
+	query := app.DB().
+		Select("COALESCE(SUM([[amount]]), 0) AS total").
+		From("refunds").
+		Where(dbx.HashExp{"payment": paymentId, "status": "posted"})
+	if exclude != "" {
+		query.AndWhere(dbx.Not(dbx.HashExp{"id": exclude}))
+	}
+
+	var row struct {
+		Total float64 `db:"total"`
+	}
+	if err := query.One(&row); err != nil {
+		return 0, err
+	}
+
+	return money.FromMinor(row.Total), nil
+}
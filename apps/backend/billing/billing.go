@@ -0,0 +1,337 @@
+// Package billing keeps the invoices consistent: line item totals, the
+// invoice header and the invoice balance are always computed server side,
+// invoices are numbered without gaps and refunds, credit notes and
+// write-offs can't be changed once posted.
+package billing
+
+import (
+	"fmt"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/hook"
+	"github.com/spf13/cast"
+	"zahrawiclinic.com/money"
+)
+
+// totalsPriority runs the totals hooks after the other record hooks
+// (e.g. pricing) have filled the amounts they depend on.
+const totalsPriority = 100
+
+// Register binds the billing hooks, the invoice and receipt documents
+// routes and the tax report to the app.
+func Register(app core.App) {
+	app.OnRecordCreate("invoice_items").Bind(&hook.Handler[*core.RecordEvent]{
+		Func:     syncItem,
+		Priority: totalsPriority,
+	})
+	app.OnRecordUpdate("invoice_items").Bind(&hook.Handler[*core.RecordEvent]{
+		Func:     syncItem,
+		Priority: totalsPriority,
+	})
+	app.OnRecordDelete("invoice_items").BindFunc(syncDeletedItem)
+
+	app.OnRecordCreate("invoices").Bind(&hook.Handler[*core.RecordEvent]{
+		Func:     computeInvoiceTotals,
+		Priority: totalsPriority,
+	})
+	app.OnRecordUpdate("invoices").Bind(&hook.Handler[*core.RecordEvent]{
+		Func:     computeInvoiceTotals,
+		Priority: totalsPriority,
+	})
+
+	app.OnRecordCreate("invoices").BindFunc(assignInvoiceNumber)
+	app.OnRecordValidate("invoices").BindFunc(validateInvoiceNumber)
+	app.OnRecordDeleteRequest("invoices").BindFunc(preventInvoiceDelete)
+
+	app.OnRecordValidate("payments").BindFunc(validatePayment)
+	app.OnRecordCreate("payments").BindFunc(syncPayment)
+	app.OnRecordUpdate("payments").BindFunc(syncPayment)
+	app.OnRecordDelete("payments").BindFunc(syncPayment)
+
+	app.OnRecordValidate("refunds").BindFunc(validateRefund)
+	app.OnRecordValidate("credit_notes").BindFunc(validateCreditNote)
+	app.OnRecordValidate("write_offs").BindFunc(validateWriteOff)
+	for _, collection := range adjustmentCollections {
+		app.OnRecordCreate(collection).BindFunc(syncAdjustment)
+		app.OnRecordUpdate(collection).BindFunc(syncAdjustment)
+		app.OnRecordDeleteRequest(collection).BindFunc(preventPostedDelete)
+	}
+	app.OnRecordCreateRequest("write_offs").BindFunc(approveWriteOff)
+	app.OnRecordUpdateRequest("write_offs").BindFunc(approveWriteOff)
+
+	app.OnRecordCreateRequest("invoice_items").BindFunc(rejectItemTotalsMismatch)
+	app.OnRecordUpdateRequest("invoice_items").BindFunc(rejectItemTotalsMismatch)
+	app.OnRecordCreateRequest("invoices").BindFunc(rejectInvoiceTotalsMismatch)
+	app.OnRecordUpdateRequest("invoices").BindFunc(rejectInvoiceTotalsMismatch)
+
+	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
+		registerRoutes(se)
+		return se.Next()
+	})
+}
+
+// syncItem computes the item total and tax, then refreshes the invoice
+// header in the same transaction.
+func syncItem(e *core.RecordEvent) error {
+	return e.App.RunInTransaction(func(txApp core.App) error {
+		e.App = txApp
+
+		invoice, err := txApp.FindRecordById("invoices", e.Record.GetString("invoice"))
+		if err != nil {
+			return e.Next() // the relation field validator reports the missing record
+		}
+
+		if err := ApplyTaxRate(txApp, e.Record, invoice); err != nil {
+			return err
+		}
+		ApplyLine(e.Record, ComputeLine(e.Record, money.CurrencyOf(txApp, invoice)))
+
+		if err := e.Next(); err != nil {
+			return err
+		}
+
+		if err := RefreshInvoice(txApp, invoice.Id); err != nil {
+			return err
+		}
+
+		// the item was moved to another invoice
+		if previous := e.Record.Original().GetString("invoice"); !e.Record.IsNew() && previous != invoice.Id {
+			return RefreshInvoice(txApp, previous)
+		}
+
+		return nil
+	})
+}
+
+// syncDeletedItem refreshes the invoice header after an item is deleted.
+func syncDeletedItem(e *core.RecordEvent) error {
+	return e.App.RunInTransaction(func(txApp core.App) error {
+		e.App = txApp
+
+		if err := e.Next(); err != nil {
+			return err
+		}
+
+		return RefreshInvoice(txApp, e.Record.GetString("invoice"))
+	})
+}
+
+// RefreshInvoice recomputes and saves the invoice header if its stored
+// totals or balance don't match its items and payments anymore.
+func RefreshInvoice(app core.App, invoiceId string) error {
+	invoice, err := app.FindRecordById("invoices", invoiceId)
+	if err != nil {
+		return nil // deleted together with its items
+	}
+
+	expected := invoice.Clone()
+	if err := computeState(app, expected); err != nil {
+		return err
+	}
+
+	for _, field := range computedFields {
+		if expected.Get(field) != invoice.Get(field) {
+			return app.Save(invoice)
+		}
+	}
+
+	if expected.GetString("taxBreakdown") != invoice.GetString("taxBreakdown") {
+		return app.Save(invoice)
+	}
+
+	return nil
+}
+
+// computedFields are the invoice fields maintained by the hooks.
+var computedFields = []string{
+	"subtotal",
+	"discount",
+	"tax",
+	"total",
+	"baseTotal",
+	"amountPaid",
+	"creditedAmount",
+	"writtenOffAmount",
+	"balanceDue",
+	"status",
+}
+
+// computeState computes the invoice totals from its items and its balance
+// and status from its payments.
+func computeState(app core.App, invoice *core.Record) error {
+	items, err := invoiceItems(app, invoice.Id)
+	if err != nil {
+		return err
+	}
+
+	currency := money.CurrencyOf(app, invoice)
+
+	ApplyTotals(invoice, ComputeTotals(items, currency))
+
+	breakdown, err := ComputeTaxBreakdown(app, items, currency)
+	if err != nil {
+		return err
+	}
+	invoice.Set("taxBreakdown", breakdown)
+
+	balance, err := ComputeBalance(app, invoice, "")
+	if err != nil {
+		return err
+	}
+
+	ApplyBalance(invoice, balance)
+
+	return nil
+}
+
+// computeInvoiceTotals computes the invoice header from its items and
+// payments. When the date of a draft invoice changes, the tax rates of the
+// items are resolved again first, issued invoices keep their taxes.
+func computeInvoiceTotals(e *core.RecordEvent) error {
+	return e.App.RunInTransaction(func(txApp core.App) error {
+		e.App = txApp
+
+		invoiceDate := e.Record.GetDateTime("invoiceDate")
+
+		if !e.Record.IsNew() &&
+			e.Record.Original().GetString("status") == "draft" &&
+			!invoiceDate.Equal(e.Record.Original().GetDateTime("invoiceDate")) {
+			items, err := invoiceItems(txApp, e.Record.Id)
+			if err != nil {
+				return err
+			}
+
+			for _, item := range items {
+				rate, percent := item.GetString("taxRate"), item.GetFloat("taxPercent")
+				if rate == "" && !item.GetBool("taxable") {
+					continue // flagged as not taxable
+				}
+				if err := resolveTaxRate(txApp, item, e.Record); err != nil {
+					return err
+				}
+				if rate == item.GetString("taxRate") && percent == item.GetFloat("taxPercent") {
+					continue
+				}
+
+				line := ComputeLine(item, money.CurrencyOf(txApp, e.Record))
+
+				// updated directly, the item hooks would refresh this invoice
+				// again with its previous date
+				_, err := txApp.DB().Update(
+					"invoice_items",
+					dbx.Params{
+						"taxCategory": item.GetString("taxCategory"),
+						"taxRate":     item.GetString("taxRate"),
+						"taxPercent":  item.GetFloat("taxPercent"),
+						"taxable":     item.GetBool("taxable"),
+						"total":       int64(line.Net),
+						"taxAmount":   int64(line.Tax),
+					},
+					dbx.HashExp{"id": item.Id},
+				).Execute()
+				if err != nil {
+					return fmt.Errorf("invoice item %s: %w", item.Id, err)
+				}
+			}
+		}
+
+		if err := computeState(txApp, e.Record); err != nil {
+			return err
+		}
+
+		return e.Next()
+	})
+}
+
+// rejectItemTotalsMismatch rejects submitted item totals that differ from
+// the computed ones. Clients may omit them.
+func rejectItemTotalsMismatch(e *core.RecordRequestEvent) error {
+	invoice, err := e.App.FindRecordById("invoices", e.Record.GetString("invoice"))
+	if err != nil {
+		return e.Next() // the relation field validator reports the missing record
+	}
+
+	if err := ApplyTaxRate(e.App, e.Record, invoice); err != nil {
+		return err
+	}
+	line := ComputeLine(e.Record, money.CurrencyOf(e.App, invoice))
+
+	errs, err := mismatches(e, map[string]money.Money{
+		"total":     line.Net,
+		"taxAmount": line.Tax,
+	})
+	if err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return e.BadRequestError("The submitted totals don't match the line item.", errs)
+	}
+
+	return e.Next()
+}
+
+// rejectInvoiceTotalsMismatch rejects submitted invoice totals and
+// balances that differ from the ones computed from its items and payments.
+// Clients may omit them.
+func rejectInvoiceTotalsMismatch(e *core.RecordRequestEvent) error {
+	computed := e.Record.Clone()
+	if err := computeState(e.App, computed); err != nil {
+		return err
+	}
+
+	expected := map[string]money.Money{}
+	for _, field := range computedFields {
+		if field != "status" {
+			expected[field] = money.Get(computed, field)
+		}
+	}
+
+	errs, err := mismatches(e, expected)
+	if err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return e.BadRequestError("The submitted totals don't match the invoice items and payments.", errs)
+	}
+
+	return e.Next()
+}
+
+// mismatches compares the submitted amounts with the expected ones.
+func mismatches(e *core.RecordRequestEvent, expected map[string]money.Money) (validation.Errors, error) {
+	info, err := e.RequestInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	currency := money.CurrencyOf(e.App, e.Record)
+
+	errs := validation.Errors{}
+	for field, want := range expected {
+		raw, ok := info.Body[field]
+		if !ok {
+			continue
+		}
+
+		got, err := cast.ToFloat64E(raw)
+		if err != nil {
+			continue // the field validator reports invalid numbers
+		}
+
+		c := currency
+		if field == "baseTotal" {
+			c = money.Default()
+		}
+
+		if c.FromDecimal(got) != want {
+			errs[field] = validation.NewError(
+				"validation_total_mismatch",
+				fmt.Sprintf("Expected %s, this amount is computed automatically.", c.Format(want)),
+			)
+		}
+	}
+
+	return errs, nil
+}
@@ -0,0 +1,247 @@
+package billing
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"zahrawiclinic.com/documents"
+	"zahrawiclinic.com/money"
+)
+
+// RenderInvoice builds the invoice PDF: the billed patient, the line items
+// with their discount and tax, the totals and the balance with the
+// insurance portion. The amounts are in the invoice currency, with the
+// total in the clinic currency for foreign currency invoices.
+func RenderInvoice(app core.App, invoice *core.Record) ([]byte, error) {
+	patient, err := app.FindRecordById("patients", invoice.GetString("patient"))
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := app.FindRecordsByFilter(
+		"invoice_items",
+		"invoice = {:invoice}",
+		"lineNumber,created",
+		0,
+		0,
+		dbx.Params{"invoice": invoice.Id},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	balance, err := ComputeBalance(app, invoice, "")
+	if err != nil {
+		return nil, err
+	}
+
+	currency, base := money.CurrencyOf(app, invoice), money.Default()
+	format := currency.Format
+
+	breakdown, err := ComputeTaxBreakdown(app, items, currency)
+	if err != nil {
+		return nil, err
+	}
+
+	title := "Invoice " + invoice.GetString("invoiceNumber")
+	switch invoice.GetString("status") {
+	case "draft":
+		title = "Draft invoice"
+	case "cancelled":
+		title += " (cancelled)"
+	}
+
+	doc := documents.New(title, documents.LetterheadFromApp(app))
+
+	doc.Title(title)
+	doc.Field("Invoice number", invoice.GetString("invoiceNumber"))
+	doc.Field("Invoice date", formatDate(invoice.GetDateTime("invoiceDate")))
+	doc.Field("Due date", formatDate(invoice.GetDateTime("dueDate")))
+	doc.Field("Currency", currency.Code)
+	if insurance := money.Get(invoice, "insuranceAmount"); insurance != 0 {
+		doc.Field("Insurance portion", format(insurance))
+	}
+
+	doc.Heading("Bill to")
+	doc.Paragraph(strings.Join(patientLines(app, patient), "\n"))
+
+	rows := make([][]string, 0, len(items))
+	for i, item := range items {
+		line := ComputeLine(item, currency)
+		rows = append(rows, []string{
+			strconv.Itoa(i + 1),
+			item.GetString("description"),
+			strconv.FormatFloat(item.GetFloat("quantity"), 'f', -1, 64),
+			format(money.Get(item, "unitPrice")),
+			blank(currency, line.Discount),
+			blank(currency, line.Tax),
+			format(line.Net),
+		})
+	}
+
+	doc.Heading("Items")
+	doc.Table([]documents.Column{
+		{Header: "#", Width: 0.05},
+		{Header: "Description", Width: 0.37},
+		{Header: "Qty", Width: 0.08, Align: "R"},
+		{Header: "Unit price", Width: 0.13, Align: "R"},
+		{Header: "Discount", Width: 0.12, Align: "R"},
+		{Header: "Tax", Width: 0.12, Align: "R"},
+		{Header: "Amount", Width: 0.13, Align: "R"},
+	}, rows)
+
+	doc.Space(3)
+	totals := [][2]string{{"Subtotal", format(money.Get(invoice, "subtotal"))}}
+	if discount := money.Get(invoice, "discount"); discount != 0 {
+		totals = append(totals, [2]string{"Discount", format(-discount)})
+	}
+	for _, line := range breakdown {
+		if line.Tax != 0 {
+			totals = append(totals, [2]string{fmt.Sprintf("%s %g%% on %s", line.Name, line.Rate, format(line.TaxableAmount)), format(line.Tax)})
+		}
+	}
+	totals = append(totals, [2]string{"Total " + currency.Code, format(money.Get(invoice, "total"))})
+	doc.Totals(totals)
+
+	if currency.Code != base.Code {
+		doc.Paragraph(fmt.Sprintf(
+			"Exchange rate: 1 %s = %g %s. Total in %s: %s.",
+			currency.Code,
+			invoice.GetFloat("exchangeRate"),
+			base.Code,
+			base.Code,
+			base.Format(money.ToBase(invoice, money.Get(invoice, "total"))),
+		))
+	}
+
+	doc.Space(3)
+	lines := [][2]string{}
+	if balance.InsurancePaid != 0 {
+		lines = append(lines, [2]string{"Insurance paid", format(-balance.InsurancePaid)})
+	}
+	if balance.PendingInsurance != 0 {
+		lines = append(lines, [2]string{"Insurance pending", format(-balance.PendingInsurance)})
+	}
+	if paid := balance.AmountPaid - balance.InsurancePaid; paid != 0 {
+		lines = append(lines, [2]string{"Patient payments", format(-paid)})
+	}
+	if balance.Credited != 0 {
+		lines = append(lines, [2]string{"Credited", format(-balance.Credited)})
+	}
+	if balance.WrittenOff != 0 {
+		lines = append(lines, [2]string{"Written off", format(-balance.WrittenOff)})
+	}
+	lines = append(lines, [2]string{"Balance due " + currency.Code, format(balance.BalanceDue)})
+	doc.Totals(lines)
+
+	if notes := invoice.GetString("notes"); notes != "" {
+		doc.Heading("Notes")
+		doc.Paragraph(notes)
+	}
+
+	return doc.Bytes()
+}
+
+// RenderReceipt builds the receipt PDF of a payment, in the payment
+// currency.
+func RenderReceipt(app core.App, payment *core.Record) ([]byte, error) {
+	patient, err := app.FindRecordById("patients", payment.GetString("patient"))
+	if err != nil {
+		return nil, err
+	}
+
+	currency := money.CurrencyOf(app, payment)
+
+	doc := documents.New("Payment receipt", documents.LetterheadFromApp(app))
+
+	doc.Title("Payment receipt")
+	doc.Field("Receipt number", strings.ToUpper(payment.Id))
+	doc.Field("Payment date", formatDate(payment.GetDateTime("paymentDate")))
+	doc.Field("Received from", strings.Join(patientLines(app, patient), "\n"))
+	doc.Field("Payment method", payment.GetString("paymentMethod"))
+	doc.Field("Transaction", payment.GetString("transactionId"))
+	doc.Field("Reference", payment.GetString("reference"))
+
+	if invoice, err := app.FindRecordById("invoices", payment.GetString("invoice")); err == nil {
+		doc.Heading("Applied to")
+		doc.Field("Invoice", invoice.GetString("invoiceNumber"))
+		doc.Field("Invoice date", formatDate(invoice.GetDateTime("invoiceDate")))
+		invoiceCurrency := money.CurrencyOf(app, invoice)
+		doc.Field("Invoice total", invoiceCurrency.Display(money.Get(invoice, "total")))
+		if invoiceCurrency.Code != currency.Code {
+			doc.Field("Amount applied", invoiceCurrency.Display(money.Get(payment, "invoiceAmount")))
+		}
+		doc.Field("Balance due", invoiceCurrency.Display(money.Get(invoice, "balanceDue")))
+	}
+
+	if notes := payment.GetString("notes"); notes != "" {
+		doc.Field("Notes", notes)
+	}
+
+	doc.Space(4)
+	doc.Totals([][2]string{{"Amount received " + currency.Code, currency.Format(money.Get(payment, "amount"))}})
+
+	if base := money.Default(); currency.Code != base.Code {
+		doc.Paragraph(fmt.Sprintf(
+			"Exchange rate: 1 %s = %g %s. Amount in %s: %s.",
+			currency.Code,
+			payment.GetFloat("exchangeRate"),
+			base.Code,
+			base.Code,
+			base.Format(money.ToBase(payment, money.Get(payment, "amount"))),
+		))
+	}
+
+	doc.Space(6)
+	doc.Paragraph("Thank you for your payment.")
+
+	return doc.Bytes()
+}
+
+// patientLines returns the patient name and postal address.
+func patientLines(app core.App, patient *core.Record) []string {
+	lines := []string{strings.TrimSpace(patient.GetString("firstName") + " " + patient.GetString("lastName"))}
+
+	if addressId := patient.GetString("primaryAddress"); addressId != "" {
+		if address, err := app.FindRecordById("addresses", addressId); err == nil {
+			lines = append(lines, nonEmpty(
+				address.GetString("street1"),
+				address.GetString("street2"),
+				strings.Join(nonEmpty(address.GetString("city"), address.GetString("state"), address.GetString("zipCode")), " "),
+				address.GetString("country"),
+			)...)
+		}
+	}
+
+	return lines
+}
+
+// blank formats an amount, leaving zero amounts blank.
+func blank(currency money.Currency, m money.Money) string {
+	if m == 0 {
+		return ""
+	}
+	return currency.Format(m)
+}
+
+func formatDate(d types.DateTime) string {
+	if d.IsZero() {
+		return ""
+	}
+	return d.Time().Local().Format(time.DateOnly)
+}
+
+func nonEmpty(values ...string) []string {
+	result := make([]string, 0, len(values))
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
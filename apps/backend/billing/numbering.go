@@ -0,0 +1,57 @@
+package billing
+
+import (
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"zahrawiclinic.com/sequences"
+)
+
+// invoiceSequence is the number_sequences key of the invoice numbers.
+const invoiceSequence = "invoice"
+
+// assignInvoiceNumber numbers new invoices created without a number in the
+// year of their invoice date. The number is taken in the transaction that
+// inserts the invoice so that a failed insert doesn't leave a gap.
+func assignInvoiceNumber(e *core.RecordEvent) error {
+	if e.Record.GetString("invoiceNumber") != "" {
+		return e.Next()
+	}
+
+	on := e.Record.GetDateTime("invoiceDate").Time().Local()
+	if on.IsZero() {
+		on = time.Now()
+	}
+
+	return e.App.RunInTransaction(func(txApp core.App) error {
+		e.App = txApp
+
+		number, err := sequences.Next(txApp, invoiceSequence, on)
+		if err != nil {
+			return err
+		}
+		e.Record.Set("invoiceNumber", number)
+
+		return e.Next()
+	})
+}
+
+// validateInvoiceNumber prevents renumbering an invoice.
+func validateInvoiceNumber(e *core.RecordEvent) error {
+	if !e.Record.IsNew() && e.Record.GetString("invoiceNumber") != e.Record.Original().GetString("invoiceNumber") {
+		return validation.Errors{
+			"invoiceNumber": validation.NewError("validation_invoice_number_locked", "The invoice number can't be changed."),
+		}
+	}
+
+	return e.Next()
+}
+
+// preventInvoiceDelete keeps the numbering gap-free: invoices are
+// cancelled, never deleted through the API. The invoices deleted together
+// with their patient (cascade delete) aren't affected.
+func preventInvoiceDelete(e *core.RecordRequestEvent) error {
+	return apis.NewBadRequestError("Invoices can't be deleted, cancel them instead.", nil)
+}
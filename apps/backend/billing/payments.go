@@ -0,0 +1,249 @@
+package billing
+
+import (
+	"fmt"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"zahrawiclinic.com/dates"
+	"zahrawiclinic.com/money"
+)
+
+// Balance holds the payment state of an invoice.
+type Balance struct {
+	// AmountPaid is the sum of all the invoice payments in the invoice
+	// currency, net of the posted refunds.
+	AmountPaid money.Money
+
+	// Credited is the sum of the posted credit notes.
+	Credited money.Money
+
+	// WrittenOff is the sum of the posted write-offs.
+	WrittenOff money.Money
+
+	// InsurancePaid is the part of AmountPaid paid by the insurance.
+	InsurancePaid money.Money
+
+	// PendingInsurance is the expected insurance amount not paid yet.
+	PendingInsurance money.Money
+
+	// BalanceDue is what the patient still owes, negative when overpaid.
+	BalanceDue money.Money
+}
+
+// ComputeBalance computes the payment state of an invoice from its
+// payments and posted adjustments, ignoring the payment, refund, credit
+// note or write-off with the given id (if any).
+func ComputeBalance(app core.App, invoice *core.Record, exclude string) (Balance, error) {
+	var balance Balance
+
+	if invoice.Id == "" {
+		balance.BalanceDue = money.Get(invoice, "total") - money.Get(invoice, "insuranceAmount")
+		return balance, nil
+	}
+
+	query := app.DB().
+		Select("[[paymentMethod]]", "COALESCE(SUM([[invoiceAmount]]), 0) AS total").
+		From("payments").
+		Where(dbx.HashExp{"invoice": invoice.Id}).
+		GroupBy("paymentMethod")
+	if exclude != "" {
+		query.AndWhere(dbx.Not(dbx.HashExp{"id": exclude}))
+	}
+
+	var rows []struct {
+		PaymentMethod string  `db:"paymentMethod"`
+		Total         float64 `db:"total"`
+	}
+	if err := query.All(&rows); err != nil {
+		return balance, err
+	}
+
+	// refunds reduce the payments of their method
+	refunds := app.DB().
+		Select("[[refundMethod]] AS paymentMethod", "-COALESCE(SUM([[amount]]), 0) AS total").
+		From("refunds").
+		Where(dbx.HashExp{"invoice": invoice.Id, "status": "posted"}).
+		GroupBy("refundMethod")
+	if exclude != "" {
+		refunds.AndWhere(dbx.Not(dbx.HashExp{"id": exclude}))
+	}
+
+	var refundRows []struct {
+		PaymentMethod string  `db:"paymentMethod"`
+		Total         float64 `db:"total"`
+	}
+	if err := refunds.All(&refundRows); err != nil {
+		return balance, err
+	}
+
+	for _, row := range append(rows, refundRows...) {
+		balance.AmountPaid += money.FromMinor(row.Total)
+		if row.PaymentMethod == "insurance" {
+			balance.InsurancePaid += money.FromMinor(row.Total)
+		}
+	}
+
+	var err error
+	if balance.Credited, err = postedTotal(app, "credit_notes", invoice.Id, exclude); err != nil {
+		return balance, err
+	}
+	if balance.WrittenOff, err = postedTotal(app, "write_offs", invoice.Id, exclude); err != nil {
+		return balance, err
+	}
+
+	balance.PendingInsurance = max(money.Get(invoice, "insuranceAmount")-balance.InsurancePaid, 0)
+	balance.BalanceDue = money.Get(invoice, "total") - balance.AmountPaid - balance.Credited - balance.WrittenOff - balance.PendingInsurance
+
+	return balance, nil
+}
+
+// postedTotal sums the posted amounts of an adjustments collection for
+// the invoice.
+func postedTotal(app core.App, collection string, invoiceId string, exclude string) (money.Money, error) {
+	query := app.DB().
+		Select("COALESCE(SUM([[amount]]), 0) AS total").
+		From(collection).
+		Where(dbx.HashExp{"invoice": invoiceId, "status": "posted"})
+	if exclude != "" {
+		query.AndWhere(dbx.Not(dbx.HashExp{"id": exclude}))
+	}
+
+	var row struct {
+		Total float64 `db:"total"`
+	}
+	if err := query.One(&row); err != nil {
+		return 0, err
+	}
+
+	return money.FromMinor(row.Total), nil
+}
+
+// ApplyBalance stores the payment state on the invoice and moves issued
+// invoices between sent, partial and paid. Draft and cancelled invoices
+// keep their status, overdue invoices stay overdue until fully settled or
+// until their due date is moved back in the future.
+func ApplyBalance(invoice *core.Record, balance Balance) {
+	money.Set(invoice, "amountPaid", balance.AmountPaid)
+	money.Set(invoice, "creditedAmount", balance.Credited)
+	money.Set(invoice, "writtenOffAmount", balance.WrittenOff)
+	money.Set(invoice, "balanceDue", balance.BalanceDue)
+
+	status := invoice.GetString("status")
+	if status == "draft" || status == "cancelled" {
+		return
+	}
+
+	total := money.Get(invoice, "total")
+	settled := balance.AmountPaid + balance.Credited + balance.WrittenOff
+	switch {
+	case total > 0 && settled >= total:
+		status = "paid"
+	case status == "overdue" && isPastDue(invoice):
+	case settled > 0:
+		status = "partial"
+	default:
+		status = "sent"
+	}
+	invoice.Set("status", status)
+}
+
+// validatePayment rejects payments for another patient or for cancelled
+// invoices, payments below what was already refunded from them and
+// payments above the outstanding balance that aren't flagged as
+// overpayments. Payments in another currency than their invoice are
+// compared by the amount they settle in the invoice currency. Payments
+// without an invoice are made towards a payment plan and validated with it.
+func validatePayment(e *core.RecordEvent) error {
+	if !e.Record.IsNew() {
+		refunded, err := refundedAmount(e.App, e.Record.Id, "")
+		if err != nil {
+			return err
+		}
+		if money.Get(e.Record, "invoiceAmount") < refunded {
+			return validation.Errors{
+				"amount": validation.NewError(
+					"validation_payment_refunded",
+					fmt.Sprintf("%s of the payment was already refunded.", refunded),
+				),
+			}
+		}
+	}
+
+	if e.Record.GetString("invoice") == "" {
+		return e.Next()
+	}
+
+	invoice, err := e.App.FindRecordById("invoices", e.Record.GetString("invoice"))
+	if err != nil {
+		return e.Next() // the relation field validator reports the missing record
+	}
+
+	if patient := e.Record.GetString("patient"); patient != "" && patient != invoice.GetString("patient") {
+		return validation.Errors{
+			"invoice": validation.NewError("validation_invoice_patient", "The invoice belongs to a different patient."),
+		}
+	}
+
+	if invoice.GetString("status") == "cancelled" {
+		return validation.Errors{
+			"invoice": validation.NewError("validation_invoice_cancelled", "The invoice is cancelled."),
+		}
+	}
+
+	if e.Record.GetBool("isOverpayment") {
+		return e.Next()
+	}
+
+	balance, err := ComputeBalance(e.App, invoice, e.Record.Id)
+	if err != nil {
+		return err
+	}
+
+	// insurance payments may also settle the expected insurance amount
+	outstanding := balance.BalanceDue
+	if e.Record.GetString("paymentMethod") == "insurance" {
+		outstanding += balance.PendingInsurance
+	}
+
+	if money.Get(e.Record, "invoiceAmount") > outstanding {
+		return validation.Errors{
+			"amount": validation.NewError(
+				"validation_overpayment",
+				fmt.Sprintf("The outstanding balance is %s, flag the payment as an overpayment to keep the excess as credit.", money.CurrencyOf(e.App, invoice).Format(max(outstanding, 0))),
+			),
+		}
+	}
+
+	return e.Next()
+}
+
+// syncPayment refreshes the invoice balance after a payment is saved, in
+// the same transaction.
+func syncPayment(e *core.RecordEvent) error {
+	return e.App.RunInTransaction(func(txApp core.App) error {
+		e.App = txApp
+
+		if err := e.Next(); err != nil {
+			return err
+		}
+
+		if err := RefreshInvoice(txApp, e.Record.GetString("invoice")); err != nil {
+			return err
+		}
+
+		// the payment was moved to another invoice
+		if previous := e.Record.Original().GetString("invoice"); previous != "" && previous != e.Record.GetString("invoice") {
+			return RefreshInvoice(txApp, previous)
+		}
+
+		return nil
+	})
+}
+
+// isPastDue reports whether the invoice due date is before today.
+func isPastDue(invoice *core.Record) bool {
+	due := invoice.GetDateTime("dueDate")
+	return !due.IsZero() && due.Time().Before(dates.Today())
+}
@@ -0,0 +1,121 @@
+package billing
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"zahrawiclinic.com/dates"
+	"zahrawiclinic.com/money"
+)
+
+// TaxReport sums the tax breakdown of the invoices issued between from and
+// to (included, zero for no limit) by rate, in the clinic currency at the
+// invoice exchange rates. Draft and cancelled invoices are left out.
+func TaxReport(app core.App, from time.Time, to time.Time) ([]TaxLine, error) {
+	exprs := []dbx.Expression{dbx.NewExp("[[status]] != 'draft' AND [[status]] != 'cancelled'")}
+	if !from.IsZero() {
+		exprs = append(exprs, dbx.NewExp("[[invoiceDate]] >= {:from}", dbx.Params{
+			"from": dates.StartOfDay(from).UTC().Format(types.DefaultDateLayout),
+		}))
+	}
+	if !to.IsZero() {
+		exprs = append(exprs, dbx.NewExp("[[invoiceDate]] < {:to}", dbx.Params{
+			"to": dates.StartOfDay(to).AddDate(0, 0, 1).UTC().Format(types.DefaultDateLayout),
+		}))
+	}
+
+	invoices, err := app.FindAllRecords("invoices", exprs...)
+	if err != nil {
+		return nil, err
+	}
+
+	type key struct {
+		code   string
+		rate   float64
+		exempt bool
+	}
+	rows := map[key]*TaxLine{}
+	for _, invoice := range invoices {
+		var breakdown []TaxLine
+		if raw := invoice.GetString("taxBreakdown"); raw != "" {
+			if err := json.Unmarshal([]byte(raw), &breakdown); err != nil {
+				return nil, fmt.Errorf("invoice %s: invalid tax breakdown: %w", invoice.GetString("invoiceNumber"), err)
+			}
+		}
+
+		for _, line := range breakdown {
+			k := key{line.Code, line.Rate, line.Exempt}
+			row := rows[k]
+			if row == nil {
+				row = &TaxLine{TaxRate: line.TaxRate, Code: line.Code, Name: line.Name, Rate: line.Rate, Exempt: line.Exempt, Currency: money.Default().Code}
+				rows[k] = row
+			}
+			row.TaxableAmount += money.ToBase(invoice, line.TaxableAmount)
+			row.Tax += money.ToBase(invoice, line.Tax)
+		}
+	}
+
+	report := make([]TaxLine, 0, len(rows))
+	for _, row := range rows {
+		report = append(report, *row)
+	}
+	slices.SortFunc(report, func(a, b TaxLine) int {
+		return cmp.Or(
+			cmp.Compare(b.Rate, a.Rate),
+			cmp.Compare(a.Code, b.Code),
+		)
+	})
+
+	return report, nil
+}
+
+// getTaxReport handles GET /api/clinic/reports/tax.
+//
+// It returns the taxable amounts and the tax of the issued invoices by
+// rate, for the VAT returns.
+//
+// Query parameters:
+//   - from: first invoice day included, YYYY-MM-DD (default: all invoices)
+//   - to: last invoice day included, YYYY-MM-DD (default: all invoices)
+func getTaxReport(e *core.RequestEvent) error {
+	var from, to time.Time
+	var err error
+	if raw := e.Request.URL.Query().Get("from"); raw != "" {
+		if from, err = time.ParseInLocation(time.DateOnly, raw, time.Local); err != nil {
+			return e.BadRequestError("Invalid from date, expected YYYY-MM-DD.", nil)
+		}
+	}
+	if raw := e.Request.URL.Query().Get("to"); raw != "" {
+		if to, err = time.ParseInLocation(time.DateOnly, raw, time.Local); err != nil {
+			return e.BadRequestError("Invalid to date, expected YYYY-MM-DD.", nil)
+		}
+	}
+	if !from.IsZero() && !to.IsZero() && to.Before(from) {
+		return e.BadRequestError("The to date is before the from date.", nil)
+	}
+
+	rows, err := TaxReport(e.App, from, to)
+	if err != nil {
+		return e.InternalServerError("Failed to build the tax report.", err)
+	}
+
+	var taxable, tax money.Money
+	for _, row := range rows {
+		taxable += row.TaxableAmount
+		tax += row.Tax
+	}
+
+	return e.JSON(200, map[string]any{
+		"from":          e.Request.URL.Query().Get("from"),
+		"to":            e.Request.URL.Query().Get("to"),
+		"rates":         rows,
+		"taxableAmount": taxable,
+		"tax":           tax,
+	})
+}
@@ -0,0 +1,117 @@
+package billing
+
+import (
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/filesystem"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"zahrawiclinic.com/documents"
+)
+
+func registerRoutes(se *core.ServeEvent) {
+	g := se.Router.Group("/api/clinic")
+	g.Bind(apis.RequireAuth())
+
+	g.POST("/invoices/{id}/document", invoiceDocument)
+	g.POST("/payments/{id}/receipt", paymentReceipt)
+
+	g.GET("/reports/tax", getTaxReport)
+}
+
+// invoiceDocument handles POST /api/clinic/invoices/{id}/document.
+//
+// It returns the invoice PDF. The document of an issued invoice is stored
+// in the invoice "document" field when first generated and the stored
+// document is returned afterwards, so that the invoice is reproduced as it
+// was issued. Draft invoices are rendered without being stored.
+//
+// Body parameters:
+//   - regenerate: render and store the document again (default: false)
+func invoiceDocument(e *core.RequestEvent) error {
+	invoice, err := e.App.FindRecordById("invoices", e.Request.PathValue("id"))
+	if err != nil {
+		return e.NotFoundError("Invoice not found.", err)
+	}
+
+	var body struct {
+		Regenerate bool `json:"regenerate"`
+	}
+	if err := e.BindBody(&body); err != nil {
+		return e.BadRequestError("Failed to read the submitted data.", err)
+	}
+
+	if invoice.GetString("document") != "" && !body.Regenerate {
+		content, err := documents.ReadFile(e.App, invoice, "document")
+		if err != nil {
+			return e.InternalServerError("Failed to read the invoice document.", err)
+		}
+		return e.Blob(200, "application/pdf", content)
+	}
+
+	content, err := RenderInvoice(e.App, invoice)
+	if err != nil {
+		return e.InternalServerError("Failed to generate the invoice document.", err)
+	}
+
+	if invoice.GetString("status") != "draft" {
+		if err := storeDocument(e.App, invoice, "document", "invoice-"+invoice.GetString("invoiceNumber")+".pdf", content); err != nil {
+			return e.BadRequestError("Failed to save the invoice document.", err)
+		}
+	}
+
+	return e.Blob(200, "application/pdf", content)
+}
+
+// paymentReceipt handles POST /api/clinic/payments/{id}/receipt.
+//
+// It returns the payment receipt PDF, stored in the payment "receipt"
+// field when first generated and returned as stored afterwards.
+//
+// Body parameters:
+//   - regenerate: render and store the receipt again (default: false)
+func paymentReceipt(e *core.RequestEvent) error {
+	payment, err := e.App.FindRecordById("payments", e.Request.PathValue("id"))
+	if err != nil {
+		return e.NotFoundError("Payment not found.", err)
+	}
+
+	var body struct {
+		Regenerate bool `json:"regenerate"`
+	}
+	if err := e.BindBody(&body); err != nil {
+		return e.BadRequestError("Failed to read the submitted data.", err)
+	}
+
+	if payment.GetString("receipt") != "" && !body.Regenerate {
+		content, err := documents.ReadFile(e.App, payment, "receipt")
+		if err != nil {
+			return e.InternalServerError("Failed to read the payment receipt.", err)
+		}
+		return e.Blob(200, "application/pdf", content)
+	}
+
+	content, err := RenderReceipt(e.App, payment)
+	if err != nil {
+		return e.InternalServerError("Failed to generate the payment receipt.", err)
+	}
+
+	if err := storeDocument(e.App, payment, "receipt", "receipt-"+payment.Id+".pdf", content); err != nil {
+		return e.BadRequestError("Failed to save the payment receipt.", err)
+	}
+
+	return e.Blob(200, "application/pdf", content)
+}
+
+// storeDocument saves the PDF in the record file field and stamps its
+// "<field>GeneratedAt" date.
+func storeDocument(app core.App, record *core.Record, field string, name string, content []byte) error {
+	file, err := filesystem.NewFileFromBytes(content, name)
+	if err != nil {
+		return err
+	}
+
+	record.Set(field, file)
+	record.Set(field+"GeneratedAt", types.NowDateTime())
+
+	return app.Save(record)
+}
@@ -0,0 +1,213 @@
+package billing
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"zahrawiclinic.com/money"
+	"zahrawiclinic.com/taxes"
+)
+
+// TaxLine is the tax of an invoice at one rate, as reported for VAT.
+type TaxLine struct {
+	// TaxRate is the id of the applied tax_rates record, empty for the
+	// items without a configured rate.
+	TaxRate string  `json:"taxRate"`
+	Code    string  `json:"code"`
+	Name    string  `json:"name"`
+	Rate    float64 `json:"rate"`
+	Exempt  bool    `json:"exempt"`
+
+	// TaxableAmount is the net amount of the items, after discount.
+	TaxableAmount money.Money `json:"taxableAmount"`
+	Tax           money.Money `json:"tax"`
+
+	// Currency is the currency of the amounts, the clinic currency when
+	// empty.
+	Currency string `json:"currency,omitempty"`
+}
+
+// MarshalJSON encodes the amounts as decimal numbers of the line currency.
+func (l TaxLine) MarshalJSON() ([]byte, error) {
+	type line TaxLine
+	currency := lineCurrency(l.Currency)
+	return json.Marshal(struct {
+		line
+		TaxableAmount float64 `json:"taxableAmount"`
+		Tax           float64 `json:"tax"`
+	}{line(l), currency.Decimal(l.TaxableAmount), currency.Decimal(l.Tax)})
+}
+
+// UnmarshalJSON decodes the amounts as decimal numbers of the line
+// currency.
+func (l *TaxLine) UnmarshalJSON(data []byte) error {
+	type line TaxLine
+	var decoded struct {
+		line
+		TaxableAmount float64 `json:"taxableAmount"`
+		Tax           float64 `json:"tax"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	currency := lineCurrency(decoded.Currency)
+	*l = TaxLine(decoded.line)
+	l.TaxableAmount = currency.FromDecimal(decoded.TaxableAmount)
+	l.Tax = currency.FromDecimal(decoded.Tax)
+
+	return nil
+}
+
+// lineCurrency returns the currency with the given code, the clinic
+// currency when empty.
+func lineCurrency(code string) money.Currency {
+	if code == "" {
+		return money.Default()
+	}
+	return money.Lookup(code)
+}
+
+// ApplyTaxRate stores the tax rate of the item category in effect on the
+// invoice date on the new items. Items without category are retail
+// products when they sell an inventory item and medical services otherwise.
+//
+// The saved items keep their applied rate so that later configuration
+// changes don't change their invoice. The rate is only resolved again on
+// draft invoices when the item category changes or when the item is
+// flagged taxable again, and cleared when it is flagged as not taxable.
+// The taxes of issued invoices can't be changed.
+func ApplyTaxRate(app core.App, item *core.Record, invoice *core.Record) error {
+	if item.IsNew() {
+		return resolveTaxRate(app, item, invoice)
+	}
+
+	original := item.Original()
+	taxable := item.GetBool("taxable")
+	switch {
+	case taxable == original.GetBool("taxable") && item.GetString("taxCategory") == original.GetString("taxCategory"):
+		// keeps the applied rate
+		item.Set("taxRate", original.GetString("taxRate"))
+		item.Set("taxPercent", original.GetFloat("taxPercent"))
+		return nil
+	case invoice.GetString("status") != "draft":
+		return validation.Errors{
+			"taxCategory": validation.NewError("validation_invoice_issued_tax", "The taxes of an issued invoice can't be changed."),
+		}
+	case !taxable:
+		item.Set("taxRate", "")
+		item.Set("taxPercent", 0)
+		return nil
+	}
+
+	return resolveTaxRate(app, item, invoice)
+}
+
+// resolveTaxRate resolves the tax rate of the item category in effect on
+// the invoice date and stores it on the item.
+func resolveTaxRate(app core.App, item *core.Record, invoice *core.Record) error {
+	category := item.GetString("taxCategory")
+	if category == "" {
+		category = taxes.CategoryMedical
+		if item.GetString("inventoryItem") != "" {
+			category = taxes.CategoryRetail
+		}
+		item.Set("taxCategory", category)
+	}
+
+	on := invoice.GetDateTime("invoiceDate").Time()
+	if on.IsZero() {
+		on = time.Now()
+	}
+
+	rate, err := taxes.Resolve(app, category, on)
+	if err != nil {
+		return err
+	}
+
+	if rate == nil {
+		item.Set("taxRate", "")
+		item.Set("taxPercent", 0)
+	} else {
+		item.Set("taxRate", rate.Id)
+		item.Set("taxPercent", rate.GetFloat("rate"))
+	}
+	item.Set("taxable", item.GetFloat("taxPercent") > 0)
+
+	return nil
+}
+
+// ComputeTaxBreakdown sums the net amount and tax of the invoice items by
+// applied rate, in the invoice currency.
+func ComputeTaxBreakdown(app core.App, items []*core.Record, currency money.Currency) ([]TaxLine, error) {
+	type key struct {
+		rate    string
+		percent float64
+	}
+
+	var breakdown []TaxLine
+	index := map[key]int{}
+	for _, item := range items {
+		k := key{item.GetString("taxRate"), item.GetFloat("taxPercent")}
+		i, ok := index[k]
+		if !ok {
+			i = len(breakdown)
+			index[k] = i
+			breakdown = append(breakdown, TaxLine{
+				TaxRate:  k.rate,
+				Name:     untaxedName(k.percent),
+				Rate:     k.percent,
+				Currency: currency.Code,
+			})
+		}
+
+		line := ComputeLine(item, currency)
+		breakdown[i].TaxableAmount += line.Net
+		breakdown[i].Tax += line.Tax
+	}
+
+	ids := make([]any, 0, len(breakdown))
+	for _, line := range breakdown {
+		if line.TaxRate != "" {
+			ids = append(ids, line.TaxRate)
+		}
+	}
+	if len(ids) > 0 {
+		rates, err := app.FindAllRecords("tax_rates", dbx.In("id", ids...))
+		if err != nil {
+			return nil, err
+		}
+		for _, rate := range rates {
+			for i := range breakdown {
+				if breakdown[i].TaxRate == rate.Id {
+					breakdown[i].Code = rate.GetString("code")
+					breakdown[i].Name = rate.GetString("name")
+					breakdown[i].Exempt = rate.GetBool("exempt")
+				}
+			}
+		}
+	}
+
+	slices.SortStableFunc(breakdown, func(a, b TaxLine) int {
+		if c := cmp.Compare(a.Rate, b.Rate); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Code, b.Code)
+	})
+
+	return breakdown, nil
+}
+
+// untaxedName names the tax of the items without a configured rate.
+func untaxedName(percent float64) string {
+	if percent == 0 {
+		return "Not taxed"
+	}
+	return fmt.Sprintf("Tax %g%%", percent)
+}
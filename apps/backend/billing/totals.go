@@ -0,0 +1,94 @@
+package billing
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"zahrawiclinic.com/money"
+)
+
+// Line holds the computed amounts of an invoice line item.
+type Line struct {
+	// Gross is the quantity times the unit price.
+	Gross money.Money
+
+	// Discount is the discount amount, from a percentage or fixed discount.
+	Discount money.Money
+
+	// Net is the gross amount less the discount, stored as the item total.
+	Net money.Money
+
+	// Tax is the tax on the net amount of taxable items.
+	Tax money.Money
+}
+
+// Totals holds the computed invoice header amounts.
+type Totals struct {
+	Subtotal money.Money
+	Discount money.Money
+	Tax      money.Money
+	Total    money.Money
+}
+
+// ComputeLine computes the amounts of an invoice item with its applied tax
+// rate (see ApplyTaxRate), in the currency of its invoice.
+func ComputeLine(item *core.Record, currency money.Currency) Line {
+	var line Line
+
+	line.Gross = money.Get(item, "unitPrice").Mul(item.GetFloat("quantity"))
+
+	// the discount is entered as a decimal percentage or amount
+	discount := item.GetFloat("discount")
+	switch item.GetString("discountType") {
+	case "percentage":
+		line.Discount = line.Gross.Percent(min(discount, 100))
+	default:
+		line.Discount = min(currency.FromDecimal(discount), line.Gross)
+	}
+
+	line.Net = line.Gross - line.Discount
+
+	line.Tax = line.Net.Percent(item.GetFloat("taxPercent"))
+
+	return line
+}
+
+// ApplyLine stores the computed line amounts on the invoice item.
+func ApplyLine(item *core.Record, line Line) {
+	money.Set(item, "total", line.Net)
+	money.Set(item, "taxAmount", line.Tax)
+}
+
+// ComputeTotals sums the computed amounts of the invoice items, in the
+// invoice currency.
+func ComputeTotals(items []*core.Record, currency money.Currency) Totals {
+	var totals Totals
+
+	for _, item := range items {
+		line := ComputeLine(item, currency)
+		totals.Subtotal += line.Gross
+		totals.Discount += line.Discount
+		totals.Tax += line.Tax
+	}
+
+	totals.Total = totals.Subtotal - totals.Discount + totals.Tax
+
+	return totals
+}
+
+// ApplyTotals stores the computed totals on the invoice header, with the
+// total in the clinic currency at the invoice exchange rate.
+func ApplyTotals(invoice *core.Record, totals Totals) {
+	money.Set(invoice, "subtotal", totals.Subtotal)
+	money.Set(invoice, "discount", totals.Discount)
+	money.Set(invoice, "tax", totals.Tax)
+	money.Set(invoice, "total", totals.Total)
+	money.Set(invoice, "baseTotal", money.ToBase(invoice, totals.Total))
+}
+
+// invoiceItems returns the stored items of the invoice.
+func invoiceItems(app core.App, invoiceId string) ([]*core.Record, error) {
+	if invoiceId == "" {
+		return nil, nil
+	}
+	return app.FindAllRecords("invoice_items", dbx.HashExp{"invoice": invoiceId})
+}
@@ -0,0 +1,100 @@
+// Package catalog maintains the treatments catalog: procedure code
+// normalization, code set imports and retired codes.
+package catalog
+
+import (
+	"regexp"
+	"strings"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"github.com/spf13/cobra"
+)
+
+// cdtCode matches an ADA Current Dental Terminology procedure code.
+var cdtCode = regexp.MustCompile(`^D\d{4}$`)
+
+// Register binds the catalog hooks to the app and the catalog command to
+// the root command.
+func Register(app core.App, rootCmd *cobra.Command) {
+	app.OnRecordCreate("treatments_catalog").BindFunc(normalizeItem)
+	app.OnRecordUpdate("treatments_catalog").BindFunc(normalizeItem)
+	app.OnRecordValidate("treatments_catalog").BindFunc(validateItem)
+
+	app.OnRecordValidate("treatments").BindFunc(validateTreatmentType)
+
+	rootCmd.AddCommand(newCommand(app))
+}
+
+// NormalizeCode uppercases the code and strips any whitespace so that
+// "d 0120" and "D0120" are the same catalog entry.
+func NormalizeCode(code string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(code), ""))
+}
+
+// normalizeItem normalizes the code and keeps retiredAt in line with the
+// retired flag.
+func normalizeItem(e *core.RecordEvent) error {
+	e.Record.Set("code", NormalizeCode(e.Record.GetString("code")))
+	e.Record.Set("codeSet", strings.ToUpper(strings.TrimSpace(e.Record.GetString("codeSet"))))
+
+	switch retired := e.Record.GetBool("retired"); {
+	case retired && e.Record.GetDateTime("retiredAt").IsZero():
+		e.Record.Set("retiredAt", types.NowDateTime())
+	case !retired:
+		e.Record.Set("retiredAt", "")
+	}
+
+	return e.Next()
+}
+
+func validateItem(e *core.RecordEvent) error {
+	code := e.Record.GetString("code")
+
+	if e.Record.GetString("codeSet") != "" && code == "" {
+		return validation.Errors{
+			"code": validation.NewError("validation_required", "Code set entries require a code."),
+		}
+	}
+
+	if e.Record.GetString("codeSet") == "CDT" && !cdtCode.MatchString(code) {
+		return validation.Errors{
+			"code": validation.NewError("validation_invalid_cdt_code", "CDT codes must be a D followed by 4 digits."),
+		}
+	}
+
+	return e.Next()
+}
+
+// validateTreatmentType prevents recording new treatments against retired
+// catalog codes. Existing treatments keep their (retired) code.
+func validateTreatmentType(e *core.RecordEvent) error {
+	id := e.Record.GetString("treatmentType")
+	if id == "" {
+		return e.Next()
+	}
+
+	if !e.Record.IsNew() {
+		original := e.Record.Original().GetString("treatmentType")
+		if original == id {
+			return e.Next()
+		}
+	}
+
+	item, err := e.App.FindRecordById("treatments_catalog", id)
+	if err != nil {
+		return e.Next() // the relation field validator reports the missing record
+	}
+
+	if item.GetBool("retired") {
+		return validation.Errors{
+			"treatmentType": validation.NewError(
+				"validation_retired_code",
+				"The procedure code "+item.GetString("code")+" is retired.",
+			),
+		}
+	}
+
+	return e.Next()
+}
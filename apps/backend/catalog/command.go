@@ -0,0 +1,81 @@
+package catalog
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/spf13/cobra"
+)
+
+func newCommand(app core.App) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "catalog",
+		Short: "Manages the treatments catalog",
+	}
+
+	command.AddCommand(newImportCommand(app))
+
+	return command
+}
+
+func newImportCommand(app core.App) *cobra.Command {
+	var opts ImportOptions
+
+	command := &cobra.Command{
+		Use:   "import <file.csv>",
+		Short: "Imports a procedure code set (CDT...) into the treatments catalog",
+		Long: `Imports a procedure code set from a CSV file into the treatments catalog.
+
+The CSV file must start with a header row. The recognized columns are
+code, descriptor, category, fee and duration (in minutes); only code and
+descriptor are required, fee is required for codes not yet in the catalog.
+
+Existing entries are updated by code. Codes of the set that are missing from
+the file are marked as retired, unless --keep-missing is used.`,
+		Example:      "  catalog import cdt-2025.csv --set CDT",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			file, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			entries, err := ParseCSV(file)
+			if err != nil {
+				return fmt.Errorf("%s: %w", args[0], err)
+			}
+
+			result, err := Import(app, entries, opts)
+			if err != nil {
+				return err
+			}
+
+			prefix := ""
+			if opts.DryRun {
+				prefix = "(dry run) "
+			}
+			fmt.Printf(
+				"%s%d codes read: %d created, %d updated, %d reactivated, %d unchanged, %d retired\n",
+				prefix,
+				len(entries),
+				result.Created,
+				result.Updated,
+				result.Reactivated,
+				result.Unchanged,
+				result.Retired,
+			)
+
+			return nil
+		},
+	}
+
+	command.Flags().StringVar(&opts.CodeSet, "set", "", "name of the imported code set, e.g. CDT (required)")
+	command.Flags().BoolVar(&opts.KeepMissing, "keep-missing", false, "don't retire the codes of the set missing from the file")
+	command.Flags().BoolVar(&opts.DryRun, "dry-run", false, "report the changes without saving them")
+	command.MarkFlagRequired("set")
+
+	return command
+}
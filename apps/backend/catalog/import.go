@@ -0,0 +1,337 @@
+package catalog
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"zahrawiclinic.com/money"
+)
+
+// nameMaxLength matches the treatments_catalog.name field limit.
+const nameMaxLength = 200
+
+// errDryRun rolls back the import transaction of a dry run.
+var errDryRun = errors.New("dry run")
+
+// Entry is a single code of an imported code set.
+type Entry struct {
+	Line       int
+	Code       string
+	Descriptor string
+	Category   string
+	Fee        *float64
+	Duration   *int
+}
+
+// ImportOptions configures a code set import.
+type ImportOptions struct {
+	// CodeSet is the name of the imported code set (e.g. "CDT").
+	CodeSet string
+
+	// KeepMissing leaves the codes of the set that are missing from the
+	// import active instead of retiring them.
+	KeepMissing bool
+
+	// DryRun reports the changes without saving them.
+	DryRun bool
+}
+
+// ImportResult summarizes the changes made by an import.
+type ImportResult struct {
+	Created     int
+	Updated     int
+	Unchanged   int
+	Reactivated int
+	Retired     int
+}
+
+// headerAliases maps the normalized CSV headers to the entry columns.
+var headerAliases = map[string]string{
+	"code":              "code",
+	"procedurecode":     "code",
+	"cdtcode":           "code",
+	"descriptor":        "descriptor",
+	"description":       "descriptor",
+	"name":              "descriptor",
+	"category":          "category",
+	"fee":               "fee",
+	"defaultfee":        "fee",
+	"price":             "fee",
+	"defaultprice":      "fee",
+	"duration":          "duration",
+	"defaultduration":   "duration",
+	"estimatedduration": "duration",
+}
+
+// ParseCSV reads code set entries from a CSV file with a header row naming
+// the code, descriptor, category, default fee and default duration (in
+// minutes) columns. Only the code and descriptor columns are mandatory.
+func ParseCSV(r io.Reader) ([]Entry, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the CSV header: %w", err)
+	}
+
+	columns := map[string]int{}
+	for i, name := range header {
+		if i == 0 {
+			name = strings.TrimPrefix(name, "\ufeff")
+		}
+		if column, ok := headerAliases[normalizeHeader(name)]; ok {
+			if _, exists := columns[column]; !exists {
+				columns[column] = i
+			}
+		}
+	}
+	for _, required := range []string{"code", "descriptor"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("missing %q column in the CSV header", required)
+		}
+	}
+
+	var entries []Entry
+	seen := map[string]int{}
+
+	for line := 2; ; line++ {
+		row, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		value := func(column string) string {
+			i, ok := columns[column]
+			if !ok || i >= len(row) {
+				return ""
+			}
+			return strings.TrimSpace(row[i])
+		}
+
+		entry := Entry{
+			Line:       line,
+			Code:       NormalizeCode(value("code")),
+			Descriptor: value("descriptor"),
+			Category:   value("category"),
+		}
+		if entry.Code == "" && entry.Descriptor == "" {
+			continue // blank line
+		}
+		if entry.Code == "" {
+			return nil, fmt.Errorf("line %d: missing code", line)
+		}
+		if entry.Descriptor == "" {
+			return nil, fmt.Errorf("line %d: missing descriptor for %s", line, entry.Code)
+		}
+		if previous, ok := seen[entry.Code]; ok {
+			return nil, fmt.Errorf("line %d: duplicate code %s (first seen on line %d)", line, entry.Code, previous)
+		}
+		seen[entry.Code] = line
+
+		if raw := value("fee"); raw != "" {
+			fee, err := parseFee(raw)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			entry.Fee = &fee
+		}
+
+		if raw := value("duration"); raw != "" {
+			duration, err := strconv.Atoi(raw)
+			if err != nil || duration < 0 {
+				return nil, fmt.Errorf("line %d: invalid duration %q", line, raw)
+			}
+			entry.Duration = &duration
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// parseFee reads a fee such as "1,250.00", "$95" or "12,50". A comma is a
+// thousands separator when it groups digits by 3, a decimal comma when it's
+// the only separator and is followed by 1 or 2 digits; "1,250" alone is
+// ambiguous and rejected.
+func parseFee(raw string) (float64, error) {
+	value := strings.ReplaceAll(strings.ReplaceAll(raw, "$", ""), " ", "")
+
+	switch {
+	case decimalComma.MatchString(value):
+		value = strings.Replace(value, ",", ".", 1)
+	case ambiguousComma.MatchString(value):
+		return 0, fmt.Errorf("ambiguous fee %q, write it as 1250.00 or 1.25", raw)
+	case strings.Contains(value, ","):
+		if !thousandsCommas.MatchString(value) {
+			return 0, fmt.Errorf("invalid fee %q", raw)
+		}
+		value = strings.ReplaceAll(value, ",", "")
+	}
+
+	fee, err := strconv.ParseFloat(value, 64)
+	if err != nil || fee < 0 || math.IsNaN(fee) || math.IsInf(fee, 0) {
+		return 0, fmt.Errorf("invalid fee %q", raw)
+	}
+
+	return fee, nil
+}
+
+var (
+	decimalComma    = regexp.MustCompile(`^\d+,\d{1,2}$`)
+	ambiguousComma  = regexp.MustCompile(`^\d{1,3},\d{3}$`)
+	thousandsCommas = regexp.MustCompile(`^\d{1,3}(,\d{3})+(\.\d*)?$`)
+)
+
+func normalizeHeader(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, name)
+}
+
+// Import upserts the code set entries into the treatments catalog by code
+// and retires the codes of the set that are no longer listed.
+//
+// Catalog entries are never deleted because treatments reference them.
+func Import(app core.App, entries []Entry, opts ImportOptions) (*ImportResult, error) {
+	codeSet := strings.ToUpper(strings.TrimSpace(opts.CodeSet))
+	if codeSet == "" {
+		return nil, errors.New("missing code set name")
+	}
+
+	result := &ImportResult{}
+
+	err := app.RunInTransaction(func(txApp core.App) error {
+		collection, err := txApp.FindCollectionByNameOrId("treatments_catalog")
+		if err != nil {
+			return err
+		}
+
+		listed := make(map[string]struct{}, len(entries))
+
+		for _, entry := range entries {
+			listed[entry.Code] = struct{}{}
+
+			item, err := txApp.FindFirstRecordByData(collection, "code", entry.Code)
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				item = core.NewRecord(collection)
+				item.Set("code", entry.Code)
+			case err != nil:
+				return err
+			}
+
+			if item.IsNew() && entry.Fee == nil {
+				return fmt.Errorf("line %d: missing fee for the new code %s", entry.Line, entry.Code)
+			}
+
+			reactivated := !item.IsNew() && item.GetBool("retired")
+
+			name, description := splitDescriptor(entry.Descriptor)
+			item.Set("name", name)
+			if description != "" || item.IsNew() {
+				item.Set("description", description)
+			}
+			if entry.Category != "" {
+				item.Set("category", entry.Category)
+			}
+			if entry.Fee != nil {
+				money.Set(item, "default_price", money.FromDecimal(*entry.Fee))
+			}
+			if entry.Duration != nil {
+				item.Set("estimatedDuration", *entry.Duration)
+			}
+			item.Set("codeSet", codeSet)
+			item.Set("retired", false)
+
+			switch {
+			case item.IsNew():
+				result.Created++
+			case !changed(item):
+				result.Unchanged++
+				continue
+			case reactivated:
+				result.Reactivated++
+			default:
+				result.Updated++
+			}
+
+			if err := txApp.Save(item); err != nil {
+				return fmt.Errorf("line %d: %s: %w", entry.Line, entry.Code, err)
+			}
+		}
+
+		if !opts.KeepMissing {
+			current, err := txApp.FindAllRecords(collection, dbx.HashExp{"codeSet": codeSet, "retired": false})
+			if err != nil {
+				return err
+			}
+			for _, item := range current {
+				if _, ok := listed[item.GetString("code")]; ok {
+					continue
+				}
+
+				item.Set("retired", true)
+				item.Set("retiredAt", types.NowDateTime())
+				if err := txApp.Save(item); err != nil {
+					return fmt.Errorf("retiring %s: %w", item.GetString("code"), err)
+				}
+				result.Retired++
+			}
+		}
+
+		if opts.DryRun {
+			return errDryRun
+		}
+
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDryRun) {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// splitDescriptor fits the descriptor in the catalog name, keeping the full
+// text in the description when it's too long.
+func splitDescriptor(descriptor string) (name string, description string) {
+	if utf8.RuneCountInString(descriptor) <= nameMaxLength {
+		return descriptor, ""
+	}
+
+	runes := []rune(descriptor)
+	return strings.TrimSpace(string(runes[:nameMaxLength-3])) + "...", descriptor
+}
+
+// changed reports whether any of the record fields differ from the stored
+// values.
+func changed(record *core.Record) bool {
+	original := record.Original()
+	for _, field := range record.Collection().Fields {
+		if record.GetString(field.GetName()) != original.GetString(field.GetName()) {
+			return true
+		}
+	}
+	return false
+}
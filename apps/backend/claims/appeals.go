@@ -0,0 +1,383 @@
+package claims
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"zahrawiclinic.com/dates"
+	"zahrawiclinic.com/money"
+	"zahrawiclinic.com/tasks"
+)
+
+// defaultFollowUpDays is when the payer is chased about an appeal, unless
+// another follow-up date is submitted.
+const defaultFollowUpDays = 30
+
+// appealableStatuses are the claim statuses with a denied amount.
+var appealableStatuses = []string{"denied", "partial"}
+
+// validateAppealStatus keeps the claim appealStatus consistent with its
+// status: a pending or denied appeal is only possible on a denied or
+// partial claim, an approved one on an approved, partial or paid claim,
+// and a pending appeal must be decided, not dropped.
+func validateAppealStatus(e *core.RecordEvent) error {
+	errs := validation.Errors{}
+
+	appealStatus := e.Record.GetString("appealStatus")
+	status := e.Record.GetString("status")
+
+	switch appealStatus {
+	case "":
+		if e.Record.Original().GetString("appealStatus") == "pending" {
+			errs["appealStatus"] = validation.NewError("validation_appeal_pending", "The pending appeal must be approved or denied.")
+		}
+	case "pending", "denied":
+		if !slices.Contains(appealableStatuses, status) {
+			errs["status"] = validation.NewError(
+				"validation_appeal_status",
+				fmt.Sprintf("Claims with a %s appeal must be denied or partial.", appealStatus),
+			)
+		}
+	case "approved":
+		if status != "approved" && status != "partial" && status != "paid" {
+			errs["status"] = validation.NewError("validation_appeal_status", "Claims with an approved appeal must be approved, partial or paid.")
+		}
+	}
+
+	if appealStatus != "" && e.Record.GetDateTime("appealDate").IsZero() {
+		errs["appealDate"] = validation.NewError("validation_required", "Appealed claims require the appeal date.")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return e.Next()
+}
+
+// syncAppeal approves the pending appeal of a claim the payer approves or
+// pays (even partly), and decides the pending claim_appeals record when the claim
+// appeal is decided.
+func syncAppeal(e *core.RecordEvent) error {
+	if e.Record.Original().GetString("appealStatus") != "pending" {
+		return e.Next()
+	}
+
+	status := e.Record.GetString("status")
+	paidMore := money.Get(e.Record, "paidAmount") > money.Get(e.Record.Original(), "paidAmount")
+	if e.Record.GetString("appealStatus") == "pending" && (status == "approved" || status == "paid" || paidMore) {
+		e.Record.Set("appealStatus", "approved")
+	}
+
+	decision := e.Record.GetString("appealStatus")
+	if decision == "pending" || decision == "" {
+		return e.Next() // invalid, reported by validateAppealStatus
+	}
+
+	return e.App.RunInTransaction(func(txApp core.App) error {
+		e.App = txApp
+
+		if err := e.Next(); err != nil {
+			return err
+		}
+
+		appeals, err := txApp.FindAllRecords("claim_appeals", dbx.HashExp{
+			"claim":  e.Record.Id,
+			"status": "pending",
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, appeal := range appeals {
+			appeal.Set("status", decision)
+			if err := txApp.Save(appeal); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// validateAppeal keeps the appealed claim and the decisions of the appeals
+// unchanged.
+func validateAppeal(e *core.RecordEvent) error {
+	if e.Record.IsNew() {
+		return e.Next()
+	}
+
+	original := e.Record.Original()
+
+	if e.Record.GetString("claim") != original.GetString("claim") {
+		return validation.Errors{
+			"claim": validation.NewError("validation_appeal_claim_locked", "The appealed claim can't be changed."),
+		}
+	}
+
+	if previous := original.GetString("status"); previous != "pending" && e.Record.GetString("status") != previous {
+		return validation.Errors{
+			"status": validation.NewError("validation_appeal_decided", "Decided appeals can't be changed, file another appeal instead."),
+		}
+	}
+
+	return e.Next()
+}
+
+// decideAppeal stamps the decision date of a decided appeal and applies
+// the decision to the claim in the same transaction: the claim appeal
+// status follows the appeal and an approved appeal sends the denied claim
+// back to approved, awaiting the payment. The follow-up task is completed.
+func decideAppeal(e *core.RecordEvent) error {
+	status := e.Record.GetString("status")
+	if e.Record.Original().GetString("status") != "pending" || status == "pending" {
+		return e.Next()
+	}
+
+	if e.Record.GetDateTime("decisionDate").IsZero() {
+		e.Record.Set("decisionDate", dates.Today())
+	}
+
+	return e.App.RunInTransaction(func(txApp core.App) error {
+		e.App = txApp
+
+		if err := e.Next(); err != nil {
+			return err
+		}
+
+		claim, err := txApp.FindRecordById("insurance_claims", e.Record.GetString("claim"))
+		if err != nil {
+			return err
+		}
+
+		// already decided when the claim was approved or paid
+		if claim.GetString("appealStatus") == "pending" {
+			claim.Set("appealStatus", status)
+			if status == "approved" && slices.Contains(appealableStatuses, claim.GetString("status")) {
+				// the deniedAmount is kept for the denial reports, the
+				// remittance of the reprocessed claim records the payment
+				claim.Set("status", "approved")
+				claim.Set("processedDate", e.Record.GetDateTime("decisionDate"))
+			}
+			if err := txApp.Save(claim); err != nil {
+				return err
+			}
+		}
+
+		task, err := txApp.FindFirstRecordByData("tasks", "source", followUpSource(e.Record.Id))
+		if err != nil || task.GetBool("completed") {
+			return nil
+		}
+		task.Set("completed", true)
+
+		return txApp.Save(task)
+	})
+}
+
+// followUpSource is the tasks source of the follow-up task of an appeal.
+func followUpSource(appealId string) string {
+	return "claim_appeal:" + appealId
+}
+
+// CanAppeal reports why the claim can't be appealed on the given day, if
+// it can't: only denied or partially denied claims without a pending
+// appeal can be appealed, within the appeal window of their appealable
+// denial reasons.
+func CanAppeal(app core.App, claim *core.Record, on time.Time) error {
+	status := claim.GetString("status")
+	if status != "denied" && (status != "partial" || money.Get(claim, "deniedAmount") <= 0) {
+		return errors.New("Only denied or partially denied claims can be appealed.")
+	}
+
+	if claim.GetString("appealStatus") == "pending" {
+		return errors.New("The claim already has a pending appeal.")
+	}
+
+	ids := claim.GetStringSlice("denialReasons")
+	if len(ids) == 0 {
+		return nil
+	}
+
+	reasons, err := app.FindRecordsByIds("denial_reasons", ids)
+	if err != nil {
+		return err
+	}
+
+	appealable := false
+	window := 0
+	for _, reason := range reasons {
+		if !reason.GetBool("appealable") {
+			continue
+		}
+		appealable = true
+
+		days := reason.GetInt("appealWindowDays")
+		if days == 0 {
+			return nil // no limit
+		}
+		window = max(window, days)
+	}
+
+	if !appealable {
+		return errors.New("The denial reasons of the claim can't be appealed.")
+	}
+
+	processed := claim.GetDateTime("processedDate").Time()
+	if processed.IsZero() {
+		return nil
+	}
+
+	deadline := dates.StartOfDay(processed.In(time.Local)).AddDate(0, 0, window)
+	if dates.StartOfDay(on).After(deadline) {
+		return fmt.Errorf("The appeal window closed on %s.", deadline.Format(time.DateOnly))
+	}
+
+	return nil
+}
+
+// snapshot returns the claim fields as appealed, with the amounts in
+// decimals of the invoice currency.
+func snapshot(app core.App, claim *core.Record) map[string]any {
+	currency := money.CurrencyOf(app, claim)
+	data := claim.PublicExport()
+	for _, field := range money.Fields["insurance_claims"] {
+		data[field] = currency.Decimal(money.Get(claim, field))
+	}
+	return data
+}
+
+// appealClaim handles POST /api/clinic/claims/{id}/appeals.
+//
+// It files an appeal of a denied or partially denied claim with the
+// submitted "reason" and the uploaded "documents" (multipart). The appeal
+// keeps a snapshot of the claim, the claim appeal status becomes pending
+// and a follow-up task is created for the "followUpDate" (YYYY-MM-DD,
+// 30 days by default).
+func appealClaim(e *core.RequestEvent) error {
+	claim, err := e.App.FindRecordById("insurance_claims", e.Request.PathValue("id"))
+	if err != nil {
+		return e.NotFoundError("Claim not found.", err)
+	}
+
+	var body struct {
+		Reason       string `json:"reason" form:"reason"`
+		FollowUpDate string `json:"followUpDate" form:"followUpDate"`
+	}
+	if err := e.BindBody(&body); err != nil {
+		return e.BadRequestError("Failed to read the submitted data.", err)
+	}
+
+	body.Reason = strings.TrimSpace(body.Reason)
+	if body.Reason == "" {
+		return e.BadRequestError("The appeal reason is required.", validation.Errors{
+			"reason": validation.NewError("validation_required", "Missing appeal reason."),
+		})
+	}
+
+	today := dates.Today()
+	followUp := today.AddDate(0, 0, defaultFollowUpDays)
+	if body.FollowUpDate != "" {
+		if followUp, err = time.ParseInLocation(time.DateOnly, body.FollowUpDate, time.Local); err != nil {
+			return e.BadRequestError("Invalid follow-up date, expected YYYY-MM-DD.", nil)
+		}
+		if followUp.Before(today) {
+			return e.BadRequestError("The follow-up date is in the past.", nil)
+		}
+	}
+
+	if err := CanAppeal(e.App, claim, today); err != nil {
+		return e.BadRequestError(err.Error(), nil)
+	}
+
+	documents, err := e.FindUploadedFiles("documents")
+	if err != nil && !errors.Is(err, http.ErrMissingFile) && !errors.Is(err, http.ErrNotMultipart) {
+		return e.BadRequestError("Failed to read the uploaded documents.", err)
+	}
+
+	collection, err := e.App.FindCachedCollectionByNameOrId("claim_appeals")
+	if err != nil {
+		return e.InternalServerError("", err)
+	}
+
+	appeal := core.NewRecord(collection)
+	appeal.Set("claim", claim.Id)
+	appeal.Set("patient", claim.GetString("patient"))
+	appeal.Set("appealDate", today)
+	appeal.Set("status", "pending")
+	appeal.Set("reason", body.Reason)
+	appeal.Set("snapshot", snapshot(e.App, claim))
+	appeal.Set("followUpDate", followUp)
+	if len(documents) > 0 {
+		appeal.Set("documents", documents)
+	}
+
+	var submittedBy string
+	if e.Auth != nil && e.Auth.Collection().Name == "users" {
+		submittedBy = e.Auth.Id
+		appeal.Set("submittedBy", submittedBy)
+	}
+
+	err = e.App.RunInTransaction(func(txApp core.App) error {
+		previous, err := txApp.CountRecords("claim_appeals", dbx.HashExp{"claim": claim.Id})
+		if err != nil {
+			return err
+		}
+		appeal.Set("level", previous+1)
+
+		if err := txApp.Save(appeal); err != nil {
+			return err
+		}
+
+		claim.Set("appealDate", today)
+		claim.Set("appealStatus", "pending")
+		if err := txApp.Save(claim); err != nil {
+			return err
+		}
+
+		label := claim.GetString("claimNumber")
+		if label == "" {
+			label = claim.Id
+		}
+
+		denied := money.Get(claim, "deniedAmount")
+		if denied == 0 {
+			denied = money.Get(claim, "claimedAmount")
+		}
+
+		_, err = tasks.Ensure(txApp, tasks.Task{
+			Source:   followUpSource(appeal.Id),
+			Title:    "Follow up claim appeal " + label,
+			Priority: "high",
+			Category: "follow_up",
+			DueDate:  followUp,
+			Description: fmt.Sprintf(
+				"Level %d appeal of claim %s filed on %s for %s denied. Contact the payer if no decision was received.",
+				appeal.GetInt("level"),
+				label,
+				today.Format(time.DateOnly),
+				money.CurrencyOf(txApp, claim).Display(denied),
+			),
+			AssignedTo: submittedBy,
+			Patient:    claim.GetString("patient"),
+		})
+
+		return err
+	})
+	if err != nil {
+		return e.BadRequestError("Failed to file the appeal.", err)
+	}
+
+	if err := apis.EnrichRecord(e, appeal); err != nil {
+		return e.InternalServerError("", err)
+	}
+
+	return e.JSON(200, appeal)
+}
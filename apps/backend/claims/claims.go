@@ -0,0 +1,255 @@
+// Package claims builds the insurance claims of the invoices from their
+// line items and the coverage rates of the procedures, and follows the
+// appeals of the denied claims.
+package claims
+
+import (
+	"encoding/json"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"zahrawiclinic.com/dates"
+	"zahrawiclinic.com/money"
+)
+
+// Register binds the claims hooks and routes to the app.
+func Register(app core.App) {
+	app.OnRecordCreate("insurance_claims").BindFunc(recordPayment)
+	app.OnRecordUpdate("insurance_claims").BindFunc(recordPayment)
+
+	app.OnRecordCreate("insurance_claims").BindFunc(syncInvoice)
+	app.OnRecordUpdate("insurance_claims").BindFunc(syncInvoice)
+	app.OnRecordDelete("insurance_claims").BindFunc(syncInvoice)
+
+	app.OnRecordValidate("insurance_claims").BindFunc(validateAppealStatus)
+	app.OnRecordUpdate("insurance_claims").BindFunc(syncAppeal)
+	app.OnRecordValidate("claim_appeals").BindFunc(validateAppeal)
+	app.OnRecordUpdate("claim_appeals").BindFunc(decideAppeal)
+
+	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
+		g := se.Router.Group("/api/clinic")
+		g.Bind(apis.RequireAuth())
+
+		g.POST("/invoices/{id}/claims", generateClaim)
+		g.POST("/claims/{id}/appeals", appealClaim)
+		g.GET("/reports/claim-denials", getDenialReport)
+
+		return se.Next()
+	})
+}
+
+// Line is the covered part of an invoice item.
+type Line struct {
+	Item string `json:"item"`
+
+	// Rate is the coverage rate in percent.
+	Rate float64 `json:"rate"`
+
+	// Amount is the item total.
+	Amount money.Money `json:"amount"`
+
+	// Covered is the part of the item total claimed from the insurer.
+	Covered money.Money `json:"covered"`
+
+	// Currency is the invoice currency of the amounts.
+	Currency money.Currency `json:"-"`
+}
+
+// MarshalJSON encodes the amounts as decimal numbers of the invoice
+// currency, with its code.
+func (l Line) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Item     string  `json:"item"`
+		Rate     float64 `json:"rate"`
+		Amount   float64 `json:"amount"`
+		Covered  float64 `json:"covered"`
+		Currency string  `json:"currency"`
+	}{l.Item, l.Rate, l.Currency.Decimal(l.Amount), l.Currency.Decimal(l.Covered), l.Currency.Code})
+}
+
+// CoveredLines returns the invoice items covered by insurance.
+//
+// The coverage rate of an item is its own insuranceCoverage when set,
+// otherwise the insuranceCoverage of its procedure in the catalog.
+func CoveredLines(app core.App, invoiceId string) ([]Line, error) {
+	items, err := app.FindRecordsByFilter(
+		"invoice_items",
+		"invoice = {:invoice}",
+		"lineNumber,created",
+		0,
+		0,
+		dbx.Params{"invoice": invoiceId},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	currency := money.Default()
+	if invoice, err := app.FindRecordById("invoices", invoiceId); err == nil {
+		currency = money.CurrencyOf(app, invoice)
+	}
+
+	lines := make([]Line, 0, len(items))
+	for _, item := range items {
+		rate := coverageRate(app, item)
+		if rate <= 0 {
+			continue
+		}
+
+		amount := money.Get(item, "total")
+		lines = append(lines, Line{
+			Item:     item.Id,
+			Rate:     rate,
+			Amount:   amount,
+			Covered:  amount.Percent(rate),
+			Currency: currency,
+		})
+	}
+
+	return lines, nil
+}
+
+// coverageRate returns the coverage rate (in percent) of the invoice item.
+func coverageRate(app core.App, item *core.Record) float64 {
+	if rate := item.GetFloat("insuranceCoverage"); rate > 0 {
+		return min(rate, 100)
+	}
+
+	treatmentTypeId := item.GetString("treatmentType")
+	if treatmentTypeId == "" && item.GetString("treatment") != "" {
+		treatment, err := app.FindRecordById("treatments", item.GetString("treatment"))
+		if err == nil {
+			treatmentTypeId = treatment.GetString("treatmentType")
+		}
+	}
+
+	return ProcedureRate(app, treatmentTypeId)
+}
+
+// ProcedureRate returns the coverage rate (in percent) of the procedure in
+// the treatments catalog, 0 when it isn't covered.
+func ProcedureRate(app core.App, treatmentTypeId string) float64 {
+	if treatmentTypeId == "" {
+		return 0
+	}
+
+	treatmentType, err := app.FindRecordById("treatments_catalog", treatmentTypeId)
+	if err != nil {
+		return 0 // deleted procedure
+	}
+
+	return min(treatmentType.GetFloat("insuranceCoverage"), 100)
+}
+
+// ExpectedInsurance sums the amounts expected from the invoice claims that
+// weren't denied: the paid amount of the paid claims and the claimed
+// amount of the others, ignoring the claim with the given id (if any).
+func ExpectedInsurance(app core.App, invoiceId string, exclude string) (money.Money, error) {
+	query := app.DB().
+		Select("COALESCE(SUM(CASE WHEN [[status]] IN ('paid', 'partial') THEN [[paidAmount]] ELSE [[claimedAmount]] END), 0) AS total").
+		From("insurance_claims").
+		Where(dbx.HashExp{"invoice": invoiceId}).
+		AndWhere(dbx.NewExp("[[status]] != 'denied'"))
+	if exclude != "" {
+		query.AndWhere(dbx.Not(dbx.HashExp{"id": exclude}))
+	}
+
+	var row struct {
+		Total float64 `db:"total"`
+	}
+	if err := query.One(&row); err != nil {
+		return 0, err
+	}
+
+	return money.FromMinor(row.Total), nil
+}
+
+// syncInvoice refreshes the expected insurance amount of the claim
+// invoice, and of its previous invoice when it was moved, in the same
+// transaction.
+func syncInvoice(e *core.RecordEvent) error {
+	return e.App.RunInTransaction(func(txApp core.App) error {
+		e.App = txApp
+
+		if err := e.Next(); err != nil {
+			return err
+		}
+
+		if err := RefreshInvoice(txApp, e.Record.GetString("invoice")); err != nil {
+			return err
+		}
+
+		if previous := e.Record.Original().GetString("invoice"); previous != e.Record.GetString("invoice") {
+			return RefreshInvoice(txApp, previous)
+		}
+
+		return nil
+	})
+}
+
+// RefreshInvoice saves the amount expected from the invoice claims as the
+// invoice insurance amount, which the invoice balance excludes.
+func RefreshInvoice(app core.App, invoiceId string) error {
+	if invoiceId == "" {
+		return nil
+	}
+
+	invoice, err := app.FindRecordById("invoices", invoiceId)
+	if err != nil {
+		return nil // deleted invoice
+	}
+
+	expected, err := ExpectedInsurance(app, invoice.Id, "")
+	if err != nil {
+		return err
+	}
+	if expected == money.Get(invoice, "insuranceAmount") {
+		return nil
+	}
+
+	money.Set(invoice, "insuranceAmount", expected)
+
+	return app.Save(invoice)
+}
+
+// Build returns a new pending claim of the invoice for the coverage.
+//
+// The claimed amount is the covered part of the invoice items, limited to
+// what the other claims of the invoice leave to claim. The rest of the
+// invoice total is the patient responsibility.
+func Build(app core.App, invoice *core.Record, coverage *core.Record) (*core.Record, []Line, error) {
+	collection, err := app.FindCollectionByNameOrId("insurance_claims")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lines, err := CoveredLines(app, invoice.Id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var covered money.Money
+	for _, line := range lines {
+		covered += line.Covered
+	}
+
+	total := money.Get(invoice, "total")
+
+	others, err := ExpectedInsurance(app, invoice.Id, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	claimed := max(min(covered, total-others), 0)
+
+	claim := core.NewRecord(collection)
+	claim.Set("patient", invoice.GetString("patient"))
+	claim.Set("insurance", coverage.Id)
+	claim.Set("invoice", invoice.Id)
+	claim.Set("claimDate", dates.Today())
+	claim.Set("status", "pending")
+	money.Set(claim, "claimedAmount", claimed)
+	money.Set(claim, "patientResponsibility", max(total-others-claimed, 0))
+
+	return claim, lines, nil
+}
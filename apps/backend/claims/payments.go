@@ -0,0 +1,96 @@
+package claims
+
+import (
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"zahrawiclinic.com/billing"
+	"zahrawiclinic.com/dates"
+	"zahrawiclinic.com/money"
+)
+
+// recordPayment records the claim paid amount as an insurance payment of
+// the claim invoice after the claim is saved, in the same transaction. It
+// is bound before syncInvoice so that the invoice insurance amount is
+// already refreshed when the payment is validated.
+func recordPayment(e *core.RecordEvent) error {
+	return e.App.RunInTransaction(func(txApp core.App) error {
+		e.App = txApp
+
+		if err := e.Next(); err != nil {
+			return err
+		}
+
+		return RecordPayment(txApp, e.Record)
+	})
+}
+
+// RecordPayment posts the part of the claim paid amount that isn't
+// recorded as payments yet (e.g. entered by hand rather than imported from
+// an 835) as an insurance payment of the claim invoice, so that the
+// invoice balance and the ledger only follow the payments. A paid amount
+// lowered below the recorded payments is left to be corrected on the
+// payments.
+func RecordPayment(app core.App, claim *core.Record) error {
+	if status := claim.GetString("status"); status != "paid" && status != "partial" {
+		return nil
+	}
+	if claim.GetString("invoice") == "" {
+		return nil
+	}
+
+	// the claim amounts and the invoice amounts of the payments are both
+	// in the currency of the claim invoice
+	var recorded struct {
+		Total float64 `db:"total"`
+	}
+	err := app.DB().
+		Select("COALESCE(SUM([[invoiceAmount]]), 0) AS total").
+		From("payments").
+		Where(dbx.HashExp{"insuranceClaim": claim.Id}).
+		One(&recorded)
+	if err != nil {
+		return err
+	}
+
+	unrecorded := money.Get(claim, "paidAmount") - money.FromMinor(recorded.Total)
+	if unrecorded <= 0 {
+		return nil
+	}
+
+	invoice, err := app.FindRecordById("invoices", claim.GetString("invoice"))
+	if err != nil {
+		return err
+	}
+
+	balance, err := billing.ComputeBalance(app, invoice, "")
+	if err != nil {
+		return err
+	}
+
+	payments, err := app.FindCollectionByNameOrId("payments")
+	if err != nil {
+		return err
+	}
+
+	paymentDate := claim.GetDateTime("paidDate").Time()
+	if paymentDate.IsZero() {
+		paymentDate = dates.Today()
+	}
+
+	payment := core.NewRecord(payments)
+	payment.Set("invoice", claim.GetString("invoice"))
+	payment.Set("patient", claim.GetString("patient"))
+	payment.Set("insuranceClaim", claim.Id)
+	payment.Set("paymentMethod", "insurance")
+	payment.Set("paymentDate", paymentDate)
+	payment.Set("notes", strings.TrimSpace("Insurance claim "+claim.GetString("claimNumber")))
+	money.Set(payment, "amount", unrecorded)
+
+	// the payer paid it anyway: the excess is kept as credit rather than
+	// failing the claim save
+	payment.Set("isOverpayment", unrecorded > balance.BalanceDue+balance.PendingInsurance)
+
+	return app.Save(payment)
+}
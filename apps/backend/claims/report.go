@@ -0,0 +1,160 @@
+package claims
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"zahrawiclinic.com/dates"
+	"zahrawiclinic.com/money"
+)
+
+// DenialRow is the denied amount of the claims of an insurer for a denial
+// reason, in the clinic currency.
+type DenialRow struct {
+	Insurer           string      `json:"insurer"`
+	ReasonCode        string      `json:"reasonCode"`
+	ReasonDescription string      `json:"reasonDescription"`
+	Claims            int         `json:"claims"`
+	DeniedAmount      money.Money `json:"deniedAmount"`
+
+	// Appealed is the number of appealed claims and Overturned the number
+	// of approved appeals, recovering OverturnedAmount.
+	Appealed         int         `json:"appealed"`
+	Overturned       int         `json:"overturned"`
+	OverturnedAmount money.Money `json:"overturnedAmount"`
+}
+
+// DenialReport returns the denied amounts of the claims processed between
+// from and to (included, zero for no limit) by insurer and denial reason,
+// the largest first.
+//
+// A claim denied for several reasons counts for its first reason, the
+// claims without reason codes are reported with an empty code.
+func DenialReport(app core.App, from time.Time, to time.Time) ([]DenialRow, error) {
+	// the claims recorded without a processing date count on their claim date
+	processed := "COALESCE(NULLIF([[processedDate]], ''), [[claimDate]])"
+
+	exprs := []dbx.Expression{dbx.NewExp("[[deniedAmount]] > 0")}
+	if !from.IsZero() {
+		exprs = append(exprs, dbx.NewExp(processed+" >= {:from}", dbx.Params{
+			"from": dates.StartOfDay(from).UTC().Format(types.DefaultDateLayout),
+		}))
+	}
+	if !to.IsZero() {
+		exprs = append(exprs, dbx.NewExp(processed+" < {:to}", dbx.Params{
+			"to": dates.StartOfDay(to).AddDate(0, 0, 1).UTC().Format(types.DefaultDateLayout),
+		}))
+	}
+
+	claims, err := app.FindAllRecords("insurance_claims", exprs...)
+	if err != nil {
+		return nil, err
+	}
+
+	if errs := app.ExpandRecords(claims, []string{"insurance", "invoice", "denialReasons"}, nil); len(errs) > 0 {
+		return nil, fmt.Errorf("failed to expand the claims: %v", errs)
+	}
+
+	type key struct{ insurer, reason string }
+	rows := map[key]*DenialRow{}
+	for _, claim := range claims {
+		var insurer string
+		if coverage := claim.ExpandedOne("insurance"); coverage != nil {
+			insurer = coverage.GetString("provider")
+		}
+
+		var code, description string
+		if reasons := claim.ExpandedAll("denialReasons"); len(reasons) > 0 {
+			code = reasons[0].GetString("code")
+			description = reasons[0].GetString("description")
+		}
+
+		row := rows[key{insurer, code}]
+		if row == nil {
+			row = &DenialRow{Insurer: insurer, ReasonCode: code, ReasonDescription: description}
+			rows[key{insurer, code}] = row
+		}
+
+		// the claim amounts are in the currency of their invoice
+		denied := money.Get(claim, "deniedAmount")
+		if invoice := claim.ExpandedOne("invoice"); invoice != nil {
+			denied = money.ToBase(invoice, denied)
+		}
+		row.Claims++
+		row.DeniedAmount += denied
+
+		switch claim.GetString("appealStatus") {
+		case "":
+		case "approved":
+			row.Appealed++
+			row.Overturned++
+			row.OverturnedAmount += denied
+		default:
+			row.Appealed++
+		}
+	}
+
+	report := make([]DenialRow, 0, len(rows))
+	for _, row := range rows {
+		report = append(report, *row)
+	}
+	slices.SortFunc(report, func(a, b DenialRow) int {
+		return cmp.Or(
+			cmp.Compare(b.DeniedAmount, a.DeniedAmount),
+			cmp.Compare(a.Insurer, b.Insurer),
+			cmp.Compare(a.ReasonCode, b.ReasonCode),
+		)
+	})
+
+	return report, nil
+}
+
+// getDenialReport handles GET /api/clinic/reports/claim-denials.
+//
+// It returns the denied claim amounts by insurer and denial reason with
+// the outcome of their appeals.
+//
+// Query parameters:
+//   - from: first processing day included, YYYY-MM-DD (default: all claims)
+//   - to: last processing day included, YYYY-MM-DD (default: all claims)
+func getDenialReport(e *core.RequestEvent) error {
+	var from, to time.Time
+	var err error
+	if raw := e.Request.URL.Query().Get("from"); raw != "" {
+		if from, err = time.ParseInLocation(time.DateOnly, raw, time.Local); err != nil {
+			return e.BadRequestError("Invalid from date, expected YYYY-MM-DD.", nil)
+		}
+	}
+	if raw := e.Request.URL.Query().Get("to"); raw != "" {
+		if to, err = time.ParseInLocation(time.DateOnly, raw, time.Local); err != nil {
+			return e.BadRequestError("Invalid to date, expected YYYY-MM-DD.", nil)
+		}
+	}
+	if !from.IsZero() && !to.IsZero() && to.Before(from) {
+		return e.BadRequestError("The to date is before the from date.", nil)
+	}
+
+	rows, err := DenialReport(e.App, from, to)
+	if err != nil {
+		return e.InternalServerError("Failed to build the denial report.", err)
+	}
+
+	var total, overturned money.Money
+	for _, row := range rows {
+		total += row.DeniedAmount
+		overturned += row.OverturnedAmount
+	}
+
+	return e.JSON(200, map[string]any{
+		"from":             e.Request.URL.Query().Get("from"),
+		"to":               e.Request.URL.Query().Get("to"),
+		"deniedAmount":     total,
+		"overturnedAmount": overturned,
+		"items":            rows,
+	})
+}
@@ -0,0 +1,110 @@
+package claims
+
+import (
+	"slices"
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"zahrawiclinic.com/money"
+	"zahrawiclinic.com/pricing"
+)
+
+var coverageTypes = []string{"primary", "secondary", "tertiary"}
+
+// generateClaim handles POST /api/clinic/invoices/{id}/claims.
+//
+// It creates a pending claim of the invoice for the patient's active
+// coverage of the submitted "coverageType" (primary by default) and
+// returns it with the covered lines. A primary claim (or the first one) is
+// linked from the invoice.
+func generateClaim(e *core.RequestEvent) error {
+	invoice, err := e.App.FindRecordById("invoices", e.Request.PathValue("id"))
+	if err != nil {
+		return e.NotFoundError("Invoice not found.", err)
+	}
+
+	var body struct {
+		CoverageType string `json:"coverageType"`
+	}
+	if err := e.BindBody(&body); err != nil {
+		return e.BadRequestError("Failed to read the submitted data.", err)
+	}
+	if body.CoverageType == "" {
+		body.CoverageType = "primary"
+	}
+	if !slices.Contains(coverageTypes, body.CoverageType) {
+		return e.BadRequestError("Invalid coverage type.", validation.Errors{
+			"coverageType": validation.NewError("validation_invalid_value", "Must be primary, secondary or tertiary."),
+		})
+	}
+
+	if status := invoice.GetString("status"); status == "draft" || status == "cancelled" {
+		return e.BadRequestError("Only issued invoices can be claimed.", nil)
+	}
+
+	on := invoice.GetDateTime("invoiceDate").Time()
+	if on.IsZero() {
+		on = time.Now()
+	}
+
+	coverage, err := pricing.ActiveCoverage(e.App, invoice.GetString("patient"), body.CoverageType, on)
+	if err != nil {
+		return e.InternalServerError("", err)
+	}
+	if coverage == nil {
+		return e.BadRequestError("The patient has no active "+body.CoverageType+" coverage on the invoice date.", nil)
+	}
+
+	existing, err := e.App.CountRecords("insurance_claims", dbx.HashExp{
+		"invoice":   invoice.Id,
+		"insurance": coverage.Id,
+	}, dbx.NewExp("[[status]] != 'denied'"))
+	if err != nil {
+		return e.InternalServerError("", err)
+	}
+	if existing > 0 {
+		return e.BadRequestError("The invoice was already claimed from this coverage.", nil)
+	}
+
+	claim, lines, err := Build(e.App, invoice, coverage)
+	if err != nil {
+		return e.InternalServerError("", err)
+	}
+	if money.Get(claim, "claimedAmount") <= 0 {
+		return e.BadRequestError("The invoice has nothing left to claim from this coverage.", nil)
+	}
+
+	err = e.App.RunInTransaction(func(txApp core.App) error {
+		if err := txApp.Save(claim); err != nil {
+			return err
+		}
+
+		if invoice.GetString("insuranceClaim") != "" && body.CoverageType != "primary" {
+			return nil
+		}
+
+		// reload, the claim hooks updated the invoice insurance amount
+		invoice, err := txApp.FindRecordById("invoices", invoice.Id)
+		if err != nil {
+			return err
+		}
+		invoice.Set("insuranceClaim", claim.Id)
+
+		return txApp.Save(invoice)
+	})
+	if err != nil {
+		return e.BadRequestError("Failed to create the claim.", err)
+	}
+
+	if err := apis.EnrichRecord(e, claim); err != nil {
+		return e.InternalServerError("", err)
+	}
+
+	return e.JSON(200, map[string]any{
+		"claim": claim,
+		"lines": lines,
+	})
+}
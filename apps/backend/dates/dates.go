@@ -0,0 +1,28 @@
+// Package dates holds the calendar helpers shared by the hooks and the
+// scheduled jobs. Days are always counted in the server's local time zone,
+// which is expected to be the clinic's.
+package dates
+
+import "time"
+
+// StartOfDay returns midnight of the day t falls on, in local time.
+func StartOfDay(t time.Time) time.Time {
+	t = t.Local()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+}
+
+// Today returns midnight of the current day.
+func Today() time.Time {
+	return StartOfDay(time.Now())
+}
+
+// DaysBetween returns the number of calendar days from a to b
+// (negative when b is before a).
+func DaysBetween(a time.Time, b time.Time) int {
+	a, b = StartOfDay(a), StartOfDay(b)
+	ya, ma, da := a.Date()
+	yb, mb, db := b.Date()
+	ua := time.Date(ya, ma, da, 0, 0, 0, 0, time.UTC)
+	ub := time.Date(yb, mb, db, 0, 0, 0, 0, time.UTC)
+	return int(ub.Sub(ua).Hours() / 24)
+}
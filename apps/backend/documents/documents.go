@@ -0,0 +1,334 @@
+// Package documents renders the clinic's printable PDF documents (letters,
+// statements, invoices...) with a shared letterhead and layout.
+package documents
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/go-pdf/fpdf"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+const (
+	margin     = 15.0
+	lineHeight = 5.0
+	fontFamily = "Helvetica"
+)
+
+// Letterhead holds the clinic details printed at the top of every document.
+type Letterhead struct {
+	Name  string
+	Lines []string
+
+	// Logo is a PNG or JPEG image printed on the right, if any.
+	Logo []byte
+}
+
+// LetterheadFromApp builds the letterhead from the clinic_settings record:
+// the clinic name, address, contact details, tax registration and logo.
+// It falls back to the app name when the clinic settings are missing.
+func LetterheadFromApp(app core.App) Letterhead {
+	letterhead := Letterhead{Name: app.Settings().Meta.AppName}
+
+	records, err := app.FindRecordsByFilter("clinic_settings", "", "created", 1, 0)
+	if err != nil || len(records) == 0 {
+		return letterhead
+	}
+	settings := records[0]
+
+	if name := settings.GetString("name"); name != "" {
+		letterhead.Name = name
+	}
+
+	letterhead.Lines = []string{
+		settings.GetString("address"),
+		join(" ", settings.GetString("city"), settings.GetString("state"), settings.GetString("postalCode")),
+		join("  |  ", labelled("Phone", settings.GetString("phone")), labelled("Email", settings.GetString("email"))),
+		labelled("Tax registration no.", settings.GetString("taxRegistrationNumber")),
+	}
+
+	if settings.GetString("logo") != "" {
+		content, err := ReadFile(app, settings, "logo")
+		if err != nil {
+			app.Logger().Warn("Failed to read the clinic logo", "error", err)
+		} else {
+			letterhead.Logo = content
+		}
+	}
+
+	return letterhead
+}
+
+// ReadFile returns the content of the (single) file stored in the record
+// field, e.g. a previously issued document.
+func ReadFile(app core.App, record *core.Record, field string) ([]byte, error) {
+	name := record.GetString(field)
+	if name == "" {
+		return nil, fmt.Errorf("no %s file stored", field)
+	}
+
+	fsys, err := app.NewFilesystem()
+	if err != nil {
+		return nil, err
+	}
+	defer fsys.Close()
+
+	reader, err := fsys.GetReader(record.BaseFilesPath() + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
+
+// Column describes a table column. Width is a fraction of the printable
+// width and Align one of "L", "C" or "R".
+type Column struct {
+	Header string
+	Width  float64
+	Align  string
+}
+
+// Document is an A4 portrait PDF under construction.
+type Document struct {
+	pdf   *fpdf.Fpdf
+	tr    func(string) string
+	width float64
+}
+
+// New starts a document with the letterhead on its first page.
+func New(title string, letterhead Letterhead) *Document {
+	pdf := fpdf.New("P", "mm", "A4", "")
+	pdf.SetMargins(margin, margin, margin)
+	pdf.SetAutoPageBreak(true, margin+5)
+	pdf.SetTitle(title, true)
+	pdf.SetCreator(letterhead.Name, true)
+	pdf.SetCreationDate(time.Now())
+	pdf.AliasNbPages("")
+
+	d := &Document{
+		pdf: pdf,
+		// the core fonts only cover cp1252
+		tr: pdf.UnicodeTranslatorFromDescriptor(""),
+	}
+
+	pageWidth, _ := pdf.GetPageSize()
+	d.width = pageWidth - 2*margin
+
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-margin)
+		pdf.SetFont(fontFamily, "I", 8)
+		pdf.SetTextColor(120, 120, 120)
+		pdf.CellFormat(d.width/2, 4, d.tr(title), "", 0, "L", false, 0, "")
+		pdf.CellFormat(d.width/2, 4, d.tr("Page {nb}"), "", 0, "R", false, 0, "")
+		pdf.SetTextColor(0, 0, 0)
+	})
+
+	pdf.AddPage()
+	d.letterhead(letterhead)
+
+	return d
+}
+
+func (d *Document) letterhead(l Letterhead) {
+	top := d.pdf.GetY()
+	bottom := top
+	textWidth := d.width
+
+	if logo, ok := d.logo(l.Logo); ok {
+		height := 20.0
+		width := height * logo.Width() / logo.Height()
+		if width > d.width/3 {
+			width = d.width / 3
+			height = width * logo.Height() / logo.Width()
+		}
+		d.pdf.ImageOptions("logo", margin+d.width-width, top, width, height, false, fpdf.ImageOptions{}, 0, "")
+		textWidth -= width + 5
+		bottom = top + height
+	}
+
+	d.pdf.SetFont(fontFamily, "B", 16)
+	d.pdf.CellFormat(textWidth, 8, d.tr(l.Name), "", 1, "L", false, 0, "")
+
+	d.pdf.SetFont(fontFamily, "", 9)
+	for _, line := range l.Lines {
+		if line != "" {
+			d.pdf.CellFormat(textWidth, 4, d.tr(line), "", 1, "L", false, 0, "")
+		}
+	}
+
+	y := max(d.pdf.GetY(), bottom) + 2
+	d.pdf.SetDrawColor(160, 160, 160)
+	d.pdf.Line(margin, y, margin+d.width, y)
+	d.pdf.SetY(y + 6)
+}
+
+// logo registers the letterhead logo, skipping images fpdf can't read so
+// that a bad upload doesn't break the documents.
+func (d *Document) logo(content []byte) (*fpdf.ImageInfoType, bool) {
+	if len(content) == 0 {
+		return nil, false
+	}
+
+	_, format, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil || (format != "png" && format != "jpeg") {
+		return nil, false
+	}
+
+	info := d.pdf.RegisterImageOptionsReader("logo", fpdf.ImageOptions{ImageType: format}, bytes.NewReader(content))
+	if !d.pdf.Ok() {
+		d.pdf.ClearError()
+		return nil, false
+	}
+	if info == nil || info.Height() == 0 {
+		return nil, false
+	}
+
+	return info, true
+}
+
+// Title prints the document title.
+func (d *Document) Title(text string) {
+	d.pdf.SetFont(fontFamily, "B", 14)
+	d.pdf.CellFormat(d.width, 8, d.tr(text), "", 1, "L", false, 0, "")
+	d.pdf.Ln(2)
+}
+
+// Heading starts a new section.
+func (d *Document) Heading(text string) {
+	d.pdf.Ln(3)
+	d.pdf.SetFont(fontFamily, "B", 11)
+	d.pdf.CellFormat(d.width, 6, d.tr(text), "B", 1, "L", false, 0, "")
+	d.pdf.Ln(1)
+}
+
+// Paragraph prints wrapped text.
+func (d *Document) Paragraph(text string) {
+	d.pdf.SetFont(fontFamily, "", 10)
+	d.pdf.MultiCell(d.width, lineHeight, d.tr(text), "", "L", false)
+	d.pdf.Ln(1)
+}
+
+// Field prints a "label: value" line, skipping empty values.
+func (d *Document) Field(label string, value string) {
+	if strings.TrimSpace(value) == "" {
+		return
+	}
+
+	labelWidth := d.width * 0.3
+
+	d.pdf.SetFont(fontFamily, "B", 10)
+	d.pdf.CellFormat(labelWidth, lineHeight, d.tr(label), "", 0, "L", false, 0, "")
+	d.pdf.SetFont(fontFamily, "", 10)
+	d.pdf.MultiCell(d.width-labelWidth, lineHeight, d.tr(value), "", "L", false)
+}
+
+// Space adds vertical space in millimeters.
+func (d *Document) Space(h float64) {
+	d.pdf.Ln(h)
+}
+
+// Table prints rows under a header row, repeating the header on page breaks.
+// Cells wrap within their column.
+func (d *Document) Table(columns []Column, rows [][]string) {
+	_, pageHeight := d.pdf.GetPageSize()
+	bottom := pageHeight - margin - 5
+
+	header := func() {
+		d.pdf.SetFont(fontFamily, "B", 9)
+		d.pdf.SetFillColor(235, 235, 235)
+		for _, c := range columns {
+			d.pdf.CellFormat(c.Width*d.width, 6, d.tr(c.Header), "B", 0, align(c.Align), true, 0, "")
+		}
+		d.pdf.Ln(-1)
+	}
+
+	header()
+
+	d.pdf.SetFont(fontFamily, "", 9)
+	for _, row := range rows {
+		lines := make([][]string, len(columns))
+		height := 1
+		for i, c := range columns {
+			var text string
+			if i < len(row) {
+				text = d.tr(row[i])
+			}
+			lines[i] = d.pdf.SplitText(text, c.Width*d.width-2)
+			height = max(height, len(lines[i]))
+		}
+		rowHeight := float64(height) * 4.5
+
+		if d.pdf.GetY()+rowHeight > bottom {
+			d.pdf.AddPage()
+			header()
+			d.pdf.SetFont(fontFamily, "", 9)
+		}
+
+		x, y := d.pdf.GetX(), d.pdf.GetY()
+		for i, c := range columns {
+			d.pdf.SetXY(x, y)
+			d.pdf.MultiCell(c.Width*d.width, 4.5, strings.Join(lines[i], "\n"), "", align(c.Align), false)
+			x += c.Width * d.width
+		}
+		d.pdf.SetXY(margin, y+rowHeight)
+		d.pdf.SetDrawColor(220, 220, 220)
+		d.pdf.Line(margin, y+rowHeight, margin+d.width, y+rowHeight)
+		d.pdf.Ln(0.5)
+	}
+}
+
+// Totals prints right aligned "label value" lines, the last one in bold.
+func (d *Document) Totals(lines [][2]string) {
+	labelWidth := d.width * 0.75
+	for i, line := range lines {
+		style := ""
+		if i == len(lines)-1 {
+			style = "B"
+		}
+		d.pdf.SetFont(fontFamily, style, 10)
+		d.pdf.CellFormat(labelWidth, lineHeight+1, d.tr(line[0]), "", 0, "R", false, 0, "")
+		d.pdf.CellFormat(d.width-labelWidth, lineHeight+1, d.tr(line[1]), "", 1, "R", false, 0, "")
+	}
+}
+
+// Bytes finalizes the document and returns its content.
+func (d *Document) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := d.pdf.Output(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func align(a string) string {
+	if a == "" {
+		return "L"
+	}
+	return a
+}
+
+func labelled(label string, value string) string {
+	if value == "" {
+		return ""
+	}
+	return label + ": " + value
+}
+
+func join(sep string, values ...string) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			parts = append(parts, v)
+		}
+	}
+	return strings.Join(parts, sep)
+}
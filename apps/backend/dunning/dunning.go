@@ -0,0 +1,224 @@
+// Package dunning marks unpaid invoices past their due date as overdue and
+// sends the reminder sequence configured in the dunning_steps collection.
+package dunning
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"zahrawiclinic.com/dates"
+	"zahrawiclinic.com/money"
+	"zahrawiclinic.com/notify"
+	"zahrawiclinic.com/tasks"
+)
+
+// Register binds the daily overdue invoices job to the app.
+func Register(app core.App) {
+	app.Cron().MustAdd("invoicesOverdue", "0 6 * * *", func() {
+		if err := Run(app); err != nil {
+			app.Logger().Error("Failed to process overdue invoices", "error", err)
+		}
+	})
+}
+
+// Run marks the overdue invoices and sends the due reminders.
+func Run(app core.App) error {
+	if err := MarkOverdue(app); err != nil {
+		return err
+	}
+	return SendReminders(app)
+}
+
+// MarkOverdue moves the issued invoices with a balance past their due date
+// to the overdue status.
+func MarkOverdue(app core.App) error {
+	invoices, err := app.FindRecordsByFilter(
+		"invoices",
+		"(status = 'sent' || status = 'partial') && dueDate != '' && dueDate < {:today} && balanceDue > 0",
+		"dueDate",
+		0,
+		0,
+		dbx.Params{"today": dates.Today().UTC().Format(types.DefaultDateLayout)},
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, invoice := range invoices {
+		invoice.Set("status", "overdue")
+		if err := app.Save(invoice); err != nil {
+			return fmt.Errorf("invoice %s: %w", invoice.GetString("invoiceNumber"), err)
+		}
+	}
+
+	return nil
+}
+
+// SendReminders sends, for every overdue invoice, the latest dunning step
+// it reached unless it was already sent. Earlier steps that were missed
+// (e.g. an invoice entered late) are not sent anymore.
+func SendReminders(app core.App) error {
+	steps, err := app.FindRecordsByFilter("dunning_steps", "", "daysOverdue", 0, 0)
+	if err != nil || len(steps) == 0 {
+		return err
+	}
+
+	invoices, err := app.FindRecordsByFilter("invoices", "status = 'overdue' && balanceDue > 0", "dueDate", 0, 0)
+	if err != nil {
+		return err
+	}
+
+	if errs := app.ExpandRecords(invoices, []string{"patient"}, nil); len(errs) > 0 {
+		return fmt.Errorf("failed to expand invoices: %v", errs)
+	}
+
+	today := dates.Today()
+
+	for _, invoice := range invoices {
+		patient := invoice.ExpandedOne("patient")
+		if patient == nil {
+			continue
+		}
+
+		daysOverdue := dates.DaysBetween(invoice.GetDateTime("dueDate").Time(), today)
+
+		var step *core.Record
+		for _, s := range steps {
+			if s.GetInt("daysOverdue") <= daysOverdue {
+				step = s
+			}
+		}
+		if step == nil {
+			continue
+		}
+
+		if err := sendStep(app, invoice, patient, step, daysOverdue); err != nil {
+			// keep going, one invoice must not block the others
+			app.Logger().Error(
+				"Failed to send the invoice reminder",
+				"invoice", invoice.GetString("invoiceNumber"),
+				"step", step.GetString("name"),
+				"error", err,
+			)
+		}
+	}
+
+	return nil
+}
+
+// sendStep sends the step reminder on each of its channels that wasn't
+// sent yet, retrying the failed ones, and logs the outcome.
+func sendStep(app core.App, invoice *core.Record, patient *core.Record, step *core.Record, daysOverdue int) error {
+	values := map[string]string{
+		"PATIENT_NAME":   strings.TrimSpace(patient.GetString("firstName") + " " + patient.GetString("lastName")),
+		"INVOICE_NUMBER": invoice.GetString("invoiceNumber"),
+		"INVOICE_DATE":   invoice.GetDateTime("invoiceDate").Time().Format(time.DateOnly),
+		"DUE_DATE":       invoice.GetDateTime("dueDate").Time().Format(time.DateOnly),
+		"DAYS_OVERDUE":   strconv.Itoa(daysOverdue),
+		"BALANCE_DUE":    money.CurrencyOf(app, invoice).Display(money.Get(invoice, "balanceDue")),
+		"CLINIC_NAME":    app.Settings().Meta.AppName,
+	}
+
+	for _, channel := range step.GetStringSlice("channels") {
+		log, err := app.FindFirstRecordByFilter(
+			"dunning_logs",
+			"invoice = {:invoice} && step = {:step} && channel = {:channel}",
+			dbx.Params{"invoice": invoice.Id, "step": step.Id, "channel": channel},
+		)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			collection, err := app.FindCachedCollectionByNameOrId("dunning_logs")
+			if err != nil {
+				return err
+			}
+			log = core.NewRecord(collection)
+			log.Set("invoice", invoice.Id)
+			log.Set("patient", patient.Id)
+			log.Set("step", step.Id)
+			log.Set("channel", channel)
+		case err != nil:
+			return err
+		case log.GetString("status") != "failed":
+			continue
+		}
+
+		recipient, sendErr := send(app, channel, patient, step, values)
+
+		log.Set("recipient", recipient)
+		money.Set(log, "balanceDue", money.Get(invoice, "balanceDue"))
+		switch {
+		case sendErr == nil:
+			log.Set("status", "sent")
+			log.Set("error", "")
+		case errors.Is(sendErr, errNoRecipient), errors.Is(sendErr, notify.ErrSMSNotConfigured):
+			log.Set("status", "skipped")
+			log.Set("error", sendErr.Error())
+		default:
+			log.Set("status", "failed")
+			log.Set("error", sendErr.Error())
+		}
+
+		if err := app.Save(log); err != nil {
+			return err
+		}
+	}
+
+	if step.GetBool("createTask") {
+		_, err := tasks.Ensure(app, tasks.Task{
+			Source:   fmt.Sprintf("dunning:%s:%s", invoice.Id, step.Id),
+			Title:    fmt.Sprintf("Unpaid invoice %s: %s sent", invoice.GetString("invoiceNumber"), step.GetString("name")),
+			Priority: "high",
+			Category: "billing",
+			DueDate:  dates.Today(),
+			Description: fmt.Sprintf(
+				"Invoice %s is %d days overdue with a balance of %s. The reminder sequence is complete, contact %s to settle the account.",
+				values["INVOICE_NUMBER"],
+				daysOverdue,
+				values["BALANCE_DUE"],
+				values["PATIENT_NAME"],
+			),
+			Patient: patient.Id,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var errNoRecipient = errors.New("the patient has no contact for this channel")
+
+// send delivers the step message on the channel and returns the recipient.
+func send(app core.App, channel string, patient *core.Record, step *core.Record, values map[string]string) (string, error) {
+	switch channel {
+	case "email":
+		to := patient.GetString("email")
+		if to == "" {
+			return "", errNoRecipient
+		}
+		return to, notify.SendEmail(app, notify.Email{
+			To:      to,
+			Subject: notify.Render(step.GetString("emailSubject"), values),
+			HTML:    notify.RenderHTML(step.GetString("emailBody"), values),
+		})
+	case "sms":
+		to := patient.GetString("mobile")
+		if to == "" {
+			to = patient.GetString("phone")
+		}
+		if to == "" {
+			return "", errNoRecipient
+		}
+		return to, notify.SendSMS(to, notify.Render(step.GetString("smsBody"), values))
+	default:
+		return "", fmt.Errorf("unknown channel %q", channel)
+	}
+}
@@ -0,0 +1,180 @@
+package eligibility
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"zahrawiclinic.com/money"
+)
+
+// Request is the coverage to verify, as sent to the payer.
+type Request struct {
+	PayerId      string `json:"payerId"`
+	PayerName    string `json:"payerName"`
+	PolicyNumber string `json:"policyNumber"`
+	GroupNumber  string `json:"groupNumber"`
+	CoverageType string `json:"coverageType"`
+
+	// Subscriber is the policy holder, the patient when Relationship is
+	// "self".
+	Subscriber   Person `json:"subscriber"`
+	Patient      Person `json:"patient"`
+	Relationship string `json:"relationship"`
+
+	// ServiceDate is the day of the appointment, YYYY-MM-DD.
+	ServiceDate string `json:"serviceDate"`
+
+	// ProviderNPI is the clinic National Provider Identifier.
+	ProviderNPI string `json:"providerNpi"`
+}
+
+// Person identifies the subscriber or the patient.
+type Person struct {
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+
+	// DateOfBirth is formatted YYYY-MM-DD.
+	DateOfBirth string `json:"dateOfBirth"`
+}
+
+// Response is the coverage reported by the payer.
+type Response struct {
+	Active   bool   `json:"active"`
+	PlanName string `json:"planName"`
+
+	// CoverageStart and CoverageEnd are formatted YYYY-MM-DD, empty when
+	// not reported.
+	CoverageStart string `json:"coverageStart"`
+	CoverageEnd   string `json:"coverageEnd"`
+
+	// RemainingMaximum and RemainingDeductible are nil when not reported.
+	RemainingMaximum    *money.Money `json:"remainingMaximum"`
+	RemainingDeductible *money.Money `json:"remainingDeductible"`
+
+	FrequencyLimits []FrequencyLimit `json:"frequencyLimits"`
+	Message         string           `json:"message"`
+}
+
+// FrequencyLimit is how often the plan covers a procedure, e.g. two
+// cleanings per benefit year.
+type FrequencyLimit struct {
+	Code        string `json:"code"`
+	Description string `json:"description"`
+	Limit       int    `json:"limit"`
+	Period      string `json:"period"`
+	Used        int    `json:"used"`
+
+	// NextEligibleDate is formatted YYYY-MM-DD, empty when the procedure
+	// is covered now.
+	NextEligibleDate string `json:"nextEligibleDate"`
+}
+
+// Checker verifies a coverage with the payer.
+type Checker interface {
+	// Name identifies the checker in the stored checks.
+	Name() string
+
+	Check(ctx context.Context, request Request) (Response, error)
+}
+
+// FromEnv returns the checker configured with the ELIGIBILITY_URL (and
+// optional ELIGIBILITY_TOKEN) environment variables, or nil.
+func FromEnv() Checker {
+	url := os.Getenv("ELIGIBILITY_URL")
+	if url == "" {
+		return nil
+	}
+
+	return &HTTPChecker{
+		URL:   url,
+		Token: os.Getenv("ELIGIBILITY_TOKEN"),
+	}
+}
+
+// HTTPChecker posts the request as JSON to an eligibility gateway, which
+// answers with the JSON encoded Response.
+type HTTPChecker struct {
+	URL   string
+	Token string
+
+	// Client defaults to a client with a 30 seconds timeout.
+	Client *http.Client
+}
+
+var defaultClient = &http.Client{Timeout: 30 * time.Second}
+
+// Name implements Checker.
+func (c *HTTPChecker) Name() string {
+	return "http"
+}
+
+// Check implements Checker.
+func (c *HTTPChecker) Check(ctx context.Context, request Request) (Response, error) {
+	var response Response
+
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return response, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(payload))
+	if err != nil {
+		return response, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	client := c.Client
+	if client == nil {
+		client = defaultClient
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return response, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(res.Body, 500))
+		return response, fmt.Errorf("eligibility gateway responded with %d: %s", res.StatusCode, strings.TrimSpace(string(detail)))
+	}
+
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&response); err != nil {
+		return response, fmt.Errorf("invalid eligibility response: %w", err)
+	}
+
+	return response, nil
+}
+
+// StubChecker answers every request with Response, or fails with Err,
+// without contacting any payer. It records the requests it received.
+type StubChecker struct {
+	Response Response
+	Err      error
+	Requests []Request
+}
+
+// Name implements Checker.
+func (c *StubChecker) Name() string {
+	return "stub"
+}
+
+// Check implements Checker.
+func (c *StubChecker) Check(ctx context.Context, request Request) (Response, error) {
+	c.Requests = append(c.Requests, request)
+	if c.Err != nil {
+		return Response{}, c.Err
+	}
+	return c.Response, nil
+}
@@ -0,0 +1,213 @@
+// Package eligibility verifies the insurance coverage of the patients with
+// their payers before the appointments and stores the answers in the
+// eligibility_checks collection.
+//
+// The payers are reached through a Checker, the HTTP JSON gateway
+// configured with the ELIGIBILITY_URL (and optional ELIGIBILITY_TOKEN)
+// environment variables. Expired and inactive policies are flagged from
+// their expirationDate and isActive fields without asking the payer.
+package eligibility
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"zahrawiclinic.com/dates"
+	"zahrawiclinic.com/money"
+)
+
+// ErrNotConfigured is returned by Check when the policy has to be verified
+// with the payer and no checker is configured.
+var ErrNotConfigured = errors.New("no eligibility checker configured")
+
+// Register binds the eligibility routes and the daily checks of the next
+// day appointments to the app.
+func Register(app core.App) {
+	checker := FromEnv()
+
+	app.Cron().MustAdd("eligibilityChecks", "0 6 * * *", func() {
+		if err := CheckUpcoming(app, checker, dates.Today().AddDate(0, 0, 1)); err != nil {
+			app.Logger().Error("Failed to check the insurance eligibility", "error", err)
+		}
+	})
+
+	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
+		registerRoutes(se, checker)
+		return se.Next()
+	})
+}
+
+// Options are the optional details of a check.
+type Options struct {
+	// Appointment is the id of the appointment the coverage is checked for.
+	Appointment string
+
+	// CheckedBy is the id of the user who asked for the check.
+	CheckedBy string
+}
+
+// Check verifies the coverage on the service date and stores the result as
+// a new eligibility_checks record.
+//
+// Inactive policies and policies expired on the service date are recorded
+// as such without asking the payer. The other policies are verified with
+// the checker and its failures are recorded with the error status. When
+// checker is nil, ErrNotConfigured is returned and nothing is recorded.
+func Check(app core.App, checker Checker, coverage *core.Record, serviceDate time.Time, opts Options) (*core.Record, error) {
+	collection, err := app.FindCachedCollectionByNameOrId("eligibility_checks")
+	if err != nil {
+		return nil, err
+	}
+
+	record := core.NewRecord(collection)
+	record.Set("patient", coverage.GetString("patient"))
+	record.Set("insurance", coverage.Id)
+	record.Set("appointment", opts.Appointment)
+	record.Set("serviceDate", dates.StartOfDay(serviceDate))
+	record.Set("checkedBy", opts.CheckedBy)
+
+	switch status, message := policyStatus(coverage, serviceDate); {
+	case status != "":
+		record.Set("provider", "local")
+		record.Set("status", status)
+		record.Set("message", message)
+	case checker == nil:
+		return nil, ErrNotConfigured
+	default:
+		record.Set("provider", checker.Name())
+
+		request, err := newRequest(app, coverage, serviceDate)
+		if err != nil {
+			return nil, err
+		}
+
+		response, err := checker.Check(context.Background(), request)
+		if err != nil {
+			record.Set("status", "error")
+			record.Set("error", truncate(err.Error(), 1000))
+		} else {
+			setResponse(record, response)
+		}
+	}
+
+	if err := app.Save(record); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// policyStatus returns "inactive" or "expired" with an explanation when
+// the policy on file doesn't cover the service date.
+func policyStatus(coverage *core.Record, serviceDate time.Time) (string, string) {
+	if !coverage.GetBool("isActive") {
+		return "inactive", "The policy is marked inactive."
+	}
+
+	// compared as ActiveCoverage does
+	day := dates.StartOfDay(serviceDate)
+
+	if expiration := coverage.GetDateTime("expirationDate").Time(); !expiration.IsZero() && expiration.Before(day) {
+		return "expired", fmt.Sprintf("The policy expired on %s.", formatDate(coverage.GetDateTime("expirationDate")))
+	}
+
+	if effective := coverage.GetDateTime("effectiveDate").Time(); !effective.IsZero() && effective.After(day) {
+		return "inactive", fmt.Sprintf("The policy is only effective from %s.", formatDate(coverage.GetDateTime("effectiveDate")))
+	}
+
+	return "", ""
+}
+
+// setResponse stores the payer answer in the check.
+func setResponse(record *core.Record, response Response) {
+	status := "inactive"
+	if response.Active {
+		status = "active"
+	}
+
+	record.Set("status", status)
+	record.Set("planName", response.PlanName)
+	record.Set("message", truncate(response.Message, 2000))
+	record.Set("frequencyLimits", response.FrequencyLimits)
+	record.Set("response", response)
+
+	if start, err := time.ParseInLocation(time.DateOnly, response.CoverageStart, time.Local); err == nil {
+		record.Set("coverageStart", start)
+	}
+	if end, err := time.ParseInLocation(time.DateOnly, response.CoverageEnd, time.Local); err == nil {
+		record.Set("coverageEnd", end)
+	}
+	if response.RemainingMaximum != nil {
+		money.Set(record, "remainingMaximum", *response.RemainingMaximum)
+	}
+	if response.RemainingDeductible != nil {
+		money.Set(record, "remainingDeductible", *response.RemainingDeductible)
+	}
+}
+
+// newRequest builds the request of the coverage with the patient and the
+// clinic identifiers.
+func newRequest(app core.App, coverage *core.Record, serviceDate time.Time) (Request, error) {
+	patient, err := app.FindRecordById("patients", coverage.GetString("patient"))
+	if err != nil {
+		return Request{}, err
+	}
+
+	request := Request{
+		PayerId:      coverage.GetString("payerId"),
+		PayerName:    coverage.GetString("provider"),
+		PolicyNumber: coverage.GetString("policyNumber"),
+		GroupNumber:  coverage.GetString("groupNumber"),
+		CoverageType: coverage.GetString("coverageType"),
+		Patient: Person{
+			FirstName:   patient.GetString("firstName"),
+			LastName:    patient.GetString("lastName"),
+			DateOfBirth: formatDate(patient.GetDateTime("dateOfBirth")),
+		},
+		Relationship: coverage.GetString("relationshipToPolicyHolder"),
+		ServiceDate:  serviceDate.Format(time.DateOnly),
+	}
+	if request.Relationship == "" {
+		request.Relationship = "self"
+	}
+
+	if request.Relationship == "self" {
+		request.Subscriber = request.Patient
+	} else {
+		fields := strings.Fields(coverage.GetString("policyHolderName"))
+		if len(fields) > 0 {
+			request.Subscriber.FirstName = strings.Join(fields[:len(fields)-1], " ")
+			request.Subscriber.LastName = fields[len(fields)-1]
+		}
+		request.Subscriber.DateOfBirth = formatDate(coverage.GetDateTime("policyHolderDOB"))
+	}
+
+	settings, err := app.FindRecordsByFilter("clinic_settings", "", "created", 1, 0)
+	if err != nil {
+		return Request{}, err
+	}
+	if len(settings) > 0 {
+		request.ProviderNPI = settings[0].GetString("npi")
+	}
+
+	return request, nil
+}
+
+func formatDate(d types.DateTime) string {
+	if d.IsZero() {
+		return ""
+	}
+	return d.Time().In(time.Local).Format(time.DateOnly)
+}
+
+func truncate(s string, length int) string {
+	if len(s) > length {
+		return s[:length]
+	}
+	return s
+}
@@ -0,0 +1,175 @@
+package eligibility
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"zahrawiclinic.com/dates"
+	"zahrawiclinic.com/tasks"
+)
+
+// statusLabels describe the flagged checks in the staff tasks.
+var statusLabels = map[string]string{
+	"inactive": "Inactive insurance",
+	"expired":  "Expired insurance",
+	"error":    "Insurance not verified",
+}
+
+// CheckUpcoming checks the coverage of the patients with a scheduled or
+// confirmed appointment on the given day. The coverages already checked for
+// the appointment are skipped, unless the payer couldn't be reached.
+//
+// A task is raised for every policy that isn't active on the appointment
+// day or couldn't be verified, so that the front desk calls the patient or
+// the payer before the visit. Without checker only the expired and inactive
+// policies are flagged. The appointments that fail are logged and skipped,
+// their errors are returned together.
+func CheckUpcoming(app core.App, checker Checker, day time.Time) error {
+	from := dates.StartOfDay(day)
+
+	appointments, err := app.FindRecordsByFilter(
+		"appointments",
+		"(status = 'scheduled' || status = 'confirmed') && start_time >= {:from} && start_time < {:to}",
+		"start_time",
+		0,
+		0,
+		dbx.Params{
+			"from": from.UTC().Format(types.DefaultDateLayout),
+			"to":   from.AddDate(0, 0, 1).UTC().Format(types.DefaultDateLayout),
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	if errs := app.ExpandRecords(appointments, []string{"patient"}, nil); len(errs) > 0 {
+		return fmt.Errorf("failed to expand appointments: %v", errs)
+	}
+
+	// one failing appointment must not leave the others unchecked
+	var failed []error
+	for _, appointment := range appointments {
+		if err := checkAppointment(app, checker, appointment, from); err != nil {
+			app.Logger().Error(
+				"Failed to check the insurance eligibility",
+				"appointment", appointment.Id,
+				"error", err,
+			)
+			failed = append(failed, fmt.Errorf("appointment %s: %w", appointment.Id, err))
+		}
+	}
+
+	return errors.Join(failed...)
+}
+
+// checkAppointment checks the coverages of the appointment patient not
+// checked yet for the appointment and flags the problems.
+func checkAppointment(app core.App, checker Checker, appointment *core.Record, from time.Time) error {
+	coverages, err := Coverages(app, appointment.GetString("patient"))
+	if err != nil {
+		return err
+	}
+
+	for _, coverage := range coverages {
+		checked, err := app.CountRecords("eligibility_checks", dbx.HashExp{
+			"appointment": appointment.Id,
+			"insurance":   coverage.Id,
+		}, dbx.NewExp("[[status]] != 'error'"))
+		if err != nil {
+			return err
+		}
+		if checked > 0 {
+			continue
+		}
+
+		check, err := Check(app, checker, coverage, from, Options{Appointment: appointment.Id})
+		if errors.Is(err, ErrNotConfigured) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := flag(app, appointment, coverage, check); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Coverages returns the policies of the patient to verify: for each
+// coverage type, the active policy on file or else the last
+// inactive one, so that an inactive primary policy gets flagged.
+func Coverages(app core.App, patientId string) ([]*core.Record, error) {
+	policies, err := app.FindRecordsByFilter(
+		"patient_insurance",
+		"patient = {:patient}",
+		"coverageType,-isActive,-effectiveDate,-created",
+		0,
+		0,
+		dbx.Params{"patient": patientId},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	coverages := make([]*core.Record, 0, len(policies))
+	seen := map[string]bool{}
+	for _, policy := range policies {
+		coverageType := policy.GetString("coverageType")
+		if seen[coverageType] {
+			continue
+		}
+		seen[coverageType] = true
+		coverages = append(coverages, policy)
+	}
+
+	return coverages, nil
+}
+
+// flag raises a task for a check that isn't active, assigned to the
+// appointment dentist and due before the appointment.
+func flag(app core.App, appointment *core.Record, coverage *core.Record, check *core.Record) error {
+	status := check.GetString("status")
+	label, ok := statusLabels[status]
+	if !ok {
+		return nil
+	}
+
+	var patientName string
+	if patient := appointment.ExpandedOne("patient"); patient != nil {
+		patientName = strings.TrimSpace(patient.GetString("firstName") + " " + patient.GetString("lastName"))
+	}
+
+	detail := check.GetString("message")
+	if status == "error" {
+		detail = fmt.Sprintf("The payer couldn't be reached (%s).", check.GetString("error"))
+	}
+
+	start := appointment.GetDateTime("start_time").Time().In(time.Local)
+
+	_, err := tasks.Ensure(app, tasks.Task{
+		Source:   fmt.Sprintf("eligibility:%s:%s", appointment.Id, coverage.Id),
+		Title:    fmt.Sprintf("%s: %s for %s", label, coverage.GetString("provider"), patientName),
+		Priority: "high",
+		Category: "administrative",
+		DueDate:  dates.StartOfDay(start).AddDate(0, 0, -1),
+		Description: fmt.Sprintf(
+			"%s The %s policy %s couldn't be confirmed for the appointment of %s. Contact the patient or the payer before the visit.",
+			detail,
+			coverage.GetString("coverageType"),
+			coverage.GetString("policyNumber"),
+			start.Format("2006-01-02 15:04"),
+		),
+		AssignedTo: appointment.GetString("dentist"),
+		Patient:    appointment.GetString("patient"),
+	})
+
+	return err
+}
@@ -0,0 +1,76 @@
+package eligibility
+
+import (
+	"errors"
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"zahrawiclinic.com/dates"
+)
+
+func registerRoutes(se *core.ServeEvent, checker Checker) {
+	g := se.Router.Group("/api/clinic")
+	g.Bind(apis.RequireAuth())
+
+	g.POST("/patient-insurance/{id}/eligibility", func(e *core.RequestEvent) error {
+		return checkEligibility(e, checker)
+	})
+}
+
+// checkEligibility handles POST /api/clinic/patient-insurance/{id}/eligibility.
+//
+// It verifies the policy with the payer and returns the stored check.
+//
+// Body parameters:
+//   - serviceDate: the day to verify, YYYY-MM-DD (default: today)
+//   - appointment: the appointment the coverage is checked for (optional)
+func checkEligibility(e *core.RequestEvent, checker Checker) error {
+	coverage, err := e.App.FindRecordById("patient_insurance", e.Request.PathValue("id"))
+	if err != nil {
+		return e.NotFoundError("Insurance not found.", err)
+	}
+
+	var body struct {
+		ServiceDate string `json:"serviceDate"`
+		Appointment string `json:"appointment"`
+	}
+	if err := e.BindBody(&body); err != nil {
+		return e.BadRequestError("Failed to read the submitted data.", err)
+	}
+
+	serviceDate := dates.Today()
+	if body.ServiceDate != "" {
+		if serviceDate, err = time.ParseInLocation(time.DateOnly, body.ServiceDate, time.Local); err != nil {
+			return e.BadRequestError("Invalid service date, expected YYYY-MM-DD.", nil)
+		}
+	}
+
+	opts := Options{Appointment: body.Appointment}
+	if body.Appointment != "" {
+		appointment, err := e.App.FindRecordById("appointments", body.Appointment)
+		if err != nil || appointment.GetString("patient") != coverage.GetString("patient") {
+			return e.BadRequestError("Invalid appointment.", validation.Errors{
+				"appointment": validation.NewError("validation_appointment_patient", "The appointment must be the insured patient's."),
+			})
+		}
+	}
+	if e.Auth != nil && e.Auth.Collection().Name == "users" {
+		opts.CheckedBy = e.Auth.Id
+	}
+
+	check, err := Check(e.App, checker, coverage, serviceDate, opts)
+	if errors.Is(err, ErrNotConfigured) {
+		return e.BadRequestError("No eligibility service is configured.", nil)
+	}
+	if err != nil {
+		return e.InternalServerError("Failed to check the eligibility.", err)
+	}
+
+	if err := apis.EnrichRecord(e, check); err != nil {
+		return e.InternalServerError("", err)
+	}
+
+	return e.JSON(200, check)
+}
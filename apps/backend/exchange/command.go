@@ -0,0 +1,80 @@
+package exchange
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/spf13/cobra"
+)
+
+func newCommand(app core.App) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "exchange-rates",
+		Short: "Manages the exchange rates of the foreign currencies",
+	}
+
+	command.AddCommand(newImportCommand(app))
+
+	return command
+}
+
+func newImportCommand(app core.App) *cobra.Command {
+	var opts ImportOptions
+
+	command := &cobra.Command{
+		Use:   "import <file.csv>",
+		Short: "Imports dated exchange rates from a CSV file",
+		Long: `Imports dated exchange rates from a CSV file.
+
+The CSV file must start with a header row naming the date (YYYY-MM-DD),
+currency (ISO 4217 code) and rate columns. The rates are in units of the
+clinic currency for one unit of the currency, use --inverse for files
+quoting the currency units for one unit of the clinic currency.
+
+Existing rates are updated by currency and date. The invoices and payments
+already recorded keep the rate they were saved with.`,
+		Example:      "  exchange-rates import rates.csv --source ECB --inverse",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			file, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			entries, err := ParseCSV(file)
+			if err != nil {
+				return fmt.Errorf("%s: %w", args[0], err)
+			}
+
+			result, err := Import(app, entries, opts)
+			if err != nil {
+				return err
+			}
+
+			prefix := ""
+			if opts.DryRun {
+				prefix = "(dry run) "
+			}
+			fmt.Printf(
+				"%s%d rates read: %d created, %d updated, %d unchanged, %d skipped (clinic currency)\n",
+				prefix,
+				len(entries),
+				result.Created,
+				result.Updated,
+				result.Unchanged,
+				result.Skipped,
+			)
+
+			return nil
+		},
+	}
+
+	command.Flags().StringVar(&opts.Source, "source", "", "source recorded on the rates, e.g. ECB")
+	command.Flags().BoolVar(&opts.Inverse, "inverse", false, "the file quotes the currency units for one unit of the clinic currency")
+	command.Flags().BoolVar(&opts.DryRun, "dry-run", false, "report the changes without saving them")
+
+	return command
+}
@@ -0,0 +1,305 @@
+// Package exchange converts the invoices and payments made in a foreign
+// currency to the clinic currency.
+//
+// The exchange_rates collection holds the dated rates of each currency, in
+// units of the clinic currency for one unit of the currency; a rate is in
+// effect from its date until the next rate of the currency. Invoices take
+// the rate in effect on their invoice date and payments on their payment
+// date, unless a rate is entered explicitly, and keep it so that later
+// rates don't change issued documents.
+//
+// A payment may be in another currency than its invoice: the amount it
+// settles (invoiceAmount) is converted to the invoice currency through the
+// clinic currency at the rates of the payment date. Payments towards a
+// payment plan only settle the plan invoice, or the clinic currency amount
+// of plans without invoice.
+package exchange
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"github.com/spf13/cobra"
+	"zahrawiclinic.com/dates"
+	"zahrawiclinic.com/money"
+)
+
+// ErrNoRate is returned by Rate when no rate of the currency is in effect
+// on the date.
+var ErrNoRate = errors.New("no exchange rate")
+
+// Register binds the exchange rate hooks to the app and the exchange-rates
+// command to the root command.
+func Register(app core.App, rootCmd *cobra.Command) {
+	app.OnRecordCreate("exchange_rates").BindFunc(normalizeRate)
+	app.OnRecordUpdate("exchange_rates").BindFunc(normalizeRate)
+	app.OnRecordValidate("exchange_rates").BindFunc(validateRate)
+
+	app.OnRecordCreate("invoices").BindFunc(applyInvoiceRate)
+	app.OnRecordUpdate("invoices").BindFunc(applyInvoiceRate)
+	app.OnRecordValidate("invoices").BindFunc(validateInvoice)
+
+	app.OnRecordCreate("payments").BindFunc(applyPaymentRate)
+	app.OnRecordUpdate("payments").BindFunc(applyPaymentRate)
+	app.OnRecordValidate("payments").BindFunc(validateDocumentRate)
+
+	rootCmd.AddCommand(newCommand(app))
+}
+
+// Rate returns the rate of the currency in effect on the given day, the
+// latest rate dated on or before it. The clinic currency rate is 1.
+func Rate(app core.App, code string, on time.Time) (float64, error) {
+	currency := money.Lookup(code)
+	if currency.Code == money.Default().Code {
+		return 1, nil
+	}
+
+	var row struct {
+		Rate float64 `db:"rate"`
+	}
+	err := app.DB().
+		Select("rate").
+		From("exchange_rates").
+		Where(dbx.HashExp{"currency": currency.Code}).
+		AndWhere(dbx.NewExp("[[date]] < {:to}", dbx.Params{
+			"to": dates.StartOfDay(on).AddDate(0, 0, 1).UTC().Format(types.DefaultDateLayout),
+		})).
+		OrderBy("date DESC").
+		Limit(1).
+		One(&row)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+	if row.Rate <= 0 {
+		return 0, fmt.Errorf("%w for %s on %s", ErrNoRate, currency.Code, on.Format(time.DateOnly))
+	}
+
+	return row.Rate, nil
+}
+
+// normalizeRate uppercases the currency code.
+func normalizeRate(e *core.RecordEvent) error {
+	e.Record.Set("currency", strings.ToUpper(strings.TrimSpace(e.Record.GetString("currency"))))
+	return e.Next()
+}
+
+// validateRate rejects rates of the clinic currency, which is always 1.
+func validateRate(e *core.RecordEvent) error {
+	if e.Record.GetString("currency") == money.Default().Code {
+		return validation.Errors{
+			"currency": validation.NewError("validation_base_currency", "This is the clinic currency, its rate is always 1."),
+		}
+	}
+	return e.Next()
+}
+
+// applyInvoiceRate sets the currency and exchange rate of the invoice. The
+// amount in the clinic currency is computed with the totals.
+func applyInvoiceRate(e *core.RecordEvent) error {
+	if err := applyRate(e.App, e.Record, "invoiceDate"); err != nil {
+		return err
+	}
+	return e.Next()
+}
+
+// applyPaymentRate sets the currency and exchange rate of the payment and
+// its converted amounts, see ApplyPaymentRate.
+func applyPaymentRate(e *core.RecordEvent) error {
+	if err := ApplyPaymentRate(e.App, e.Record); err != nil {
+		return err
+	}
+	return e.Next()
+}
+
+// ApplyPaymentRate sets the currency and exchange rate of the payment, by
+// default the currency of its invoice, its amount in the clinic currency
+// and the amount it settles of its invoice. It runs when the payment is
+// saved, and before for code that needs the converted amounts first.
+func ApplyPaymentRate(app core.App, payment *core.Record) error {
+	invoice := settledInvoice(app, payment)
+
+	if payment.GetString("currency") == "" && invoice != nil {
+		payment.Set("currency", invoice.GetString("currency"))
+	}
+
+	if err := applyRate(app, payment, "paymentDate"); err != nil {
+		return err
+	}
+
+	amount := money.Get(payment, "amount")
+	money.Set(payment, "baseAmount", money.ToBase(payment, amount))
+
+	invoiceAmount, err := applied(app, payment, invoice, amount)
+	if err != nil {
+		return err
+	}
+	money.Set(payment, "invoiceAmount", invoiceAmount)
+
+	return nil
+}
+
+// settledInvoice returns the invoice the payment settles: its own
+// invoice, else the invoice of its payment plan, nil when it has none.
+func settledInvoice(app core.App, payment *core.Record) *core.Record {
+	invoiceId := payment.GetString("invoice")
+	if invoiceId == "" {
+		plan, err := app.FindRecordById("payment_plans", payment.GetString("paymentPlan"))
+		if err != nil {
+			return nil
+		}
+		invoiceId = plan.GetString("invoice")
+	}
+
+	invoice, err := app.FindRecordById("invoices", invoiceId)
+	if err != nil {
+		return nil
+	}
+
+	return invoice
+}
+
+// applied returns the amount of the payment in the currency of the invoice
+// it settles, or in the clinic currency when it settles no invoice.
+//
+// A payment in another currency than its invoice is converted through the
+// clinic currency at the rates of the payment date, or the invoice rate
+// when the invoice currency has none. The converted amount is kept as long
+// as the payment amount, currency, rate, date and invoice don't change, so
+// that later rates don't change recorded payments.
+func applied(app core.App, payment *core.Record, invoice *core.Record, amount money.Money) (money.Money, error) {
+	if invoice == nil {
+		return money.ToBase(payment, amount), nil
+	}
+
+	currency := money.CurrencyOf(app, payment)
+	if invoice.GetString("currency") == currency.Code {
+		return amount, nil
+	}
+
+	original := payment.Original()
+	if !payment.IsNew() &&
+		amount == money.Get(original, "amount") &&
+		payment.GetString("currency") == original.GetString("currency") &&
+		payment.GetFloat("exchangeRate") == original.GetFloat("exchangeRate") &&
+		payment.GetDateTime("paymentDate").Equal(original.GetDateTime("paymentDate")) &&
+		payment.GetString("invoice") == original.GetString("invoice") &&
+		payment.GetString("paymentPlan") == original.GetString("paymentPlan") {
+		return money.Get(original, "invoiceAmount"), nil
+	}
+
+	on := time.Now()
+	if date := payment.GetDateTime("paymentDate"); !date.IsZero() {
+		on = date.Time()
+	}
+
+	rate, err := Rate(app, invoice.GetString("currency"), on)
+	if errors.Is(err, ErrNoRate) {
+		rate = invoice.GetFloat("exchangeRate")
+	} else if err != nil {
+		return 0, err
+	}
+	if rate <= 0 {
+		return 0, fmt.Errorf("no exchange rate of %s", invoice.GetString("currency"))
+	}
+
+	return currency.Convert(amount, payment.GetFloat("exchangeRate")/rate, money.CurrencyOf(app, invoice)), nil
+}
+
+// applyRate normalizes the document currency, the clinic currency when
+// empty, and sets the rate in effect on the document date when the
+// currency or the date changed. Rates entered explicitly are kept. The
+// rate is left at 0 when none is available, validateDocumentRate reports
+// it.
+func applyRate(app core.App, record *core.Record, dateField string) error {
+	code := money.Lookup(record.GetString("currency")).Code
+	if code == "" {
+		code = money.Default().Code
+	}
+	record.Set("currency", code)
+
+	if code == money.Default().Code {
+		record.Set("exchangeRate", 1)
+		return nil
+	}
+
+	original := record.Original()
+	rate := record.GetFloat("exchangeRate")
+	switch {
+	case rate > 0 && (record.IsNew() || rate != original.GetFloat("exchangeRate")):
+		return nil // entered explicitly
+	case rate > 0 &&
+		code == original.GetString("currency") &&
+		record.GetDateTime(dateField).Equal(original.GetDateTime(dateField)):
+		return nil // unchanged
+	}
+
+	on := time.Now()
+	if date := record.GetDateTime(dateField); !date.IsZero() {
+		on = date.Time()
+	}
+
+	rate, err := Rate(app, code, on)
+	if errors.Is(err, ErrNoRate) {
+		rate = 0
+	} else if err != nil {
+		return err
+	}
+	record.Set("exchangeRate", rate)
+
+	return nil
+}
+
+// validateInvoice rejects currency changes once the invoice is issued or
+// paid, its amounts were agreed in that currency.
+func validateInvoice(e *core.RecordEvent) error {
+	original := e.Record.Original()
+	if e.Record.IsNew() || e.Record.GetString("currency") == original.GetString("currency") {
+		return validateDocumentRate(e)
+	}
+
+	if original.GetString("status") != "draft" {
+		return validation.Errors{
+			"currency": validation.NewError("validation_invoice_currency_issued", "The currency of an issued invoice can't be changed."),
+		}
+	}
+
+	var payments struct {
+		Count int `db:"count"`
+	}
+	err := e.App.DB().
+		Select("COUNT(*) AS count").
+		From("payments").
+		Where(dbx.HashExp{"invoice": e.Record.Id}).
+		One(&payments)
+	if err != nil {
+		return err
+	}
+	if payments.Count > 0 {
+		return validation.Errors{
+			"currency": validation.NewError("validation_invoice_currency_paid", "The invoice has payments, its currency can't be changed."),
+		}
+	}
+
+	return validateDocumentRate(e)
+}
+
+// validateDocumentRate requires an exchange rate for the documents in a
+// foreign currency.
+func validateDocumentRate(e *core.RecordEvent) error {
+	if e.Record.GetFloat("exchangeRate") <= 0 {
+		return validation.Errors{
+			"currency": validation.NewError(
+				"validation_no_exchange_rate",
+				fmt.Sprintf("No exchange rate of %s is available for this date, import the rates or enter the rate.", e.Record.GetString("currency")),
+			),
+		}
+	}
+	return e.Next()
+}
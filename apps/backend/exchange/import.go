@@ -0,0 +1,233 @@
+package exchange
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"zahrawiclinic.com/money"
+)
+
+// errDryRun rolls back the import transaction of a dry run.
+var errDryRun = errors.New("dry run")
+
+// Entry is a single dated rate of an imported file.
+type Entry struct {
+	Line     int
+	Date     time.Time
+	Currency string
+	Rate     float64
+}
+
+// ImportOptions configures an exchange rates import.
+type ImportOptions struct {
+	// Source is recorded on the imported rates (e.g. "ECB").
+	Source string
+
+	// Inverse reads the rates as units of the currency for one unit of
+	// the clinic currency, as most central banks publish them.
+	Inverse bool
+
+	// DryRun reports the changes without saving them.
+	DryRun bool
+}
+
+// ImportResult summarizes the changes made by an import.
+type ImportResult struct {
+	Created   int
+	Updated   int
+	Unchanged int
+
+	// Skipped counts the rates of the clinic currency.
+	Skipped int
+}
+
+// headerAliases maps the normalized CSV headers to the entry columns.
+var headerAliases = map[string]string{
+	"date":          "date",
+	"day":           "date",
+	"effectivedate": "date",
+	"currency":      "currency",
+	"code":          "currency",
+	"currencycode":  "currency",
+	"rate":          "rate",
+	"exchangerate":  "rate",
+	"value":         "rate",
+}
+
+// ParseCSV reads exchange rates from a CSV file with a header row naming
+// the date (YYYY-MM-DD), currency (ISO 4217 code) and rate columns.
+func ParseCSV(r io.Reader) ([]Entry, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the CSV header: %w", err)
+	}
+
+	columns := map[string]int{}
+	for i, name := range header {
+		if i == 0 {
+			name = strings.TrimPrefix(name, "\ufeff")
+		}
+		if column, ok := headerAliases[normalizeHeader(name)]; ok {
+			if _, exists := columns[column]; !exists {
+				columns[column] = i
+			}
+		}
+	}
+	for _, required := range []string{"date", "currency", "rate"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("missing %q column in the CSV header", required)
+		}
+	}
+
+	var entries []Entry
+	seen := map[string]int{}
+
+	for line := 2; ; line++ {
+		row, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		value := func(column string) string {
+			i, ok := columns[column]
+			if !ok || i >= len(row) {
+				return ""
+			}
+			return strings.TrimSpace(row[i])
+		}
+
+		rawDate, currency, rawRate := value("date"), strings.ToUpper(value("currency")), value("rate")
+		if rawDate == "" && currency == "" && rawRate == "" {
+			continue // blank line
+		}
+
+		entry := Entry{Line: line, Currency: currency}
+
+		if entry.Date, err = time.ParseInLocation(time.DateOnly, rawDate, time.Local); err != nil {
+			return nil, fmt.Errorf("line %d: invalid date %q, expected YYYY-MM-DD", line, rawDate)
+		}
+		if len(currency) != 3 || strings.IndexFunc(currency, func(r rune) bool { return r < 'A' || r > 'Z' }) >= 0 {
+			return nil, fmt.Errorf("line %d: invalid currency %q", line, currency)
+		}
+		entry.Rate, err = strconv.ParseFloat(rawRate, 64)
+		if err != nil || entry.Rate <= 0 || math.IsInf(entry.Rate, 0) {
+			return nil, fmt.Errorf("line %d: invalid rate %q", line, rawRate)
+		}
+
+		key := currency + " " + rawDate
+		if previous, ok := seen[key]; ok {
+			return nil, fmt.Errorf("line %d: duplicate rate of %s on %s (first seen on line %d)", line, currency, rawDate, previous)
+		}
+		seen[key] = line
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func normalizeHeader(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, name)
+}
+
+// Import upserts the rates by currency and date. Rates of the clinic
+// currency are skipped, its rate is always 1.
+//
+// The documents keep the rate they were saved with: importing a rate
+// doesn't change the invoices and payments already recorded.
+func Import(app core.App, entries []Entry, opts ImportOptions) (*ImportResult, error) {
+	result := &ImportResult{}
+	base := money.Default().Code
+
+	err := app.RunInTransaction(func(txApp core.App) error {
+		collection, err := txApp.FindCollectionByNameOrId("exchange_rates")
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if entry.Currency == base {
+				result.Skipped++
+				continue
+			}
+
+			rate := entry.Rate
+			if opts.Inverse {
+				rate = 1 / rate
+			}
+
+			date, err := types.ParseDateTime(entry.Date)
+			if err != nil {
+				return err
+			}
+
+			record, err := txApp.FindFirstRecordByFilter(
+				collection,
+				"currency = {:currency} && date = {:date}",
+				dbx.Params{"currency": entry.Currency, "date": date.String()},
+			)
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				record = core.NewRecord(collection)
+				record.Set("currency", entry.Currency)
+				record.Set("date", date)
+			case err != nil:
+				return err
+			}
+
+			record.Set("rate", rate)
+			if opts.Source != "" {
+				record.Set("source", opts.Source)
+			}
+
+			switch {
+			case record.IsNew():
+				result.Created++
+			case record.GetFloat("rate") == record.Original().GetFloat("rate") &&
+				record.GetString("source") == record.Original().GetString("source"):
+				result.Unchanged++
+				continue
+			default:
+				result.Updated++
+			}
+
+			if err := txApp.Save(record); err != nil {
+				return fmt.Errorf("line %d: %s: %w", entry.Line, entry.Currency, err)
+			}
+		}
+
+		if opts.DryRun {
+			return errDryRun
+		}
+
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDryRun) {
+		return nil, err
+	}
+
+	return result, nil
+}
@@ -0,0 +1,69 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/pocketbase/tools/security"
+)
+
+// FakeProvider is a local gateway for development and tests. Its checkout
+// pages are served by the clinic itself, and completing one delivers a
+// signed event to the webhook as a real gateway would. No card is charged.
+type FakeProvider struct {
+	// BaseURL is the clinic URL the checkout pages are served under.
+	BaseURL string
+
+	// Secret signs the events, the PAYMENT_WEBHOOK_SECRET of the clinic.
+	Secret string
+}
+
+// Name implements Provider.
+func (p *FakeProvider) Name() string {
+	return "fake"
+}
+
+// CreateCheckout implements Provider.
+func (p *FakeProvider) CreateCheckout(ctx context.Context, request CheckoutRequest) (Checkout, error) {
+	return Checkout{
+		Id:  "fake_cs_" + security.RandomString(16),
+		URL: strings.TrimRight(p.BaseURL, "/") + "/api/clinic/payment-gateway/fake/" + request.Reference,
+	}, nil
+}
+
+// ParseWebhook implements Provider.
+func (p *FakeProvider) ParseWebhook(header http.Header, payload []byte) (Event, error) {
+	return parseSignedEvent(p.Secret, header, payload)
+}
+
+// Complete returns the signed notification of a completed checkout: a
+// succeeded payment with a new transaction id, or a declined card.
+func (p *FakeProvider) Complete(reference string, amount int64, currency string, succeeded bool) (http.Header, []byte, error) {
+	event := Event{
+		Id:        "fake_evt_" + security.RandomString(16),
+		Type:      EventSucceeded,
+		Reference: reference,
+		Amount:    amount,
+		Currency:  currency,
+	}
+	if succeeded {
+		event.TransactionId = "fake_txn_" + security.RandomString(16)
+	} else {
+		event.Type = EventFailed
+		event.Message = "The card was declined."
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set(SignatureHeader, Sign(p.Secret, payload, time.Now()))
+
+	return header, payload, nil
+}
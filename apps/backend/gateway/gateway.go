@@ -0,0 +1,305 @@
+// Package gateway takes the card payments of the invoices online through a
+// payment gateway with hosted checkout pages.
+//
+// A checkout creates a payment_intents record for the invoice balance (or
+// part of it) and the gateway page the patient pays on. The gateway then
+// notifies the outcome on the webhook route with a signed event, and the
+// succeeded payments are recorded in the payments collection keyed by the
+// gateway transaction id, so that repeated notifications record them once.
+//
+// The gateway is configured with environment variables, see FromEnv.
+package gateway
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"zahrawiclinic.com/billing"
+	"zahrawiclinic.com/exchange"
+	"zahrawiclinic.com/money"
+)
+
+var (
+	// ErrNotConfigured is returned when no payment gateway is configured.
+	ErrNotConfigured = errors.New("no payment gateway configured")
+
+	// ErrNotPayable is returned by CreateCheckout for draft, cancelled
+	// and settled invoices.
+	ErrNotPayable = errors.New("the invoice can't be paid online")
+
+	// ErrInvalidAmount is returned by CreateCheckout for amounts that
+	// aren't positive or exceed the balance due.
+	ErrInvalidAmount = errors.New("invalid amount")
+
+	// ErrUnknownIntent is returned by HandleEvent for events of checkouts
+	// not created by the clinic.
+	ErrUnknownIntent = errors.New("unknown payment intent")
+)
+
+// Register binds the checkout, webhook and fake gateway routes to the app.
+func Register(app core.App) {
+	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
+		provider, err := FromEnv(se.App.Settings().Meta.AppURL, se.App.IsDev())
+		if err != nil {
+			// the checkouts are then refused as without a gateway
+			se.App.Logger().Error("Payment gateway not configured", "error", err)
+		}
+
+		registerRoutes(se, provider)
+		return se.Next()
+	})
+}
+
+// CheckoutOptions are the optional details of a checkout.
+type CheckoutOptions struct {
+	// Amount defaults to the invoice balance due.
+	Amount money.Money
+
+	// SuccessURL and CancelURL are where the patient is sent back to from
+	// the hosted payment page.
+	SuccessURL string
+	CancelURL  string
+
+	// CreatedBy is the id of the user who created the checkout.
+	CreatedBy string
+}
+
+// CreateCheckout creates a payment intent for the invoice and its hosted
+// payment page with the provider. The gateway failures are recorded on the
+// intent with the failed status and returned.
+func CreateCheckout(app core.App, provider Provider, invoice *core.Record, opts CheckoutOptions) (*core.Record, error) {
+	if provider == nil {
+		return nil, ErrNotConfigured
+	}
+
+	switch invoice.GetString("status") {
+	case "sent", "partial", "overdue":
+	default:
+		return nil, ErrNotPayable
+	}
+
+	balance, err := billing.ComputeBalance(app, invoice, "")
+	if err != nil {
+		return nil, err
+	}
+	if balance.BalanceDue <= 0 {
+		return nil, ErrNotPayable
+	}
+
+	currency := money.CurrencyOf(app, invoice)
+
+	amount := opts.Amount
+	if amount == 0 {
+		amount = balance.BalanceDue
+	}
+	if amount < 0 || amount > balance.BalanceDue {
+		return nil, fmt.Errorf("%w: the balance due is %s", ErrInvalidAmount, currency.Display(balance.BalanceDue))
+	}
+
+	collection, err := app.FindCachedCollectionByNameOrId("payment_intents")
+	if err != nil {
+		return nil, err
+	}
+
+	intent := core.NewRecord(collection)
+	intent.Set("invoice", invoice.Id)
+	intent.Set("patient", invoice.GetString("patient"))
+	money.Set(intent, "amount", amount)
+	intent.Set("currency", currency.Code)
+	intent.Set("provider", provider.Name())
+	intent.Set("status", "pending")
+	intent.Set("createdBy", opts.CreatedBy)
+	if err := app.Save(intent); err != nil {
+		return nil, err
+	}
+
+	request := CheckoutRequest{
+		Reference:   intent.Id,
+		Amount:      int64(amount),
+		Currency:    currency.Code,
+		Description: "Invoice " + invoice.GetString("invoiceNumber"),
+		SuccessURL:  opts.SuccessURL,
+		CancelURL:   opts.CancelURL,
+	}
+	if patient, err := app.FindRecordById("patients", invoice.GetString("patient")); err == nil {
+		request.CustomerEmail = patient.GetString("email")
+	}
+
+	checkout, checkoutErr := provider.CreateCheckout(context.Background(), request)
+	if checkoutErr != nil {
+		intent.Set("status", "failed")
+		intent.Set("error", truncate(checkoutErr.Error(), 1000))
+	} else {
+		intent.Set("checkoutId", checkout.Id)
+		intent.Set("checkoutUrl", checkout.URL)
+	}
+
+	if err := app.Save(intent); err != nil {
+		return nil, err
+	}
+
+	return intent, checkoutErr
+}
+
+// HandleEvent applies a verified gateway event to its payment intent: a
+// succeeded payment is recorded as a card payment of the invoice, a failed
+// one marks the pending intent as failed. Other events are ignored.
+//
+// The payment is keyed by the gateway transaction id: when it's already
+// recorded for the intent, or the intent already succeeded, the existing
+// payment is returned, and a transaction recorded as another payment is
+// rejected. Payments above the balance due, e.g. paid meanwhile at the
+// front desk, are recorded as overpayments since the card was charged
+// anyway.
+func HandleEvent(app core.App, provider Provider, event Event) (*core.Record, error) {
+	var payment *core.Record
+
+	err := app.RunInTransaction(func(txApp core.App) error {
+		intent, err := txApp.FindRecordById("payment_intents", event.Reference)
+		if err != nil || intent.GetString("provider") != provider.Name() {
+			return fmt.Errorf("%w %q", ErrUnknownIntent, event.Reference)
+		}
+
+		switch event.Type {
+		case EventSucceeded:
+			if intent.GetString("status") == "succeeded" {
+				// an intent is paid once, whatever the transactions notified
+				if event.TransactionId != intent.GetString("transactionId") {
+					txApp.Logger().Warn(
+						"Ignored a second payment of a completed payment intent",
+						"intent", intent.Id,
+						"transactionId", event.TransactionId,
+						"recordedTransactionId", intent.GetString("transactionId"),
+					)
+				}
+				payment, err = txApp.FindRecordById("payments", intent.GetString("payment"))
+				return err
+			}
+
+			payment, err = recordPayment(txApp, intent, event)
+			if err != nil {
+				return err
+			}
+
+			intent.Set("status", "succeeded")
+			intent.Set("payment", payment.Id)
+			intent.Set("transactionId", event.TransactionId)
+			intent.Set("error", "")
+			if intent.GetDateTime("completedAt").IsZero() {
+				intent.Set("completedAt", types.NowDateTime())
+			}
+		case EventFailed:
+			if intent.GetString("status") != "pending" {
+				return nil // already completed
+			}
+			intent.Set("status", "failed")
+			intent.Set("error", truncate(event.Message, 1000))
+			intent.Set("completedAt", types.NowDateTime())
+		default:
+			return nil
+		}
+
+		return txApp.Save(intent)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return payment, nil
+}
+
+// recordPayment returns the payment of the transaction, recording it when
+// it's new.
+func recordPayment(app core.App, intent *core.Record, event Event) (*core.Record, error) {
+	if strings.TrimSpace(event.TransactionId) == "" {
+		return nil, errors.New("the event has no transaction id")
+	}
+
+	payment, err := app.FindFirstRecordByData("payments", "transactionId", event.TransactionId)
+	if err == nil {
+		return payment, matchPayment(app, intent, payment)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	currency := intent.GetString("currency")
+	if event.Currency != "" && !strings.EqualFold(event.Currency, currency) {
+		return nil, fmt.Errorf("the event currency %s differs from the checkout currency %s", event.Currency, currency)
+	}
+
+	amount := money.Money(event.Amount)
+	if amount <= 0 {
+		amount = money.Get(intent, "amount")
+	}
+
+	invoice, err := app.FindRecordById("invoices", intent.GetString("invoice"))
+	if err != nil {
+		return nil, err
+	}
+
+	balance, err := billing.ComputeBalance(app, invoice, "")
+	if err != nil {
+		return nil, err
+	}
+
+	collection, err := app.FindCachedCollectionByNameOrId("payments")
+	if err != nil {
+		return nil, err
+	}
+
+	payment = core.NewRecord(collection)
+	payment.Set("patient", intent.GetString("patient"))
+	payment.Set("invoice", invoice.Id)
+	money.Set(payment, "amount", amount)
+	payment.Set("currency", currency)
+	payment.Set("paymentDate", types.NowDateTime())
+	payment.Set("paymentMethod", "card")
+	payment.Set("transactionId", event.TransactionId)
+	payment.Set("reference", intent.GetString("checkoutId"))
+	payment.Set("notes", "Paid online ("+intent.GetString("provider")+").")
+
+	// compared by the amount it settles in the invoice currency
+	if err := exchange.ApplyPaymentRate(app, payment); err != nil {
+		return nil, err
+	}
+	payment.Set("isOverpayment", money.Get(payment, "invoiceAmount") > balance.BalanceDue)
+
+	if err := app.Save(payment); err != nil {
+		return nil, err
+	}
+
+	return payment, nil
+}
+
+// matchPayment checks that the payment already recorded with the
+// transaction id of the event is the payment of the intent: a card payment
+// of the same invoice not recorded for another intent.
+func matchPayment(app core.App, intent *core.Record, payment *core.Record) error {
+	if payment.GetString("invoice") != intent.GetString("invoice") || payment.GetString("paymentMethod") != "card" {
+		return fmt.Errorf("the transaction %s is recorded as another payment", payment.GetString("transactionId"))
+	}
+
+	others, err := app.CountRecords("payment_intents", dbx.HashExp{"payment": payment.Id}, dbx.Not(dbx.HashExp{"id": intent.Id}))
+	if err != nil {
+		return err
+	}
+	if others > 0 {
+		return fmt.Errorf("the transaction %s is recorded for another payment intent", payment.GetString("transactionId"))
+	}
+
+	return nil
+}
+
+func truncate(s string, length int) string {
+	if len(s) > length {
+		return s[:length]
+	}
+	return s
+}
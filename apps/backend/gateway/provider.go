@@ -0,0 +1,262 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The notified event types.
+const (
+	EventSucceeded = "payment.succeeded"
+	EventFailed    = "payment.failed"
+)
+
+// SignatureHeader is the webhook header holding the notification
+// signature, "t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">".
+const SignatureHeader = "X-Signature"
+
+// signatureTolerance is how old a notification may be, to reject replays.
+const signatureTolerance = 5 * time.Minute
+
+// ErrInvalidSignature is returned when a webhook isn't signed with the
+// webhook secret, or was signed too long ago.
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// CheckoutRequest is the payment asked to the gateway.
+type CheckoutRequest struct {
+	// Reference is the payment intent id, notified back with the events.
+	Reference string `json:"reference"`
+
+	// Amount is in minor units of the currency.
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+
+	Description   string `json:"description"`
+	CustomerEmail string `json:"customerEmail,omitempty"`
+
+	// SuccessURL and CancelURL are where the patient is sent back to from
+	// the hosted payment page.
+	SuccessURL string `json:"successUrl,omitempty"`
+	CancelURL  string `json:"cancelUrl,omitempty"`
+}
+
+// Checkout is the hosted payment page created by the gateway.
+type Checkout struct {
+	Id  string `json:"id"`
+	URL string `json:"url"`
+}
+
+// Event is a payment notification received from the gateway.
+type Event struct {
+	Id   string `json:"id"`
+	Type string `json:"type"`
+
+	// Reference is the payment intent id of the checkout.
+	Reference string `json:"reference"`
+
+	// TransactionId identifies the card transaction at the gateway.
+	TransactionId string `json:"transactionId"`
+
+	// Amount is in minor units of the currency.
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+
+	// Message explains failures.
+	Message string `json:"message"`
+}
+
+// Provider is a card payment gateway with hosted checkout pages.
+type Provider interface {
+	// Name identifies the provider in the stored payment intents.
+	Name() string
+
+	CreateCheckout(ctx context.Context, request CheckoutRequest) (Checkout, error)
+
+	// ParseWebhook verifies the signature of a notification and decodes
+	// its event.
+	ParseWebhook(header http.Header, payload []byte) (Event, error)
+}
+
+// FromEnv returns the provider configured with the environment variables,
+// or nil:
+//   - PAYMENT_GATEWAY_URL, PAYMENT_GATEWAY_KEY and PAYMENT_WEBHOOK_SECRET
+//     configure a HostedCheckout gateway;
+//   - PAYMENT_GATEWAY=fake and PAYMENT_WEBHOOK_SECRET configure the local
+//     FakeProvider in dev mode only, its checkout pages are served under
+//     appURL.
+func FromEnv(appURL string, dev bool) (Provider, error) {
+	secret := os.Getenv("PAYMENT_WEBHOOK_SECRET")
+
+	if os.Getenv("PAYMENT_GATEWAY") == "fake" {
+		switch {
+		case !dev:
+			return nil, errors.New("the fake payment gateway is only available in dev mode")
+		case secret == "":
+			return nil, errors.New("the fake payment gateway requires PAYMENT_WEBHOOK_SECRET")
+		}
+		return &FakeProvider{BaseURL: appURL, Secret: secret}, nil
+	}
+
+	url := os.Getenv("PAYMENT_GATEWAY_URL")
+	if url == "" || secret == "" {
+		return nil, nil
+	}
+
+	return &HostedCheckout{
+		URL:           url,
+		APIKey:        os.Getenv("PAYMENT_GATEWAY_KEY"),
+		WebhookSecret: secret,
+	}, nil
+}
+
+// HostedCheckout creates the checkouts by posting the CheckoutRequest as
+// JSON to the gateway, which answers with the JSON encoded Checkout, and
+// receives the events signed with the shared webhook secret.
+type HostedCheckout struct {
+	URL           string
+	APIKey        string
+	WebhookSecret string
+
+	// Client defaults to a client with a 30 seconds timeout.
+	Client *http.Client
+}
+
+var defaultClient = &http.Client{Timeout: 30 * time.Second}
+
+// Name implements Provider.
+func (p *HostedCheckout) Name() string {
+	return "hosted"
+}
+
+// CreateCheckout implements Provider.
+func (p *HostedCheckout) CreateCheckout(ctx context.Context, request CheckoutRequest) (Checkout, error) {
+	var checkout Checkout
+
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return checkout, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.URL, bytes.NewReader(payload))
+	if err != nil {
+		return checkout, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	// retried requests don't create a second checkout
+	req.Header.Set("Idempotency-Key", request.Reference)
+	if p.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.APIKey)
+	}
+
+	client := p.Client
+	if client == nil {
+		client = defaultClient
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return checkout, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(res.Body, 500))
+		return checkout, fmt.Errorf("payment gateway responded with %d: %s", res.StatusCode, strings.TrimSpace(string(detail)))
+	}
+
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&checkout); err != nil {
+		return checkout, fmt.Errorf("invalid payment gateway response: %w", err)
+	}
+	if checkout.URL == "" {
+		return checkout, errors.New("the payment gateway returned no checkout url")
+	}
+
+	return checkout, nil
+}
+
+// ParseWebhook implements Provider.
+func (p *HostedCheckout) ParseWebhook(header http.Header, payload []byte) (Event, error) {
+	return parseSignedEvent(p.WebhookSecret, header, payload)
+}
+
+// Sign returns the SignatureHeader value of a payload signed at the given
+// time.
+func Sign(secret string, payload []byte, at time.Time) string {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	return "t=" + timestamp + ",v1=" + signature(secret, timestamp, payload)
+}
+
+// Verify checks the SignatureHeader value of a payload against the secret
+// and rejects the signatures older than 5 minutes.
+func Verify(secret string, value string, payload []byte, now time.Time) error {
+	if secret == "" {
+		return fmt.Errorf("%w: no webhook secret configured", ErrInvalidSignature)
+	}
+
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(value, ",") {
+		key, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = v
+		case "v1":
+			signatures = append(signatures, v)
+		}
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return fmt.Errorf("%w: malformed %s header", ErrInvalidSignature, SignatureHeader)
+	}
+
+	if age := now.Sub(time.Unix(unix, 0)); age > signatureTolerance || age < -signatureTolerance {
+		return fmt.Errorf("%w: signed %s ago", ErrInvalidSignature, age.Round(time.Second))
+	}
+
+	expected := signature(secret, timestamp, payload)
+	for _, s := range signatures {
+		if hmac.Equal([]byte(s), []byte(expected)) {
+			return nil
+		}
+	}
+
+	return ErrInvalidSignature
+}
+
+func signature(secret string, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// parseSignedEvent verifies the notification signature and decodes its
+// event.
+func parseSignedEvent(secret string, header http.Header, payload []byte) (Event, error) {
+	var event Event
+
+	if err := Verify(secret, header.Get(SignatureHeader), payload, time.Now()); err != nil {
+		return event, err
+	}
+
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return event, fmt.Errorf("invalid webhook event: %w", err)
+	}
+
+	return event, nil
+}
@@ -0,0 +1,201 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"zahrawiclinic.com/money"
+)
+
+// maxWebhookSize bounds the webhook payloads read.
+const maxWebhookSize = 1 << 20
+
+func registerRoutes(se *core.ServeEvent, provider Provider) {
+	g := se.Router.Group("/api/clinic")
+
+	// called by the gateway, authenticated by the event signature
+	g.POST("/payment-gateway/webhook", func(e *core.RequestEvent) error {
+		return receiveWebhook(e, provider)
+	})
+
+	if fake, ok := provider.(*FakeProvider); ok {
+		// the hosted payment page, opened by the patient
+		g.GET("/payment-gateway/fake/{id}", func(e *core.RequestEvent) error {
+			return fakeCheckoutPage(e)
+		})
+		g.POST("/payment-gateway/fake/{id}", func(e *core.RequestEvent) error {
+			return completeFakeCheckout(e, fake)
+		})
+	}
+
+	g.POST("/invoices/{id}/checkout", func(e *core.RequestEvent) error {
+		return createCheckout(e, provider)
+	}).Bind(apis.RequireAuth())
+}
+
+// createCheckout handles POST /api/clinic/invoices/{id}/checkout.
+//
+// It creates a payment intent for the invoice with its hosted payment page
+// (checkoutUrl) and returns it.
+//
+// Body parameters:
+//   - amount: the amount to pay, in the invoice currency (default: the
+//     balance due)
+//   - successUrl, cancelUrl: where the patient is sent back to from the
+//     payment page (optional)
+func createCheckout(e *core.RequestEvent, provider Provider) error {
+	invoice, err := e.App.FindRecordById("invoices", e.Request.PathValue("id"))
+	if err != nil {
+		return e.NotFoundError("Invoice not found.", err)
+	}
+
+	var body struct {
+		Amount     float64 `json:"amount"`
+		SuccessURL string  `json:"successUrl"`
+		CancelURL  string  `json:"cancelUrl"`
+	}
+	if err := e.BindBody(&body); err != nil {
+		return e.BadRequestError("Failed to read the submitted data.", err)
+	}
+
+	opts := CheckoutOptions{
+		Amount:     money.CurrencyOf(e.App, invoice).FromDecimal(body.Amount),
+		SuccessURL: body.SuccessURL,
+		CancelURL:  body.CancelURL,
+	}
+	if e.Auth != nil && e.Auth.Collection().Name == "users" {
+		opts.CreatedBy = e.Auth.Id
+	}
+
+	intent, err := CreateCheckout(e.App, provider, invoice, opts)
+	switch {
+	case errors.Is(err, ErrNotConfigured):
+		return e.BadRequestError("No payment gateway is configured.", nil)
+	case errors.Is(err, ErrNotPayable):
+		return e.BadRequestError("Only issued invoices with a balance due can be paid online.", nil)
+	case errors.Is(err, ErrInvalidAmount):
+		return e.BadRequestError("The amount must be positive and at most the balance due.", nil)
+	case err != nil && intent != nil:
+		return e.InternalServerError("The payment gateway failed to create the checkout.", err)
+	case err != nil:
+		return e.InternalServerError("Failed to create the checkout.", err)
+	}
+
+	if err := apis.EnrichRecord(e, intent); err != nil {
+		return e.InternalServerError("", err)
+	}
+
+	return e.JSON(200, intent)
+}
+
+// receiveWebhook handles POST /api/clinic/payment-gateway/webhook.
+//
+// It verifies the signature of the gateway event and applies it, see
+// HandleEvent. Repeated events are acknowledged without effect.
+func receiveWebhook(e *core.RequestEvent, provider Provider) error {
+	if provider == nil {
+		return e.NotFoundError("No payment gateway is configured.", nil)
+	}
+
+	payload, err := io.ReadAll(io.LimitReader(e.Request.Body, maxWebhookSize))
+	if err != nil {
+		return e.BadRequestError("Failed to read the event.", err)
+	}
+
+	return applyWebhook(e, provider, e.Request.Header, payload)
+}
+
+// applyWebhook verifies and applies a signed event, for the webhook route
+// and the fake checkout page.
+func applyWebhook(e *core.RequestEvent, provider Provider, header http.Header, payload []byte) error {
+	event, err := provider.ParseWebhook(header, payload)
+	if errors.Is(err, ErrInvalidSignature) {
+		return e.UnauthorizedError("Invalid signature.", err)
+	}
+	if err != nil {
+		return e.BadRequestError("Invalid event.", err)
+	}
+
+	payment, err := HandleEvent(e.App, provider, event)
+	if errors.Is(err, ErrUnknownIntent) {
+		return e.NotFoundError("Payment intent not found.", err)
+	}
+	if err != nil {
+		e.App.Logger().Error("Failed to apply the payment gateway event", "event", event.Id, "type", event.Type, "error", err)
+		return e.InternalServerError("Failed to apply the event.", err)
+	}
+
+	result := map[string]any{"received": true}
+	if payment != nil {
+		result["payment"] = payment.Id
+	}
+
+	return e.JSON(200, result)
+}
+
+// fakeCheckoutPage handles GET /api/clinic/payment-gateway/fake/{id}, the
+// payment page of the fake gateway.
+func fakeCheckoutPage(e *core.RequestEvent) error {
+	intent, err := e.App.FindRecordById("payment_intents", e.Request.PathValue("id"))
+	if err != nil {
+		return e.NotFoundError("Payment intent not found.", err)
+	}
+
+	amount := money.CurrencyOf(e.App, intent).Format(money.Get(intent, "amount"))
+	action := html.EscapeString(e.Request.URL.Path)
+
+	return e.HTML(200, fmt.Sprintf(`<!doctype html>
+<html><head><title>Fake checkout</title></head>
+<body>
+<h1>Fake checkout</h1>
+<p>Pay %s %s. No card is charged.</p>
+<form method="post" action="%s"><input type="hidden" name="outcome" value="succeeded"><button>Pay</button></form>
+<form method="post" action="%s"><input type="hidden" name="outcome" value="failed"><button>Decline</button></form>
+</body></html>`,
+		html.EscapeString(amount),
+		html.EscapeString(intent.GetString("currency")),
+		action,
+		action,
+	))
+}
+
+// completeFakeCheckout handles POST /api/clinic/payment-gateway/fake/{id}.
+//
+// It completes the pending fake checkout and applies the signed event the
+// gateway would notify.
+//
+// Body parameters:
+//   - outcome: "succeeded" (default) or "failed"
+func completeFakeCheckout(e *core.RequestEvent, fake *FakeProvider) error {
+	intent, err := e.App.FindRecordById("payment_intents", e.Request.PathValue("id"))
+	if err != nil {
+		return e.NotFoundError("Payment intent not found.", err)
+	}
+	if intent.GetString("status") != "pending" {
+		return e.BadRequestError("The checkout is already completed.", nil)
+	}
+
+	var body struct {
+		Outcome string `json:"outcome" form:"outcome"`
+	}
+	if err := e.BindBody(&body); err != nil {
+		return e.BadRequestError("Failed to read the submitted data.", err)
+	}
+
+	header, payload, err := fake.Complete(
+		intent.Id,
+		int64(money.Get(intent, "amount")),
+		intent.GetString("currency"),
+		body.Outcome != "failed",
+	)
+	if err != nil {
+		return e.InternalServerError("", err)
+	}
+
+	return applyWebhook(e, fake, header, payload)
+}
@@ -0,0 +1,550 @@
+package imaging
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotDICOM is returned when the uploaded file is not a DICOM Part 10 file.
+var ErrNotDICOM = errors.New("not a DICOM Part 10 file")
+
+// Transfer syntaxes understood by the reader.
+const (
+	tsImplicitLittle = "1.2.840.10008.1.2"
+	tsExplicitLittle = "1.2.840.10008.1.2.1"
+	tsDeflated       = "1.2.840.10008.1.2.1.99"
+	tsExplicitBig    = "1.2.840.10008.1.2.2"
+	tsJPEGBaseline   = "1.2.840.10008.1.2.4.50"
+	tsJPEGExtended   = "1.2.840.10008.1.2.4.51"
+)
+
+const undefinedLength = 0xFFFFFFFF
+
+// tag packs a DICOM (group, element) pair into a single value.
+type tag uint32
+
+const (
+	tagTransferSyntaxUID     tag = 0x00020010
+	tagSOPClassUID           tag = 0x00080016
+	tagSOPInstanceUID        tag = 0x00080018
+	tagStudyDate             tag = 0x00080020
+	tagSeriesDate            tag = 0x00080021
+	tagAcquisitionDate       tag = 0x00080022
+	tagContentDate           tag = 0x00080023
+	tagAcquisitionDateTime   tag = 0x0008002A
+	tagAcquisitionTime       tag = 0x00080032
+	tagModality              tag = 0x00080060
+	tagManufacturer          tag = 0x00080070
+	tagInstitutionName       tag = 0x00080080
+	tagStudyDescription      tag = 0x00081030
+	tagSeriesDescription     tag = 0x0008103E
+	tagManufacturerModelName tag = 0x00081090
+	tagPatientName           tag = 0x00100010
+	tagPatientID             tag = 0x00100020
+	tagPatientBirthDate      tag = 0x00100030
+	tagPatientSex            tag = 0x00100040
+	tagBodyPartExamined      tag = 0x00180015
+	tagStudyInstanceUID      tag = 0x0020000D
+	tagSeriesInstanceUID     tag = 0x0020000E
+	tagSamplesPerPixel       tag = 0x00280002
+	tagPhotometric           tag = 0x00280004
+	tagPlanarConfiguration   tag = 0x00280006
+	tagRows                  tag = 0x00280010
+	tagColumns               tag = 0x00280011
+	tagBitsAllocated         tag = 0x00280100
+	tagBitsStored            tag = 0x00280101
+	tagPixelRepresentation   tag = 0x00280103
+	tagWindowCenter          tag = 0x00281050
+	tagWindowWidth           tag = 0x00281051
+	tagRescaleIntercept      tag = 0x00281052
+	tagRescaleSlope          tag = 0x00281053
+	tagPixelData             tag = 0x7FE00010
+	tagItem                  tag = 0xFFFEE000
+	tagItemDelimitation      tag = 0xFFFEE00D
+	tagSequenceDelimitation  tag = 0xFFFEE0DD
+)
+
+func (t tag) group() uint16 {
+	return uint16(t >> 16)
+}
+
+func (t tag) String() string {
+	return fmt.Sprintf("(%04X,%04X)", uint16(t>>16), uint16(t))
+}
+
+// Study holds the header attributes extracted from a single DICOM instance
+// together with the raw pixel data needed to render a preview.
+type Study struct {
+	TransferSyntax string
+
+	PatientID        string
+	PatientName      string
+	PatientBirthDate string
+	PatientSex       string
+
+	StudyInstanceUID  string
+	SeriesInstanceUID string
+	SOPInstanceUID    string
+	SOPClassUID       string
+
+	Modality          string
+	AcquisitionDate   time.Time
+	StudyDescription  string
+	SeriesDescription string
+	BodyPart          string
+	Manufacturer      string
+	Model             string
+	Institution       string
+
+	Rows                int
+	Columns             int
+	SamplesPerPixel     int
+	BitsAllocated       int
+	BitsStored          int
+	PixelRepresentation int
+	PlanarConfiguration int
+	Photometric         string
+	WindowCenter        float64
+	WindowWidth         float64
+	RescaleIntercept    float64
+	RescaleSlope        float64
+
+	// candidate dates in order of preference, resolved after parsing
+	dates map[tag]string
+	time  string
+
+	byteOrder binary.ByteOrder
+	pixels    []byte
+	fragments [][]byte
+}
+
+// Description returns the most specific description available.
+func (s *Study) Description() string {
+	if s.SeriesDescription != "" {
+		return s.SeriesDescription
+	}
+	return s.StudyDescription
+}
+
+// ParseDICOM reads the file meta information and the dataset of a DICOM
+// Part 10 file. Sequences are skipped; only the top level attributes listed
+// above are decoded.
+func ParseDICOM(data []byte) (*Study, error) {
+	if len(data) < 132 || string(data[128:132]) != "DICM" {
+		return nil, ErrNotDICOM
+	}
+
+	// the file meta group is always explicit VR little endian
+	d := &decoder{buf: data, pos: 132, explicit: true, order: binary.LittleEndian}
+
+	study := &Study{
+		RescaleSlope: 1,
+		dates:        map[tag]string{},
+	}
+
+	for d.remaining() >= 4 && d.order.Uint16(d.buf[d.pos:]) == 0x0002 {
+		el, err := d.next()
+		if err != nil {
+			return nil, fmt.Errorf("file meta information: %w", err)
+		}
+		if el.tag == tagTransferSyntaxUID {
+			study.TransferSyntax = stringValue(el.value)
+		}
+	}
+
+	switch study.TransferSyntax {
+	case tsImplicitLittle:
+		d.explicit = false
+	case tsExplicitBig:
+		d.order = binary.BigEndian
+	case tsDeflated:
+		// bounded like the uploads so that a small deflated file can't
+		// expand without limit
+		inflated, err := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(d.buf[d.pos:])), maxUploadSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("inflate dataset: %w", err)
+		}
+		if len(inflated) > maxUploadSize {
+			return nil, errors.New("inflate dataset: the dataset is too large")
+		}
+		d.buf, d.pos = inflated, 0
+	case "":
+		return nil, errors.New("missing transfer syntax")
+	default:
+		// explicit VR little endian and every encapsulated syntax
+	}
+	study.byteOrder = d.order
+
+	for d.remaining() > 0 {
+		el, err := d.next()
+		if err != nil {
+			return nil, fmt.Errorf("dataset: %w", err)
+		}
+
+		study.set(el, d.order)
+
+		if el.tag == tagPixelData {
+			break // trailing padding is irrelevant
+		}
+	}
+
+	study.resolveAcquisitionDate()
+
+	return study, nil
+}
+
+func (s *Study) set(el element, order binary.ByteOrder) {
+	switch el.tag {
+	case tagPatientName:
+		s.PatientName = stringValue(el.value)
+	case tagPatientID:
+		s.PatientID = stringValue(el.value)
+	case tagPatientBirthDate:
+		s.PatientBirthDate = stringValue(el.value)
+	case tagPatientSex:
+		s.PatientSex = stringValue(el.value)
+	case tagStudyInstanceUID:
+		s.StudyInstanceUID = stringValue(el.value)
+	case tagSeriesInstanceUID:
+		s.SeriesInstanceUID = stringValue(el.value)
+	case tagSOPInstanceUID:
+		s.SOPInstanceUID = stringValue(el.value)
+	case tagSOPClassUID:
+		s.SOPClassUID = stringValue(el.value)
+	case tagModality:
+		s.Modality = stringValue(el.value)
+	case tagStudyDescription:
+		s.StudyDescription = stringValue(el.value)
+	case tagSeriesDescription:
+		s.SeriesDescription = stringValue(el.value)
+	case tagBodyPartExamined:
+		s.BodyPart = stringValue(el.value)
+	case tagManufacturer:
+		s.Manufacturer = stringValue(el.value)
+	case tagManufacturerModelName:
+		s.Model = stringValue(el.value)
+	case tagInstitutionName:
+		s.Institution = stringValue(el.value)
+	case tagAcquisitionDateTime, tagAcquisitionDate, tagContentDate, tagSeriesDate, tagStudyDate:
+		s.dates[el.tag] = stringValue(el.value)
+	case tagAcquisitionTime:
+		s.time = stringValue(el.value)
+	case tagSamplesPerPixel:
+		s.SamplesPerPixel = uint16Value(el.value, order)
+	case tagPhotometric:
+		s.Photometric = stringValue(el.value)
+	case tagPlanarConfiguration:
+		s.PlanarConfiguration = uint16Value(el.value, order)
+	case tagRows:
+		s.Rows = uint16Value(el.value, order)
+	case tagColumns:
+		s.Columns = uint16Value(el.value, order)
+	case tagBitsAllocated:
+		s.BitsAllocated = uint16Value(el.value, order)
+	case tagBitsStored:
+		s.BitsStored = uint16Value(el.value, order)
+	case tagPixelRepresentation:
+		s.PixelRepresentation = uint16Value(el.value, order)
+	case tagWindowCenter:
+		s.WindowCenter = decimalValue(el.value)
+	case tagWindowWidth:
+		s.WindowWidth = decimalValue(el.value)
+	case tagRescaleIntercept:
+		s.RescaleIntercept = decimalValue(el.value)
+	case tagRescaleSlope:
+		if v := decimalValue(el.value); v != 0 {
+			s.RescaleSlope = v
+		}
+	case tagPixelData:
+		s.pixels = el.value
+		s.fragments = el.fragments
+	}
+}
+
+// resolveAcquisitionDate picks the most specific date the device recorded.
+func (s *Study) resolveAcquisitionDate() {
+	if dt := s.dates[tagAcquisitionDateTime]; len(dt) >= 8 {
+		s.AcquisitionDate = parseDate(dt[:8], dt[8:])
+		if !s.AcquisitionDate.IsZero() {
+			return
+		}
+	}
+
+	if da := s.dates[tagAcquisitionDate]; da != "" {
+		s.AcquisitionDate = parseDate(da, s.time)
+		if !s.AcquisitionDate.IsZero() {
+			return
+		}
+	}
+
+	for _, t := range []tag{tagContentDate, tagSeriesDate, tagStudyDate} {
+		if da := s.dates[t]; da != "" {
+			s.AcquisitionDate = parseDate(da, "")
+			if !s.AcquisitionDate.IsZero() {
+				return
+			}
+		}
+	}
+}
+
+// parseDate parses a DA value ("YYYYMMDD" or the legacy "YYYY.MM.DD")
+// and an optional TM value ("HHMMSS.FFFFFF", any trailing part may be omitted).
+func parseDate(da string, tm string) time.Time {
+	da = strings.ReplaceAll(da, ".", "")
+	date, err := time.Parse("20060102", da)
+	if err != nil {
+		return time.Time{}
+	}
+
+	tm = strings.ReplaceAll(tm, ":", "")
+	if i := strings.IndexAny(tm, ".+-"); i >= 0 {
+		tm = tm[:i]
+	}
+	parts := []time.Duration{time.Hour, time.Minute, time.Second}
+	for i := 0; i < len(parts) && len(tm) >= 2*(i+1); i++ {
+		n, err := strconv.Atoi(tm[2*i : 2*i+2])
+		if err != nil {
+			break
+		}
+		date = date.Add(time.Duration(n) * parts[i])
+	}
+
+	return date
+}
+
+// -------------------------------------------------------------------
+
+type element struct {
+	tag       tag
+	vr        string
+	length    uint32
+	value     []byte
+	fragments [][]byte
+}
+
+// maxDepth is the deepest nesting of sequences the decoder skips, well
+// above what real files use.
+const maxDepth = 32
+
+type decoder struct {
+	buf      []byte
+	pos      int
+	explicit bool
+	order    binary.ByteOrder
+
+	// depth is the number of sequences being skipped.
+	depth int
+}
+
+func (d *decoder) remaining() int {
+	return len(d.buf) - d.pos
+}
+
+func (d *decoder) read(n int) ([]byte, error) {
+	if n < 0 || d.remaining() < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := d.buf[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *decoder) uint16() (uint16, error) {
+	b, err := d.read(2)
+	if err != nil {
+		return 0, err
+	}
+	return d.order.Uint16(b), nil
+}
+
+func (d *decoder) uint32() (uint32, error) {
+	b, err := d.read(4)
+	if err != nil {
+		return 0, err
+	}
+	return d.order.Uint32(b), nil
+}
+
+func (d *decoder) tag() (tag, error) {
+	group, err := d.uint16()
+	if err != nil {
+		return 0, err
+	}
+	elem, err := d.uint16()
+	if err != nil {
+		return 0, err
+	}
+	return tag(group)<<16 | tag(elem), nil
+}
+
+// next reads the next data element. Sequences are skipped and encapsulated
+// pixel data is split into its fragments.
+func (d *decoder) next() (element, error) {
+	var el element
+
+	t, err := d.tag()
+	if err != nil {
+		return el, err
+	}
+	el.tag = t
+
+	// items and delimiters never carry a VR
+	if t.group() == 0xFFFE {
+		el.length, err = d.uint32()
+		return el, err
+	}
+
+	if d.explicit {
+		var vr []byte
+		if vr, err = d.read(2); err != nil {
+			return el, err
+		}
+		el.vr = string(vr)
+
+		switch el.vr {
+		case "OB", "OD", "OF", "OL", "OV", "OW", "SQ", "SV", "UC", "UN", "UR", "UT", "UV":
+			if _, err = d.read(2); err != nil {
+				return el, err
+			}
+			el.length, err = d.uint32()
+		default:
+			var l uint16
+			l, err = d.uint16()
+			el.length = uint32(l)
+		}
+	} else {
+		el.length, err = d.uint32()
+	}
+	if err != nil {
+		return el, err
+	}
+
+	switch {
+	case el.length == undefinedLength && t == tagPixelData:
+		el.fragments, err = d.readFragments()
+	case el.length == undefinedLength:
+		// SQ, or UN whose content is always implicit VR little endian
+		explicit := d.explicit
+		if el.vr == "UN" {
+			d.explicit = false
+		}
+		err = d.skipSequence()
+		d.explicit = explicit
+	case el.vr == "SQ":
+		_, err = d.read(int(el.length))
+	default:
+		el.value, err = d.read(int(el.length))
+	}
+
+	if err != nil {
+		return el, fmt.Errorf("element %s: %w", t, err)
+	}
+
+	return el, nil
+}
+
+func (d *decoder) skipSequence() error {
+	if d.depth >= maxDepth {
+		return errors.New("sequences nested too deep")
+	}
+	d.depth++
+	defer func() { d.depth-- }()
+
+	for {
+		el, err := d.next()
+		if err != nil {
+			return err
+		}
+
+		switch el.tag {
+		case tagSequenceDelimitation:
+			return nil
+		case tagItem:
+			if el.length != undefinedLength {
+				if _, err := d.read(int(el.length)); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.skipItem(); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected %s inside sequence", el.tag)
+		}
+	}
+}
+
+func (d *decoder) skipItem() error {
+	for {
+		el, err := d.next()
+		if err != nil {
+			return err
+		}
+		if el.tag == tagItemDelimitation {
+			return nil
+		}
+	}
+}
+
+// readFragments reads encapsulated pixel data, dropping the basic offset table.
+func (d *decoder) readFragments() ([][]byte, error) {
+	var fragments [][]byte
+
+	for first := true; ; first = false {
+		t, err := d.tag()
+		if err != nil {
+			return nil, err
+		}
+		length, err := d.uint32()
+		if err != nil {
+			return nil, err
+		}
+
+		switch t {
+		case tagSequenceDelimitation:
+			return fragments, nil
+		case tagItem:
+			b, err := d.read(int(length))
+			if err != nil {
+				return nil, err
+			}
+			if !first {
+				fragments = append(fragments, b)
+			}
+		default:
+			return nil, fmt.Errorf("unexpected %s inside pixel data", t)
+		}
+	}
+}
+
+// -------------------------------------------------------------------
+
+// stringValue returns the first value of a (possibly multi-valued) string
+// element without its padding.
+func stringValue(b []byte) string {
+	s := strings.TrimRight(string(b), " \x00")
+	if i := strings.IndexByte(s, '\\'); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+func uint16Value(b []byte, order binary.ByteOrder) int {
+	if len(b) < 2 {
+		return 0
+	}
+	return int(order.Uint16(b))
+}
+
+func decimalValue(b []byte) float64 {
+	v, _ := strconv.ParseFloat(stringValue(b), 64)
+	return v
+}
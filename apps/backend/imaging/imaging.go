@@ -0,0 +1,143 @@
+// Package imaging imports DICOM files exported by the clinic's radiography
+// devices into the imaging_records collection.
+package imaging
+
+import (
+	"errors"
+	"io"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/filesystem"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// maxUploadSize matches the imaging_records.file field limit.
+const maxUploadSize = 100 << 20
+
+// Register binds the imaging routes to the app.
+func Register(app core.App) {
+	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
+		g := se.Router.Group("/api/clinic")
+		g.Bind(apis.RequireAuth())
+
+		g.POST("/patients/{id}/imaging", uploadDICOM).Bind(apis.BodyLimit(maxUploadSize))
+
+		return se.Next()
+	})
+}
+
+// uploadDICOM handles POST /api/clinic/patients/{id}/imaging.
+//
+// It expects a multipart "file" field with a single DICOM Part 10 file and
+// an optional "notes" field. The study must belong to the target patient.
+func uploadDICOM(e *core.RequestEvent) error {
+	patient, err := e.App.FindRecordById("patients", e.Request.PathValue("id"))
+	if err != nil {
+		return e.NotFoundError("Patient not found.", err)
+	}
+
+	files, err := e.FindUploadedFiles("file")
+	if err != nil || len(files) != 1 {
+		return e.BadRequestError("Exactly one DICOM file is required.", validation.Errors{
+			"file": validation.NewError("validation_required", "Missing DICOM file."),
+		})
+	}
+	upload := files[0]
+
+	data, err := readAll(upload)
+	if err != nil {
+		return e.BadRequestError("Failed to read the uploaded file.", err)
+	}
+
+	study, err := ParseDICOM(data)
+	if err != nil {
+		return e.BadRequestError("Invalid DICOM file.", validation.Errors{
+			"file": validation.NewError("validation_invalid_dicom", err.Error()),
+		})
+	}
+
+	if err := MatchPatient(study, patient); err != nil {
+		return e.BadRequestError("The DICOM file belongs to a different patient.", validation.Errors{
+			"file": validation.NewError("validation_patient_mismatch", err.Error()),
+		})
+	}
+
+	if study.SOPInstanceUID != "" {
+		existing, _ := e.App.FindFirstRecordByData("imaging_records", "sopInstanceUid", study.SOPInstanceUID)
+		if existing != nil {
+			return e.BadRequestError("This DICOM instance has already been imported.", validation.Errors{
+				"file": validation.NewError("validation_duplicate_instance", "Duplicate SOP Instance UID."),
+			})
+		}
+	}
+
+	collection, err := e.App.FindCachedCollectionByNameOrId("imaging_records")
+	if err != nil {
+		return e.InternalServerError("", err)
+	}
+
+	record := core.NewRecord(collection)
+	record.Set("patient", patient.Id)
+	record.Set("file", upload)
+	record.Set("modality", study.Modality)
+	record.Set("description", study.Description())
+	record.Set("bodyPart", study.BodyPart)
+	record.Set("studyInstanceUid", study.StudyInstanceUID)
+	record.Set("seriesInstanceUid", study.SeriesInstanceUID)
+	record.Set("sopInstanceUid", study.SOPInstanceUID)
+	record.Set("manufacturer", study.Manufacturer)
+	record.Set("dicomPatientId", study.PatientID)
+	record.Set("dicomPatientName", study.PatientName)
+	record.Set("dicomPatientBirthDate", study.PatientBirthDate)
+	record.Set("rows", study.Rows)
+	record.Set("columns", study.Columns)
+	record.Set("notes", e.Request.FormValue("notes"))
+
+	if !study.AcquisitionDate.IsZero() {
+		acquired, _ := types.ParseDateTime(study.AcquisitionDate)
+		record.Set("acquisitionDate", acquired)
+	}
+
+	if e.Auth != nil && e.Auth.Collection().Name == "users" {
+		record.Set("uploadedBy", e.Auth.Id)
+	}
+
+	// the preview is a convenience for the web UI, the import itself
+	// must not fail because of an unusual pixel encoding
+	if preview, err := study.PreviewPNG(); err != nil {
+		e.App.Logger().Warn(
+			"Failed to render DICOM preview",
+			"patient", patient.Id,
+			"sopInstanceUid", study.SOPInstanceUID,
+			"error", err,
+		)
+	} else if previewFile, err := filesystem.NewFileFromBytes(preview, "preview.png"); err == nil {
+		record.Set("preview", previewFile)
+	}
+
+	if err := e.App.Save(record); err != nil {
+		return e.BadRequestError("Failed to save the imaging record.", err)
+	}
+
+	if err := apis.EnrichRecord(e, record); err != nil {
+		return e.InternalServerError("", err)
+	}
+
+	return e.JSON(200, record)
+}
+
+func readAll(f *filesystem.File) ([]byte, error) {
+	if f.Size > maxUploadSize {
+		return nil, errors.New("file too large")
+	}
+
+	r, err := f.Reader.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
@@ -0,0 +1,81 @@
+package imaging
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// ErrIdentityMismatch is returned when the DICOM patient module does not
+// identify the target patient record.
+var ErrIdentityMismatch = errors.New("DICOM patient identity does not match the patient record")
+
+// MatchPatient verifies that the study belongs to the given patients record.
+//
+// A study matches when its Patient ID equals the record id, or when both the
+// patient name and date of birth agree. A name or date of birth present on
+// both sides that disagrees always rejects the study, even when the ids match.
+// Studies tagged with the family name only (e.g. by intraoral sensors) are
+// compared by family name.
+func MatchPatient(s *Study, patient *core.Record) error {
+	family, given := splitPersonName(s.PatientName)
+
+	nameKnown := family != "" && patient.GetString("lastName") != ""
+	nameMatches := nameKnown &&
+		normalizeName(family) == normalizeName(patient.GetString("lastName")) &&
+		(given == "" || firstToken(given) == firstToken(patient.GetString("firstName")))
+
+	dob := patient.GetDateTime("dateOfBirth")
+	dobKnown := len(s.PatientBirthDate) >= 8 && !dob.IsZero()
+	dobMatches := dobKnown &&
+		strings.ReplaceAll(s.PatientBirthDate, ".", "") == dob.Time().Format("20060102")
+
+	if (nameKnown && !nameMatches) || (dobKnown && !dobMatches) {
+		return ErrIdentityMismatch
+	}
+
+	idMatches := s.PatientID != "" && strings.EqualFold(strings.TrimSpace(s.PatientID), patient.Id)
+	if idMatches || (nameMatches && dobMatches) {
+		return nil
+	}
+
+	return ErrIdentityMismatch
+}
+
+// splitPersonName splits a DICOM PN value ("Family^Given^Middle^Prefix^Suffix")
+// into its family and given name components, ignoring any ideographic or
+// phonetic representations.
+func splitPersonName(pn string) (family string, given string) {
+	if i := strings.IndexByte(pn, '='); i >= 0 {
+		pn = pn[:i]
+	}
+
+	parts := strings.Split(pn, "^")
+	family = strings.TrimSpace(parts[0])
+	if len(parts) > 1 {
+		given = strings.TrimSpace(parts[1])
+	}
+
+	return family, given
+}
+
+// normalizeName keeps only letters and digits, upper-cased, so that
+// "O'Brien" and "OBRIEN" compare equal.
+func normalizeName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToUpper(r)
+		}
+		return -1
+	}, s)
+}
+
+func firstToken(s string) string {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return ""
+	}
+	return normalizeName(fields[0])
+}
@@ -0,0 +1,188 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+
+	"golang.org/x/image/draw"
+)
+
+// ErrPreviewUnsupported is returned when the pixel data is stored in a form
+// the preview renderer cannot decode (eg. JPEG 2000 or JPEG lossless).
+var ErrPreviewUnsupported = errors.New("unsupported pixel data encoding")
+
+// previewMaxSize is the longest side of the generated preview in pixels.
+const previewMaxSize = 1600
+
+// maxPixels bounds the frames decoded for the preview: raw pixel data of
+// an upload holds at most maxUploadSize 8 bits samples, and compressed
+// frames must not declare more.
+const maxPixels = maxUploadSize
+
+// PreviewPNG renders the first frame of the study as a PNG that fits
+// within previewMaxSize.
+func (s *Study) PreviewPNG() ([]byte, error) {
+	img, err := s.firstFrame()
+	if err != nil {
+		return nil, err
+	}
+
+	img = fit(img, previewMaxSize)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (s *Study) firstFrame() (image.Image, error) {
+	if len(s.fragments) > 0 {
+		if s.TransferSyntax != tsJPEGBaseline && s.TransferSyntax != tsJPEGExtended {
+			return nil, fmt.Errorf("%w: transfer syntax %s", ErrPreviewUnsupported, s.TransferSyntax)
+		}
+		// a single frame may be split across several fragments
+		data := bytes.Join(s.fragments, nil)
+
+		// the decoder allocates the declared size, whatever the data
+		config, err := jpeg.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if config.Width*config.Height > maxPixels {
+			return nil, fmt.Errorf("frame too large: %dx%d", config.Width, config.Height)
+		}
+
+		return jpeg.Decode(bytes.NewReader(data))
+	}
+
+	if len(s.pixels) == 0 || s.Rows == 0 || s.Columns == 0 {
+		return nil, errors.New("missing pixel data")
+	}
+	if s.Rows*s.Columns > maxPixels {
+		return nil, fmt.Errorf("frame too large: %dx%d", s.Columns, s.Rows)
+	}
+
+	switch {
+	case s.SamplesPerPixel <= 1 && (s.BitsAllocated == 8 || s.BitsAllocated == 16):
+		return s.grayscale()
+	case s.SamplesPerPixel == 3 && s.BitsAllocated == 8 && s.Photometric == "RGB":
+		return s.rgb()
+	default:
+		return nil, fmt.Errorf(
+			"%w: %d samples, %d bits, %s",
+			ErrPreviewUnsupported, s.SamplesPerPixel, s.BitsAllocated, s.Photometric,
+		)
+	}
+}
+
+// grayscale applies the modality rescale and the VOI window (or the full
+// value range when the device did not specify one) to a monochrome frame.
+func (s *Study) grayscale() (image.Image, error) {
+	count := s.Rows * s.Columns
+	bytesPerSample := s.BitsAllocated / 8
+	if len(s.pixels) < count*bytesPerSample {
+		return nil, errors.New("truncated pixel data")
+	}
+
+	bitsStored := s.BitsStored
+	if bitsStored <= 0 || bitsStored > s.BitsAllocated {
+		bitsStored = s.BitsAllocated
+	}
+	mask := uint32(1)<<bitsStored - 1
+	signBit := uint32(1) << (bitsStored - 1)
+
+	values := make([]float64, count)
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for i := range values {
+		var raw uint32
+		if bytesPerSample == 1 {
+			raw = uint32(s.pixels[i])
+		} else {
+			raw = uint32(s.byteOrder.Uint16(s.pixels[2*i:]))
+		}
+		raw &= mask
+
+		v := float64(raw)
+		if s.PixelRepresentation == 1 && raw&signBit != 0 {
+			v = float64(int64(raw) - int64(mask) - 1)
+		}
+		v = v*s.RescaleSlope + s.RescaleIntercept
+
+		values[i] = v
+		lo = math.Min(lo, v)
+		hi = math.Max(hi, v)
+	}
+
+	if s.WindowWidth > 1 {
+		lo = s.WindowCenter - s.WindowWidth/2
+		hi = s.WindowCenter + s.WindowWidth/2
+	}
+	span := hi - lo
+	if span <= 0 {
+		span = 1
+	}
+
+	invert := s.Photometric == "MONOCHROME1"
+
+	img := image.NewGray(image.Rect(0, 0, s.Columns, s.Rows))
+	for i, v := range values {
+		level := math.Round((v - lo) / span * 255)
+		level = math.Max(0, math.Min(255, level))
+		if invert {
+			level = 255 - level
+		}
+		img.Pix[i] = uint8(level)
+	}
+
+	return img, nil
+}
+
+func (s *Study) rgb() (image.Image, error) {
+	count := s.Rows * s.Columns
+	if len(s.pixels) < count*3 {
+		return nil, errors.New("truncated pixel data")
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, s.Columns, s.Rows))
+	for i := 0; i < count; i++ {
+		var c color.NRGBA
+		if s.PlanarConfiguration == 1 {
+			c = color.NRGBA{s.pixels[i], s.pixels[count+i], s.pixels[2*count+i], 0xFF}
+		} else {
+			c = color.NRGBA{s.pixels[3*i], s.pixels[3*i+1], s.pixels[3*i+2], 0xFF}
+		}
+		img.SetNRGBA(i%s.Columns, i/s.Columns, c)
+	}
+
+	return img, nil
+}
+
+// fit downscales img so that neither side exceeds limit, keeping the aspect ratio.
+func fit(img image.Image, limit int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= limit && h <= limit {
+		return img
+	}
+
+	if w >= h {
+		h = max(h*limit/w, 1)
+		w = limit
+	} else {
+		w = max(w*limit/h, 1)
+		h = limit
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+
+	return dst
+}
@@ -0,0 +1,193 @@
+// Package labcases tracks prosthetic work (crowns, bridges, dentures...)
+// sent to external dental labs and keeps the seating appointments in line
+// with the lab's expected return date.
+package labcases
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"zahrawiclinic.com/dates"
+	"zahrawiclinic.com/tasks"
+)
+
+// Register binds the lab case hooks and the daily overdue job to the app.
+func Register(app core.App) {
+	app.OnRecordValidate("appointments").BindFunc(validateSeatingAppointment)
+	app.OnRecordValidate("lab_cases").BindFunc(validateLabCase)
+
+	app.OnRecordCreate("lab_cases").BindFunc(stampStatusDates)
+	app.OnRecordUpdate("lab_cases").BindFunc(stampStatusDates)
+
+	app.Cron().MustAdd("labCasesOverdue", "0 7 * * *", func() {
+		if err := CreateOverdueTasks(app); err != nil {
+			app.Logger().Error("Failed to create overdue lab case tasks", "error", err)
+		}
+	})
+}
+
+// isAtLab reports whether the lab work has not come back yet.
+func isAtLab(labCase *core.Record) bool {
+	status := labCase.GetString("status")
+	return status == "sent" || status == "remake"
+}
+
+// isActiveAppointment reports whether the appointment still has to take place.
+func isActiveAppointment(appointment *core.Record) bool {
+	status := appointment.GetString("status")
+	return status == "scheduled" || status == "confirmed"
+}
+
+// validateSeatingAppointment rejects seating appointments booked before
+// the linked lab case is expected back from the lab.
+func validateSeatingAppointment(e *core.RecordEvent) error {
+	labCaseId := e.Record.GetString("labCase")
+	if labCaseId == "" || !isActiveAppointment(e.Record) {
+		return e.Next()
+	}
+
+	labCase, err := e.App.FindRecordById("lab_cases", labCaseId)
+	if err != nil {
+		return e.Next() // the relation field validator reports the missing record
+	}
+
+	if labCase.GetString("patient") != e.Record.GetString("patient") {
+		return validation.Errors{
+			"labCase": validation.NewError("validation_lab_case_patient", "The lab case belongs to a different patient."),
+		}
+	}
+
+	due := labCase.GetDateTime("dueDate")
+	if isAtLab(labCase) && e.Record.GetDateTime("start_time").Time().Before(due.Time()) {
+		return validation.Errors{
+			"start_time": validation.NewError(
+				"validation_before_lab_due_date",
+				fmt.Sprintf("The lab case is not expected back before %s.", due.Time().Format(time.DateOnly)),
+			),
+		}
+	}
+
+	return e.Next()
+}
+
+// validateLabCase prevents moving the expected return date past an already
+// booked seating appointment and requires a reason for remakes.
+func validateLabCase(e *core.RecordEvent) error {
+	if e.Record.GetString("status") == "remake" && strings.TrimSpace(e.Record.GetString("remakeReason")) == "" {
+		return validation.Errors{
+			"remakeReason": validation.NewError("validation_required", "A remake reason is required."),
+		}
+	}
+
+	if e.Record.IsNew() || !isAtLab(e.Record) {
+		return e.Next()
+	}
+
+	conflicts, err := e.App.FindRecordsByFilter(
+		"appointments",
+		"labCase = {:labCase} && (status = 'scheduled' || status = 'confirmed') && start_time < {:due}",
+		"start_time",
+		1,
+		0,
+		dbx.Params{
+			"labCase": e.Record.Id,
+			"due":     e.Record.GetDateTime("dueDate").String(),
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	if len(conflicts) > 0 {
+		return validation.Errors{
+			"dueDate": validation.NewError(
+				"validation_seating_before_due_date",
+				fmt.Sprintf(
+					"The seating appointment on %s is before this date, reschedule it first.",
+					conflicts[0].GetDateTime("start_time").Time().Format(time.DateOnly),
+				),
+			),
+		}
+	}
+
+	return e.Next()
+}
+
+// stampStatusDates fills the date matching the current status when the
+// staff didn't enter one explicitly.
+func stampStatusDates(e *core.RecordEvent) error {
+	dateField := map[string]string{
+		"sent":     "sentDate",
+		"received": "receivedDate",
+		"fitted":   "fittedDate",
+	}[e.Record.GetString("status")]
+
+	if dateField != "" && e.Record.GetDateTime(dateField).IsZero() {
+		e.Record.Set(dateField, types.NowDateTime())
+	}
+
+	return e.Next()
+}
+
+// CreateOverdueTasks raises a follow-up task for every lab case that is
+// still at the lab after its due date.
+//
+// The task source includes the due date so that a case whose due date was
+// extended gets a new task if it becomes overdue again.
+func CreateOverdueTasks(app core.App) error {
+	today := dates.Today()
+
+	labCases, err := app.FindRecordsByFilter(
+		"lab_cases",
+		"(status = 'sent' || status = 'remake') && dueDate != '' && dueDate < {:today}",
+		"dueDate",
+		0,
+		0,
+		dbx.Params{"today": today.UTC().Format(types.DefaultDateLayout)},
+	)
+	if err != nil {
+		return err
+	}
+
+	if errs := app.ExpandRecords(labCases, []string{"lab", "patient"}, nil); len(errs) > 0 {
+		return fmt.Errorf("failed to expand lab cases: %v", errs)
+	}
+
+	for _, labCase := range labCases {
+		due := labCase.GetDateTime("dueDate").Time()
+
+		var labName, patientName string
+		if lab := labCase.ExpandedOne("lab"); lab != nil {
+			labName = lab.GetString("name")
+		}
+		if patient := labCase.ExpandedOne("patient"); patient != nil {
+			patientName = strings.TrimSpace(patient.GetString("firstName") + " " + patient.GetString("lastName"))
+		}
+
+		_, err := tasks.Ensure(app, tasks.Task{
+			Source:   fmt.Sprintf("lab_case_overdue:%s:%s", labCase.Id, due.Format(time.DateOnly)),
+			Title:    fmt.Sprintf("Overdue lab case: %s for %s", labCase.GetString("caseType"), patientName),
+			Priority: "high",
+			Category: "clinical",
+			DueDate:  today,
+			Description: fmt.Sprintf(
+				"The %s sent to %s was due back on %s. Contact the lab and reschedule the seating appointment if needed.",
+				labCase.GetString("caseType"),
+				labName,
+				due.Format(time.DateOnly),
+			),
+			AssignedTo: labCase.GetString("dentist"),
+			Patient:    labCase.GetString("patient"),
+		})
+		if err != nil {
+			return fmt.Errorf("lab case %s: %w", labCase.Id, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,356 @@
+// Package ledger keeps the append-only patient account ledger. Every change
+// to the amount an invoice, payment, refund, credit note or write-off brings
+// to the patient account is posted as a new entry, entries are never updated
+// or deleted. The insurance claims are posted through their payments.
+package ledger
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"zahrawiclinic.com/money"
+)
+
+// Register binds the ledger hooks and routes to the app.
+func Register(app core.App) {
+	app.OnRecordCreate("invoices").BindFunc(syncInvoice)
+	app.OnRecordUpdate("invoices").BindFunc(syncInvoice)
+
+	app.OnRecordCreate("payments").BindFunc(syncPayment)
+	app.OnRecordUpdate("payments").BindFunc(syncPayment)
+	app.OnRecordDelete("payments").BindFunc(syncPayment)
+
+	// posted adjustments can't be changed or deleted, drafts aren't posted
+	for _, collection := range []string{"refunds", "credit_notes", "write_offs"} {
+		app.OnRecordCreate(collection).BindFunc(syncAdjustment)
+		app.OnRecordUpdate(collection).BindFunc(syncAdjustment)
+	}
+
+	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
+		registerRoutes(se)
+		return se.Next()
+	})
+}
+
+// posting is the amount a record currently brings to a patient account,
+// positive for charges and negative for payments.
+type posting struct {
+	Patient     string
+	Amount      money.Money
+	Date        types.DateTime
+	Type        string
+	Description string
+
+	// Link is the ledger relation field pointing to the record, left
+	// empty once the record is deleted.
+	Link   string
+	LinkId string
+
+	// Invoice is the invoice the record relates to, if any.
+	Invoice string
+}
+
+// syncInvoice posts the invoice total once it is issued, and reverses it
+// when the invoice is cancelled. The totals are final after e.Next() since
+// the billing hooks run with a lower priority. The exchange differences of
+// the invoice payments follow its exchange rate.
+func syncInvoice(e *core.RecordEvent) error {
+	return e.App.RunInTransaction(func(txApp core.App) error {
+		e.App = txApp
+
+		if err := e.Next(); err != nil {
+			return err
+		}
+
+		if err := sync(txApp, "invoice:"+e.Record.Id, invoicePosting(e.Record)); err != nil {
+			return err
+		}
+
+		if e.Record.GetFloat("exchangeRate") == e.Record.Original().GetFloat("exchangeRate") {
+			return nil
+		}
+
+		payments, err := txApp.FindAllRecords("payments", dbx.HashExp{"invoice": e.Record.Id})
+		if err != nil {
+			return err
+		}
+		for _, payment := range payments {
+			if err := sync(txApp, "exchange:"+payment.Id, exchangePosting(payment, e.Record, false)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// syncPayment posts the payment as a credit with its exchange difference.
+func syncPayment(e *core.RecordEvent) error {
+	return e.App.RunInTransaction(func(txApp core.App) error {
+		e.App = txApp
+
+		if err := e.Next(); err != nil {
+			return err
+		}
+
+		deleted := e.Type == core.ModelEventTypeDelete
+
+		if err := sync(txApp, "payment:"+e.Record.Id, paymentPosting(txApp, e.Record, deleted)); err != nil {
+			return err
+		}
+
+		// without invoice (e.g. moved off it), any exchange difference is
+		// reversed
+		invoice, _ := txApp.FindRecordById("invoices", e.Record.GetString("invoice"))
+		if err := sync(txApp, "exchange:"+e.Record.Id, exchangePosting(e.Record, invoice, deleted)); err != nil {
+			return err
+		}
+
+		return nil
+	})
+}
+
+// syncAdjustment posts refunds as debits, and credit notes and write-offs
+// as credits, once they are posted.
+func syncAdjustment(e *core.RecordEvent) error {
+	return e.App.RunInTransaction(func(txApp core.App) error {
+		e.App = txApp
+
+		if err := e.Next(); err != nil {
+			return err
+		}
+
+		return sync(txApp, e.Record.Collection().Name+":"+e.Record.Id, adjustmentPosting(txApp, e.Record))
+	})
+}
+
+func invoicePosting(invoice *core.Record) posting {
+	p := posting{
+		Patient:     invoice.GetString("patient"),
+		Date:        invoice.GetDateTime("invoiceDate"),
+		Type:        "charge",
+		Description: strings.TrimSpace("Invoice " + invoice.GetString("invoiceNumber")),
+		Link:        "invoice",
+		LinkId:      invoice.Id,
+	}
+
+	if status := invoice.GetString("status"); status != "draft" && status != "cancelled" {
+		p.Amount = money.ToBase(invoice, money.Get(invoice, "total"))
+		p.Description += original(invoice, money.Get(invoice, "total"))
+	}
+
+	return p
+}
+
+func paymentPosting(app core.App, payment *core.Record, deleted bool) posting {
+	p := posting{
+		Patient:     payment.GetString("patient"),
+		Date:        payment.GetDateTime("paymentDate"),
+		Type:        "payment",
+		Description: fmt.Sprintf("Payment (%s)", payment.GetString("paymentMethod")),
+		Link:        "payment",
+		LinkId:      payment.Id,
+	}
+
+	if payment.GetString("paymentMethod") == "insurance" {
+		p.Type = "insurance_payment"
+		p.Description = "Insurance payment"
+	}
+
+	if invoice, err := app.FindRecordById("invoices", payment.GetString("invoice")); err == nil {
+		p.Description += ", invoice " + invoice.GetString("invoiceNumber")
+		p.Invoice = invoice.Id
+	}
+
+	if deleted {
+		p.LinkId = ""
+	} else {
+		p.Amount = -money.ToBase(payment, money.Get(payment, "amount"))
+	}
+	p.Description += original(payment, money.Get(payment, "amount"))
+
+	return p
+}
+
+// exchangePosting posts the difference between the payment converted at
+// the payment rate and the amount it settles of a foreign currency invoice
+// converted at the invoice rate, so that a settled invoice leaves no
+// balance in the clinic currency.
+func exchangePosting(payment *core.Record, invoice *core.Record, deleted bool) posting {
+	p := posting{
+		Patient:     payment.GetString("patient"),
+		Date:        payment.GetDateTime("paymentDate"),
+		Type:        "adjustment",
+		Description: "Exchange difference",
+		Link:        "payment",
+		LinkId:      payment.Id,
+	}
+
+	if deleted {
+		p.LinkId = ""
+	}
+	if invoice == nil {
+		return p
+	}
+
+	p.Description += ", invoice " + invoice.GetString("invoiceNumber")
+	p.Invoice = invoice.Id
+
+	if !deleted {
+		p.Amount = money.ToBase(payment, money.Get(payment, "amount")) - money.ToBase(invoice, money.Get(payment, "invoiceAmount"))
+	}
+
+	return p
+}
+
+func adjustmentPosting(app core.App, record *core.Record) posting {
+	p := posting{
+		Patient: record.GetString("patient"),
+		LinkId:  record.Id,
+		Invoice: record.GetString("invoice"),
+	}
+
+	// the adjustments are in the currency of their invoice
+	amount := money.Get(record, "amount")
+	suffix := ""
+	if invoice, err := app.FindRecordById("invoices", p.Invoice); err == nil {
+		suffix = ", invoice " + invoice.GetString("invoiceNumber") + original(invoice, amount)
+		amount = money.ToBase(invoice, amount)
+	}
+
+	switch record.Collection().Name {
+	case "refunds":
+		p.Type = "refund"
+		p.Link = "refund"
+		p.Date = record.GetDateTime("refundDate")
+		p.Description = fmt.Sprintf("Refund (%s)%s", record.GetString("refundMethod"), suffix)
+	case "credit_notes":
+		p.Type = "credit_note"
+		p.Link = "creditNote"
+		p.Date = record.GetDateTime("issueDate")
+		p.Description = fmt.Sprintf("Credit note %s%s", record.GetString("creditNoteNumber"), suffix)
+		amount = -amount
+	case "write_offs":
+		p.Type = "write_off"
+		p.Link = "writeOff"
+		p.Date = record.GetDateTime("writeOffDate")
+		p.Description = fmt.Sprintf("Write-off (%s)%s", record.GetString("reasonCode"), suffix)
+		amount = -amount
+	}
+
+	if record.GetString("status") == "posted" {
+		p.Amount = amount
+	}
+
+	return p
+}
+
+// original describes an amount of a record in a foreign currency for the
+// entry descriptions, e.g. " (100.00 EUR at 1.08)", and is empty for the
+// clinic currency.
+func original(record *core.Record, m money.Money) string {
+	currency := money.Lookup(record.GetString("currency"))
+	if currency.Code == "" || currency.Code == money.Default().Code {
+		return ""
+	}
+	return fmt.Sprintf(" (%s at %g)", currency.Display(m), record.GetFloat("exchangeRate"))
+}
+
+// sync posts the difference between the posting amount and what was
+// already posted for the source. Amounts posted to another patient (the
+// record was moved) are reversed.
+func sync(app core.App, source string, p posting) error {
+	var rows []struct {
+		Patient string  `db:"patient"`
+		Total   float64 `db:"total"`
+	}
+	err := app.DB().
+		Select("[[patient]]", "COALESCE(SUM([[debit]] - [[credit]]), 0) AS total").
+		From("ledger_entries").
+		Where(dbx.HashExp{"source": source}).
+		GroupBy("patient").
+		All(&rows)
+	if err != nil {
+		return err
+	}
+
+	first := len(rows) == 0
+	var posted money.Money
+
+	for _, row := range rows {
+		if row.Patient == p.Patient {
+			posted = money.FromMinor(row.Total)
+			continue
+		}
+		if money.FromMinor(row.Total) == 0 {
+			continue
+		}
+
+		reversal := p
+		reversal.Patient = row.Patient
+		reversal.Type = "adjustment"
+		reversal.Description = "Reversal: " + p.Description
+		if err := post(app, source, reversal, -money.FromMinor(row.Total), types.NowDateTime()); err != nil {
+			return err
+		}
+	}
+
+	delta := p.Amount - posted
+	if delta == 0 || p.Patient == "" {
+		return nil
+	}
+
+	// the first posting is dated as the record, later corrections when
+	// they happen
+	date := types.NowDateTime()
+	if first && !p.Date.IsZero() {
+		date = p.Date
+	}
+
+	switch {
+	case first:
+	case p.Amount == 0:
+		p.Type = "adjustment"
+		p.Description = "Reversal: " + p.Description
+	default:
+		p.Type = "adjustment"
+		p.Description = "Adjustment: " + p.Description
+	}
+
+	return post(app, source, p, delta, date)
+}
+
+// post saves a ledger entry of the given signed amount.
+func post(app core.App, source string, p posting, amount money.Money, date types.DateTime) error {
+	collection, err := app.FindCachedCollectionByNameOrId("ledger_entries")
+	if err != nil {
+		return err
+	}
+
+	entry := core.NewRecord(collection)
+	entry.Set("patient", p.Patient)
+	entry.Set("date", date)
+	entry.Set("type", p.Type)
+	entry.Set("description", p.Description)
+	entry.Set("source", source)
+	if amount > 0 {
+		money.Set(entry, "debit", amount)
+	} else {
+		money.Set(entry, "credit", -amount)
+	}
+	if p.Invoice != "" {
+		entry.Set("invoice", p.Invoice)
+	}
+	if p.LinkId != "" {
+		entry.Set(p.Link, p.LinkId)
+	}
+
+	if err := app.Save(entry); err != nil {
+		return fmt.Errorf("failed to post %s to the ledger: %w", source, err)
+	}
+
+	return nil
+}
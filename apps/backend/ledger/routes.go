@@ -0,0 +1,122 @@
+package ledger
+
+import (
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"zahrawiclinic.com/dates"
+	"zahrawiclinic.com/money"
+)
+
+func registerRoutes(se *core.ServeEvent) {
+	g := se.Router.Group("/api/clinic")
+	g.Bind(apis.RequireAuth())
+
+	g.GET("/patients/{id}/ledger", getLedger)
+}
+
+type ledgerEntry struct {
+	Id          string         `json:"id"`
+	Date        types.DateTime `json:"date"`
+	Type        string         `json:"type"`
+	Description string         `json:"description"`
+	Debit       money.Money    `json:"debit"`
+	Credit      money.Money    `json:"credit"`
+	Balance     money.Money    `json:"balance"`
+	Invoice     string         `json:"invoice"`
+	Payment     string         `json:"payment"`
+}
+
+// getLedger handles GET /api/clinic/patients/{id}/ledger.
+//
+// It returns the patient ledger entries in chronological order with the
+// running balance after each entry. The balance is positive when the
+// patient owes the clinic.
+//
+// Query parameters:
+//   - from: first day included, YYYY-MM-DD (default: the first entry)
+//   - to: last day included, YYYY-MM-DD (default: all entries)
+func getLedger(e *core.RequestEvent) error {
+	patient, err := e.App.FindRecordById("patients", e.Request.PathValue("id"))
+	if err != nil {
+		return e.NotFoundError("Patient not found.", err)
+	}
+
+	var from, to time.Time
+	if raw := e.Request.URL.Query().Get("from"); raw != "" {
+		if from, err = time.ParseInLocation(time.DateOnly, raw, time.Local); err != nil {
+			return e.BadRequestError("Invalid from date, expected YYYY-MM-DD.", nil)
+		}
+	}
+	if raw := e.Request.URL.Query().Get("to"); raw != "" {
+		if to, err = time.ParseInLocation(time.DateOnly, raw, time.Local); err != nil {
+			return e.BadRequestError("Invalid to date, expected YYYY-MM-DD.", nil)
+		}
+	}
+	if !from.IsZero() && !to.IsZero() && to.Before(from) {
+		return e.BadRequestError("The to date is before the from date.", nil)
+	}
+
+	var opening struct {
+		Balance float64 `db:"balance"`
+	}
+	if !from.IsZero() {
+		err := e.App.DB().
+			Select("COALESCE(SUM([[debit]] - [[credit]]), 0) AS balance").
+			From("ledger_entries").
+			Where(dbx.HashExp{"patient": patient.Id}).
+			AndWhere(dbx.NewExp("[[date]] < {:from}", dbx.Params{"from": formatDate(from)})).
+			One(&opening)
+		if err != nil {
+			return e.InternalServerError("Failed to load the ledger.", err)
+		}
+	}
+
+	filter := "patient = {:patient}"
+	params := dbx.Params{"patient": patient.Id}
+	if !from.IsZero() {
+		filter += " && date >= {:from}"
+		params["from"] = formatDate(from)
+	}
+	if !to.IsZero() {
+		filter += " && date < {:to}"
+		params["to"] = formatDate(dates.StartOfDay(to).AddDate(0, 0, 1))
+	}
+
+	records, err := e.App.FindRecordsByFilter("ledger_entries", filter, "date,created,id", 0, 0, params)
+	if err != nil {
+		return e.InternalServerError("Failed to load the ledger.", err)
+	}
+
+	balance := money.FromMinor(opening.Balance)
+	entries := make([]ledgerEntry, 0, len(records))
+	for _, record := range records {
+		balance += money.Get(record, "debit") - money.Get(record, "credit")
+		entries = append(entries, ledgerEntry{
+			Id:          record.Id,
+			Date:        record.GetDateTime("date"),
+			Type:        record.GetString("type"),
+			Description: record.GetString("description"),
+			Debit:       money.Get(record, "debit"),
+			Credit:      money.Get(record, "credit"),
+			Balance:     balance,
+			Invoice:     record.GetString("invoice"),
+			Payment:     record.GetString("payment"),
+		})
+	}
+
+	return e.JSON(200, map[string]any{
+		"patient":        patient.Id,
+		"openingBalance": money.FromMinor(opening.Balance),
+		"closingBalance": balance,
+		"entries":        entries,
+	})
+}
+
+// formatDate formats t as stored in the date fields.
+func formatDate(t time.Time) string {
+	return t.UTC().Format(types.DefaultDateLayout)
+}
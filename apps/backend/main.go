@@ -11,7 +11,27 @@ import (
 	"github.com/pocketbase/pocketbase/apis"
 	"github.com/pocketbase/pocketbase/core"
 	"github.com/pocketbase/pocketbase/plugins/migratecmd"
+	"zahrawiclinic.com/benefits"
+	"zahrawiclinic.com/billing"
+	"zahrawiclinic.com/catalog"
+	"zahrawiclinic.com/claims"
+	"zahrawiclinic.com/dunning"
+	"zahrawiclinic.com/eligibility"
+	"zahrawiclinic.com/exchange"
+	"zahrawiclinic.com/gateway"
+	"zahrawiclinic.com/imaging"
+	"zahrawiclinic.com/labcases"
+	"zahrawiclinic.com/ledger"
 	_ "zahrawiclinic.com/migrations"
+	"zahrawiclinic.com/money"
+	"zahrawiclinic.com/paymentplans"
+	"zahrawiclinic.com/pricing"
+	"zahrawiclinic.com/recalls"
+	"zahrawiclinic.com/referrals"
+	"zahrawiclinic.com/sequences"
+	"zahrawiclinic.com/statements"
+	"zahrawiclinic.com/taxes"
+	"zahrawiclinic.com/x12"
 )
 
 // embed frontend/dist
@@ -38,6 +58,27 @@ func main() {
 		return se.Next()
 	})
 
+	benefits.Register(app)
+	billing.Register(app)
+	catalog.Register(app, app.RootCmd)
+	claims.Register(app)
+	dunning.Register(app)
+	eligibility.Register(app)
+	exchange.Register(app, app.RootCmd)
+	gateway.Register(app)
+	imaging.Register(app)
+	labcases.Register(app)
+	ledger.Register(app)
+	money.Register(app)
+	paymentplans.Register(app)
+	pricing.Register(app)
+	recalls.Register(app)
+	referrals.Register(app)
+	sequences.Register(app)
+	statements.Register(app, app.RootCmd)
+	taxes.Register(app)
+	x12.Register(app, app.RootCmd)
+
 	// loosely check if it was executed using "go run"
 	isGoRun := strings.HasPrefix(os.Args[0], os.TempDir())
 
@@ -0,0 +1,140 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// =============================================================================
+		// Imaging Collection - DICOM studies imported from the radiography devices
+		// =============================================================================
+
+		// Get dependencies
+		patients, err := app.FindCollectionByNameOrId("patients")
+		if err != nil {
+			return err
+		}
+
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		// ---------------------------------------------------------------------------
+		// imaging_records - One record per imported DICOM instance
+		// ---------------------------------------------------------------------------
+		imagingRecords := core.NewBaseCollection("imaging_records")
+
+		imagingRecords.ListRule = types.Pointer("@request.auth.id != ''")
+		imagingRecords.ViewRule = types.Pointer("@request.auth.id != ''")
+		imagingRecords.CreateRule = types.Pointer("@request.auth.id != ''")
+		imagingRecords.UpdateRule = types.Pointer("@request.auth.id != ''")
+		imagingRecords.DeleteRule = types.Pointer("@request.auth.id != ''")
+
+		imagingRecords.Fields.Add(
+			&core.RelationField{
+				Name:          "patient",
+				Required:      true,
+				CollectionId:  patients.Id,
+				CascadeDelete: true,
+			},
+			&core.FileField{
+				Name:      "file",
+				MaxSelect: 1,
+				MaxSize:   100 << 20,
+				Protected: true,
+			},
+			&core.FileField{
+				Name:      "preview",
+				MaxSelect: 1,
+				MaxSize:   20 << 20,
+				MimeTypes: []string{"image/png"},
+				Thumbs:    []string{"300x0"},
+				Protected: true,
+			},
+			&core.TextField{
+				Name: "modality",
+				Max:  16,
+			},
+			&core.DateField{
+				Name: "acquisitionDate",
+			},
+			&core.TextField{
+				Name: "description",
+				Max:  500,
+			},
+			&core.TextField{
+				Name: "bodyPart",
+				Max:  100,
+			},
+			&core.TextField{
+				Name: "studyInstanceUid",
+				Max:  64,
+			},
+			&core.TextField{
+				Name: "seriesInstanceUid",
+				Max:  64,
+			},
+			&core.TextField{
+				Name: "sopInstanceUid",
+				Max:  64,
+			},
+			&core.TextField{
+				Name: "manufacturer",
+				Max:  200,
+			},
+			&core.TextField{
+				Name: "dicomPatientId",
+				Max:  64,
+			},
+			&core.TextField{
+				Name: "dicomPatientName",
+				Max:  200,
+			},
+			&core.TextField{
+				Name: "dicomPatientBirthDate",
+				Max:  16,
+			},
+			&core.NumberField{
+				Name:    "rows",
+				OnlyInt: true,
+			},
+			&core.NumberField{
+				Name:    "columns",
+				OnlyInt: true,
+			},
+			&core.RelationField{
+				Name:         "uploadedBy",
+				CollectionId: users.Id,
+			},
+			&core.TextField{
+				Name: "notes",
+				Max:  2000,
+			},
+
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+
+		// The same DICOM instance must never be imported twice
+		imagingRecords.Indexes = []string{
+			"CREATE UNIQUE INDEX idx_imaging_records_sopInstanceUid ON imaging_records (sopInstanceUid) WHERE sopInstanceUid != ''",
+			"CREATE INDEX idx_imaging_records_patient ON imaging_records (patient)",
+		}
+
+		return app.Save(imagingRecords)
+	}, func(app core.App) error {
+		// Rollback
+		return app.Delete(core.NewBaseCollection("imaging_records"))
+	})
+}
@@ -0,0 +1,266 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// =============================================================================
+		// Lab Collections - External dental labs and the cases sent to them
+		// =============================================================================
+
+		// Get dependencies
+		patients, err := app.FindCollectionByNameOrId("patients")
+		if err != nil {
+			return err
+		}
+
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		addresses, err := app.FindCollectionByNameOrId("addresses")
+		if err != nil {
+			return err
+		}
+
+		treatments, err := app.FindCollectionByNameOrId("treatments")
+		if err != nil {
+			return err
+		}
+
+		treatmentPlanItems, err := app.FindCollectionByNameOrId("treatment_plan_items")
+		if err != nil {
+			return err
+		}
+
+		appointments, err := app.FindCollectionByNameOrId("appointments")
+		if err != nil {
+			return err
+		}
+
+		tasks, err := app.FindCollectionByNameOrId("tasks")
+		if err != nil {
+			return err
+		}
+
+		// ---------------------------------------------------------------------------
+		// 1. labs - External dental laboratories
+		// ---------------------------------------------------------------------------
+		labs := core.NewBaseCollection("labs")
+
+		labs.ListRule = types.Pointer("@request.auth.id != ''")
+		labs.ViewRule = types.Pointer("@request.auth.id != ''")
+		labs.CreateRule = types.Pointer("@request.auth.id != ''")
+		labs.UpdateRule = types.Pointer("@request.auth.id != ''")
+		labs.DeleteRule = types.Pointer("@request.auth.id != ''")
+
+		labs.Fields.Add(
+			&core.TextField{
+				Name:     "name",
+				Required: true,
+				Max:      200,
+			},
+			&core.TextField{
+				Name: "contactName",
+				Max:  200,
+			},
+			&core.TextField{
+				Name: "phone",
+				Max:  50,
+			},
+			&core.EmailField{
+				Name: "email",
+			},
+			&core.RelationField{
+				Name:         "address",
+				CollectionId: addresses.Id,
+			},
+			&core.NumberField{
+				Name:    "defaultTurnaroundDays",
+				Min:     types.Pointer(float64(0)),
+				OnlyInt: true,
+			},
+			&core.BoolField{
+				Name: "isActive",
+			},
+			&core.TextField{
+				Name: "notes",
+				Max:  1000,
+			},
+
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+
+		if err := app.Save(labs); err != nil {
+			return err
+		}
+
+		// ---------------------------------------------------------------------------
+		// 2. lab_cases - Prosthetic work sent to an external lab
+		// ---------------------------------------------------------------------------
+		labCases := core.NewBaseCollection("lab_cases")
+
+		labCases.ListRule = types.Pointer("@request.auth.id != ''")
+		labCases.ViewRule = types.Pointer("@request.auth.id != ''")
+		labCases.CreateRule = types.Pointer("@request.auth.id != ''")
+		labCases.UpdateRule = types.Pointer("@request.auth.id != ''")
+		labCases.DeleteRule = types.Pointer("@request.auth.id != ''")
+
+		labCases.Fields.Add(
+			&core.RelationField{
+				Name:          "patient",
+				Required:      true,
+				CollectionId:  patients.Id,
+				CascadeDelete: true,
+			},
+			&core.RelationField{
+				Name:         "lab",
+				Required:     true,
+				CollectionId: labs.Id,
+			},
+			&core.RelationField{
+				Name:         "dentist",
+				CollectionId: users.Id,
+			},
+			&core.RelationField{
+				Name:         "treatment",
+				CollectionId: treatments.Id,
+			},
+			&core.RelationField{
+				Name:         "treatmentPlanItem",
+				CollectionId: treatmentPlanItems.Id,
+			},
+			&core.SelectField{
+				Name:      "caseType",
+				Required:  true,
+				Values:    []string{"crown", "bridge", "denture", "partial_denture", "implant_crown", "veneer", "inlay_onlay", "night_guard", "other"},
+				MaxSelect: 1,
+			},
+			&core.TextField{
+				Name: "toothNumbers",
+				Max:  100,
+			},
+			&core.TextField{
+				Name: "shade",
+				Max:  20,
+			},
+			&core.TextField{
+				Name: "material",
+				Max:  100,
+			},
+			&core.DateField{
+				Name: "sentDate",
+			},
+			&core.DateField{
+				Name:     "dueDate",
+				Required: true,
+			},
+			&core.DateField{
+				Name: "receivedDate",
+			},
+			&core.DateField{
+				Name: "fittedDate",
+			},
+			&core.SelectField{
+				Name:      "status",
+				Required:  true,
+				Values:    []string{"sent", "received", "fitted", "remake"},
+				MaxSelect: 1,
+			},
+			&core.TextField{
+				Name: "remakeReason",
+				Max:  1000,
+			},
+			&core.TextField{
+				Name: "instructions",
+				Max:  2000,
+			},
+			&core.TextField{
+				Name: "notes",
+				Max:  2000,
+			},
+
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+
+		labCases.Indexes = []string{
+			"CREATE INDEX idx_lab_cases_status_dueDate ON lab_cases (status, dueDate)",
+		}
+
+		if err := app.Save(labCases); err != nil {
+			return err
+		}
+
+		// Link the seating appointment to the lab case it depends on
+		appointments.Fields.Add(
+			&core.RelationField{
+				Name:         "labCase",
+				CollectionId: labCases.Id,
+			},
+		)
+		if err := app.Save(appointments); err != nil {
+			return err
+		}
+
+		// Tasks created by background jobs carry a source key so that a job
+		// running again does not create the same task twice
+		tasks.Fields.Add(
+			&core.TextField{
+				Name: "source",
+				Max:  200,
+			},
+		)
+		tasks.AddIndex("idx_tasks_source", false, "source", "source != ''")
+
+		return app.Save(tasks)
+	}, func(app core.App) error {
+		// Rollback: remove the added fields, then delete collections in reverse order
+		tasks, err := app.FindCollectionByNameOrId("tasks")
+		if err != nil {
+			return err
+		}
+		tasks.RemoveIndex("idx_tasks_source")
+		tasks.Fields.RemoveByName("source")
+		if err := app.Save(tasks); err != nil {
+			return err
+		}
+
+		appointments, err := app.FindCollectionByNameOrId("appointments")
+		if err != nil {
+			return err
+		}
+		appointments.Fields.RemoveByName("labCase")
+		if err := app.Save(appointments); err != nil {
+			return err
+		}
+
+		collections := []string{"lab_cases", "labs"}
+		for _, name := range collections {
+			if err := app.Delete(core.NewBaseCollection(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,189 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// =============================================================================
+		// Recall Collections - Hygiene and continuing-care recall tracking
+		// =============================================================================
+
+		// Get dependencies
+		patients, err := app.FindCollectionByNameOrId("patients")
+		if err != nil {
+			return err
+		}
+
+		treatmentsCatalog, err := app.FindCollectionByNameOrId("treatments_catalog")
+		if err != nil {
+			return err
+		}
+
+		// ---------------------------------------------------------------------------
+		// 1. recall_types - Kinds of recall and their default interval
+		// ---------------------------------------------------------------------------
+		recallTypes := core.NewBaseCollection("recall_types")
+
+		recallTypes.ListRule = types.Pointer("@request.auth.id != ''")
+		recallTypes.ViewRule = types.Pointer("@request.auth.id != ''")
+		recallTypes.CreateRule = types.Pointer("@request.auth.id != ''")
+		recallTypes.UpdateRule = types.Pointer("@request.auth.id != ''")
+		recallTypes.DeleteRule = types.Pointer("@request.auth.id != ''")
+
+		recallTypes.Fields.Add(
+			&core.TextField{
+				Name:     "name",
+				Required: true,
+				Max:      100,
+			},
+			&core.TextField{
+				Name:     "code",
+				Required: true,
+				Max:      50,
+			},
+			&core.NumberField{
+				Name:     "intervalMonths",
+				Required: true,
+				Min:      types.Pointer(float64(1)),
+				OnlyInt:  true,
+			},
+			// completed appointments of these types satisfy the recall
+			&core.SelectField{
+				Name:      "appointmentTypes",
+				Values:    []string{"checkup", "cleaning", "filling", "extraction", "root_canal", "crown", "consultation", "emergency", "other"},
+				MaxSelect: 9,
+			},
+			// completed treatments of these catalog items satisfy the recall
+			&core.RelationField{
+				Name:         "treatmentTypes",
+				CollectionId: treatmentsCatalog.Id,
+				MaxSelect:    999,
+			},
+			&core.BoolField{
+				Name: "isActive",
+			},
+			&core.TextField{
+				Name: "description",
+				Max:  500,
+			},
+
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+
+		recallTypes.Indexes = []string{
+			"CREATE UNIQUE INDEX idx_recall_types_code ON recall_types (code)",
+		}
+
+		if err := app.Save(recallTypes); err != nil {
+			return err
+		}
+
+		// Default recall types
+		defaults := []struct {
+			name             string
+			code             string
+			intervalMonths   int
+			appointmentTypes []string
+		}{
+			{"Hygiene recall", "hygiene", 6, []string{"cleaning"}},
+			{"Periodic exam", "exam", 6, []string{"checkup"}},
+		}
+		for _, d := range defaults {
+			record := core.NewRecord(recallTypes)
+			record.Set("name", d.name)
+			record.Set("code", d.code)
+			record.Set("intervalMonths", d.intervalMonths)
+			record.Set("appointmentTypes", d.appointmentTypes)
+			record.Set("isActive", true)
+			if err := app.Save(record); err != nil {
+				return err
+			}
+		}
+
+		// ---------------------------------------------------------------------------
+		// 2. patient_recalls - Per-patient recall state
+		// ---------------------------------------------------------------------------
+		patientRecalls := core.NewBaseCollection("patient_recalls")
+
+		patientRecalls.ListRule = types.Pointer("@request.auth.id != ''")
+		patientRecalls.ViewRule = types.Pointer("@request.auth.id != ''")
+		patientRecalls.CreateRule = types.Pointer("@request.auth.id != ''")
+		patientRecalls.UpdateRule = types.Pointer("@request.auth.id != ''")
+		patientRecalls.DeleteRule = types.Pointer("@request.auth.id != ''")
+
+		patientRecalls.Fields.Add(
+			&core.RelationField{
+				Name:          "patient",
+				Required:      true,
+				CollectionId:  patients.Id,
+				CascadeDelete: true,
+			},
+			&core.RelationField{
+				Name:          "recallType",
+				Required:      true,
+				CollectionId:  recallTypes.Id,
+				CascadeDelete: true,
+			},
+			// overrides the recall type interval for this patient
+			&core.NumberField{
+				Name:    "intervalMonths",
+				Min:     types.Pointer(float64(1)),
+				OnlyInt: true,
+			},
+			&core.DateField{
+				Name: "lastVisitDate",
+			},
+			&core.DateField{
+				Name: "nextDueDate",
+			},
+			&core.SelectField{
+				Name:      "status",
+				Required:  true,
+				Values:    []string{"active", "paused", "inactive"},
+				MaxSelect: 1,
+			},
+			&core.TextField{
+				Name: "notes",
+				Max:  1000,
+			},
+
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+
+		patientRecalls.Indexes = []string{
+			"CREATE UNIQUE INDEX idx_patient_recalls_patient_recallType ON patient_recalls (patient, recallType)",
+			"CREATE INDEX idx_patient_recalls_status_nextDueDate ON patient_recalls (status, nextDueDate)",
+		}
+
+		return app.Save(patientRecalls)
+	}, func(app core.App) error {
+		// Rollback: delete collections in reverse order
+		collections := []string{"patient_recalls", "recall_types"}
+		for _, name := range collections {
+			if err := app.Delete(core.NewBaseCollection(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,229 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// =============================================================================
+		// Referral Collections - Provider directory and referrals in and out
+		// =============================================================================
+
+		// Get dependencies
+		patients, err := app.FindCollectionByNameOrId("patients")
+		if err != nil {
+			return err
+		}
+
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		addresses, err := app.FindCollectionByNameOrId("addresses")
+		if err != nil {
+			return err
+		}
+
+		appointments, err := app.FindCollectionByNameOrId("appointments")
+		if err != nil {
+			return err
+		}
+
+		imagingRecords, err := app.FindCollectionByNameOrId("imaging_records")
+		if err != nil {
+			return err
+		}
+
+		// ---------------------------------------------------------------------------
+		// 1. providers - External practitioners we refer to or receive from
+		// ---------------------------------------------------------------------------
+		providers := core.NewBaseCollection("providers")
+
+		providers.ListRule = types.Pointer("@request.auth.id != ''")
+		providers.ViewRule = types.Pointer("@request.auth.id != ''")
+		providers.CreateRule = types.Pointer("@request.auth.id != ''")
+		providers.UpdateRule = types.Pointer("@request.auth.id != ''")
+		providers.DeleteRule = types.Pointer("@request.auth.id != ''")
+
+		providers.Fields.Add(
+			&core.TextField{
+				Name:     "name",
+				Required: true,
+				Max:      200,
+			},
+			&core.TextField{
+				Name: "practiceName",
+				Max:  200,
+			},
+			&core.SelectField{
+				Name:      "specialty",
+				Required:  true,
+				Values:    []string{"general_practitioner", "general_dentist", "oral_surgeon", "orthodontist", "endodontist", "periodontist", "prosthodontist", "pediatric_dentist", "radiologist", "other"},
+				MaxSelect: 1,
+			},
+			&core.TextField{
+				Name: "licenseNumber",
+				Max:  100,
+			},
+			&core.TextField{
+				Name: "phone",
+				Max:  50,
+			},
+			&core.TextField{
+				Name: "fax",
+				Max:  50,
+			},
+			&core.EmailField{
+				Name: "email",
+			},
+			&core.RelationField{
+				Name:         "address",
+				CollectionId: addresses.Id,
+			},
+			&core.BoolField{
+				Name: "isActive",
+			},
+			&core.TextField{
+				Name: "notes",
+				Max:  1000,
+			},
+
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+
+		if err := app.Save(providers); err != nil {
+			return err
+		}
+
+		// ---------------------------------------------------------------------------
+		// 2. referrals - Incoming and outgoing patient referrals
+		// ---------------------------------------------------------------------------
+		referrals := core.NewBaseCollection("referrals")
+
+		referrals.ListRule = types.Pointer("@request.auth.id != ''")
+		referrals.ViewRule = types.Pointer("@request.auth.id != ''")
+		referrals.CreateRule = types.Pointer("@request.auth.id != ''")
+		referrals.UpdateRule = types.Pointer("@request.auth.id != ''")
+		referrals.DeleteRule = types.Pointer("@request.auth.id != ''")
+
+		referrals.Fields.Add(
+			&core.RelationField{
+				Name:          "patient",
+				Required:      true,
+				CollectionId:  patients.Id,
+				CascadeDelete: true,
+			},
+			&core.SelectField{
+				Name:      "direction",
+				Required:  true,
+				Values:    []string{"incoming", "outgoing"},
+				MaxSelect: 1,
+			},
+			// required for incoming referrals
+			&core.RelationField{
+				Name:         "referringProvider",
+				CollectionId: providers.Id,
+			},
+			// required for outgoing referrals
+			&core.RelationField{
+				Name:         "receivingProvider",
+				CollectionId: providers.Id,
+			},
+			// the clinic dentist sending or handling the referral
+			&core.RelationField{
+				Name:         "clinician",
+				CollectionId: users.Id,
+			},
+			&core.TextField{
+				Name:     "reason",
+				Required: true,
+				Max:      2000,
+			},
+			&core.TextField{
+				Name: "toothNumbers",
+				Max:  100,
+			},
+			&core.SelectField{
+				Name:      "urgency",
+				Required:  true,
+				Values:    []string{"routine", "urgent", "emergency"},
+				MaxSelect: 1,
+			},
+			&core.SelectField{
+				Name:      "status",
+				Required:  true,
+				Values:    []string{"draft", "sent", "received", "accepted", "scheduled", "completed", "declined", "cancelled"},
+				MaxSelect: 1,
+			},
+			&core.DateField{
+				Name: "referralDate",
+			},
+			&core.RelationField{
+				Name:         "appointment",
+				CollectionId: appointments.Id,
+			},
+			&core.RelationField{
+				Name:         "images",
+				CollectionId: imagingRecords.Id,
+				MaxSelect:    50,
+			},
+			&core.FileField{
+				Name:      "attachments",
+				MaxSelect: 20,
+				MaxSize:   20 << 20,
+				Protected: true,
+			},
+			&core.FileField{
+				Name:      "letter",
+				MaxSelect: 1,
+				MaxSize:   10 << 20,
+				MimeTypes: []string{"application/pdf"},
+				Protected: true,
+			},
+			&core.DateField{
+				Name: "letterGeneratedAt",
+			},
+			&core.TextField{
+				Name: "notes",
+				Max:  2000,
+			},
+
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+
+		referrals.Indexes = []string{
+			"CREATE INDEX idx_referrals_patient ON referrals (patient)",
+		}
+
+		return app.Save(referrals)
+	}, func(app core.App) error {
+		// Rollback: delete collections in reverse order
+		collections := []string{"referrals", "providers"}
+		for _, name := range collections {
+			if err := app.Delete(core.NewBaseCollection(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
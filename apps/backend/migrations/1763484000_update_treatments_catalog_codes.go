@@ -0,0 +1,85 @@
+package migrations
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// =============================================================================
+		// Treatments Catalog - Procedure code sets (CDT...) and code retirement
+		// =============================================================================
+
+		treatmentsCatalog, err := app.FindCollectionByNameOrId("treatments_catalog")
+		if err != nil {
+			return err
+		}
+
+		treatmentsCatalog.Fields.Add(
+			// the code set the code was imported from (e.g. "CDT")
+			&core.TextField{
+				Name: "codeSet",
+				Max:  50,
+			},
+			// retired codes stay in the catalog for the treatments that
+			// reference them but can't be used for new treatments
+			&core.BoolField{
+				Name: "retired",
+			},
+			&core.DateField{
+				Name: "retiredAt",
+			},
+		)
+		if err := app.Save(treatmentsCatalog); err != nil {
+			return err
+		}
+
+		// Normalize the manually typed codes before enforcing uniqueness
+		items, err := app.FindAllRecords(treatmentsCatalog)
+		if err != nil {
+			return err
+		}
+
+		seen := map[string]string{}
+		for _, item := range items {
+			code := strings.ToUpper(strings.Join(strings.Fields(item.GetString("code")), ""))
+			if code == "" {
+				continue
+			}
+			if other, ok := seen[code]; ok {
+				return fmt.Errorf("treatments_catalog records %s and %s share the code %q, fix them before migrating", other, item.Id, code)
+			}
+			seen[code] = item.Id
+
+			if code != item.GetString("code") {
+				if _, err := app.DB().Update(
+					"treatments_catalog",
+					dbx.Params{"code": code},
+					dbx.HashExp{"id": item.Id},
+				).Execute(); err != nil {
+					return err
+				}
+			}
+		}
+
+		treatmentsCatalog.AddIndex("idx_treatments_catalog_code", true, "code", "code != ''")
+
+		return app.Save(treatmentsCatalog)
+	}, func(app core.App) error {
+		// Rollback: remove the added index and fields
+		treatmentsCatalog, err := app.FindCollectionByNameOrId("treatments_catalog")
+		if err != nil {
+			return err
+		}
+		treatmentsCatalog.RemoveIndex("idx_treatments_catalog_code")
+		treatmentsCatalog.Fields.RemoveByName("retiredAt")
+		treatmentsCatalog.Fields.RemoveByName("retired")
+		treatmentsCatalog.Fields.RemoveByName("codeSet")
+		return app.Save(treatmentsCatalog)
+	})
+}
@@ -0,0 +1,195 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// =============================================================================
+		// Fee Schedule Collections - Per insurer and cash plan fees
+		// =============================================================================
+
+		// Get dependencies
+		treatmentsCatalog, err := app.FindCollectionByNameOrId("treatments_catalog")
+		if err != nil {
+			return err
+		}
+
+		patientInsurance, err := app.FindCollectionByNameOrId("patient_insurance")
+		if err != nil {
+			return err
+		}
+
+		invoiceItems, err := app.FindCollectionByNameOrId("invoice_items")
+		if err != nil {
+			return err
+		}
+
+		// ---------------------------------------------------------------------------
+		// 1. fee_schedules - Named price lists (insurer, cash plan...)
+		// ---------------------------------------------------------------------------
+		feeSchedules := core.NewBaseCollection("fee_schedules")
+
+		feeSchedules.ListRule = types.Pointer("@request.auth.id != ''")
+		feeSchedules.ViewRule = types.Pointer("@request.auth.id != ''")
+		feeSchedules.CreateRule = types.Pointer("@request.auth.id != ''")
+		feeSchedules.UpdateRule = types.Pointer("@request.auth.id != ''")
+		feeSchedules.DeleteRule = types.Pointer("@request.auth.id != ''")
+
+		feeSchedules.Fields.Add(
+			&core.TextField{
+				Name:     "name",
+				Required: true,
+				Max:      200,
+			},
+			&core.SelectField{
+				Name:      "type",
+				Required:  true,
+				Values:    []string{"insurance", "cash", "plan"},
+				MaxSelect: 1,
+			},
+			// insurer name, for insurance schedules
+			&core.TextField{
+				Name: "payer",
+				Max:  200,
+			},
+			// the schedule used for patients without a scheduled coverage
+			&core.BoolField{
+				Name: "isDefault",
+			},
+			&core.DateField{
+				Name: "effectiveDate",
+			},
+			&core.DateField{
+				Name: "expirationDate",
+			},
+			&core.TextField{
+				Name: "notes",
+				Max:  1000,
+			},
+
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+
+		feeSchedules.Indexes = []string{
+			"CREATE UNIQUE INDEX idx_fee_schedules_isDefault ON fee_schedules (isDefault) WHERE isDefault = TRUE",
+		}
+
+		if err := app.Save(feeSchedules); err != nil {
+			return err
+		}
+
+		// ---------------------------------------------------------------------------
+		// 2. fee_schedule_entries - Fee of a procedure in a schedule
+		// ---------------------------------------------------------------------------
+		feeScheduleEntries := core.NewBaseCollection("fee_schedule_entries")
+
+		feeScheduleEntries.ListRule = types.Pointer("@request.auth.id != ''")
+		feeScheduleEntries.ViewRule = types.Pointer("@request.auth.id != ''")
+		feeScheduleEntries.CreateRule = types.Pointer("@request.auth.id != ''")
+		feeScheduleEntries.UpdateRule = types.Pointer("@request.auth.id != ''")
+		feeScheduleEntries.DeleteRule = types.Pointer("@request.auth.id != ''")
+
+		feeScheduleEntries.Fields.Add(
+			&core.RelationField{
+				Name:          "feeSchedule",
+				Required:      true,
+				CollectionId:  feeSchedules.Id,
+				CascadeDelete: true,
+			},
+			&core.RelationField{
+				Name:          "treatmentType",
+				Required:      true,
+				CollectionId:  treatmentsCatalog.Id,
+				CascadeDelete: true,
+			},
+			// zero is a valid fee (e.g. exams included in a plan)
+			&core.NumberField{
+				Name: "fee",
+				Min:  types.Pointer(float64(0)),
+			},
+			&core.TextField{
+				Name: "notes",
+				Max:  500,
+			},
+
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+
+		feeScheduleEntries.Indexes = []string{
+			"CREATE UNIQUE INDEX idx_fee_schedule_entries_schedule_treatment ON fee_schedule_entries (feeSchedule, treatmentType)",
+		}
+
+		if err := app.Save(feeScheduleEntries); err != nil {
+			return err
+		}
+
+		// Link coverages to the schedule the insurer pays
+		patientInsurance.Fields.Add(
+			&core.RelationField{
+				Name:         "feeSchedule",
+				CollectionId: feeSchedules.Id,
+			},
+		)
+		if err := app.Save(patientInsurance); err != nil {
+			return err
+		}
+
+		// Invoice items record the billed procedure so it can be priced
+		// (and later claimed) without a completed treatment
+		invoiceItems.Fields.Add(
+			&core.RelationField{
+				Name:         "treatmentType",
+				CollectionId: treatmentsCatalog.Id,
+			},
+		)
+
+		return app.Save(invoiceItems)
+	}, func(app core.App) error {
+		// Rollback: remove the added fields, then delete collections in reverse order
+		invoiceItems, err := app.FindCollectionByNameOrId("invoice_items")
+		if err != nil {
+			return err
+		}
+		invoiceItems.Fields.RemoveByName("treatmentType")
+		if err := app.Save(invoiceItems); err != nil {
+			return err
+		}
+
+		patientInsurance, err := app.FindCollectionByNameOrId("patient_insurance")
+		if err != nil {
+			return err
+		}
+		patientInsurance.Fields.RemoveByName("feeSchedule")
+		if err := app.Save(patientInsurance); err != nil {
+			return err
+		}
+
+		collections := []string{"fee_schedule_entries", "fee_schedules"}
+		for _, name := range collections {
+			if err := app.Delete(core.NewBaseCollection(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
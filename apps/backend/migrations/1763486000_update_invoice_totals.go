@@ -0,0 +1,76 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// =============================================================================
+		// Invoice Totals - Computed server side from the line items
+		// =============================================================================
+
+		invoices, err := app.FindCollectionByNameOrId("invoices")
+		if err != nil {
+			return err
+		}
+
+		// Tax rate (percent) applied to the taxable line items
+		invoices.Fields.Add(
+			&core.NumberField{
+				Name: "taxRate",
+				Min:  types.Pointer(float64(0)),
+				Max:  types.Pointer(float64(100)),
+			},
+		)
+
+		// The totals are computed by the hooks and are zero until the first
+		// line item is added, so they can no longer be required
+		for _, name := range []string{"subtotal", "total"} {
+			if field, ok := invoices.Fields.GetByName(name).(*core.NumberField); ok {
+				field.Required = false
+			}
+		}
+
+		if err := app.Save(invoices); err != nil {
+			return err
+		}
+
+		invoiceItems, err := app.FindCollectionByNameOrId("invoice_items")
+		if err != nil {
+			return err
+		}
+
+		if field, ok := invoiceItems.Fields.GetByName("total").(*core.NumberField); ok {
+			field.Required = false
+		}
+
+		return app.Save(invoiceItems)
+	}, func(app core.App) error {
+		// Rollback: restore the required totals and remove the tax rate
+		invoiceItems, err := app.FindCollectionByNameOrId("invoice_items")
+		if err != nil {
+			return err
+		}
+		if field, ok := invoiceItems.Fields.GetByName("total").(*core.NumberField); ok {
+			field.Required = true
+		}
+		if err := app.Save(invoiceItems); err != nil {
+			return err
+		}
+
+		invoices, err := app.FindCollectionByNameOrId("invoices")
+		if err != nil {
+			return err
+		}
+		for _, name := range []string{"subtotal", "total"} {
+			if field, ok := invoices.Fields.GetByName(name).(*core.NumberField); ok {
+				field.Required = true
+			}
+		}
+		invoices.Fields.RemoveByName("taxRate")
+		return app.Save(invoices)
+	})
+}
@@ -0,0 +1,97 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// =============================================================================
+		// Number Sequences - Gap-free document numbering (invoices...)
+		// =============================================================================
+
+		numberSequences := core.NewBaseCollection("number_sequences")
+
+		// Staff can read the formats; only superusers may change them since
+		// editing a counter could reuse numbers
+		numberSequences.ListRule = types.Pointer("@request.auth.id != ''")
+		numberSequences.ViewRule = types.Pointer("@request.auth.id != ''")
+		numberSequences.CreateRule = nil
+		numberSequences.UpdateRule = nil
+		numberSequences.DeleteRule = nil
+
+		numberSequences.Fields.Add(
+			&core.TextField{
+				Name:     "key",
+				Required: true,
+				Max:      50,
+			},
+			&core.TextField{
+				Name: "prefix",
+				Max:  20,
+			},
+			&core.TextField{
+				Name: "separator",
+				Max:  5,
+			},
+			&core.BoolField{
+				Name: "includeYear",
+			},
+			// minimum number of digits of the counter
+			&core.NumberField{
+				Name:    "padding",
+				Min:     types.Pointer(float64(0)),
+				Max:     types.Pointer(float64(12)),
+				OnlyInt: true,
+			},
+			&core.BoolField{
+				Name: "resetYearly",
+			},
+			// the year of the last assigned number
+			&core.NumberField{
+				Name:    "currentYear",
+				OnlyInt: true,
+			},
+			// the last assigned counter value
+			&core.NumberField{
+				Name:    "lastValue",
+				Min:     types.Pointer(float64(0)),
+				OnlyInt: true,
+			},
+
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+
+		numberSequences.Indexes = []string{
+			"CREATE UNIQUE INDEX idx_number_sequences_key ON number_sequences (key)",
+		}
+
+		if err := app.Save(numberSequences); err != nil {
+			return err
+		}
+
+		// Invoice numbers: INV-2025-00001
+		invoiceSequence := core.NewRecord(numberSequences)
+		invoiceSequence.Set("key", "invoice")
+		invoiceSequence.Set("prefix", "INV")
+		invoiceSequence.Set("separator", "-")
+		invoiceSequence.Set("includeYear", true)
+		invoiceSequence.Set("padding", 5)
+		invoiceSequence.Set("resetYearly", true)
+
+		return app.Save(invoiceSequence)
+	}, func(app core.App) error {
+		// Rollback: delete the collection
+		return app.Delete(core.NewBaseCollection("number_sequences"))
+	})
+}
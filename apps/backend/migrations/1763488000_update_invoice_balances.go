@@ -0,0 +1,79 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// =============================================================================
+		// Invoice Balances - Amount paid and balance due computed from payments
+		// =============================================================================
+
+		invoices, err := app.FindCollectionByNameOrId("invoices")
+		if err != nil {
+			return err
+		}
+
+		invoices.Fields.Add(
+			&core.NumberField{
+				Name: "amountPaid",
+			},
+			// negative when the invoice was overpaid
+			&core.NumberField{
+				Name: "balanceDue",
+			},
+		)
+		if err := app.Save(invoices); err != nil {
+			return err
+		}
+
+		payments, err := app.FindCollectionByNameOrId("payments")
+		if err != nil {
+			return err
+		}
+
+		// Payments above the outstanding balance must be flagged explicitly,
+		// the excess is kept as a credit on the patient account
+		payments.Fields.Add(
+			&core.BoolField{
+				Name: "isOverpayment",
+			},
+		)
+		payments.AddIndex("idx_payments_invoice", false, "invoice", "")
+		if err := app.Save(payments); err != nil {
+			return err
+		}
+
+		// Backfill the existing invoices
+		_, err = app.DB().NewQuery(`
+			UPDATE invoices SET
+				amountPaid = (SELECT COALESCE(SUM(amount), 0) FROM payments WHERE payments.invoice = invoices.id),
+				balanceDue = total
+					- (SELECT COALESCE(SUM(amount), 0) FROM payments WHERE payments.invoice = invoices.id)
+					- MAX(insuranceAmount - (SELECT COALESCE(SUM(amount), 0) FROM payments WHERE payments.invoice = invoices.id AND paymentMethod = 'insurance'), 0)
+		`).Execute()
+
+		return err
+	}, func(app core.App) error {
+		// Rollback: remove the added fields
+		payments, err := app.FindCollectionByNameOrId("payments")
+		if err != nil {
+			return err
+		}
+		payments.RemoveIndex("idx_payments_invoice")
+		payments.Fields.RemoveByName("isOverpayment")
+		if err := app.Save(payments); err != nil {
+			return err
+		}
+
+		invoices, err := app.FindCollectionByNameOrId("invoices")
+		if err != nil {
+			return err
+		}
+		invoices.Fields.RemoveByName("balanceDue")
+		invoices.Fields.RemoveByName("amountPaid")
+		return app.Save(invoices)
+	})
+}
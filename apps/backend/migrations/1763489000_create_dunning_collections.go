@@ -0,0 +1,227 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// =============================================================================
+		// Dunning Collections - Overdue invoice reminders
+		// =============================================================================
+
+		// Get dependencies
+		invoices, err := app.FindCollectionByNameOrId("invoices")
+		if err != nil {
+			return err
+		}
+
+		patients, err := app.FindCollectionByNameOrId("patients")
+		if err != nil {
+			return err
+		}
+
+		// ---------------------------------------------------------------------------
+		// 1. dunning_steps - Reminder sequence for overdue invoices
+		// ---------------------------------------------------------------------------
+		dunningSteps := core.NewBaseCollection("dunning_steps")
+
+		dunningSteps.ListRule = types.Pointer("@request.auth.id != ''")
+		dunningSteps.ViewRule = types.Pointer("@request.auth.id != ''")
+		dunningSteps.CreateRule = types.Pointer("@request.auth.id != ''")
+		dunningSteps.UpdateRule = types.Pointer("@request.auth.id != ''")
+		dunningSteps.DeleteRule = types.Pointer("@request.auth.id != ''")
+
+		dunningSteps.Fields.Add(
+			&core.TextField{
+				Name:     "name",
+				Required: true,
+				Max:      100,
+			},
+			// days after the invoice due date
+			&core.NumberField{
+				Name:     "daysOverdue",
+				Required: true,
+				Min:      types.Pointer(float64(1)),
+				OnlyInt:  true,
+			},
+			&core.SelectField{
+				Name:      "channels",
+				Values:    []string{"email", "sms"},
+				MaxSelect: 2,
+			},
+			// templates placeholders: {PATIENT_NAME}, {INVOICE_NUMBER},
+			// {INVOICE_DATE}, {DUE_DATE}, {DAYS_OVERDUE}, {BALANCE_DUE},
+			// {CLINIC_NAME}
+			&core.TextField{
+				Name: "emailSubject",
+				Max:  200,
+			},
+			&core.EditorField{
+				Name: "emailBody",
+			},
+			&core.TextField{
+				Name: "smsBody",
+				Max:  480,
+			},
+			// raise a billing task for the staff to follow up personally
+			&core.BoolField{
+				Name: "createTask",
+			},
+
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+
+		dunningSteps.Indexes = []string{
+			"CREATE UNIQUE INDEX idx_dunning_steps_daysOverdue ON dunning_steps (daysOverdue)",
+		}
+
+		if err := app.Save(dunningSteps); err != nil {
+			return err
+		}
+
+		// Default sequence
+		defaults := []struct {
+			name        string
+			daysOverdue int
+			subject     string
+			body        string
+			sms         string
+			createTask  bool
+		}{
+			{
+				"First reminder", 7,
+				"Reminder: invoice {INVOICE_NUMBER} is overdue",
+				"<p>Dear {PATIENT_NAME},</p>" +
+					"<p>Our records show that invoice {INVOICE_NUMBER} of {INVOICE_DATE} was due on {DUE_DATE} and has an outstanding balance of {BALANCE_DUE}.</p>" +
+					"<p>If you have already paid, please disregard this message.</p>" +
+					"<p>Kind regards,<br/>{CLINIC_NAME}</p>",
+				"{CLINIC_NAME}: invoice {INVOICE_NUMBER} has an outstanding balance of {BALANCE_DUE}, due on {DUE_DATE}.",
+				false,
+			},
+			{
+				"Second reminder", 30,
+				"Second reminder: invoice {INVOICE_NUMBER} is {DAYS_OVERDUE} days overdue",
+				"<p>Dear {PATIENT_NAME},</p>" +
+					"<p>Invoice {INVOICE_NUMBER} is now {DAYS_OVERDUE} days overdue with an outstanding balance of {BALANCE_DUE}.</p>" +
+					"<p>Please settle it at your earliest convenience or contact us to arrange a payment plan.</p>" +
+					"<p>Kind regards,<br/>{CLINIC_NAME}</p>",
+				"{CLINIC_NAME}: invoice {INVOICE_NUMBER} is {DAYS_OVERDUE} days overdue ({BALANCE_DUE}). Please contact us.",
+				false,
+			},
+			{
+				"Final notice", 60,
+				"Final notice: invoice {INVOICE_NUMBER}",
+				"<p>Dear {PATIENT_NAME},</p>" +
+					"<p>Despite our previous reminders, invoice {INVOICE_NUMBER} remains unpaid with an outstanding balance of {BALANCE_DUE}.</p>" +
+					"<p>Please contact us within 14 days to settle your account.</p>" +
+					"<p>Kind regards,<br/>{CLINIC_NAME}</p>",
+				"{CLINIC_NAME}: final notice for invoice {INVOICE_NUMBER} ({BALANCE_DUE}). Please contact us within 14 days.",
+				true,
+			},
+		}
+		for _, d := range defaults {
+			record := core.NewRecord(dunningSteps)
+			record.Set("name", d.name)
+			record.Set("daysOverdue", d.daysOverdue)
+			record.Set("channels", []string{"email", "sms"})
+			record.Set("emailSubject", d.subject)
+			record.Set("emailBody", d.body)
+			record.Set("smsBody", d.sms)
+			record.Set("createTask", d.createTask)
+			if err := app.Save(record); err != nil {
+				return err
+			}
+		}
+
+		// ---------------------------------------------------------------------------
+		// 2. dunning_logs - Reminders sent for each invoice
+		// ---------------------------------------------------------------------------
+		dunningLogs := core.NewBaseCollection("dunning_logs")
+
+		// Written by the dunning job only
+		dunningLogs.ListRule = types.Pointer("@request.auth.id != ''")
+		dunningLogs.ViewRule = types.Pointer("@request.auth.id != ''")
+		dunningLogs.CreateRule = nil
+		dunningLogs.UpdateRule = nil
+		dunningLogs.DeleteRule = nil
+
+		dunningLogs.Fields.Add(
+			&core.RelationField{
+				Name:          "invoice",
+				Required:      true,
+				CollectionId:  invoices.Id,
+				CascadeDelete: true,
+			},
+			&core.RelationField{
+				Name:          "patient",
+				Required:      true,
+				CollectionId:  patients.Id,
+				CascadeDelete: true,
+			},
+			&core.RelationField{
+				Name:         "step",
+				Required:     true,
+				CollectionId: dunningSteps.Id,
+			},
+			&core.SelectField{
+				Name:      "channel",
+				Required:  true,
+				Values:    []string{"email", "sms"},
+				MaxSelect: 1,
+			},
+			&core.TextField{
+				Name: "recipient",
+				Max:  200,
+			},
+			&core.SelectField{
+				Name:      "status",
+				Required:  true,
+				Values:    []string{"sent", "failed", "skipped"},
+				MaxSelect: 1,
+			},
+			&core.NumberField{
+				Name: "balanceDue",
+			},
+			&core.TextField{
+				Name: "error",
+				Max:  1000,
+			},
+
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+
+		dunningLogs.Indexes = []string{
+			"CREATE UNIQUE INDEX idx_dunning_logs_invoice_step_channel ON dunning_logs (invoice, step, channel)",
+		}
+
+		return app.Save(dunningLogs)
+	}, func(app core.App) error {
+		// Rollback: delete collections in reverse order
+		collections := []string{"dunning_logs", "dunning_steps"}
+		for _, name := range collections {
+			if err := app.Delete(core.NewBaseCollection(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
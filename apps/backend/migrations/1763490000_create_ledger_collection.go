@@ -0,0 +1,227 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// =============================================================================
+		// Ledger Collection - Append-only patient account ledger
+		// =============================================================================
+
+		// Get dependencies
+		patients, err := app.FindCollectionByNameOrId("patients")
+		if err != nil {
+			return err
+		}
+
+		invoices, err := app.FindCollectionByNameOrId("invoices")
+		if err != nil {
+			return err
+		}
+
+		payments, err := app.FindCollectionByNameOrId("payments")
+		if err != nil {
+			return err
+		}
+
+		insuranceClaims, err := app.FindCollectionByNameOrId("insurance_claims")
+		if err != nil {
+			return err
+		}
+
+		// Insurance payments can be recorded against the claim they settle
+		payments.Fields.Add(
+			&core.RelationField{
+				Name:         "insuranceClaim",
+				CollectionId: insuranceClaims.Id,
+			},
+		)
+		if err := app.Save(payments); err != nil {
+			return err
+		}
+
+		ledgerEntries := core.NewBaseCollection("ledger_entries")
+
+		// Append-only: entries are written by the hooks and never changed,
+		// corrections are posted as new entries
+		ledgerEntries.ListRule = types.Pointer("@request.auth.id != ''")
+		ledgerEntries.ViewRule = types.Pointer("@request.auth.id != ''")
+		ledgerEntries.CreateRule = nil
+		ledgerEntries.UpdateRule = nil
+		ledgerEntries.DeleteRule = nil
+
+		ledgerEntries.Fields.Add(
+			&core.RelationField{
+				Name:          "patient",
+				Required:      true,
+				CollectionId:  patients.Id,
+				CascadeDelete: true,
+			},
+			&core.DateField{
+				Name:     "date",
+				Required: true,
+			},
+			&core.SelectField{
+				Name:      "type",
+				Required:  true,
+				Values:    []string{"charge", "payment", "insurance_payment", "adjustment"},
+				MaxSelect: 1,
+			},
+			&core.TextField{
+				Name: "description",
+				Max:  500,
+			},
+			// increases what the patient owes
+			&core.NumberField{
+				Name: "debit",
+				Min:  types.Pointer(float64(0)),
+			},
+			// decreases what the patient owes
+			&core.NumberField{
+				Name: "credit",
+				Min:  types.Pointer(float64(0)),
+			},
+			// the record the entry was posted for, e.g. "payment:<id>"
+			&core.TextField{
+				Name:     "source",
+				Required: true,
+				Max:      100,
+			},
+			&core.RelationField{
+				Name:         "invoice",
+				CollectionId: invoices.Id,
+			},
+			&core.RelationField{
+				Name:         "payment",
+				CollectionId: payments.Id,
+			},
+			&core.RelationField{
+				Name:         "insuranceClaim",
+				CollectionId: insuranceClaims.Id,
+			},
+
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+		)
+
+		ledgerEntries.Indexes = []string{
+			"CREATE INDEX idx_ledger_entries_patient_date ON ledger_entries (patient, date)",
+			"CREATE INDEX idx_ledger_entries_source ON ledger_entries (source)",
+		}
+
+		if err := app.Save(ledgerEntries); err != nil {
+			return err
+		}
+
+		// Backfill the ledger with the existing invoices and payments
+		post := func(patient string, date types.DateTime, entryType string, description string, amount float64, source string, link string, linkId string) error {
+			if amount == 0 {
+				return nil
+			}
+			if date.IsZero() {
+				date = types.NowDateTime()
+			}
+
+			entry := core.NewRecord(ledgerEntries)
+			entry.Set("patient", patient)
+			entry.Set("date", date)
+			entry.Set("type", entryType)
+			entry.Set("description", description)
+			if amount > 0 {
+				entry.Set("debit", amount)
+			} else {
+				entry.Set("credit", -amount)
+			}
+			entry.Set("source", source)
+			entry.Set(link, linkId)
+			return app.Save(entry)
+		}
+
+		existingInvoices, err := app.FindAllRecords(invoices)
+		if err != nil {
+			return err
+		}
+		for _, invoice := range existingInvoices {
+			if status := invoice.GetString("status"); status == "draft" || status == "cancelled" {
+				continue
+			}
+			err := post(
+				invoice.GetString("patient"),
+				invoice.GetDateTime("invoiceDate"),
+				"charge",
+				"Invoice "+invoice.GetString("invoiceNumber"),
+				invoice.GetFloat("total"),
+				"invoice:"+invoice.Id,
+				"invoice",
+				invoice.Id,
+			)
+			if err != nil {
+				return err
+			}
+		}
+
+		existingPayments, err := app.FindAllRecords(payments)
+		if err != nil {
+			return err
+		}
+		for _, payment := range existingPayments {
+			entryType, description := "payment", "Payment ("+payment.GetString("paymentMethod")+")"
+			if payment.GetString("paymentMethod") == "insurance" {
+				entryType, description = "insurance_payment", "Insurance payment"
+			}
+			err := post(
+				payment.GetString("patient"),
+				payment.GetDateTime("paymentDate"),
+				entryType,
+				description,
+				-payment.GetFloat("amount"),
+				"payment:"+payment.Id,
+				"payment",
+				payment.Id,
+			)
+			if err != nil {
+				return err
+			}
+		}
+
+		existingClaims, err := app.FindAllRecords(insuranceClaims)
+		if err != nil {
+			return err
+		}
+		for _, claim := range existingClaims {
+			err := post(
+				claim.GetString("patient"),
+				claim.GetDateTime("paidDate"),
+				"insurance_payment",
+				"Insurance claim "+claim.GetString("claimNumber"),
+				-claim.GetFloat("paidAmount"),
+				"claim:"+claim.Id,
+				"insuranceClaim",
+				claim.Id,
+			)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}, func(app core.App) error {
+		// Rollback: delete the collection, then remove the added field
+		if err := app.Delete(core.NewBaseCollection("ledger_entries")); err != nil {
+			return err
+		}
+
+		payments, err := app.FindCollectionByNameOrId("payments")
+		if err != nil {
+			return err
+		}
+		payments.Fields.RemoveByName("insuranceClaim")
+		return app.Save(payments)
+	})
+}
@@ -0,0 +1,394 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// =============================================================================
+		// Adjustment Collections - Refunds, credit notes and write-offs
+		// =============================================================================
+
+		// Get dependencies
+		patients, err := app.FindCollectionByNameOrId("patients")
+		if err != nil {
+			return err
+		}
+
+		invoices, err := app.FindCollectionByNameOrId("invoices")
+		if err != nil {
+			return err
+		}
+
+		payments, err := app.FindCollectionByNameOrId("payments")
+		if err != nil {
+			return err
+		}
+
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		// ---------------------------------------------------------------------------
+		// 1. refunds - Money returned from a payment
+		// ---------------------------------------------------------------------------
+		refunds := core.NewBaseCollection("refunds")
+
+		// Posted refunds are immutable, only drafts can be changed or deleted
+		refunds.ListRule = types.Pointer("@request.auth.id != ''")
+		refunds.ViewRule = types.Pointer("@request.auth.id != ''")
+		refunds.CreateRule = types.Pointer("@request.auth.id != ''")
+		refunds.UpdateRule = types.Pointer("@request.auth.id != ''")
+		refunds.DeleteRule = types.Pointer("@request.auth.id != ''")
+
+		refunds.Fields.Add(
+			&core.RelationField{
+				Name:         "payment",
+				Required:     true,
+				CollectionId: payments.Id,
+			},
+			// copied from the payment
+			&core.RelationField{
+				Name:         "invoice",
+				CollectionId: invoices.Id,
+			},
+			&core.RelationField{
+				Name:          "patient",
+				Required:      true,
+				CollectionId:  patients.Id,
+				CascadeDelete: true,
+			},
+			&core.NumberField{
+				Name:     "amount",
+				Required: true,
+				Min:      types.Pointer(0.01),
+			},
+			&core.DateField{
+				Name:     "refundDate",
+				Required: true,
+			},
+			&core.SelectField{
+				Name:      "refundMethod",
+				Required:  true,
+				Values:    []string{"cash", "card", "insurance", "check", "transfer"},
+				MaxSelect: 1,
+			},
+			&core.TextField{
+				Name:     "reason",
+				Required: true,
+				Max:      500,
+			},
+			&core.TextField{
+				Name: "reference",
+				Max:  200,
+			},
+			&core.SelectField{
+				Name:      "status",
+				Required:  true,
+				Values:    []string{"draft", "posted"},
+				MaxSelect: 1,
+			},
+			&core.DateField{
+				Name: "postedAt",
+			},
+			&core.RelationField{
+				Name:         "processedBy",
+				CollectionId: users.Id,
+			},
+			&core.TextField{
+				Name: "notes",
+				Max:  1000,
+			},
+
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+
+		refunds.Indexes = []string{
+			"CREATE INDEX idx_refunds_payment ON refunds (payment)",
+			"CREATE INDEX idx_refunds_invoice ON refunds (invoice)",
+		}
+
+		if err := app.Save(refunds); err != nil {
+			return err
+		}
+
+		// ---------------------------------------------------------------------------
+		// 2. credit_notes - Partial or full reversal of an invoice
+		// ---------------------------------------------------------------------------
+		creditNotes := core.NewBaseCollection("credit_notes")
+
+		creditNotes.ListRule = types.Pointer("@request.auth.id != ''")
+		creditNotes.ViewRule = types.Pointer("@request.auth.id != ''")
+		creditNotes.CreateRule = types.Pointer("@request.auth.id != ''")
+		creditNotes.UpdateRule = types.Pointer("@request.auth.id != ''")
+		creditNotes.DeleteRule = types.Pointer("@request.auth.id != ''")
+
+		creditNotes.Fields.Add(
+			// assigned when the credit note is posted
+			&core.TextField{
+				Name: "creditNoteNumber",
+				Max:  50,
+			},
+			&core.RelationField{
+				Name:         "invoice",
+				Required:     true,
+				CollectionId: invoices.Id,
+			},
+			&core.RelationField{
+				Name:          "patient",
+				Required:      true,
+				CollectionId:  patients.Id,
+				CascadeDelete: true,
+			},
+			&core.DateField{
+				Name:     "issueDate",
+				Required: true,
+			},
+			&core.NumberField{
+				Name:     "amount",
+				Required: true,
+				Min:      types.Pointer(0.01),
+			},
+			&core.TextField{
+				Name:     "reason",
+				Required: true,
+				Max:      500,
+			},
+			&core.SelectField{
+				Name:      "status",
+				Required:  true,
+				Values:    []string{"draft", "posted"},
+				MaxSelect: 1,
+			},
+			&core.DateField{
+				Name: "postedAt",
+			},
+			&core.RelationField{
+				Name:         "issuedBy",
+				CollectionId: users.Id,
+			},
+			&core.TextField{
+				Name: "notes",
+				Max:  1000,
+			},
+
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+
+		creditNotes.Indexes = []string{
+			"CREATE UNIQUE INDEX idx_credit_notes_number ON credit_notes (creditNoteNumber) WHERE creditNoteNumber != ''",
+			"CREATE INDEX idx_credit_notes_invoice ON credit_notes (invoice)",
+		}
+
+		if err := app.Save(creditNotes); err != nil {
+			return err
+		}
+
+		// ---------------------------------------------------------------------------
+		// 3. write_offs - Uncollectable balances approved by a dentist
+		// ---------------------------------------------------------------------------
+		writeOffs := core.NewBaseCollection("write_offs")
+
+		writeOffs.ListRule = types.Pointer("@request.auth.id != ''")
+		writeOffs.ViewRule = types.Pointer("@request.auth.id != ''")
+		writeOffs.CreateRule = types.Pointer("@request.auth.id != ''")
+		writeOffs.UpdateRule = types.Pointer("@request.auth.id != ''")
+		writeOffs.DeleteRule = types.Pointer("@request.auth.id != ''")
+
+		writeOffs.Fields.Add(
+			&core.RelationField{
+				Name:         "invoice",
+				Required:     true,
+				CollectionId: invoices.Id,
+			},
+			&core.RelationField{
+				Name:          "patient",
+				Required:      true,
+				CollectionId:  patients.Id,
+				CascadeDelete: true,
+			},
+			&core.NumberField{
+				Name:     "amount",
+				Required: true,
+				Min:      types.Pointer(0.01),
+			},
+			&core.DateField{
+				Name:     "writeOffDate",
+				Required: true,
+			},
+			&core.SelectField{
+				Name:     "reasonCode",
+				Required: true,
+				Values: []string{
+					"bad_debt",
+					"small_balance",
+					"courtesy",
+					"insurance_adjustment",
+					"hardship",
+					"deceased",
+					"bankruptcy",
+					"other",
+				},
+				MaxSelect: 1,
+			},
+			&core.TextField{
+				Name: "reason",
+				Max:  500,
+			},
+			// required to post the write-off
+			&core.RelationField{
+				Name:         "approvedBy",
+				CollectionId: users.Id,
+			},
+			&core.SelectField{
+				Name:      "status",
+				Required:  true,
+				Values:    []string{"draft", "posted"},
+				MaxSelect: 1,
+			},
+			&core.DateField{
+				Name: "postedAt",
+			},
+			&core.TextField{
+				Name: "notes",
+				Max:  1000,
+			},
+
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+
+		writeOffs.Indexes = []string{
+			"CREATE INDEX idx_write_offs_invoice ON write_offs (invoice)",
+		}
+
+		if err := app.Save(writeOffs); err != nil {
+			return err
+		}
+
+		// Invoice balances include the posted adjustments, amountPaid is net
+		// of the refunds
+		invoices.Fields.Add(
+			&core.NumberField{
+				Name: "creditedAmount",
+			},
+			&core.NumberField{
+				Name: "writtenOffAmount",
+			},
+		)
+		if err := app.Save(invoices); err != nil {
+			return err
+		}
+
+		// Ledger entry types of the adjustments
+		ledgerEntries, err := app.FindCollectionByNameOrId("ledger_entries")
+		if err != nil {
+			return err
+		}
+		ledgerType, ok := ledgerEntries.Fields.GetByName("type").(*core.SelectField)
+		if ok {
+			ledgerType.Values = append(ledgerType.Values, "refund", "credit_note", "write_off")
+		}
+		ledgerEntries.Fields.Add(
+			&core.RelationField{
+				Name:         "refund",
+				CollectionId: refunds.Id,
+			},
+			&core.RelationField{
+				Name:         "creditNote",
+				CollectionId: creditNotes.Id,
+			},
+			&core.RelationField{
+				Name:         "writeOff",
+				CollectionId: writeOffs.Id,
+			},
+		)
+		if err := app.Save(ledgerEntries); err != nil {
+			return err
+		}
+
+		// Credit note numbers: CN-2025-00001
+		sequences, err := app.FindCollectionByNameOrId("number_sequences")
+		if err != nil {
+			return err
+		}
+
+		creditNoteSequence := core.NewRecord(sequences)
+		creditNoteSequence.Set("key", "credit_note")
+		creditNoteSequence.Set("prefix", "CN")
+		creditNoteSequence.Set("separator", "-")
+		creditNoteSequence.Set("includeYear", true)
+		creditNoteSequence.Set("padding", 5)
+		creditNoteSequence.Set("resetYearly", true)
+
+		return app.Save(creditNoteSequence)
+	}, func(app core.App) error {
+		// Rollback: remove the added fields, then delete the collections in
+		// reverse order
+		sequence, err := app.FindFirstRecordByData("number_sequences", "key", "credit_note")
+		if err == nil {
+			if err := app.Delete(sequence); err != nil {
+				return err
+			}
+		}
+
+		ledgerEntries, err := app.FindCollectionByNameOrId("ledger_entries")
+		if err != nil {
+			return err
+		}
+		ledgerEntries.Fields.RemoveByName("writeOff")
+		ledgerEntries.Fields.RemoveByName("creditNote")
+		ledgerEntries.Fields.RemoveByName("refund")
+		if ledgerType, ok := ledgerEntries.Fields.GetByName("type").(*core.SelectField); ok {
+			ledgerType.Values = []string{"charge", "payment", "insurance_payment", "adjustment"}
+		}
+		if err := app.Save(ledgerEntries); err != nil {
+			return err
+		}
+
+		invoices, err := app.FindCollectionByNameOrId("invoices")
+		if err != nil {
+			return err
+		}
+		invoices.Fields.RemoveByName("writtenOffAmount")
+		invoices.Fields.RemoveByName("creditedAmount")
+		if err := app.Save(invoices); err != nil {
+			return err
+		}
+
+		collections := []string{"write_offs", "credit_notes", "refunds"}
+		for _, name := range collections {
+			if err := app.Delete(core.NewBaseCollection(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,246 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// =============================================================================
+		// Payment Plan Collections - Instalment schedules
+		// =============================================================================
+
+		// Get dependencies
+		patients, err := app.FindCollectionByNameOrId("patients")
+		if err != nil {
+			return err
+		}
+
+		invoices, err := app.FindCollectionByNameOrId("invoices")
+		if err != nil {
+			return err
+		}
+
+		treatmentPlans, err := app.FindCollectionByNameOrId("treatment_plans")
+		if err != nil {
+			return err
+		}
+
+		payments, err := app.FindCollectionByNameOrId("payments")
+		if err != nil {
+			return err
+		}
+
+		// ---------------------------------------------------------------------------
+		// 1. payment_plans - Agreement to pay an invoice or treatment plan over time
+		// ---------------------------------------------------------------------------
+		paymentPlans := core.NewBaseCollection("payment_plans")
+
+		paymentPlans.ListRule = types.Pointer("@request.auth.id != ''")
+		paymentPlans.ViewRule = types.Pointer("@request.auth.id != ''")
+		paymentPlans.CreateRule = types.Pointer("@request.auth.id != ''")
+		paymentPlans.UpdateRule = types.Pointer("@request.auth.id != ''")
+		paymentPlans.DeleteRule = types.Pointer("@request.auth.id != ''")
+
+		paymentPlans.Fields.Add(
+			&core.RelationField{
+				Name:          "patient",
+				Required:      true,
+				CollectionId:  patients.Id,
+				CascadeDelete: true,
+			},
+			// one of invoice or treatmentPlan is required
+			&core.RelationField{
+				Name:         "invoice",
+				CollectionId: invoices.Id,
+			},
+			&core.RelationField{
+				Name:         "treatmentPlan",
+				CollectionId: treatmentPlans.Id,
+			},
+			// defaults to the invoice balance or the treatment plan estimate
+			&core.NumberField{
+				Name: "totalAmount",
+				Min:  types.Pointer(float64(0)),
+			},
+			// due on the start date, before the instalments
+			&core.NumberField{
+				Name: "downPayment",
+				Min:  types.Pointer(float64(0)),
+			},
+			&core.NumberField{
+				Name:     "numberOfInstalments",
+				Required: true,
+				Min:      types.Pointer(float64(1)),
+				Max:      types.Pointer(float64(120)),
+				OnlyInt:  true,
+			},
+			&core.SelectField{
+				Name:      "frequency",
+				Required:  true,
+				Values:    []string{"weekly", "biweekly", "monthly"},
+				MaxSelect: 1,
+			},
+			&core.DateField{
+				Name:     "startDate",
+				Required: true,
+			},
+			// days after the due date before an instalment is missed
+			&core.NumberField{
+				Name:    "graceDays",
+				Min:     types.Pointer(float64(0)),
+				OnlyInt: true,
+			},
+			&core.SelectField{
+				Name:      "status",
+				Required:  true,
+				Values:    []string{"active", "completed", "defaulted", "cancelled"},
+				MaxSelect: 1,
+			},
+			&core.NumberField{
+				Name: "amountPaid",
+			},
+			&core.NumberField{
+				Name: "balanceDue",
+			},
+			&core.TextField{
+				Name: "notes",
+				Max:  1000,
+			},
+
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+
+		paymentPlans.Indexes = []string{
+			"CREATE INDEX idx_payment_plans_invoice ON payment_plans (invoice)",
+		}
+
+		if err := app.Save(paymentPlans); err != nil {
+			return err
+		}
+
+		// ---------------------------------------------------------------------------
+		// 2. payment_plan_instalments - Generated schedule of a payment plan
+		// ---------------------------------------------------------------------------
+		instalments := core.NewBaseCollection("payment_plan_instalments")
+
+		// Generated from the plan and allocated from its payments
+		instalments.ListRule = types.Pointer("@request.auth.id != ''")
+		instalments.ViewRule = types.Pointer("@request.auth.id != ''")
+		instalments.CreateRule = nil
+		instalments.UpdateRule = nil
+		instalments.DeleteRule = nil
+
+		instalments.Fields.Add(
+			&core.RelationField{
+				Name:          "paymentPlan",
+				Required:      true,
+				CollectionId:  paymentPlans.Id,
+				CascadeDelete: true,
+			},
+			&core.RelationField{
+				Name:          "patient",
+				Required:      true,
+				CollectionId:  patients.Id,
+				CascadeDelete: true,
+			},
+			// 0 for the down payment
+			&core.NumberField{
+				Name:    "sequence",
+				Min:     types.Pointer(float64(0)),
+				OnlyInt: true,
+			},
+			&core.DateField{
+				Name:     "dueDate",
+				Required: true,
+			},
+			&core.NumberField{
+				Name: "amount",
+				Min:  types.Pointer(float64(0)),
+			},
+			&core.NumberField{
+				Name: "amountPaid",
+				Min:  types.Pointer(float64(0)),
+			},
+			&core.SelectField{
+				Name:      "status",
+				Required:  true,
+				Values:    []string{"pending", "partial", "paid", "missed"},
+				MaxSelect: 1,
+			},
+			&core.DateField{
+				Name: "paidDate",
+			},
+			&core.DateField{
+				Name: "missedAt",
+			},
+
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+
+		instalments.Indexes = []string{
+			"CREATE UNIQUE INDEX idx_payment_plan_instalments_sequence ON payment_plan_instalments (paymentPlan, sequence)",
+			"CREATE INDEX idx_payment_plan_instalments_due ON payment_plan_instalments (status, dueDate)",
+		}
+
+		if err := app.Save(instalments); err != nil {
+			return err
+		}
+
+		// Payments can be made towards a payment plan, before the treatment
+		// is invoiced: the invoice is then optional
+		payments.Fields.Add(
+			&core.RelationField{
+				Name:         "paymentPlan",
+				CollectionId: paymentPlans.Id,
+			},
+		)
+		if invoice, ok := payments.Fields.GetByName("invoice").(*core.RelationField); ok {
+			invoice.Required = false
+		}
+		payments.AddIndex("idx_payments_paymentPlan", false, "paymentPlan", "")
+
+		return app.Save(payments)
+	}, func(app core.App) error {
+		// Rollback: remove the added fields, then delete the collections in
+		// reverse order
+		payments, err := app.FindCollectionByNameOrId("payments")
+		if err != nil {
+			return err
+		}
+		payments.RemoveIndex("idx_payments_paymentPlan")
+		payments.Fields.RemoveByName("paymentPlan")
+		if invoice, ok := payments.Fields.GetByName("invoice").(*core.RelationField); ok {
+			invoice.Required = true
+		}
+		if err := app.Save(payments); err != nil {
+			return err
+		}
+
+		collections := []string{"payment_plan_instalments", "payment_plans"}
+		for _, name := range collections {
+			if err := app.Delete(core.NewBaseCollection(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,101 @@
+package migrations
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"zahrawiclinic.com/money"
+)
+
+// moneyFields are the monetary fields converted to minor units. The item
+// discount (a percentage or a fixed amount) and the tax and coverage rates
+// aren't amounts and keep their decimal values.
+var moneyFields = map[string][]string{
+	"patient_insurance":        {"annualMaximum", "deductible", "deductibleMet"},
+	"treatments_catalog":       {"default_price"},
+	"treatments":               {"actualCost"},
+	"treatment_plans":          {"estimatedCost"},
+	"treatment_plan_items":     {"estimatedCost"},
+	"invoices":                 {"subtotal", "tax", "discount", "total", "insuranceAmount", "amountPaid", "balanceDue", "creditedAmount", "writtenOffAmount"},
+	"invoice_items":            {"unitPrice", "total", "taxAmount"},
+	"payments":                 {"amount"},
+	"insurance_claims":         {"claimedAmount", "approvedAmount", "paidAmount", "deniedAmount", "patientResponsibility"},
+	"inventory":                {"costPrice", "sellingPrice"},
+	"fee_schedule_entries":     {"fee"},
+	"dunning_logs":             {"balanceDue"},
+	"ledger_entries":           {"debit", "credit"},
+	"refunds":                  {"amount"},
+	"credit_notes":             {"amount"},
+	"write_offs":               {"amount"},
+	"payment_plans":            {"totalAmount", "downPayment", "amountPaid", "balanceDue"},
+	"payment_plan_instalments": {"amount", "amountPaid"},
+}
+
+func init() {
+	m.Register(func(app core.App) error {
+		// =============================================================================
+		// Money - Monetary fields stored as integer minor units (cents)
+		// =============================================================================
+
+		// the existing amounts are all in the clinic currency, converted
+		// to its minor units as the money package reads them
+		return convertMoneyFields(app, true, minorUnitsFactor(), "CAST(ROUND([[%s]] * {:factor}) AS INTEGER)")
+	}, func(app core.App) error {
+		// Rollback: back to decimal amounts
+		return convertMoneyFields(app, false, 1/minorUnitsFactor(), "[[%s]] / {:divisor}")
+	})
+}
+
+// minorUnitsFactor is the number of minor units in a unit of the clinic
+// currency (CLINIC_CURRENCY), e.g. 100 for USD, 1000 for KWD or 1 for JPY.
+func minorUnitsFactor() float64 {
+	return math.Pow10(money.Default().Digits)
+}
+
+// convertMoneyFields scales the monetary fields limits and stored amounts
+// by the factor with the given SQL expression.
+func convertMoneyFields(app core.App, onlyInt bool, factor float64, expr string) error {
+	for name, fields := range moneyFields {
+		collection, err := app.FindCollectionByNameOrId(name)
+		if err != nil {
+			return err
+		}
+
+		for _, fieldName := range fields {
+			field, ok := collection.Fields.GetByName(fieldName).(*core.NumberField)
+			if !ok {
+				continue
+			}
+
+			field.OnlyInt = onlyInt
+			if field.Min != nil {
+				field.Min = types.Pointer(math.Round(*field.Min*factor*100) / 100)
+			}
+			if field.Max != nil {
+				field.Max = types.Pointer(math.Round(*field.Max*factor*100) / 100)
+			}
+
+			_, err := app.DB().Update(
+				name,
+				dbx.Params{fieldName: dbx.NewExp(
+					fmt.Sprintf(expr, fieldName),
+					dbx.Params{"factor": factor, "divisor": 1 / factor},
+				)},
+				dbx.NewExp("[["+fieldName+"]] IS NOT NULL"),
+			).Execute()
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := app.Save(collection); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// =============================================================================
+		// Insurance Benefits - Used benefits and deductible met per benefit year
+		// =============================================================================
+
+		patientInsurance, err := app.FindCollectionByNameOrId("patient_insurance")
+		if err != nil {
+			return err
+		}
+
+		patientInsurance.Fields.Add(
+			// paid by the insurer in the current benefit year, in minor units
+			&core.NumberField{
+				Name:    "benefitsUsed",
+				Min:     types.Pointer(float64(0)),
+				OnlyInt: true,
+			},
+			// month the benefit year starts (January when empty)
+			&core.NumberField{
+				Name:    "benefitYearStartMonth",
+				Min:     types.Pointer(float64(1)),
+				Max:     types.Pointer(float64(12)),
+				OnlyInt: true,
+			},
+		)
+		if err := app.Save(patientInsurance); err != nil {
+			return err
+		}
+
+		insuranceClaims, err := app.FindCollectionByNameOrId("insurance_claims")
+		if err != nil {
+			return err
+		}
+
+		// Deductible applied by the insurer on the claim (from the EOB), in
+		// minor units
+		insuranceClaims.Fields.Add(
+			&core.NumberField{
+				Name:    "deductibleApplied",
+				Min:     types.Pointer(float64(0)),
+				OnlyInt: true,
+			},
+		)
+		insuranceClaims.AddIndex("idx_insurance_claims_insurance", false, "insurance", "")
+		if err := app.Save(insuranceClaims); err != nil {
+			return err
+		}
+
+		// Backfill the benefits paid in the current calendar year
+		_, err = app.DB().NewQuery(`
+			UPDATE patient_insurance SET benefitsUsed = (
+				SELECT COALESCE(SUM(paidAmount), 0) FROM insurance_claims
+				WHERE insurance_claims.insurance = patient_insurance.id
+					AND insurance_claims.claimDate >= strftime('%Y-01-01', 'now')
+			)
+		`).Execute()
+
+		return err
+	}, func(app core.App) error {
+		// Rollback: remove the added fields
+		insuranceClaims, err := app.FindCollectionByNameOrId("insurance_claims")
+		if err != nil {
+			return err
+		}
+		insuranceClaims.RemoveIndex("idx_insurance_claims_insurance")
+		insuranceClaims.Fields.RemoveByName("deductibleApplied")
+		if err := app.Save(insuranceClaims); err != nil {
+			return err
+		}
+
+		patientInsurance, err := app.FindCollectionByNameOrId("patient_insurance")
+		if err != nil {
+			return err
+		}
+		patientInsurance.Fields.RemoveByName("benefitYearStartMonth")
+		patientInsurance.Fields.RemoveByName("benefitsUsed")
+		return app.Save(patientInsurance)
+	})
+}
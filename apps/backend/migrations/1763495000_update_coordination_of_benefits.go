@@ -0,0 +1,66 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// =============================================================================
+		// Coordination of Benefits - Secondary claims computed from the primary EOB
+		// =============================================================================
+
+		patientInsurance, err := app.FindCollectionByNameOrId("patient_insurance")
+		if err != nil {
+			return err
+		}
+
+		// How a secondary coverage accounts for the primary payment
+		// (standard when empty)
+		patientInsurance.Fields.Add(
+			&core.SelectField{
+				Name:      "cobRule",
+				Values:    []string{"standard", "non_duplication", "carve_out"},
+				MaxSelect: 1,
+			},
+		)
+		if err := app.Save(patientInsurance); err != nil {
+			return err
+		}
+
+		insuranceClaims, err := app.FindCollectionByNameOrId("insurance_claims")
+		if err != nil {
+			return err
+		}
+
+		// Secondary claims link the primary claim they coordinate with
+		insuranceClaims.Fields.Add(
+			&core.RelationField{
+				Name:         "primaryClaim",
+				CollectionId: insuranceClaims.Id,
+			},
+		)
+		insuranceClaims.AddIndex("idx_insurance_claims_primaryClaim", false, "primaryClaim", "")
+
+		return app.Save(insuranceClaims)
+	}, func(app core.App) error {
+		// Rollback: remove the added fields
+		insuranceClaims, err := app.FindCollectionByNameOrId("insurance_claims")
+		if err != nil {
+			return err
+		}
+		insuranceClaims.RemoveIndex("idx_insurance_claims_primaryClaim")
+		insuranceClaims.Fields.RemoveByName("primaryClaim")
+		if err := app.Save(insuranceClaims); err != nil {
+			return err
+		}
+
+		patientInsurance, err := app.FindCollectionByNameOrId("patient_insurance")
+		if err != nil {
+			return err
+		}
+		patientInsurance.Fields.RemoveByName("cobRule")
+		return app.Save(patientInsurance)
+	})
+}
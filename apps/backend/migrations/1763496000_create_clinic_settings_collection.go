@@ -0,0 +1,168 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// =============================================================================
+		// Clinic Settings - Clinic identity used on claims and printed documents
+		// =============================================================================
+
+		// A single record, seeded below
+		clinicSettings := core.NewBaseCollection("clinic_settings")
+
+		clinicSettings.ListRule = types.Pointer("@request.auth.id != ''")
+		clinicSettings.ViewRule = types.Pointer("@request.auth.id != ''")
+		clinicSettings.CreateRule = nil
+		clinicSettings.UpdateRule = types.Pointer("@request.auth.id != ''")
+		clinicSettings.DeleteRule = nil
+
+		clinicSettings.Fields.Add(
+			&core.TextField{
+				Name:     "name",
+				Required: true,
+				Max:      200,
+			},
+			// billing provider National Provider Identifier
+			&core.TextField{
+				Name:    "npi",
+				Pattern: `^\d{10}$`,
+			},
+			&core.TextField{
+				Name: "taxId",
+				Max:  20,
+			},
+			&core.TextField{
+				Name: "address",
+				Max:  200,
+			},
+			&core.TextField{
+				Name: "city",
+				Max:  100,
+			},
+			&core.TextField{
+				Name: "state",
+				Max:  50,
+			},
+			&core.TextField{
+				Name: "postalCode",
+				Max:  20,
+			},
+			&core.TextField{
+				Name: "phone",
+				Max:  50,
+			},
+			&core.EmailField{
+				Name: "email",
+			},
+			// clearinghouse identifiers of the X12 interchanges
+			&core.TextField{
+				Name: "x12SenderId",
+				Max:  15,
+			},
+			&core.TextField{
+				Name: "x12ReceiverId",
+				Max:  15,
+			},
+			&core.TextField{
+				Name: "x12ReceiverName",
+				Max:  60,
+			},
+
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+
+		if err := app.Save(clinicSettings); err != nil {
+			return err
+		}
+
+		settings := core.NewRecord(clinicSettings)
+		settings.Set("name", app.Settings().Meta.AppName)
+		if err := app.Save(settings); err != nil {
+			return err
+		}
+
+		// Payer identifiers of the clearinghouse
+		patientInsurance, err := app.FindCollectionByNameOrId("patient_insurance")
+		if err != nil {
+			return err
+		}
+		patientInsurance.Fields.Add(
+			&core.TextField{
+				Name: "payerId",
+				Max:  80,
+			},
+		)
+		if err := app.Save(patientInsurance); err != nil {
+			return err
+		}
+
+		// Rendering provider National Provider Identifier
+		staff, err := app.FindCollectionByNameOrId("staff")
+		if err != nil {
+			return err
+		}
+		staff.Fields.Add(
+			&core.TextField{
+				Name:    "npi",
+				Pattern: `^\d{10}$`,
+			},
+		)
+		if err := app.Save(staff); err != nil {
+			return err
+		}
+
+		// X12 interchange control numbers: 000000001
+		sequences, err := app.FindCollectionByNameOrId("number_sequences")
+		if err != nil {
+			return err
+		}
+
+		interchangeSequence := core.NewRecord(sequences)
+		interchangeSequence.Set("key", "x12_interchange")
+		interchangeSequence.Set("padding", 9)
+
+		return app.Save(interchangeSequence)
+	}, func(app core.App) error {
+		// Rollback: remove the added fields and sequence, then delete the
+		// collection
+		sequence, err := app.FindFirstRecordByData("number_sequences", "key", "x12_interchange")
+		if err == nil {
+			if err := app.Delete(sequence); err != nil {
+				return err
+			}
+		}
+
+		staff, err := app.FindCollectionByNameOrId("staff")
+		if err != nil {
+			return err
+		}
+		staff.Fields.RemoveByName("npi")
+		if err := app.Save(staff); err != nil {
+			return err
+		}
+
+		patientInsurance, err := app.FindCollectionByNameOrId("patient_insurance")
+		if err != nil {
+			return err
+		}
+		patientInsurance.Fields.RemoveByName("payerId")
+		if err := app.Save(patientInsurance); err != nil {
+			return err
+		}
+
+		return app.Delete(core.NewBaseCollection("clinic_settings"))
+	})
+}
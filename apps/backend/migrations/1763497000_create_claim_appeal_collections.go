@@ -0,0 +1,245 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// =============================================================================
+		// Claim Appeal Collections - Denial reason codes and claim appeals
+		// =============================================================================
+
+		// Get dependencies
+		insuranceClaims, err := app.FindCollectionByNameOrId("insurance_claims")
+		if err != nil {
+			return err
+		}
+
+		patients, err := app.FindCollectionByNameOrId("patients")
+		if err != nil {
+			return err
+		}
+
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		// ---------------------------------------------------------------------------
+		// 1. denial_reasons - Claim adjustment reason codes (CARC)
+		// ---------------------------------------------------------------------------
+		denialReasons := core.NewBaseCollection("denial_reasons")
+
+		denialReasons.ListRule = types.Pointer("@request.auth.id != ''")
+		denialReasons.ViewRule = types.Pointer("@request.auth.id != ''")
+		denialReasons.CreateRule = types.Pointer("@request.auth.id != ''")
+		denialReasons.UpdateRule = types.Pointer("@request.auth.id != ''")
+		denialReasons.DeleteRule = types.Pointer("@request.auth.id != ''")
+
+		denialReasons.Fields.Add(
+			// the reason code of the remittances, e.g. "50"
+			&core.TextField{
+				Name:     "code",
+				Required: true,
+				Max:      10,
+			},
+			&core.TextField{
+				Name:     "description",
+				Required: true,
+				Max:      500,
+			},
+			&core.SelectField{
+				Name:      "category",
+				Required:  true,
+				Values:    []string{"eligibility", "coverage", "coding", "documentation", "authorization", "medical_necessity", "duplicate", "timely_filing", "other"},
+				MaxSelect: 1,
+			},
+			&core.BoolField{
+				Name: "appealable",
+			},
+			// days after the claim was processed during which the payer
+			// accepts an appeal (no limit when empty)
+			&core.NumberField{
+				Name:    "appealWindowDays",
+				Min:     types.Pointer(float64(0)),
+				OnlyInt: true,
+			},
+
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+
+		denialReasons.Indexes = []string{
+			"CREATE UNIQUE INDEX idx_denial_reasons_code ON denial_reasons (code)",
+		}
+
+		if err := app.Save(denialReasons); err != nil {
+			return err
+		}
+
+		// Common dental denial reasons
+		defaults := []struct {
+			code        string
+			description string
+			category    string
+			appealable  bool
+		}{
+			{"4", "The procedure code is inconsistent with the modifier used", "coding", true},
+			{"11", "The diagnosis is inconsistent with the procedure", "coding", true},
+			{"16", "Claim/service lacks information or has submission/billing error(s)", "documentation", true},
+			{"18", "Exact duplicate claim/service", "duplicate", false},
+			{"27", "Expenses incurred after coverage terminated", "eligibility", true},
+			{"29", "The time limit for filing has expired", "timely_filing", true},
+			{"50", "Non-covered service because it is not deemed a medical necessity by the payer", "medical_necessity", true},
+			{"96", "Non-covered charge(s)", "coverage", true},
+			{"97", "The benefit for this service is included in the payment/allowance for another service", "coding", true},
+			{"119", "Benefit maximum for this time period or occurrence has been reached", "coverage", false},
+			{"197", "Precertification/authorization/notification/pre-treatment absent", "authorization", true},
+			{"204", "This service/equipment/drug is not covered under the patient's current benefit plan", "coverage", true},
+		}
+		for _, d := range defaults {
+			record := core.NewRecord(denialReasons)
+			record.Set("code", d.code)
+			record.Set("description", d.description)
+			record.Set("category", d.category)
+			record.Set("appealable", d.appealable)
+			if d.appealable {
+				record.Set("appealWindowDays", 180)
+			}
+			if err := app.Save(record); err != nil {
+				return err
+			}
+		}
+
+		// Reason codes of the denied amount, the free text denialReason
+		// keeps the details
+		insuranceClaims.Fields.Add(
+			&core.RelationField{
+				Name:         "denialReasons",
+				CollectionId: denialReasons.Id,
+				MaxSelect:    20,
+			},
+		)
+		if err := app.Save(insuranceClaims); err != nil {
+			return err
+		}
+
+		// ---------------------------------------------------------------------------
+		// 2. claim_appeals - Appeals of denied claims
+		// ---------------------------------------------------------------------------
+		claimAppeals := core.NewBaseCollection("claim_appeals")
+
+		// Appeals are filed with POST /api/clinic/claims/{id}/appeals, which
+		// snapshots the claim and creates the follow-up task
+		claimAppeals.ListRule = types.Pointer("@request.auth.id != ''")
+		claimAppeals.ViewRule = types.Pointer("@request.auth.id != ''")
+		claimAppeals.CreateRule = nil
+		claimAppeals.UpdateRule = types.Pointer("@request.auth.id != ''")
+		claimAppeals.DeleteRule = nil
+
+		claimAppeals.Fields.Add(
+			&core.RelationField{
+				Name:          "claim",
+				Required:      true,
+				CollectionId:  insuranceClaims.Id,
+				CascadeDelete: true,
+			},
+			// copied from the claim
+			&core.RelationField{
+				Name:          "patient",
+				Required:      true,
+				CollectionId:  patients.Id,
+				CascadeDelete: true,
+			},
+			// 1 for the first appeal of the claim, 2 for the second...
+			&core.NumberField{
+				Name:     "level",
+				Required: true,
+				Min:      types.Pointer(float64(1)),
+				OnlyInt:  true,
+			},
+			&core.DateField{
+				Name:     "appealDate",
+				Required: true,
+			},
+			&core.SelectField{
+				Name:      "status",
+				Required:  true,
+				Values:    []string{"pending", "approved", "denied"},
+				MaxSelect: 1,
+			},
+			&core.TextField{
+				Name:     "reason",
+				Required: true,
+				Max:      5000,
+			},
+			// the claim as it was when appealed
+			&core.JSONField{
+				Name: "snapshot",
+			},
+			&core.FileField{
+				Name:      "documents",
+				MaxSelect: 20,
+				MaxSize:   20 << 20,
+				Protected: true,
+			},
+			&core.DateField{
+				Name: "followUpDate",
+			},
+			&core.DateField{
+				Name: "decisionDate",
+			},
+			&core.TextField{
+				Name: "decisionNotes",
+				Max:  2000,
+			},
+			&core.RelationField{
+				Name:         "submittedBy",
+				CollectionId: users.Id,
+			},
+
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+
+		claimAppeals.Indexes = []string{
+			"CREATE INDEX idx_claim_appeals_claim ON claim_appeals (claim)",
+		}
+
+		return app.Save(claimAppeals)
+	}, func(app core.App) error {
+		// Rollback: delete the appeals, remove the claim reasons, then delete
+		// the reasons
+		if err := app.Delete(core.NewBaseCollection("claim_appeals")); err != nil {
+			return err
+		}
+
+		insuranceClaims, err := app.FindCollectionByNameOrId("insurance_claims")
+		if err != nil {
+			return err
+		}
+		insuranceClaims.Fields.RemoveByName("denialReasons")
+		if err := app.Save(insuranceClaims); err != nil {
+			return err
+		}
+
+		return app.Delete(core.NewBaseCollection("denial_reasons"))
+	})
+}
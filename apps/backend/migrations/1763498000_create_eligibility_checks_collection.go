@@ -0,0 +1,143 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// =============================================================================
+		// Eligibility Checks - Insurance coverage verified with the payers
+		// =============================================================================
+
+		// Get dependencies
+		patients, err := app.FindCollectionByNameOrId("patients")
+		if err != nil {
+			return err
+		}
+
+		patientInsurance, err := app.FindCollectionByNameOrId("patient_insurance")
+		if err != nil {
+			return err
+		}
+
+		appointments, err := app.FindCollectionByNameOrId("appointments")
+		if err != nil {
+			return err
+		}
+
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		eligibilityChecks := core.NewBaseCollection("eligibility_checks")
+
+		// Written by the eligibility route and job only
+		eligibilityChecks.ListRule = types.Pointer("@request.auth.id != ''")
+		eligibilityChecks.ViewRule = types.Pointer("@request.auth.id != ''")
+		eligibilityChecks.CreateRule = nil
+		eligibilityChecks.UpdateRule = nil
+		eligibilityChecks.DeleteRule = nil
+
+		eligibilityChecks.Fields.Add(
+			&core.RelationField{
+				Name:          "patient",
+				Required:      true,
+				CollectionId:  patients.Id,
+				CascadeDelete: true,
+			},
+			&core.RelationField{
+				Name:          "insurance",
+				Required:      true,
+				CollectionId:  patientInsurance.Id,
+				CascadeDelete: true,
+			},
+			// the appointment the coverage was checked for, if any
+			&core.RelationField{
+				Name:         "appointment",
+				CollectionId: appointments.Id,
+			},
+			&core.DateField{
+				Name:     "serviceDate",
+				Required: true,
+			},
+			// the checker that answered, e.g. "http"
+			&core.TextField{
+				Name: "provider",
+				Max:  50,
+			},
+			// expired and inactive policies are flagged without asking the
+			// payer, error when the payer couldn't be reached
+			&core.SelectField{
+				Name:      "status",
+				Required:  true,
+				Values:    []string{"active", "inactive", "expired", "error"},
+				MaxSelect: 1,
+			},
+			&core.TextField{
+				Name: "planName",
+				Max:  200,
+			},
+			&core.DateField{
+				Name: "coverageStart",
+			},
+			&core.DateField{
+				Name: "coverageEnd",
+			},
+			// in minor units, empty when not reported by the payer
+			&core.NumberField{
+				Name:    "remainingMaximum",
+				OnlyInt: true,
+			},
+			&core.NumberField{
+				Name:    "remainingDeductible",
+				OnlyInt: true,
+			},
+			// [{"code": "D1110", "description": ..., "limit": 2, "period":
+			// "benefit_year", "used": 1, "nextEligibleDate": ...}]
+			&core.JSONField{
+				Name: "frequencyLimits",
+			},
+			&core.TextField{
+				Name: "message",
+				Max:  2000,
+			},
+			// the payer response as received
+			&core.JSONField{
+				Name:    "response",
+				MaxSize: 1 << 20,
+			},
+			&core.TextField{
+				Name: "error",
+				Max:  1000,
+			},
+			&core.RelationField{
+				Name:         "checkedBy",
+				CollectionId: users.Id,
+			},
+
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+
+		eligibilityChecks.Indexes = []string{
+			"CREATE INDEX idx_eligibility_checks_insurance ON eligibility_checks (insurance)",
+			"CREATE INDEX idx_eligibility_checks_appointment ON eligibility_checks (appointment)",
+		}
+
+		return app.Save(eligibilityChecks)
+	}, func(app core.App) error {
+		// Rollback: delete the collection
+		return app.Delete(core.NewBaseCollection("eligibility_checks"))
+	})
+}
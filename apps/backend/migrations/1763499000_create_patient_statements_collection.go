@@ -0,0 +1,144 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// =============================================================================
+		// Patient Statements - Monthly account statements sent to the patients
+		// =============================================================================
+
+		// Get dependencies
+		patients, err := app.FindCollectionByNameOrId("patients")
+		if err != nil {
+			return err
+		}
+
+		statements := core.NewBaseCollection("patient_statements")
+
+		// Written by the statements route and command only
+		statements.ListRule = types.Pointer("@request.auth.id != ''")
+		statements.ViewRule = types.Pointer("@request.auth.id != ''")
+		statements.CreateRule = nil
+		statements.UpdateRule = nil
+		statements.DeleteRule = nil
+
+		statements.Fields.Add(
+			&core.RelationField{
+				Name:          "patient",
+				Required:      true,
+				CollectionId:  patients.Id,
+				CascadeDelete: true,
+			},
+			&core.DateField{
+				Name:     "periodStart",
+				Required: true,
+			},
+			&core.DateField{
+				Name:     "periodEnd",
+				Required: true,
+			},
+
+			// in minor units, from the patient ledger over the period
+			&core.NumberField{
+				Name:    "previousBalance",
+				OnlyInt: true,
+			},
+			&core.NumberField{
+				Name:    "newCharges",
+				OnlyInt: true,
+			},
+			// patient payments net of the refunds
+			&core.NumberField{
+				Name:    "payments",
+				OnlyInt: true,
+			},
+			// insurance payments
+			&core.NumberField{
+				Name:    "insuranceAdjustments",
+				OnlyInt: true,
+			},
+			// credit notes, write-offs and reversals
+			&core.NumberField{
+				Name:    "otherAdjustments",
+				OnlyInt: true,
+			},
+			// the insurance amounts expected and not paid yet
+			&core.NumberField{
+				Name:    "pendingInsurance",
+				OnlyInt: true,
+			},
+			// closing balance less the pending insurance
+			&core.NumberField{
+				Name:    "amountDue",
+				OnlyInt: true,
+			},
+
+			// unpaid invoices by age at the end of the period
+			&core.NumberField{
+				Name:    "agingCurrent",
+				OnlyInt: true,
+			},
+			&core.NumberField{
+				Name:    "aging30",
+				OnlyInt: true,
+			},
+			&core.NumberField{
+				Name:    "aging60",
+				OnlyInt: true,
+			},
+			&core.NumberField{
+				Name:    "aging90",
+				OnlyInt: true,
+			},
+
+			&core.FileField{
+				Name:      "document",
+				MaxSelect: 1,
+				MaxSize:   10 << 20,
+				MimeTypes: []string{"application/pdf"},
+				Protected: true,
+			},
+			&core.SelectField{
+				Name:      "status",
+				Required:  true,
+				Values:    []string{"generated", "sent", "failed"},
+				MaxSelect: 1,
+			},
+			&core.DateField{
+				Name: "sentAt",
+			},
+			&core.EmailField{
+				Name: "sentTo",
+			},
+			&core.TextField{
+				Name: "error",
+				Max:  1000,
+			},
+
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+
+		// one statement per patient and period, regenerated in place
+		statements.Indexes = []string{
+			"CREATE UNIQUE INDEX idx_patient_statements_period ON patient_statements (patient, periodStart)",
+		}
+
+		return app.Save(statements)
+	}, func(app core.App) error {
+		// Rollback: delete the collection
+		return app.Delete(core.NewBaseCollection("patient_statements"))
+	})
+}
@@ -0,0 +1,110 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// =============================================================================
+		// Document Branding - Clinic logo and tax registration, issued invoice and
+		// receipt PDFs
+		// =============================================================================
+
+		clinicSettings, err := app.FindCollectionByNameOrId("clinic_settings")
+		if err != nil {
+			return err
+		}
+
+		clinicSettings.Fields.Add(
+			// printed on the letterhead of the documents
+			&core.FileField{
+				Name:      "logo",
+				MaxSelect: 1,
+				MaxSize:   2 << 20,
+				MimeTypes: []string{"image/png", "image/jpeg"},
+			},
+			// sales tax / VAT registration printed on the invoices and receipts
+			&core.TextField{
+				Name: "taxRegistrationNumber",
+				Max:  50,
+			},
+		)
+		if err := app.Save(clinicSettings); err != nil {
+			return err
+		}
+
+		// The documents as issued, kept so that they can be reproduced
+		invoices, err := app.FindCollectionByNameOrId("invoices")
+		if err != nil {
+			return err
+		}
+
+		invoices.Fields.Add(
+			&core.FileField{
+				Name:      "document",
+				MaxSelect: 1,
+				MaxSize:   10 << 20,
+				MimeTypes: []string{"application/pdf"},
+				Protected: true,
+			},
+			&core.DateField{
+				Name: "documentGeneratedAt",
+			},
+		)
+		if err := app.Save(invoices); err != nil {
+			return err
+		}
+
+		payments, err := app.FindCollectionByNameOrId("payments")
+		if err != nil {
+			return err
+		}
+
+		payments.Fields.Add(
+			&core.FileField{
+				Name:      "receipt",
+				MaxSelect: 1,
+				MaxSize:   10 << 20,
+				MimeTypes: []string{"application/pdf"},
+				Protected: true,
+			},
+			&core.DateField{
+				Name: "receiptGeneratedAt",
+			},
+		)
+
+		return app.Save(payments)
+	}, func(app core.App) error {
+		// Rollback: remove the added fields
+		payments, err := app.FindCollectionByNameOrId("payments")
+		if err != nil {
+			return err
+		}
+		payments.Fields.RemoveByName("receiptGeneratedAt")
+		payments.Fields.RemoveByName("receipt")
+		if err := app.Save(payments); err != nil {
+			return err
+		}
+
+		invoices, err := app.FindCollectionByNameOrId("invoices")
+		if err != nil {
+			return err
+		}
+		invoices.Fields.RemoveByName("documentGeneratedAt")
+		invoices.Fields.RemoveByName("document")
+		if err := app.Save(invoices); err != nil {
+			return err
+		}
+
+		clinicSettings, err := app.FindCollectionByNameOrId("clinic_settings")
+		if err != nil {
+			return err
+		}
+		clinicSettings.Fields.RemoveByName("taxRegistrationNumber")
+		clinicSettings.Fields.RemoveByName("logo")
+
+		return app.Save(clinicSettings)
+	})
+}
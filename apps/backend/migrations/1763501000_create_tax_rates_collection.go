@@ -0,0 +1,280 @@
+package migrations
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"zahrawiclinic.com/money"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// =============================================================================
+		// Tax Rates - Tax applied to the invoice items by category and date
+		// =============================================================================
+
+		// Get dependencies
+		invoices, err := app.FindCollectionByNameOrId("invoices")
+		if err != nil {
+			return err
+		}
+
+		invoiceItems, err := app.FindCollectionByNameOrId("invoice_items")
+		if err != nil {
+			return err
+		}
+
+		inventory, err := app.FindCollectionByNameOrId("inventory")
+		if err != nil {
+			return err
+		}
+
+		taxRates := core.NewBaseCollection("tax_rates")
+
+		taxRates.ListRule = types.Pointer("@request.auth.id != ''")
+		taxRates.ViewRule = types.Pointer("@request.auth.id != ''")
+		taxRates.CreateRule = types.Pointer("@request.auth.id != ''")
+		taxRates.UpdateRule = types.Pointer("@request.auth.id != ''")
+		taxRates.DeleteRule = types.Pointer("@request.auth.id != ''")
+
+		taxRates.Fields.Add(
+			&core.TextField{
+				Name:     "name",
+				Required: true,
+				Max:      200,
+			},
+			// reporting code, e.g. "VAT-STD"
+			&core.TextField{
+				Name:     "code",
+				Required: true,
+				Max:      50,
+			},
+			// the items the rate applies to
+			&core.SelectField{
+				Name:      "category",
+				Required:  true,
+				Values:    []string{"medical_service", "retail_product"},
+				MaxSelect: 1,
+			},
+			// percent
+			&core.NumberField{
+				Name: "rate",
+				Min:  types.Pointer(float64(0)),
+				Max:  types.Pointer(float64(100)),
+			},
+			// exempt supplies are reported apart from the zero rated ones
+			&core.BoolField{
+				Name: "exempt",
+			},
+			&core.DateField{
+				Name:     "effectiveFrom",
+				Required: true,
+			},
+			// empty while the rate is in effect
+			&core.DateField{
+				Name: "effectiveTo",
+			},
+			&core.TextField{
+				Name: "notes",
+				Max:  1000,
+			},
+
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+
+		taxRates.Indexes = []string{
+			"CREATE INDEX idx_tax_rates_category ON tax_rates (category, effectiveFrom)",
+		}
+
+		if err := app.Save(taxRates); err != nil {
+			return err
+		}
+
+		// Medical services are exempt by default, the clinic adds the rates
+		// of its retail products
+		exempt := core.NewRecord(taxRates)
+		exempt.Set("name", "Medical services")
+		exempt.Set("code", "EXEMPT")
+		exempt.Set("category", "medical_service")
+		exempt.Set("exempt", true)
+		exempt.Set("effectiveFrom", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+		if err := app.Save(exempt); err != nil {
+			return err
+		}
+
+		// The tax is resolved per item when it is saved: the item keeps the
+		// applied rate so that issued invoices aren't changed by later
+		// configuration changes
+		invoiceItems.Fields.Add(
+			&core.SelectField{
+				Name:      "taxCategory",
+				Values:    []string{"medical_service", "retail_product"},
+				MaxSelect: 1,
+			},
+			// the retail product sold, priced from its selling price
+			&core.RelationField{
+				Name:         "inventoryItem",
+				CollectionId: inventory.Id,
+			},
+			&core.RelationField{
+				Name:         "taxRate",
+				CollectionId: taxRates.Id,
+			},
+			// percent of the applied rate
+			&core.NumberField{
+				Name: "taxPercent",
+				Min:  types.Pointer(float64(0)),
+				Max:  types.Pointer(float64(100)),
+			},
+		)
+		if err := app.Save(invoiceItems); err != nil {
+			return err
+		}
+
+		// Backfill the items with the tax rate of their invoice
+		_, err = app.DB().NewQuery(`
+			UPDATE invoice_items SET
+				taxCategory = 'medical_service',
+				taxPercent = CASE WHEN taxable = TRUE
+					THEN COALESCE((SELECT taxRate FROM invoices WHERE invoices.id = invoice_items.invoice), 0)
+					ELSE 0 END
+		`).Execute()
+		if err != nil {
+			return err
+		}
+
+		invoices.Fields.RemoveByName("taxRate")
+		invoices.Fields.Add(
+			// [{"taxRate": ..., "code": ..., "name": ..., "rate": 20,
+			// "exempt": false, "taxableAmount": 100.00, "tax": 20.00}]
+			&core.JSONField{
+				Name: "taxBreakdown",
+			},
+		)
+		if err := app.Save(invoices); err != nil {
+			return err
+		}
+
+		return backfillTaxBreakdown(app)
+	}, func(app core.App) error {
+		// Rollback: restore the invoice tax rate from the items, then delete
+		// the collection
+		invoices, err := app.FindCollectionByNameOrId("invoices")
+		if err != nil {
+			return err
+		}
+		invoices.Fields.RemoveByName("taxBreakdown")
+		invoices.Fields.Add(
+			&core.NumberField{
+				Name: "taxRate",
+				Min:  types.Pointer(float64(0)),
+				Max:  types.Pointer(float64(100)),
+			},
+		)
+		if err := app.Save(invoices); err != nil {
+			return err
+		}
+
+		_, err = app.DB().NewQuery(`
+			UPDATE invoices SET taxRate = COALESCE(
+				(SELECT MAX(taxPercent) FROM invoice_items WHERE invoice_items.invoice = invoices.id), 0)
+		`).Execute()
+		if err != nil {
+			return err
+		}
+
+		_, err = app.DB().NewQuery("UPDATE invoice_items SET taxable = (taxPercent > 0)").Execute()
+		if err != nil {
+			return err
+		}
+
+		invoiceItems, err := app.FindCollectionByNameOrId("invoice_items")
+		if err != nil {
+			return err
+		}
+		invoiceItems.Fields.RemoveByName("taxPercent")
+		invoiceItems.Fields.RemoveByName("taxRate")
+		invoiceItems.Fields.RemoveByName("inventoryItem")
+		invoiceItems.Fields.RemoveByName("taxCategory")
+		if err := app.Save(invoiceItems); err != nil {
+			return err
+		}
+
+		return app.Delete(core.NewBaseCollection("tax_rates"))
+	})
+}
+
+// backfillTaxBreakdown stores the tax breakdown of the existing invoices,
+// one line per tax percent of their items.
+func backfillTaxBreakdown(app core.App) error {
+	var rows []struct {
+		Invoice       string  `db:"invoice"`
+		TaxPercent    float64 `db:"taxPercent"`
+		TaxableAmount float64 `db:"taxableAmount"`
+		Tax           float64 `db:"tax"`
+	}
+	err := app.DB().
+		Select("invoice", "taxPercent", "SUM(total) AS taxableAmount", "SUM(taxAmount) AS tax").
+		From("invoice_items").
+		GroupBy("invoice", "taxPercent").
+		OrderBy("invoice", "taxPercent").
+		All(&rows)
+	if err != nil {
+		return err
+	}
+
+	type taxLine struct {
+		TaxRate       string      `json:"taxRate"`
+		Code          string      `json:"code"`
+		Name          string      `json:"name"`
+		Rate          float64     `json:"rate"`
+		Exempt        bool        `json:"exempt"`
+		TaxableAmount money.Money `json:"taxableAmount"`
+		Tax           money.Money `json:"tax"`
+	}
+
+	breakdowns := map[string][]taxLine{}
+	for _, row := range rows {
+		name := "Not taxed"
+		if row.TaxPercent != 0 {
+			name = fmt.Sprintf("Tax %g%%", row.TaxPercent)
+		}
+		breakdowns[row.Invoice] = append(breakdowns[row.Invoice], taxLine{
+			Name:          name,
+			Rate:          row.TaxPercent,
+			TaxableAmount: money.FromMinor(row.TaxableAmount),
+			Tax:           money.FromMinor(row.Tax),
+		})
+	}
+
+	for invoiceId, breakdown := range breakdowns {
+		raw, err := json.Marshal(breakdown)
+		if err != nil {
+			return err
+		}
+
+		_, err = app.DB().Update(
+			"invoices",
+			dbx.Params{"taxBreakdown": string(raw)},
+			dbx.HashExp{"id": invoiceId},
+		).Execute()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"zahrawiclinic.com/money"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// =============================================================================
+		// Exchange Rates - Dated rates of the foreign currencies to the clinic currency
+		// =============================================================================
+
+		exchangeRates := core.NewBaseCollection("exchange_rates")
+
+		exchangeRates.ListRule = types.Pointer("@request.auth.id != ''")
+		exchangeRates.ViewRule = types.Pointer("@request.auth.id != ''")
+		exchangeRates.CreateRule = types.Pointer("@request.auth.id != ''")
+		exchangeRates.UpdateRule = types.Pointer("@request.auth.id != ''")
+		exchangeRates.DeleteRule = types.Pointer("@request.auth.id != ''")
+
+		exchangeRates.Fields.Add(
+			// ISO 4217 code
+			&core.TextField{
+				Name:     "currency",
+				Required: true,
+				Pattern:  "^[A-Z]{3}$",
+			},
+			// units of the clinic currency for one unit of the currency
+			&core.NumberField{
+				Name:     "rate",
+				Required: true,
+				Min:      types.Pointer(float64(0)),
+			},
+			// in effect from this day until the next rate of the currency
+			&core.DateField{
+				Name:     "date",
+				Required: true,
+			},
+			// e.g. "ECB", "manual"
+			&core.TextField{
+				Name: "source",
+				Max:  100,
+			},
+
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+
+		exchangeRates.Indexes = []string{
+			"CREATE UNIQUE INDEX idx_exchange_rates_currency_date ON exchange_rates (currency, date)",
+		}
+
+		if err := app.Save(exchangeRates); err != nil {
+			return err
+		}
+
+		// The invoices and payments keep their amounts in their own currency
+		// with the rate applied and the amount in the clinic currency
+		invoices, err := app.FindCollectionByNameOrId("invoices")
+		if err != nil {
+			return err
+		}
+		invoices.Fields.Add(currencyFields("baseTotal")...)
+		if err := app.Save(invoices); err != nil {
+			return err
+		}
+
+		payments, err := app.FindCollectionByNameOrId("payments")
+		if err != nil {
+			return err
+		}
+		payments.Fields.Add(currencyFields("baseAmount")...)
+		if err := app.Save(payments); err != nil {
+			return err
+		}
+
+		// Backfill: the existing documents are in the clinic currency
+		params := dbx.Params{"currency": money.Default().Code}
+		_, err = app.DB().NewQuery("UPDATE invoices SET currency = {:currency}, exchangeRate = 1, baseTotal = total").Bind(params).Execute()
+		if err != nil {
+			return err
+		}
+		_, err = app.DB().NewQuery("UPDATE payments SET currency = {:currency}, exchangeRate = 1, baseAmount = amount").Bind(params).Execute()
+
+		return err
+	}, func(app core.App) error {
+		// Rollback: remove the currency fields, then delete the collection
+		for name, base := range map[string]string{"invoices": "baseTotal", "payments": "baseAmount"} {
+			collection, err := app.FindCollectionByNameOrId(name)
+			if err != nil {
+				return err
+			}
+			collection.Fields.RemoveByName("currency")
+			collection.Fields.RemoveByName("exchangeRate")
+			collection.Fields.RemoveByName(base)
+			if err := app.Save(collection); err != nil {
+				return err
+			}
+		}
+
+		return app.Delete(core.NewBaseCollection("exchange_rates"))
+	})
+}
+
+// currencyFields returns the currency, the exchange rate and the amount in
+// the clinic currency fields of a document.
+func currencyFields(base string) []core.Field {
+	return []core.Field{
+		// ISO 4217 code, the clinic currency when empty
+		&core.TextField{
+			Name:    "currency",
+			Pattern: "^[A-Z]{3}$",
+		},
+		// units of the clinic currency for one unit of the currency
+		&core.NumberField{
+			Name: "exchangeRate",
+			Min:  types.Pointer(float64(0)),
+		},
+		&core.NumberField{
+			Name:    base,
+			OnlyInt: true,
+		},
+	}
+}
@@ -0,0 +1,172 @@
+package migrations
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// =============================================================================
+		// Payment Intents - Online card payments of the invoices through a payment gateway
+		// =============================================================================
+
+		// Get dependencies
+		invoices, err := app.FindCollectionByNameOrId("invoices")
+		if err != nil {
+			return err
+		}
+
+		patients, err := app.FindCollectionByNameOrId("patients")
+		if err != nil {
+			return err
+		}
+
+		payments, err := app.FindCollectionByNameOrId("payments")
+		if err != nil {
+			return err
+		}
+
+		users, err := app.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		intents := core.NewBaseCollection("payment_intents")
+
+		// Written by the checkout and webhook routes only
+		intents.ListRule = types.Pointer("@request.auth.id != ''")
+		intents.ViewRule = types.Pointer("@request.auth.id != ''")
+		intents.CreateRule = nil
+		intents.UpdateRule = nil
+		intents.DeleteRule = nil
+
+		intents.Fields.Add(
+			&core.RelationField{
+				Name:         "invoice",
+				Required:     true,
+				CollectionId: invoices.Id,
+			},
+			&core.RelationField{
+				Name:         "patient",
+				Required:     true,
+				CollectionId: patients.Id,
+			},
+			// in minor units of the currency
+			&core.NumberField{
+				Name:     "amount",
+				Required: true,
+				OnlyInt:  true,
+			},
+			// the invoice currency
+			&core.TextField{
+				Name:    "currency",
+				Pattern: "^[A-Z]{3}$",
+			},
+			// the gateway the checkout was created with, e.g. "hosted", "fake"
+			&core.TextField{
+				Name:     "provider",
+				Required: true,
+				Max:      50,
+			},
+			// the gateway checkout session
+			&core.TextField{
+				Name: "checkoutId",
+				Max:  200,
+			},
+			// the hosted payment page the patient is sent to
+			&core.TextField{
+				Name: "checkoutUrl",
+				Max:  2000,
+			},
+			&core.SelectField{
+				Name:      "status",
+				Required:  true,
+				Values:    []string{"pending", "succeeded", "failed"},
+				MaxSelect: 1,
+			},
+			// the payment recorded from the gateway notification
+			&core.RelationField{
+				Name:         "payment",
+				CollectionId: payments.Id,
+			},
+			&core.TextField{
+				Name: "transactionId",
+				Max:  200,
+			},
+			&core.DateField{
+				Name: "completedAt",
+			},
+			&core.TextField{
+				Name: "error",
+				Max:  1000,
+			},
+			&core.RelationField{
+				Name:         "createdBy",
+				CollectionId: users.Id,
+			},
+
+			&core.AutodateField{
+				Name:     "created",
+				OnCreate: true,
+			},
+			&core.AutodateField{
+				Name:     "updated",
+				OnCreate: true,
+				OnUpdate: true,
+			},
+		)
+
+		intents.Indexes = []string{
+			"CREATE INDEX idx_payment_intents_invoice ON payment_intents (invoice)",
+		}
+
+		if err := app.Save(intents); err != nil {
+			return err
+		}
+
+		// A gateway transaction is recorded as a single payment, whatever
+		// the number of notifications received
+		var duplicates []struct {
+			TransactionId string `db:"transactionId"`
+		}
+		err = app.DB().
+			Select("transactionId").
+			From("payments").
+			Where(dbx.NewExp("transactionId != ''")).
+			GroupBy("transactionId").
+			Having(dbx.NewExp("COUNT(*) > 1")).
+			All(&duplicates)
+		if err != nil {
+			return err
+		}
+		if len(duplicates) > 0 {
+			ids := make([]string, len(duplicates))
+			for i, d := range duplicates {
+				ids[i] = d.TransactionId
+			}
+			return fmt.Errorf("several payments share the transaction ids %s, fix them before migrating", strings.Join(ids, ", "))
+		}
+
+		payments.AddIndex("idx_payments_transactionId", true, "transactionId", "transactionId != ''")
+
+		return app.Save(payments)
+	}, func(app core.App) error {
+		// Rollback: remove the index, then delete the collection
+		payments, err := app.FindCollectionByNameOrId("payments")
+		if err != nil {
+			return err
+		}
+		payments.RemoveIndex("idx_payments_transactionId")
+		if err := app.Save(payments); err != nil {
+			return err
+		}
+
+		return app.Delete(core.NewBaseCollection("payment_intents"))
+	})
+}
@@ -0,0 +1,43 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// =============================================================================
+		// Payments - Amount applied to the invoice, in the invoice currency
+		// =============================================================================
+
+		payments, err := app.FindCollectionByNameOrId("payments")
+		if err != nil {
+			return err
+		}
+
+		// in minor units of the invoice currency, the payment amount
+		// converted when the payment is in another currency
+		payments.Fields.Add(&core.NumberField{
+			Name:    "invoiceAmount",
+			OnlyInt: true,
+		})
+		if err := app.Save(payments); err != nil {
+			return err
+		}
+
+		// Backfill: the existing payments are in the currency of their invoice
+		_, err = app.DB().NewQuery("UPDATE payments SET invoiceAmount = amount").Execute()
+
+		return err
+	}, func(app core.App) error {
+		// Rollback: remove the field
+		payments, err := app.FindCollectionByNameOrId("payments")
+		if err != nil {
+			return err
+		}
+		payments.Fields.RemoveByName("invoiceAmount")
+
+		return app.Save(payments)
+	})
+}
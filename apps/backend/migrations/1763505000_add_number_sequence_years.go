@@ -0,0 +1,112 @@
+package migrations
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+// numberedDocuments maps the sequences reset yearly to their documents
+// collection and number field.
+var numberedDocuments = map[string][2]string{
+	"invoice":     {"invoices", "invoiceNumber"},
+	"credit_note": {"credit_notes", "creditNoteNumber"},
+}
+
+func init() {
+	m.Register(func(app core.App) error {
+		// =============================================================================
+		// Number Sequences - Counter per year of the sequences reset yearly
+		// =============================================================================
+
+		numberSequences, err := app.FindCollectionByNameOrId("number_sequences")
+		if err != nil {
+			return err
+		}
+
+		// the last counter value of each year, e.g. {"2025": 42}, so that
+		// back-dated documents are numbered in their own year
+		numberSequences.Fields.Add(&core.JSONField{
+			Name: "yearValues",
+		})
+		if err := app.Save(numberSequences); err != nil {
+			return err
+		}
+
+		// Backfill: the current year counter and the highest number of the
+		// previous years found on the documents
+		sequences, err := app.FindAllRecords("number_sequences")
+		if err != nil {
+			return err
+		}
+		for _, sequence := range sequences {
+			if !sequence.GetBool("resetYearly") {
+				continue
+			}
+
+			values := map[string]int{}
+			if year := sequence.GetInt("currentYear"); year > 0 {
+				values[strconv.Itoa(year)] = sequence.GetInt("lastValue")
+			}
+
+			if document, ok := numberedDocuments[sequence.GetString("key")]; ok && sequence.GetBool("includeYear") {
+				var numbers []string
+				err := app.DB().Select(document[1]).From(document[0]).Column(&numbers)
+				if err != nil {
+					return err
+				}
+				for _, number := range numbers {
+					year, value, ok := parseDocumentNumber(sequence, number)
+					if ok && value > values[year] {
+						values[year] = value
+					}
+				}
+			}
+
+			sequence.Set("yearValues", values)
+			if err := app.Save(sequence); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}, func(app core.App) error {
+		// Rollback: remove the field
+		numberSequences, err := app.FindCollectionByNameOrId("number_sequences")
+		if err != nil {
+			return err
+		}
+		numberSequences.Fields.RemoveByName("yearValues")
+
+		return app.Save(numberSequences)
+	})
+}
+
+// parseDocumentNumber returns the year and counter of a number formatted
+// with the prefix, year and separator of the sequence, e.g.
+// "INV-2025-00042".
+func parseDocumentNumber(sequence *core.Record, number string) (string, int, bool) {
+	prefix, separator := sequence.GetString("prefix"), sequence.GetString("separator")
+	if prefix != "" {
+		prefix += separator
+	}
+
+	rest, ok := strings.CutPrefix(number, prefix)
+	if !ok || len(rest) < 4 {
+		return "", 0, false
+	}
+
+	year := rest[:4]
+	if _, err := strconv.Atoi(year); err != nil {
+		return "", 0, false
+	}
+
+	value, err := strconv.Atoi(strings.TrimPrefix(rest[4:], separator))
+	if err != nil {
+		return "", 0, false
+	}
+
+	return year, value, true
+}
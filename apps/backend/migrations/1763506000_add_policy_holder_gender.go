@@ -0,0 +1,38 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// =============================================================================
+		// Patient Insurance - Gender of the policy holder (837D subscriber DMG03)
+		// =============================================================================
+
+		patientInsurance, err := app.FindCollectionByNameOrId("patient_insurance")
+		if err != nil {
+			return err
+		}
+
+		// the subscriber gender of the claims when the patient isn't the
+		// policy holder, the patient gender otherwise
+		patientInsurance.Fields.Add(&core.SelectField{
+			Name:      "policyHolderGender",
+			Values:    []string{"male", "female", "other", "prefer_not_to_say"},
+			MaxSelect: 1,
+		})
+
+		return app.Save(patientInsurance)
+	}, func(app core.App) error {
+		// Rollback: remove the field
+		patientInsurance, err := app.FindCollectionByNameOrId("patient_insurance")
+		if err != nil {
+			return err
+		}
+		patientInsurance.Fields.RemoveByName("policyHolderGender")
+
+		return app.Save(patientInsurance)
+	})
+}
@@ -0,0 +1,206 @@
+package migrations
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"zahrawiclinic.com/money"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// =============================================================================
+		// Insurance Claims - Paid amounts recorded as insurance payments
+		// =============================================================================
+
+		// the ledger only follows the payments: the claim postings are
+		// reversed and the paid amounts not recorded as payments yet are
+		// recorded (and posted) as insurance payments of the claim invoices,
+		// without the record hooks so that the backfill doesn't depend on
+		// today's validations
+		ledgerEntries, err := app.FindCollectionByNameOrId("ledger_entries")
+		if err != nil {
+			return err
+		}
+
+		post := func(patient string, date types.DateTime, entryType string, description string, amount int64, source string, link string, linkId string, invoice string) error {
+			entry := core.NewRecord(ledgerEntries)
+			entry.Set("patient", patient)
+			entry.Set("date", date)
+			entry.Set("type", entryType)
+			entry.Set("description", description)
+			if amount > 0 {
+				entry.Set("debit", amount)
+			} else {
+				entry.Set("credit", -amount)
+			}
+			entry.Set("source", source)
+			if linkId != "" {
+				entry.Set(link, linkId)
+			}
+			if invoice != "" {
+				entry.Set("invoice", invoice)
+			}
+			return app.Save(entry)
+		}
+
+		var postings []struct {
+			Source  string  `db:"source"`
+			Patient string  `db:"patient"`
+			Total   float64 `db:"total"`
+		}
+		err = app.DB().
+			Select("[[source]]", "[[patient]]", "COALESCE(SUM([[debit]] - [[credit]]), 0) AS total").
+			From("ledger_entries").
+			Where(dbx.Like("source", "claim:").Match(false, true)).
+			GroupBy("source", "patient").
+			All(&postings)
+		if err != nil {
+			return err
+		}
+		for _, row := range postings {
+			if row.Total == 0 {
+				continue
+			}
+			err := post(row.Patient, types.NowDateTime(), "adjustment", "Reversal: insurance claim, recorded as a payment", -int64(row.Total), row.Source, "", "", "")
+			if err != nil {
+				return err
+			}
+		}
+
+		var claims []struct {
+			Id            string         `db:"id"`
+			Patient       string         `db:"patient"`
+			Invoice       string         `db:"invoice"`
+			ClaimNumber   string         `db:"claimNumber"`
+			PaidAmount    int64          `db:"paidAmount"`
+			PaidDate      types.DateTime `db:"paidDate"`
+			InvoiceNumber string         `db:"invoiceNumber"`
+			Currency      string         `db:"currency"`
+			ExchangeRate  float64        `db:"exchangeRate"`
+			Recorded      int64          `db:"recorded"`
+			Outstanding   int64          `db:"outstanding"`
+		}
+		err = app.DB().NewQuery(`
+			SELECT
+				c.id, c.patient, c.invoice, c.claimNumber, c.paidAmount, c.paidDate,
+				i.invoiceNumber, i.currency, i.exchangeRate,
+				(SELECT COALESCE(SUM(invoiceAmount), 0) FROM payments WHERE insuranceClaim = c.id) AS recorded,
+				i.total
+					- (SELECT COALESCE(SUM(invoiceAmount), 0) FROM payments WHERE invoice = i.id)
+					+ (SELECT COALESCE(SUM(amount), 0) FROM refunds WHERE invoice = i.id AND status = 'posted')
+					- (SELECT COALESCE(SUM(amount), 0) FROM credit_notes WHERE invoice = i.id AND status = 'posted')
+					- (SELECT COALESCE(SUM(amount), 0) FROM write_offs WHERE invoice = i.id AND status = 'posted') AS outstanding
+			FROM insurance_claims c
+			JOIN invoices i ON i.id = c.invoice
+			WHERE c.status IN ('paid', 'partial')
+		`).All(&claims)
+		if err != nil {
+			return err
+		}
+
+		base := money.Default()
+		invoices := map[string]struct{}{}
+
+		for _, claim := range claims {
+			unrecorded := claim.PaidAmount - claim.Recorded
+			if unrecorded <= 0 {
+				continue
+			}
+
+			// the claim amounts are in the currency of their invoice
+			currency := money.Lookup(claim.Currency)
+			baseAmount, exchangeRate, original := unrecorded, claim.ExchangeRate, ""
+			if currency.Code != "" && currency.Code != base.Code {
+				baseAmount = int64(currency.Convert(money.Money(unrecorded), exchangeRate, base))
+				original = fmt.Sprintf(" (%s at %g)", currency.Display(money.Money(unrecorded)), exchangeRate)
+			} else {
+				exchangeRate = 1
+			}
+
+			paymentDate := claim.PaidDate
+			if paymentDate.IsZero() {
+				paymentDate = types.NowDateTime()
+			}
+			now := types.NowDateTime()
+
+			id := core.GenerateDefaultRandomId()
+			_, err := app.DB().Insert("payments", dbx.Params{
+				"id":             id,
+				"patient":        claim.Patient,
+				"invoice":        claim.Invoice,
+				"insuranceClaim": claim.Id,
+				"paymentMethod":  "insurance",
+				"paymentDate":    paymentDate.String(),
+				"notes":          strings.TrimSpace("Insurance claim " + claim.ClaimNumber),
+				"amount":         unrecorded,
+				"currency":       claim.Currency,
+				"exchangeRate":   exchangeRate,
+				"baseAmount":     baseAmount,
+				"invoiceAmount":  unrecorded,
+				"isOverpayment":  unrecorded > claim.Outstanding,
+				"created":        now.String(),
+				"updated":        now.String(),
+			}).Execute()
+			if err != nil {
+				return err
+			}
+
+			err = post(
+				claim.Patient,
+				paymentDate,
+				"insurance_payment",
+				"Insurance payment, invoice "+claim.InvoiceNumber+original,
+				-baseAmount,
+				"payment:"+id,
+				"payment",
+				id,
+				claim.Invoice,
+			)
+			if err != nil {
+				return err
+			}
+
+			invoices[claim.Invoice] = struct{}{}
+		}
+
+		// refresh the balances of the invoices as billing.ComputeBalance
+		for invoice := range invoices {
+			_, err := app.DB().NewQuery(`
+				UPDATE invoices SET
+					amountPaid = (SELECT COALESCE(SUM(invoiceAmount), 0) FROM payments WHERE invoice = invoices.id)
+						- (SELECT COALESCE(SUM(amount), 0) FROM refunds WHERE invoice = invoices.id AND status = 'posted')
+				WHERE id = {:id}
+			`).Bind(dbx.Params{"id": invoice}).Execute()
+			if err != nil {
+				return err
+			}
+
+			_, err = app.DB().NewQuery(`
+				UPDATE invoices SET
+					balanceDue = total - amountPaid - creditedAmount - writtenOffAmount
+						- MAX(insuranceAmount
+							- (SELECT COALESCE(SUM(invoiceAmount), 0) FROM payments WHERE invoice = invoices.id AND paymentMethod = 'insurance')
+							+ (SELECT COALESCE(SUM(amount), 0) FROM refunds WHERE invoice = invoices.id AND status = 'posted' AND refundMethod = 'insurance'), 0),
+					status = CASE
+						WHEN status IN ('sent', 'partial', 'overdue') AND total > 0 AND amountPaid + creditedAmount + writtenOffAmount >= total THEN 'paid'
+						WHEN status = 'sent' AND amountPaid + creditedAmount + writtenOffAmount > 0 THEN 'partial'
+						ELSE status
+					END
+				WHERE id = {:id}
+			`).Bind(dbx.Params{"id": invoice}).Execute()
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}, func(app core.App) error {
+		// Rollback: nothing to undo, the recorded payments are kept
+		return nil
+	})
+}
@@ -0,0 +1,57 @@
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(app core.App) error {
+		// =============================================================================
+		// Imaging Records - Writes restricted to the DICOM upload route
+		// =============================================================================
+
+		imagingRecords, err := app.FindCollectionByNameOrId("imaging_records")
+		if err != nil {
+			return err
+		}
+
+		// Created only by POST /api/clinic/patients/{id}/imaging, which checks
+		// that the DICOM file belongs to the patient; afterwards only the
+		// notes can be changed, not the file or what was read from it
+		imagingRecords.CreateRule = nil
+		imagingRecords.UpdateRule = types.Pointer(
+			"@request.auth.id != ''" +
+				" && @request.body.patient:isset = false" +
+				" && @request.body.file:isset = false" +
+				" && @request.body.preview:isset = false" +
+				" && @request.body.modality:isset = false" +
+				" && @request.body.acquisitionDate:isset = false" +
+				" && @request.body.description:isset = false" +
+				" && @request.body.bodyPart:isset = false" +
+				" && @request.body.studyInstanceUid:isset = false" +
+				" && @request.body.seriesInstanceUid:isset = false" +
+				" && @request.body.sopInstanceUid:isset = false" +
+				" && @request.body.manufacturer:isset = false" +
+				" && @request.body.dicomPatientId:isset = false" +
+				" && @request.body.dicomPatientName:isset = false" +
+				" && @request.body.dicomPatientBirthDate:isset = false" +
+				" && @request.body.rows:isset = false" +
+				" && @request.body.columns:isset = false" +
+				" && @request.body.uploadedBy:isset = false",
+		)
+
+		return app.Save(imagingRecords)
+	}, func(app core.App) error {
+		// Rollback: restore the rules open to any authenticated user
+		imagingRecords, err := app.FindCollectionByNameOrId("imaging_records")
+		if err != nil {
+			return err
+		}
+		imagingRecords.CreateRule = types.Pointer("@request.auth.id != ''")
+		imagingRecords.UpdateRule = types.Pointer("@request.auth.id != ''")
+
+		return app.Save(imagingRecords)
+	})
+}
@@ -0,0 +1,250 @@
+package money
+
+import (
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/hook"
+	"github.com/spf13/cast"
+)
+
+// Fields lists the monetary fields of each collection, stored in minor
+// units. New monetary fields must be added here so that the API keeps
+// exposing them as decimals.
+var Fields = map[string][]string{
+	"patient_insurance":        {"annualMaximum", "deductible", "deductibleMet", "benefitsUsed"},
+	"treatments_catalog":       {"default_price"},
+	"treatments":               {"actualCost"},
+	"treatment_plans":          {"estimatedCost"},
+	"treatment_plan_items":     {"estimatedCost"},
+	"invoices":                 {"subtotal", "tax", "discount", "total", "insuranceAmount", "amountPaid", "balanceDue", "creditedAmount", "writtenOffAmount", "baseTotal"},
+	"invoice_items":            {"unitPrice", "total", "taxAmount"},
+	"payments":                 {"amount", "baseAmount", "invoiceAmount"},
+	"insurance_claims":         {"claimedAmount", "approvedAmount", "paidAmount", "deniedAmount", "patientResponsibility", "deductibleApplied"},
+	"inventory":                {"costPrice", "sellingPrice"},
+	"fee_schedule_entries":     {"fee"},
+	"dunning_logs":             {"balanceDue"},
+	"eligibility_checks":       {"remainingMaximum", "remainingDeductible"},
+	"patient_statements":       {"previousBalance", "newCharges", "payments", "insuranceAdjustments", "otherAdjustments", "pendingInsurance", "amountDue", "agingCurrent", "aging30", "aging60", "aging90"},
+	"ledger_entries":           {"debit", "credit"},
+	"refunds":                  {"amount"},
+	"credit_notes":             {"amount"},
+	"write_offs":               {"amount"},
+	"payment_plans":            {"totalAmount", "downPayment", "amountPaid", "balanceDue"},
+	"payment_plan_instalments": {"amount", "amountPaid"},
+	"payment_intents":          {"amount"},
+}
+
+// baseFields lists the monetary fields always in the clinic currency,
+// whatever the currency of their record.
+var baseFields = map[string][]string{
+	"invoices": {"baseTotal"},
+	"payments": {"baseAmount"},
+}
+
+// settledFields lists the monetary fields in the currency of what their
+// record settles, its invoice or else its payment plan, whatever the
+// currency of the record.
+var settledFields = map[string][]string{
+	"payments": {"invoiceAmount"},
+}
+
+// currencyRelations maps the collections whose amounts are in the currency
+// of a related record to the relation field, e.g. the invoice items are in
+// the currency of their invoice.
+var currencyRelations = map[string]string{
+	"invoice_items":    "invoice",
+	"payments":         "invoice",
+	"refunds":          "invoice",
+	"credit_notes":     "invoice",
+	"write_offs":       "invoice",
+	"insurance_claims": "invoice",
+
+	"payment_plans":            "invoice",
+	"payment_plan_instalments": "paymentPlan",
+}
+
+// CurrencyOf returns the currency of the record amounts: its own currency
+// field, else the currency of its related record (e.g. the invoice of an
+// item), else the clinic currency.
+func CurrencyOf(app core.App, record *core.Record) Currency {
+	if code := record.GetString("currency"); code != "" {
+		return Lookup(code)
+	}
+
+	if currency, ok := relatedCurrency(app, record, currencyRelations[record.Collection().Name]); ok {
+		return currency
+	}
+
+	return Default()
+}
+
+// relatedCurrency returns the currency of the record related through the
+// relation field with the given name, if any.
+func relatedCurrency(app core.App, record *core.Record, name string) (Currency, bool) {
+	if name == "" || record.GetString(name) == "" {
+		return Currency{}, false
+	}
+
+	field, ok := record.Collection().Fields.GetByName(name).(*core.RelationField)
+	if !ok {
+		return Currency{}, false
+	}
+
+	related, err := app.FindRecordById(field.CollectionId, record.GetString(name))
+	if err != nil {
+		return Currency{}, false
+	}
+
+	return CurrencyOf(app, related), true
+}
+
+// fieldCurrency returns the currency of a monetary field of a record in
+// the given currency.
+func fieldCurrency(app core.App, record *core.Record, field string, currency Currency) Currency {
+	name := record.Collection().Name
+	switch {
+	case slices.Contains(baseFields[name], field):
+		return Default()
+	case slices.Contains(settledFields[name], field):
+		for _, relation := range []string{"invoice", "paymentPlan"} {
+			if c, ok := relatedCurrency(app, record, relation); ok {
+				return c
+			}
+		}
+		return Default()
+	}
+	return currency
+}
+
+// requestPriority converts the submitted amounts before the other request
+// hooks (e.g. the billing totals checks) read them.
+const requestPriority = -100
+
+// Register binds the decimal compatibility layer of the monetary fields to
+// the app: the API clients keep sending and receiving decimal amounts.
+//
+// The numbers compared with the monetary fields of a collection in the
+// filter of its list requests are converted too, as decimals of the clinic
+// currency: "total > 100" lists the invoices above 100.00 of a 2 decimal
+// currency, whatever the invoice currency. Sorting is unaffected within a
+// currency.
+func Register(app core.App) {
+	collections := make([]string, 0, len(Fields))
+	for collection := range Fields {
+		collections = append(collections, collection)
+	}
+
+	app.OnRecordEnrich(collections...).BindFunc(func(e *core.RecordEnrichEvent) error {
+		currency := CurrencyOf(e.App, e.Record)
+		for _, field := range Fields[e.Record.Collection().Name] {
+			e.Record.Set(field, fieldCurrency(e.App, e.Record, field, currency).Decimal(Get(e.Record, field)))
+		}
+		return e.Next()
+	})
+
+	app.OnRecordCreateRequest(collections...).Bind(&hook.Handler[*core.RecordRequestEvent]{
+		Func:     fromRequest,
+		Priority: requestPriority,
+	})
+	app.OnRecordUpdateRequest(collections...).Bind(&hook.Handler[*core.RecordRequestEvent]{
+		Func:     fromRequest,
+		Priority: requestPriority,
+	})
+
+	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
+		se.Router.BindFunc(filterFromRequest)
+		return se.Next()
+	})
+}
+
+// filterComparison matches a field compared with a number in a filter,
+// e.g. "total >= 100.50", the field not being a relation path.
+var filterComparison = regexp.MustCompile(`(^|[^\w.@])(\w+)(\s*(?:\?|)(?:!=|>=|<=|=|>|<)\s*)(-?\d+(?:\.\d+)?)\b`)
+
+// filterFromRequest converts the decimal numbers compared with monetary
+// fields in the filter of a records list request to minor units of the
+// clinic currency.
+func filterFromRequest(e *core.RequestEvent) error {
+	if e.Request.Method != http.MethodGet {
+		return e.Next()
+	}
+
+	// /api/collections/{collection}/records
+	parts := strings.Split(strings.Trim(e.Request.URL.Path, "/"), "/")
+	if len(parts) != 4 || parts[0] != "api" || parts[1] != "collections" || parts[3] != "records" {
+		return e.Next()
+	}
+
+	query := e.Request.URL.Query()
+	filter := query.Get("filter")
+	if filter == "" {
+		return e.Next()
+	}
+
+	collection, err := e.App.FindCachedCollectionByNameOrId(parts[2])
+	if err != nil {
+		return e.Next() // reported by the list handler
+	}
+	fields := Fields[collection.Name]
+	if len(fields) == 0 {
+		return e.Next()
+	}
+
+	query.Set("filter", filterComparison.ReplaceAllStringFunc(filter, func(match string) string {
+		groups := filterComparison.FindStringSubmatch(match)
+		if !slices.Contains(fields, groups[2]) {
+			return match
+		}
+		amount, err := strconv.ParseFloat(groups[4], 64)
+		if err != nil {
+			return match
+		}
+		return groups[1] + groups[2] + groups[3] + strconv.FormatInt(int64(FromDecimal(amount)), 10)
+	}))
+	e.Request.URL.RawQuery = query.Encode()
+
+	return e.Next()
+}
+
+// fromRequest converts the submitted decimal amounts, including the "+"
+// and "-" number modifiers, to minor units of the record currency.
+//
+// The request body is read again because PocketBase resolves the modifiers
+// against the stored minor units before the request hooks run.
+func fromRequest(e *core.RecordRequestEvent) error {
+	body := map[string]any{}
+	if err := e.BindBody(&body); err != nil {
+		return e.BadRequestError("Failed to read the submitted data.", err)
+	}
+
+	currency := CurrencyOf(e.App, e.Record)
+	for _, field := range Fields[e.Record.Collection().Name] {
+		value, set := body[field]
+		add, hasAdd := body[field+"+"]
+		sub, hasSub := body[field+"-"]
+		if !set && !hasAdd && !hasSub {
+			continue
+		}
+
+		c := fieldCurrency(e.App, e.Record, field, currency)
+		amount := Get(e.Record.Original(), field)
+		if set {
+			amount = c.FromDecimal(cast.ToFloat64(value))
+		}
+		if hasAdd {
+			amount += c.FromDecimal(cast.ToFloat64(add))
+		}
+		if hasSub {
+			amount -= c.FromDecimal(cast.ToFloat64(sub))
+		}
+
+		Set(e.Record, field, amount)
+	}
+
+	return e.Next()
+}
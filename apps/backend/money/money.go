@@ -0,0 +1,191 @@
+// Package money represents amounts as integer minor units (cents) so that
+// the financial hooks add up exactly. The monetary record fields are stored
+// in minor units and converted from and to decimals at the API boundary.
+//
+// The clinic currency is set with the CLINIC_CURRENCY environment variable
+// (ISO 4217 code, USD by default) and determines the number of minor units.
+// Invoices and payments may be in another currency: their amounts are in
+// minor units of their own currency and converted to the clinic currency at
+// their exchange rate for the ledger and the reports.
+package money
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// Money is an amount in minor units of the clinic currency, or of the
+// currency of the record it belongs to.
+type Money int64
+
+// Currency is an ISO 4217 currency and its number of decimal digits.
+type Currency struct {
+	Code   string
+	Digits int
+}
+
+// digits lists the currencies that don't have 2 decimal digits.
+var digits = map[string]int{
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0,
+	"KRW": 0, "PYG": 0, "RWF": 0, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0,
+	"XOF": 0, "XPF": 0,
+}
+
+// Lookup returns the currency with the given code.
+func Lookup(code string) Currency {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if d, ok := digits[code]; ok {
+		return Currency{Code: code, Digits: d}
+	}
+	return Currency{Code: code, Digits: 2}
+}
+
+// Default returns the clinic currency.
+func Default() Currency {
+	code := os.Getenv("CLINIC_CURRENCY")
+	if code == "" {
+		code = "USD"
+	}
+	return Lookup(code)
+}
+
+// factor returns the number of minor units in a unit of the currency.
+func (c Currency) factor() float64 {
+	return math.Pow10(c.Digits)
+}
+
+// FromDecimal converts a decimal amount of the currency to minor units,
+// rounding half away from zero.
+func (c Currency) FromDecimal(amount float64) Money {
+	return Money(math.Round(amount * c.factor()))
+}
+
+// Decimal converts minor units of the currency to a decimal amount.
+func (c Currency) Decimal(m Money) float64 {
+	return float64(m) / c.factor()
+}
+
+// Format formats the amount with the currency decimal digits, without
+// symbol (e.g. "1250.50").
+func (c Currency) Format(m Money) string {
+	return strconv.FormatFloat(c.Decimal(m), 'f', c.Digits, 64)
+}
+
+// Display formats the amount followed by the currency code when it isn't
+// the clinic currency, e.g. "1250.50" or "1250.50 EUR".
+func (c Currency) Display(m Money) string {
+	if c.Code == Default().Code {
+		return c.Format(m)
+	}
+	return c.Format(m) + " " + c.Code
+}
+
+// Convert converts an amount of the currency to the currency to, at the
+// given rate in units of to for one unit of c.
+func (c Currency) Convert(m Money, rate float64, to Currency) Money {
+	return to.FromDecimal(c.Decimal(m) * rate)
+}
+
+// FromDecimal converts a decimal amount of the clinic currency to minor
+// units.
+func FromDecimal(amount float64) Money {
+	return Default().FromDecimal(amount)
+}
+
+// FromMinor rounds a number of minor units, as returned by SQL aggregates.
+func FromMinor(units float64) Money {
+	return Money(math.Round(units))
+}
+
+// Decimal returns the amount in units of the clinic currency.
+func (m Money) Decimal() float64 {
+	return Default().Decimal(m)
+}
+
+// String formats the amount in the clinic currency, e.g. "1250.50".
+func (m Money) String() string {
+	return Default().Format(m)
+}
+
+// MarshalJSON encodes the amount as a decimal number of the clinic
+// currency, as the API clients expect. Amounts of another currency are
+// encoded by their holder with Currency.Decimal, see e.g.
+// billing.TaxLine.
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.Decimal())
+}
+
+// UnmarshalJSON decodes a decimal number of the clinic currency.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var amount float64
+	if err := json.Unmarshal(data, &amount); err != nil {
+		return err
+	}
+	*m = FromDecimal(amount)
+	return nil
+}
+
+// Mul multiplies the amount by a quantity, rounding half away from zero.
+func (m Money) Mul(quantity float64) Money {
+	return Money(math.Round(float64(m) * quantity))
+}
+
+// Percent returns the given percentage of the amount, rounding half away
+// from zero.
+func (m Money) Percent(rate float64) Money {
+	return Money(math.Round(float64(m) * rate / 100))
+}
+
+// Split divides the amount in n parts that add up to it, the remainder
+// going to the last part.
+func (m Money) Split(n int) []Money {
+	if n < 1 {
+		return nil
+	}
+
+	parts := make([]Money, n)
+	part := m / Money(n)
+	for i := range parts {
+		parts[i] = part
+	}
+	parts[n-1] = m - part*Money(n-1)
+
+	return parts
+}
+
+// Get returns the amount stored in a monetary record field.
+func Get(record *core.Record, field string) Money {
+	return FromMinor(record.GetFloat(field))
+}
+
+// Set stores the amount in a monetary record field.
+func Set(record *core.Record, field string, m Money) {
+	record.Set(field, int64(m))
+}
+
+// ToBase converts an amount of the record currency to the clinic currency
+// at the record exchange rate. Records without currency are in the clinic
+// currency.
+func ToBase(record *core.Record, m Money) Money {
+	currency, base := Lookup(record.GetString("currency")), Default()
+	if currency.Code == "" || currency.Code == base.Code {
+		return m
+	}
+	return currency.Convert(m, record.GetFloat("exchangeRate"), base)
+}
+
+// FromBase converts an amount of the clinic currency to the record
+// currency at the record exchange rate, the reverse of ToBase.
+func FromBase(record *core.Record, m Money) Money {
+	currency, base := Lookup(record.GetString("currency")), Default()
+	if currency.Code == "" || currency.Code == base.Code || record.GetFloat("exchangeRate") <= 0 {
+		return m
+	}
+	return base.Convert(m, 1/record.GetFloat("exchangeRate"), currency)
+}
@@ -0,0 +1,107 @@
+// Package notify sends messages to patients by email, through the app mail
+// settings, and by SMS, through an HTTP gateway configured with the
+// SMS_WEBHOOK_URL (and optional SMS_WEBHOOK_TOKEN) environment variables.
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/mailer"
+)
+
+// ErrSMSNotConfigured is returned by SendSMS when no gateway is configured.
+var ErrSMSNotConfigured = errors.New("no SMS gateway configured")
+
+var httpClient = &http.Client{Timeout: 15 * time.Second}
+
+// Email is an email message to a single recipient.
+type Email struct {
+	To          string
+	Subject     string
+	HTML        string
+	Attachments map[string]io.Reader
+}
+
+// SendEmail sends the message from the app sender address.
+func SendEmail(app core.App, email Email) error {
+	to, err := mail.ParseAddress(email.To)
+	if err != nil {
+		return fmt.Errorf("invalid email address %q: %w", email.To, err)
+	}
+
+	return app.NewMailClient().Send(&mailer.Message{
+		From: mail.Address{
+			Name:    app.Settings().Meta.SenderName,
+			Address: app.Settings().Meta.SenderAddress,
+		},
+		To:          []mail.Address{*to},
+		Subject:     email.Subject,
+		HTML:        email.HTML,
+		Attachments: email.Attachments,
+	})
+}
+
+// SendSMS posts the message to the SMS gateway as {"to": ..., "body": ...}.
+func SendSMS(to string, body string) error {
+	url := os.Getenv("SMS_WEBHOOK_URL")
+	if url == "" {
+		return ErrSMSNotConfigured
+	}
+
+	payload, err := json.Marshal(map[string]string{"to": to, "body": body})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token := os.Getenv("SMS_WEBHOOK_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(res.Body, 500))
+		return fmt.Errorf("SMS gateway responded with %d: %s", res.StatusCode, strings.TrimSpace(string(detail)))
+	}
+
+	return nil
+}
+
+// Render replaces the {PLACEHOLDER} values of a plain text template.
+func Render(template string, values map[string]string) string {
+	pairs := make([]string, 0, 2*len(values))
+	for key, value := range values {
+		pairs = append(pairs, "{"+key+"}", value)
+	}
+	return strings.NewReplacer(pairs...).Replace(template)
+}
+
+// RenderHTML replaces the {PLACEHOLDER} values of an HTML template,
+// escaping the values.
+func RenderHTML(template string, values map[string]string) string {
+	escaped := make(map[string]string, len(values))
+	for key, value := range values {
+		escaped[key] = html.EscapeString(value)
+	}
+	return Render(template, escaped)
+}
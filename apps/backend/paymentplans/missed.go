@@ -0,0 +1,90 @@
+package paymentplans
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"zahrawiclinic.com/dates"
+	"zahrawiclinic.com/money"
+	"zahrawiclinic.com/tasks"
+)
+
+// MarkMissed flags the unpaid instalments of the active plans that are
+// past their due date and grace period, and raises a billing task for the
+// staff to remind the patient.
+func MarkMissed(app core.App) error {
+	instalments, err := app.FindRecordsByFilter(
+		"payment_plan_instalments",
+		"(status = 'pending' || status = 'partial') && dueDate < {:today} && paymentPlan.status = 'active'",
+		"dueDate",
+		0,
+		0,
+		dbx.Params{"today": dates.Today().UTC().Format(types.DefaultDateLayout)},
+	)
+	if err != nil {
+		return err
+	}
+
+	if errs := app.ExpandRecords(instalments, []string{"paymentPlan", "patient"}, nil); len(errs) > 0 {
+		return fmt.Errorf("failed to expand instalments: %v", errs)
+	}
+
+	for _, instalment := range instalments {
+		plan := instalment.ExpandedOne("paymentPlan")
+		if plan == nil || !isMissed(instalment, plan.GetInt("graceDays")) {
+			continue
+		}
+
+		if err := markMissed(app, instalment, plan); err != nil {
+			// keep going, one plan must not block the others
+			app.Logger().Error(
+				"Failed to flag the missed instalment",
+				"instalment", instalment.Id,
+				"paymentPlan", plan.Id,
+				"error", err,
+			)
+		}
+	}
+
+	return nil
+}
+
+func markMissed(app core.App, instalment *core.Record, plan *core.Record) error {
+	instalment.Set("status", "missed")
+	instalment.Set("missedAt", types.NowDateTime())
+	if err := app.Save(instalment); err != nil {
+		return err
+	}
+
+	patientName := ""
+	if patient := instalment.ExpandedOne("patient"); patient != nil {
+		patientName = strings.TrimSpace(patient.GetString("firstName") + " " + patient.GetString("lastName"))
+	}
+
+	label := fmt.Sprintf("Instalment %d", instalment.GetInt("sequence"))
+	if instalment.GetInt("sequence") == 0 {
+		label = "The down payment"
+	}
+
+	_, err := tasks.Ensure(app, tasks.Task{
+		Source:   "payment_plan_missed:" + instalment.Id,
+		Title:    fmt.Sprintf("Missed instalment: %s", patientName),
+		Priority: "medium",
+		Category: "billing",
+		DueDate:  dates.Today(),
+		Description: fmt.Sprintf(
+			"%s of the payment plan was due on %s and %s is still unpaid. Remind %s and arrange the payment.",
+			label,
+			instalment.GetDateTime("dueDate").Time().Local().Format(time.DateOnly),
+			money.CurrencyOf(app, instalment).Display(money.Get(instalment, "amount")-money.Get(instalment, "amountPaid")),
+			patientName,
+		),
+		Patient: plan.GetString("patient"),
+	})
+
+	return err
+}
@@ -0,0 +1,381 @@
+// Package paymentplans spreads the payment of an invoice or treatment plan
+// over instalments. The schedule is generated from the plan terms, incoming
+// payments are allocated to the earliest unpaid instalments and a daily job
+// flags the missed ones.
+package paymentplans
+
+import (
+	"fmt"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"zahrawiclinic.com/dates"
+	"zahrawiclinic.com/money"
+)
+
+// scheduleFields are the plan terms the instalments are generated from.
+var scheduleFields = []string{"totalAmount", "downPayment", "numberOfInstalments", "frequency", "startDate"}
+
+// Register binds the payment plan hooks and the daily missed instalments
+// job to the app.
+func Register(app core.App) {
+	app.OnRecordValidate("payment_plans").BindFunc(validatePlan)
+	app.OnRecordCreate("payment_plans").BindFunc(syncPlan)
+	app.OnRecordUpdate("payment_plans").BindFunc(syncPlan)
+
+	app.OnRecordValidate("payments").BindFunc(validatePayment)
+	app.OnRecordCreate("payments").BindFunc(syncPayment)
+	app.OnRecordUpdate("payments").BindFunc(syncPayment)
+	app.OnRecordDelete("payments").BindFunc(syncPayment)
+
+	app.OnRecordCreate("refunds").BindFunc(syncRefund)
+	app.OnRecordUpdate("refunds").BindFunc(syncRefund)
+
+	app.Cron().MustAdd("paymentPlansMissed", "0 7 * * *", func() {
+		if err := MarkMissed(app); err != nil {
+			app.Logger().Error("Failed to flag the missed instalments", "error", err)
+		}
+	})
+}
+
+// validatePlan checks that the plan pays for an invoice or a treatment
+// plan of the same patient and that its amounts add up.
+func validatePlan(e *core.RecordEvent) error {
+	errs := validation.Errors{}
+
+	invoiceId, treatmentPlanId := e.Record.GetString("invoice"), e.Record.GetString("treatmentPlan")
+	if invoiceId == "" && treatmentPlanId == "" {
+		errs["invoice"] = validation.NewError("validation_required", "An invoice or a treatment plan is required.")
+	}
+
+	if invoice, err := e.App.FindRecordById("invoices", invoiceId); err == nil {
+		if invoice.GetString("patient") != e.Record.GetString("patient") {
+			errs["invoice"] = validation.NewError("validation_invoice_patient", "The invoice belongs to a different patient.")
+		} else if invoice.GetString("status") == "cancelled" {
+			errs["invoice"] = validation.NewError("validation_invoice_cancelled", "The invoice is cancelled.")
+		}
+	}
+
+	if plan, err := e.App.FindRecordById("treatment_plans", treatmentPlanId); err == nil {
+		if plan.GetString("patient") != e.Record.GetString("patient") {
+			errs["treatmentPlan"] = validation.NewError("validation_treatment_plan_patient", "The treatment plan belongs to a different patient.")
+		}
+	}
+
+	total := money.Get(e.Record, "totalAmount")
+	switch {
+	case total <= 0:
+		errs["totalAmount"] = validation.NewError("validation_required", "The amount to pay in instalments is required.")
+	case money.Get(e.Record, "downPayment") >= total:
+		errs["downPayment"] = validation.NewError("validation_down_payment_too_high", "The down payment must be lower than the total amount.")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return e.Next()
+}
+
+// syncPlan defaults the plan amount to the invoice balance or the
+// treatment plan estimate, (re)generates the instalments when the terms
+// change and reallocates the plan payments, in the same transaction.
+func syncPlan(e *core.RecordEvent) error {
+	if e.Record.GetString("status") == "" {
+		e.Record.Set("status", "active")
+	}
+
+	if money.Get(e.Record, "totalAmount") == 0 {
+		if invoice, err := e.App.FindRecordById("invoices", e.Record.GetString("invoice")); err == nil {
+			money.Set(e.Record, "totalAmount", money.Get(invoice, "balanceDue"))
+		} else if plan, err := e.App.FindRecordById("treatment_plans", e.Record.GetString("treatmentPlan")); err == nil {
+			money.Set(e.Record, "totalAmount", money.Get(plan, "estimatedCost"))
+		}
+	}
+
+	regenerate := e.Record.IsNew()
+	for _, field := range scheduleFields {
+		if e.Record.Get(field) != e.Record.Original().Get(field) {
+			regenerate = true
+		}
+	}
+
+	return e.App.RunInTransaction(func(txApp core.App) error {
+		e.App = txApp
+
+		if err := e.Next(); err != nil {
+			return err
+		}
+
+		if regenerate {
+			if err := generateInstalments(txApp, e.Record); err != nil {
+				return err
+			}
+		}
+
+		return Refresh(txApp, e.Record.Id)
+	})
+}
+
+// generateInstalments replaces the plan instalments with the schedule of
+// its current terms.
+func generateInstalments(app core.App, plan *core.Record) error {
+	existing, err := app.FindAllRecords("payment_plan_instalments", dbx.HashExp{"paymentPlan": plan.Id})
+	if err != nil {
+		return err
+	}
+	for _, instalment := range existing {
+		if err := app.Delete(instalment); err != nil {
+			return err
+		}
+	}
+
+	collection, err := app.FindCachedCollectionByNameOrId("payment_plan_instalments")
+	if err != nil {
+		return err
+	}
+
+	schedule := Schedule(
+		money.Get(plan, "totalAmount"),
+		money.Get(plan, "downPayment"),
+		plan.GetInt("numberOfInstalments"),
+		plan.GetString("frequency"),
+		plan.GetDateTime("startDate").Time(),
+	)
+	for _, s := range schedule {
+		instalment := core.NewRecord(collection)
+		instalment.Set("paymentPlan", plan.Id)
+		instalment.Set("patient", plan.GetString("patient"))
+		instalment.Set("sequence", s.Sequence)
+		instalment.Set("dueDate", s.DueDate)
+		money.Set(instalment, "amount", s.Amount)
+		instalment.Set("status", "pending")
+		if err := app.Save(instalment); err != nil {
+			return fmt.Errorf("instalment %d: %w", s.Sequence, err)
+		}
+	}
+
+	return nil
+}
+
+// Refresh allocates the plan payments, net of their refunds, to the
+// instalments in due date order and updates the plan balance. Plans are
+// completed once fully paid. Missed instalments stay missed until paid.
+func Refresh(app core.App, planId string) error {
+	plan, err := app.FindRecordById("payment_plans", planId)
+	if err != nil {
+		return nil // deleted
+	}
+
+	paid, err := planPaid(app, plan.Id)
+	if err != nil {
+		return err
+	}
+
+	instalments, err := app.FindRecordsByFilter(
+		"payment_plan_instalments",
+		"paymentPlan = {:plan}",
+		"dueDate,sequence",
+		0,
+		0,
+		dbx.Params{"plan": plan.Id},
+	)
+	if err != nil {
+		return err
+	}
+
+	remaining := paid
+	for _, instalment := range instalments {
+		amount := money.Get(instalment, "amount")
+		allocated := min(max(remaining, 0), amount)
+		remaining -= allocated
+
+		status := instalment.GetString("status")
+		switch {
+		case allocated >= amount:
+			status = "paid"
+		case status == "missed":
+		case allocated > 0:
+			status = "partial"
+		default:
+			status = "pending"
+		}
+
+		paidDate := instalment.GetDateTime("paidDate")
+		switch {
+		case status != "paid":
+			paidDate = types.DateTime{}
+		case paidDate.IsZero():
+			paidDate = types.NowDateTime()
+		}
+
+		if allocated == money.Get(instalment, "amountPaid") &&
+			status == instalment.GetString("status") &&
+			paidDate.Equal(instalment.GetDateTime("paidDate")) {
+			continue
+		}
+
+		money.Set(instalment, "amountPaid", allocated)
+		instalment.Set("status", status)
+		instalment.Set("paidDate", paidDate)
+		if err := app.Save(instalment); err != nil {
+			return err
+		}
+	}
+
+	balanceDue := money.Get(plan, "totalAmount") - paid
+
+	status := plan.GetString("status")
+	switch {
+	case status == "active" && balanceDue <= 0:
+		status = "completed"
+	case status == "completed" && balanceDue > 0:
+		status = "active"
+	}
+
+	if money.Get(plan, "amountPaid") == paid && money.Get(plan, "balanceDue") == balanceDue && plan.GetString("status") == status {
+		return nil
+	}
+
+	money.Set(plan, "amountPaid", paid)
+	money.Set(plan, "balanceDue", balanceDue)
+	plan.Set("status", status)
+
+	return app.Save(plan)
+}
+
+// planPaid sums the payments made towards the plan in the plan currency,
+// net of their posted refunds.
+func planPaid(app core.App, planId string) (money.Money, error) {
+	var row struct {
+		Total float64 `db:"total"`
+	}
+	err := app.DB().NewQuery(
+		"SELECT " +
+			"(SELECT COALESCE(SUM([[invoiceAmount]]), 0) FROM {{payments}} WHERE [[paymentPlan]] = {:plan}) - " +
+			"(SELECT COALESCE(SUM([[r.amount]]), 0) FROM {{refunds}} r JOIN {{payments}} p ON [[p.id]] = [[r.payment]] " +
+			"WHERE [[p.paymentPlan]] = {:plan} AND [[r.status]] = 'posted') AS total",
+	).Bind(dbx.Params{"plan": planId}).One(&row)
+	if err != nil {
+		return 0, err
+	}
+
+	return money.FromMinor(row.Total), nil
+}
+
+// validatePayment requires an invoice or a payment plan and checks that
+// the payment plan matches the payment patient and invoice. Payments made
+// towards a plan only are checked against the plan balance.
+func validatePayment(e *core.RecordEvent) error {
+	planId := e.Record.GetString("paymentPlan")
+	if planId == "" {
+		if e.Record.GetString("invoice") == "" {
+			return validation.Errors{
+				"invoice": validation.NewError("validation_required", "An invoice or a payment plan is required."),
+			}
+		}
+		return e.Next()
+	}
+
+	plan, err := e.App.FindRecordById("payment_plans", planId)
+	if err != nil {
+		return e.Next() // the relation field validator reports the missing record
+	}
+
+	if plan.GetString("patient") != e.Record.GetString("patient") {
+		return validation.Errors{
+			"paymentPlan": validation.NewError("validation_payment_plan_patient", "The payment plan belongs to a different patient."),
+		}
+	}
+
+	invoiceId := e.Record.GetString("invoice")
+	if invoiceId != "" && plan.GetString("invoice") != "" && invoiceId != plan.GetString("invoice") {
+		return validation.Errors{
+			"paymentPlan": validation.NewError("validation_payment_plan_invoice", "The payment plan is for another invoice."),
+		}
+	}
+
+	if invoiceId != "" || e.Record.GetBool("isOverpayment") {
+		return e.Next() // checked against the invoice balance
+	}
+
+	paid, err := planPaid(e.App, plan.Id)
+	if err != nil {
+		return err
+	}
+	if !e.Record.IsNew() {
+		paid -= money.Get(e.Record.Original(), "invoiceAmount")
+	}
+
+	if outstanding := money.Get(plan, "totalAmount") - paid; money.Get(e.Record, "invoiceAmount") > outstanding {
+		return validation.Errors{
+			"amount": validation.NewError(
+				"validation_overpayment",
+				fmt.Sprintf("The payment plan balance is %s, flag the payment as an overpayment to keep the excess as credit.", money.CurrencyOf(e.App, plan).Display(max(outstanding, 0))),
+			),
+		}
+	}
+
+	return e.Next()
+}
+
+// syncPayment links the payments of an invoice paid in instalments to its
+// active plan, then reallocates the plan payments in the same transaction.
+func syncPayment(e *core.RecordEvent) error {
+	if e.Type != core.ModelEventTypeDelete && e.Record.GetString("paymentPlan") == "" && e.Record.GetString("invoice") != "" {
+		plan, err := e.App.FindFirstRecordByFilter(
+			"payment_plans",
+			"invoice = {:invoice} && status = 'active'",
+			dbx.Params{"invoice": e.Record.GetString("invoice")},
+		)
+		if err == nil {
+			e.Record.Set("paymentPlan", plan.Id)
+		}
+	}
+
+	return e.App.RunInTransaction(func(txApp core.App) error {
+		e.App = txApp
+
+		if err := e.Next(); err != nil {
+			return err
+		}
+
+		if err := Refresh(txApp, e.Record.GetString("paymentPlan")); err != nil {
+			return err
+		}
+
+		// the payment was moved to another plan
+		if previous := e.Record.Original().GetString("paymentPlan"); previous != "" && previous != e.Record.GetString("paymentPlan") {
+			return Refresh(txApp, previous)
+		}
+
+		return nil
+	})
+}
+
+// syncRefund reallocates the plan of the refunded payment.
+func syncRefund(e *core.RecordEvent) error {
+	return e.App.RunInTransaction(func(txApp core.App) error {
+		e.App = txApp
+
+		if err := e.Next(); err != nil {
+			return err
+		}
+
+		payment, err := txApp.FindRecordById("payments", e.Record.GetString("payment"))
+		if err != nil {
+			return nil
+		}
+
+		return Refresh(txApp, payment.GetString("paymentPlan"))
+	})
+}
+
+// isMissed reports whether the instalment is past its due date and grace
+// period.
+func isMissed(instalment *core.Record, graceDays int) bool {
+	due := instalment.GetDateTime("dueDate")
+	return !due.IsZero() && due.Time().AddDate(0, 0, graceDays).Before(dates.Today())
+}
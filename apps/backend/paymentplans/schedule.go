@@ -0,0 +1,57 @@
+package paymentplans
+
+import (
+	"time"
+
+	"zahrawiclinic.com/dates"
+	"zahrawiclinic.com/money"
+)
+
+// Instalment is a scheduled payment of a plan.
+type Instalment struct {
+	// Sequence is 0 for the down payment, then 1 to the number of
+	// instalments.
+	Sequence int
+	DueDate  time.Time
+	Amount   money.Money
+}
+
+// Schedule splits what is left after the down payment in equal
+// instalments, the last one absorbing the rounding. The down payment is
+// due on the start date and the first instalment one period later, or on
+// the start date when there is no down payment.
+func Schedule(total money.Money, downPayment money.Money, count int, frequency string, start time.Time) []Instalment {
+	start = dates.StartOfDay(start)
+	schedule := make([]Instalment, 0, count+1)
+
+	offset := 0
+	if downPayment > 0 {
+		schedule = append(schedule, Instalment{Sequence: 0, DueDate: start, Amount: downPayment})
+		offset = 1
+	}
+
+	for i, amount := range (total - downPayment).Split(count) {
+		schedule = append(schedule, Instalment{
+			Sequence: i + 1,
+			DueDate:  dueDate(start, frequency, i+offset),
+			Amount:   amount,
+		})
+	}
+
+	return schedule
+}
+
+// dueDate returns the date n periods after start. Monthly dates falling
+// after the end of a shorter month are moved to its last day.
+func dueDate(start time.Time, frequency string, n int) time.Time {
+	switch frequency {
+	case "weekly":
+		return start.AddDate(0, 0, 7*n)
+	case "biweekly":
+		return start.AddDate(0, 0, 14*n)
+	default:
+		first := time.Date(start.Year(), start.Month()+time.Month(n), 1, 0, 0, 0, 0, start.Location())
+		lastDay := first.AddDate(0, 1, -1).Day()
+		return first.AddDate(0, 0, min(start.Day(), lastDay)-1)
+	}
+}
@@ -0,0 +1,131 @@
+package pricing
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"zahrawiclinic.com/money"
+)
+
+// Register binds the pricing hooks and routes to the app.
+func Register(app core.App) {
+	app.OnRecordCreate("treatment_plan_items").BindFunc(priceTreatmentPlanItem)
+	app.OnRecordCreate("invoice_items").BindFunc(priceInvoiceItem)
+
+	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
+		g := se.Router.Group("/api/clinic")
+		g.Bind(apis.RequireAuth())
+
+		g.GET("/patients/{id}/fees/{treatmentType}", getFee)
+
+		return se.Next()
+	})
+}
+
+// priceTreatmentPlanItem fills the estimated cost of new plan items that
+// were created without one.
+func priceTreatmentPlanItem(e *core.RecordEvent) error {
+	treatmentTypeId := e.Record.GetString("treatmentType")
+	if money.Get(e.Record, "estimatedCost") != 0 || treatmentTypeId == "" {
+		return e.Next()
+	}
+
+	plan, err := e.App.FindRecordById("treatment_plans", e.Record.GetString("treatmentPlan"))
+	if err != nil {
+		return e.Next() // the relation field validator reports the missing record
+	}
+
+	fee, err := ResolveFee(e.App, plan.GetString("patient"), treatmentTypeId, time.Now())
+	if errors.Is(err, sql.ErrNoRows) {
+		return e.Next() // the relation field validator reports the missing procedure
+	}
+	if err != nil {
+		return err
+	}
+	money.Set(e.Record, "estimatedCost", fee.Amount)
+
+	return e.Next()
+}
+
+// priceInvoiceItem fills the unit price of new invoice items that were
+// created without one from the selling price of the inventory item sold or
+// the fee in effect on the invoice date. The prices are in the clinic
+// currency and converted at the exchange rate of invoices in another
+// currency.
+func priceInvoiceItem(e *core.RecordEvent) error {
+	if inventoryItemId := e.Record.GetString("inventoryItem"); inventoryItemId != "" {
+		if money.Get(e.Record, "unitPrice") != 0 {
+			return e.Next()
+		}
+
+		invoice, err := e.App.FindRecordById("invoices", e.Record.GetString("invoice"))
+		if err != nil {
+			return e.Next() // the relation field validator reports the missing record
+		}
+		if product, err := e.App.FindRecordById("inventory", inventoryItemId); err == nil {
+			money.Set(e.Record, "unitPrice", money.FromBase(invoice, money.Get(product, "sellingPrice")))
+		}
+		return e.Next()
+	}
+
+	if e.Record.GetString("treatmentType") == "" && e.Record.GetString("treatment") != "" {
+		treatment, err := e.App.FindRecordById("treatments", e.Record.GetString("treatment"))
+		if err == nil {
+			e.Record.Set("treatmentType", treatment.GetString("treatmentType"))
+		}
+	}
+
+	treatmentTypeId := e.Record.GetString("treatmentType")
+	if money.Get(e.Record, "unitPrice") != 0 || treatmentTypeId == "" {
+		return e.Next()
+	}
+
+	invoice, err := e.App.FindRecordById("invoices", e.Record.GetString("invoice"))
+	if err != nil {
+		return e.Next() // the relation field validator reports the missing record
+	}
+
+	on := invoice.GetDateTime("invoiceDate").Time()
+	if on.IsZero() {
+		on = time.Now()
+	}
+
+	fee, err := ResolveFee(e.App, invoice.GetString("patient"), treatmentTypeId, on)
+	if errors.Is(err, sql.ErrNoRows) {
+		return e.Next() // the relation field validator reports the missing procedure
+	}
+	if err != nil {
+		return err
+	}
+	money.Set(e.Record, "unitPrice", money.FromBase(invoice, fee.Amount))
+
+	return e.Next()
+}
+
+// getFee handles GET /api/clinic/patients/{id}/fees/{treatmentType}.
+//
+// It returns the fee the patient would be charged for the procedure on the
+// optional "date" query parameter (today by default).
+func getFee(e *core.RequestEvent) error {
+	patient, err := e.App.FindRecordById("patients", e.Request.PathValue("id"))
+	if err != nil {
+		return e.NotFoundError("Patient not found.", err)
+	}
+
+	on := time.Now()
+	if raw := e.Request.URL.Query().Get("date"); raw != "" {
+		if on, err = time.ParseInLocation(time.DateOnly, raw, time.Local); err != nil {
+			return e.BadRequestError("Invalid date, expected YYYY-MM-DD.", nil)
+		}
+	}
+
+	fee, err := ResolveFee(e.App, patient.Id, e.Request.PathValue("treatmentType"), on)
+	if err != nil {
+		return e.NotFoundError("Procedure not found.", err)
+	}
+
+	return e.JSON(200, fee)
+}
@@ -0,0 +1,144 @@
+// Package pricing resolves the fee of a procedure for a patient from the
+// fee schedule of their coverage, the default (cash) schedule or the
+// treatments catalog.
+package pricing
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"zahrawiclinic.com/dates"
+	"zahrawiclinic.com/money"
+)
+
+// Fee sources, from the most to the least specific.
+const (
+	SourceCoverage = "coverage"
+	SourceDefault  = "default_schedule"
+	SourceCatalog  = "catalog"
+)
+
+// Fee is the resolved fee of a procedure.
+type Fee struct {
+	Amount      money.Money `json:"amount"`
+	Source      string      `json:"source"`
+	FeeSchedule string      `json:"feeSchedule"`
+	Coverage    string      `json:"coverage"`
+}
+
+// ActivePrimaryCoverage returns the patient's active primary insurance
+// coverage on the given date or nil if there is none.
+func ActivePrimaryCoverage(app core.App, patientId string, on time.Time) (*core.Record, error) {
+	return ActiveCoverage(app, patientId, "primary", on)
+}
+
+// ActiveCoverage returns the patient's active insurance coverage of the
+// given type (primary, secondary or tertiary) on the given date or nil if
+// there is none.
+func ActiveCoverage(app core.App, patientId string, coverageType string, on time.Time) (*core.Record, error) {
+	date := dates.StartOfDay(on).UTC().Format(types.DefaultDateLayout)
+
+	coverages, err := app.FindRecordsByFilter(
+		"patient_insurance",
+		"patient = {:patient} && isActive = true && coverageType = {:coverageType}"+
+			" && (effectiveDate = '' || effectiveDate <= {:date})"+
+			" && (expirationDate = '' || expirationDate >= {:date})",
+		"-effectiveDate",
+		1,
+		0,
+		dbx.Params{"patient": patientId, "coverageType": coverageType, "date": date},
+	)
+	if err != nil || len(coverages) == 0 {
+		return nil, err
+	}
+
+	return coverages[0], nil
+}
+
+// ResolveFee returns the fee of the procedure for the patient on the given
+// date.
+//
+// The fee comes from the schedule of the patient's active primary coverage,
+// then from the default schedule and finally from the catalog default price
+// when no schedule lists the procedure.
+func ResolveFee(app core.App, patientId string, treatmentTypeId string, on time.Time) (*Fee, error) {
+	treatmentType, err := app.FindRecordById("treatments_catalog", treatmentTypeId)
+	if err != nil {
+		return nil, err
+	}
+
+	coverage, err := ActivePrimaryCoverage(app, patientId, on)
+	if err != nil {
+		return nil, err
+	}
+
+	if coverage != nil && coverage.GetString("feeSchedule") != "" {
+		fee, err := scheduleFee(app, coverage.GetString("feeSchedule"), treatmentType.Id, on)
+		if err != nil {
+			return nil, err
+		}
+		if fee != nil {
+			fee.Source = SourceCoverage
+			fee.Coverage = coverage.Id
+			return fee, nil
+		}
+	}
+
+	defaultSchedule, err := app.FindFirstRecordByFilter("fee_schedules", "isDefault = true")
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		return nil, err
+	default:
+		fee, err := scheduleFee(app, defaultSchedule.Id, treatmentType.Id, on)
+		if err != nil {
+			return nil, err
+		}
+		if fee != nil {
+			fee.Source = SourceDefault
+			return fee, nil
+		}
+	}
+
+	return &Fee{
+		Amount: money.Get(treatmentType, "default_price"),
+		Source: SourceCatalog,
+	}, nil
+}
+
+// scheduleFee returns the fee listed by the schedule or nil if the schedule
+// is not in effect or doesn't list the procedure.
+func scheduleFee(app core.App, scheduleId string, treatmentTypeId string, on time.Time) (*Fee, error) {
+	schedule, err := app.FindRecordById("fee_schedules", scheduleId)
+	if err != nil {
+		return nil, nil // deleted schedule
+	}
+
+	on = dates.StartOfDay(on)
+	effective := schedule.GetDateTime("effectiveDate")
+	expiration := schedule.GetDateTime("expirationDate")
+	if (!effective.IsZero() && on.Before(effective.Time())) || (!expiration.IsZero() && on.After(expiration.Time())) {
+		return nil, nil
+	}
+
+	entry, err := app.FindFirstRecordByFilter(
+		"fee_schedule_entries",
+		"feeSchedule = {:schedule} && treatmentType = {:treatmentType}",
+		dbx.Params{"schedule": schedule.Id, "treatmentType": treatmentTypeId},
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Fee{
+		Amount:      money.Get(entry, "fee"),
+		FeeSchedule: schedule.Id,
+	}, nil
+}
@@ -0,0 +1,309 @@
+// Package recalls tracks when patients are due back for continuing care
+// (hygiene, periodic exams...) based on their completed appointments and
+// treatments.
+package recalls
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"zahrawiclinic.com/dates"
+	"zahrawiclinic.com/tasks"
+)
+
+// Register binds the recall hooks, routes and the daily overdue job to the app.
+func Register(app core.App) {
+	refresh := func(e *core.RecordEvent) error {
+		if err := Refresh(e.App, e.Record.GetString("patient")); err != nil {
+			e.App.Logger().Error(
+				"Failed to refresh patient recalls",
+				"patient", e.Record.GetString("patient"),
+				"error", err,
+			)
+		}
+		return e.Next()
+	}
+	app.OnRecordAfterCreateSuccess("appointments", "treatments").BindFunc(refresh)
+	app.OnRecordAfterUpdateSuccess("appointments", "treatments").BindFunc(refresh)
+	app.OnRecordAfterDeleteSuccess("appointments", "treatments").BindFunc(refresh)
+
+	app.OnRecordCreate("patient_recalls").BindFunc(computeNextDueDate)
+	app.OnRecordUpdate("patient_recalls").BindFunc(computeNextDueDate)
+
+	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
+		registerRoutes(se)
+		return se.Next()
+	})
+
+	app.Cron().MustAdd("recallsOverdue", "30 7 * * *", func() {
+		if err := CreateOverdueTasks(app); err != nil {
+			app.Logger().Error("Failed to create overdue recall tasks", "error", err)
+		}
+	})
+}
+
+// Refresh recomputes the last visit of every active recall type for the
+// patient, creating the patient recall on the first qualifying visit.
+func Refresh(app core.App, patientId string) error {
+	if _, err := app.FindRecordById("patients", patientId); err != nil {
+		return nil // deleted together with its appointments
+	}
+
+	recallTypes, err := app.FindAllRecords("recall_types", dbx.HashExp{"isActive": true})
+	if err != nil {
+		return err
+	}
+
+	for _, recallType := range recallTypes {
+		last, err := lastVisit(app, patientId, recallType)
+		if err != nil {
+			return err
+		}
+
+		recall, err := app.FindFirstRecordByFilter(
+			"patient_recalls",
+			"patient = {:patient} && recallType = {:recallType}",
+			dbx.Params{"patient": patientId, "recallType": recallType.Id},
+		)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			if last.IsZero() {
+				continue
+			}
+			collection, err := app.FindCachedCollectionByNameOrId("patient_recalls")
+			if err != nil {
+				return err
+			}
+			recall = core.NewRecord(collection)
+			recall.Set("patient", patientId)
+			recall.Set("recallType", recallType.Id)
+			recall.Set("status", "active")
+		case err != nil:
+			return err
+		case recall.GetDateTime("lastVisitDate").Equal(last):
+			continue
+		}
+
+		recall.Set("lastVisitDate", last)
+		if err := app.Save(recall); err != nil {
+			return fmt.Errorf("recall %s: %w", recallType.GetString("code"), err)
+		}
+	}
+
+	return nil
+}
+
+// lastVisit returns the most recent completed appointment or treatment that
+// satisfies the recall type.
+func lastVisit(app core.App, patientId string, recallType *core.Record) (types.DateTime, error) {
+	var latest types.DateTime
+
+	if values := recallType.GetStringSlice("appointmentTypes"); len(values) > 0 {
+		var last sql.NullString
+		err := app.DB().
+			Select("MAX(CASE WHEN [[completedAt]] != '' THEN [[completedAt]] ELSE [[start_time]] END)").
+			From("appointments").
+			Where(dbx.HashExp{"patient": patientId, "status": "completed"}).
+			AndWhere(dbx.In("type", anySlice(values)...)).
+			Row(&last)
+		if err != nil {
+			return latest, err
+		}
+		latest = laterOf(latest, last)
+	}
+
+	if values := recallType.GetStringSlice("treatmentTypes"); len(values) > 0 {
+		var last sql.NullString
+		err := app.DB().
+			Select("MAX([[completedAt]])").
+			From("treatments").
+			Where(dbx.HashExp{"patient": patientId}).
+			AndWhere(dbx.In("treatmentType", anySlice(values)...)).
+			AndWhere(dbx.NewExp("[[completedAt]] != ''")).
+			Row(&last)
+		if err != nil {
+			return latest, err
+		}
+		latest = laterOf(latest, last)
+	}
+
+	return latest, nil
+}
+
+func laterOf(current types.DateTime, raw sql.NullString) types.DateTime {
+	if !raw.Valid || raw.String == "" {
+		return current
+	}
+	candidate, err := types.ParseDateTime(raw.String)
+	if err != nil || !candidate.After(current) {
+		return current
+	}
+	return candidate
+}
+
+// computeNextDueDate derives nextDueDate from the last visit and the
+// patient specific interval (falling back to the recall type default).
+func computeNextDueDate(e *core.RecordEvent) error {
+	last := e.Record.GetDateTime("lastVisitDate")
+	if last.IsZero() {
+		e.Record.Set("nextDueDate", "")
+		return e.Next()
+	}
+
+	months := e.Record.GetInt("intervalMonths")
+	if months <= 0 {
+		recallType, err := e.App.FindRecordById("recall_types", e.Record.GetString("recallType"))
+		if err != nil {
+			return e.Next() // the relation field validator reports the missing record
+		}
+		months = recallType.GetInt("intervalMonths")
+	}
+
+	e.Record.Set("nextDueDate", last.Time().AddDate(0, months, 0))
+
+	return e.Next()
+}
+
+// Due is an active patient recall that is due soon or already overdue.
+type Due struct {
+	Recall     *core.Record
+	Patient    *core.Record
+	RecallType *core.Record
+
+	// DaysOverdue is negative while the recall is not due yet.
+	DaysOverdue int
+
+	// ScheduledAppointment is the id of an upcoming appointment that
+	// satisfies the recall, if any.
+	ScheduledAppointment string
+}
+
+// IsOverdue reports whether the due date has passed.
+func (d *Due) IsOverdue() bool {
+	return d.DaysOverdue > 0
+}
+
+// FindDue returns the active recalls due before until, oldest first.
+func FindDue(app core.App, until time.Time) ([]*Due, error) {
+	recalls, err := app.FindRecordsByFilter(
+		"patient_recalls",
+		"status = 'active' && nextDueDate != '' && nextDueDate < {:until}",
+		"nextDueDate",
+		0,
+		0,
+		dbx.Params{"until": until.UTC().Format(types.DefaultDateLayout)},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if errs := app.ExpandRecords(recalls, []string{"patient", "recallType"}, nil); len(errs) > 0 {
+		return nil, fmt.Errorf("failed to expand patient recalls: %v", errs)
+	}
+
+	today := dates.Today()
+	result := make([]*Due, 0, len(recalls))
+	for _, recall := range recalls {
+		due := &Due{
+			Recall:      recall,
+			Patient:     recall.ExpandedOne("patient"),
+			RecallType:  recall.ExpandedOne("recallType"),
+			DaysOverdue: dates.DaysBetween(recall.GetDateTime("nextDueDate").Time(), today),
+		}
+		if due.Patient == nil || due.RecallType == nil {
+			continue
+		}
+
+		due.ScheduledAppointment, err = upcomingAppointment(app, due.Patient.Id, due.RecallType)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, due)
+	}
+
+	return result, nil
+}
+
+// upcomingAppointment returns the id of the next booked appointment that
+// would satisfy the recall type.
+func upcomingAppointment(app core.App, patientId string, recallType *core.Record) (string, error) {
+	query := app.DB().
+		Select("id").
+		From("appointments").
+		Where(dbx.HashExp{"patient": patientId}).
+		AndWhere(dbx.In("status", "scheduled", "confirmed")).
+		AndWhere(dbx.NewExp("[[start_time]] >= {:now}", dbx.Params{"now": types.NowDateTime().String()})).
+		OrderBy("start_time ASC").
+		Limit(1)
+
+	if values := recallType.GetStringSlice("appointmentTypes"); len(values) > 0 {
+		query.AndWhere(dbx.In("type", anySlice(values)...))
+	}
+
+	var id string
+	err := query.Row(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+
+	return id, err
+}
+
+// CreateOverdueTasks raises a follow_up task to call every patient with an
+// overdue recall and no appointment booked for it yet.
+func CreateOverdueTasks(app core.App) error {
+	overdue, err := FindDue(app, dates.Today())
+	if err != nil {
+		return err
+	}
+
+	for _, due := range overdue {
+		if due.ScheduledAppointment != "" {
+			continue
+		}
+
+		nextDue := due.Recall.GetDateTime("nextDueDate").Time()
+		patientName := strings.TrimSpace(due.Patient.GetString("firstName") + " " + due.Patient.GetString("lastName"))
+
+		phone := due.Patient.GetString("mobile")
+		if phone == "" {
+			phone = due.Patient.GetString("phone")
+		}
+
+		_, err := tasks.Ensure(app, tasks.Task{
+			Source:   fmt.Sprintf("recall_overdue:%s:%s", due.Recall.Id, nextDue.Format(time.DateOnly)),
+			Title:    fmt.Sprintf("Call %s: %s overdue", patientName, due.RecallType.GetString("name")),
+			Priority: "medium",
+			Category: "follow_up",
+			DueDate:  dates.Today(),
+			Description: fmt.Sprintf(
+				"%s was due on %s (last visit %s). Call %s to book an appointment.",
+				due.RecallType.GetString("name"),
+				nextDue.Format(time.DateOnly),
+				due.Recall.GetDateTime("lastVisitDate").Time().Format(time.DateOnly),
+				phone,
+			),
+			Patient: due.Patient.Id,
+		})
+		if err != nil {
+			return fmt.Errorf("patient recall %s: %w", due.Recall.Id, err)
+		}
+	}
+
+	return nil
+}
+
+func anySlice(values []string) []any {
+	result := make([]any, len(values))
+	for i, v := range values {
+		result[i] = v
+	}
+	return result
+}
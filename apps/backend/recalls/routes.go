@@ -0,0 +1,117 @@
+package recalls
+
+import (
+	"strconv"
+
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"zahrawiclinic.com/dates"
+)
+
+// defaultDueWindowDays is how far ahead "due" recalls are listed by default.
+const defaultDueWindowDays = 30
+
+func registerRoutes(se *core.ServeEvent) {
+	g := se.Router.Group("/api/clinic")
+	g.Bind(apis.RequireAuth())
+
+	g.GET("/recalls", listRecalls)
+}
+
+type recallPatient struct {
+	Id        string `json:"id"`
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+	Phone     string `json:"phone"`
+	Mobile    string `json:"mobile"`
+	Email     string `json:"email"`
+}
+
+type recallType struct {
+	Id   string `json:"id"`
+	Code string `json:"code"`
+	Name string `json:"name"`
+}
+
+type recallItem struct {
+	Id                   string         `json:"id"`
+	Status               string         `json:"status"`
+	Patient              recallPatient  `json:"patient"`
+	RecallType           recallType     `json:"recallType"`
+	LastVisitDate        types.DateTime `json:"lastVisitDate"`
+	NextDueDate          types.DateTime `json:"nextDueDate"`
+	DaysOverdue          int            `json:"daysOverdue"`
+	ScheduledAppointment string         `json:"scheduledAppointment"`
+}
+
+// listRecalls handles GET /api/clinic/recalls.
+//
+// Query parameters:
+//   - status: "due", "overdue" or "all" (default)
+//   - days: how many days ahead due recalls are included (default 30)
+func listRecalls(e *core.RequestEvent) error {
+	status := e.Request.URL.Query().Get("status")
+	if status == "" {
+		status = "all"
+	}
+	if status != "all" && status != "due" && status != "overdue" {
+		return e.BadRequestError("Invalid status, expected due, overdue or all.", nil)
+	}
+
+	days := defaultDueWindowDays
+	if raw := e.Request.URL.Query().Get("days"); raw != "" {
+		var err error
+		if days, err = strconv.Atoi(raw); err != nil || days < 0 {
+			return e.BadRequestError("Invalid days parameter.", nil)
+		}
+	}
+
+	until := dates.Today()
+	if status != "overdue" {
+		until = until.AddDate(0, 0, days+1)
+	}
+
+	found, err := FindDue(e.App, until)
+	if err != nil {
+		return e.InternalServerError("Failed to load recalls.", err)
+	}
+
+	items := make([]recallItem, 0, len(found))
+	for _, due := range found {
+		itemStatus := "due"
+		if due.IsOverdue() {
+			itemStatus = "overdue"
+		}
+		if status != "all" && status != itemStatus {
+			continue
+		}
+
+		items = append(items, recallItem{
+			Id:     due.Recall.Id,
+			Status: itemStatus,
+			Patient: recallPatient{
+				Id:        due.Patient.Id,
+				FirstName: due.Patient.GetString("firstName"),
+				LastName:  due.Patient.GetString("lastName"),
+				Phone:     due.Patient.GetString("phone"),
+				Mobile:    due.Patient.GetString("mobile"),
+				Email:     due.Patient.GetString("email"),
+			},
+			RecallType: recallType{
+				Id:   due.RecallType.Id,
+				Code: due.RecallType.GetString("code"),
+				Name: due.RecallType.GetString("name"),
+			},
+			LastVisitDate:        due.Recall.GetDateTime("lastVisitDate"),
+			NextDueDate:          due.Recall.GetDateTime("nextDueDate"),
+			DaysOverdue:          max(due.DaysOverdue, 0),
+			ScheduledAppointment: due.ScheduledAppointment,
+		})
+	}
+
+	return e.JSON(200, map[string]any{
+		"asOf":  types.NowDateTime(),
+		"items": items,
+	})
+}
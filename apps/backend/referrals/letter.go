@@ -0,0 +1,406 @@
+package referrals
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/filesystem"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"zahrawiclinic.com/documents"
+)
+
+// recentTreatmentsLimit caps the treatment history printed when the
+// referral is not about specific teeth.
+const recentTreatmentsLimit = 10
+
+// generateLetter handles POST /api/clinic/referrals/{id}/letter.
+//
+// It renders the referral letter of an outgoing referral, stores it in the
+// referral "letter" field and returns the PDF.
+func generateLetter(e *core.RequestEvent) error {
+	referral, err := e.App.FindRecordById("referrals", e.Request.PathValue("id"))
+	if err != nil {
+		return e.NotFoundError("Referral not found.", err)
+	}
+
+	if referral.GetString("direction") != "outgoing" {
+		return e.BadRequestError("Letters can only be generated for outgoing referrals.", nil)
+	}
+
+	content, err := RenderLetter(e.App, referral)
+	if err != nil {
+		return e.InternalServerError("Failed to generate the referral letter.", err)
+	}
+
+	file, err := filesystem.NewFileFromBytes(content, "referral-"+referral.Id+".pdf")
+	if err != nil {
+		return e.InternalServerError("", err)
+	}
+
+	referral.Set("letter", file)
+	referral.Set("letterGeneratedAt", types.NowDateTime())
+	if err := e.App.Save(referral); err != nil {
+		return e.BadRequestError("Failed to save the referral letter.", err)
+	}
+
+	return e.Blob(200, "application/pdf", content)
+}
+
+// RenderLetter builds the referral letter PDF from the patient's medical
+// history, dental chart and treatments relevant to the referral.
+func RenderLetter(app core.App, referral *core.Record) ([]byte, error) {
+	if errs := app.ExpandRecord(referral, []string{"patient", "receivingProvider", "clinician", "images"}, nil); len(errs) > 0 {
+		return nil, fmt.Errorf("failed to expand referral: %v", errs)
+	}
+
+	patient := referral.ExpandedOne("patient")
+	if patient == nil {
+		return nil, fmt.Errorf("missing referral patient")
+	}
+
+	teeth := toothNumbers(referral.GetString("toothNumbers"))
+
+	doc := documents.New("Referral letter", documents.LetterheadFromApp(app))
+
+	referralDate := referral.GetDateTime("referralDate")
+	if referralDate.IsZero() {
+		referralDate = types.NowDateTime()
+	}
+	doc.Paragraph(referralDate.Time().Format("2 January 2006"))
+
+	if provider := referral.ExpandedOne("receivingProvider"); provider != nil {
+		doc.Paragraph(strings.Join(providerLines(app, provider), "\n"))
+	}
+
+	doc.Title("Re: " + fullName(patient))
+	doc.Field("Date of birth", formatDate(patient.GetDateTime("dateOfBirth")))
+	doc.Field("Gender", patient.GetString("gender"))
+	doc.Field("Phone", firstNonEmpty(patient.GetString("mobile"), patient.GetString("phone")))
+	doc.Field("Urgency", referral.GetString("urgency"))
+	doc.Field("Teeth", strings.Join(teeth, ", "))
+
+	doc.Heading("Reason for referral")
+	doc.Paragraph(referral.GetString("reason"))
+	if notes := referral.GetString("notes"); notes != "" {
+		doc.Paragraph(notes)
+	}
+
+	if err := writeMedicalHistory(app, doc, patient.Id); err != nil {
+		return nil, err
+	}
+
+	if err := writeDentalChart(app, doc, patient.Id, teeth); err != nil {
+		return nil, err
+	}
+
+	if err := writeTreatments(app, doc, patient.Id, teeth); err != nil {
+		return nil, err
+	}
+
+	if images := referral.ExpandedAll("images"); len(images) > 0 {
+		doc.Heading("Enclosed imaging")
+		rows := make([][]string, 0, len(images))
+		for _, image := range images {
+			rows = append(rows, []string{
+				formatDate(image.GetDateTime("acquisitionDate")),
+				image.GetString("modality"),
+				image.GetString("bodyPart"),
+				image.GetString("description"),
+			})
+		}
+		doc.Table([]documents.Column{
+			{Header: "Date", Width: 0.2},
+			{Header: "Modality", Width: 0.15},
+			{Header: "Region", Width: 0.25},
+			{Header: "Description", Width: 0.4},
+		}, rows)
+	}
+
+	doc.Space(8)
+	doc.Paragraph("Thank you for seeing this patient. Please do not hesitate to contact us should you require any further information.")
+	doc.Space(4)
+	doc.Paragraph("Kind regards,")
+	if clinician := referral.ExpandedOne("clinician"); clinician != nil {
+		doc.Paragraph(firstNonEmpty(clinician.GetString("name"), clinician.GetString("email")))
+	}
+
+	return doc.Bytes()
+}
+
+func writeMedicalHistory(app core.App, doc *documents.Document, patientId string) error {
+	histories, err := app.FindRecordsByFilter(
+		"medical_history",
+		"patient = {:patient}",
+		"-recordDate",
+		1,
+		0,
+		dbx.Params{"patient": patientId},
+	)
+	if err != nil {
+		return err
+	}
+
+	doc.Heading("Medical history")
+
+	if len(histories) == 0 {
+		doc.Paragraph("No medical history on record.")
+		return nil
+	}
+	history := histories[0]
+
+	doc.Field("Recorded", formatDate(history.GetDateTime("recordDate")))
+	doc.Field("Conditions", orNone(jsonText(history.Get("conditions"))))
+	doc.Field("Allergies", orNone(jsonText(history.Get("allergies"))))
+	doc.Field("Medications", orNone(jsonText(history.Get("medications"))))
+	doc.Field("Smoking", habit(history.GetBool("smoking"), history.GetString("smokingFrequency")))
+	doc.Field("Alcohol", habit(history.GetBool("alcohol"), history.GetString("alcoholFrequency")))
+	doc.Field("Previous dental work", history.GetString("previousDentalWork"))
+	doc.Field("Notes", history.GetString("notes"))
+
+	return nil
+}
+
+// writeDentalChart prints the chart entries of the referred teeth or, when
+// the referral isn't about specific teeth, every non healthy tooth.
+func writeDentalChart(app core.App, doc *documents.Document, patientId string, teeth []string) error {
+	entries, err := app.FindAllRecords("dental_chart", dbx.HashExp{"patient": patientId})
+	if err != nil {
+		return err
+	}
+
+	entries = slices.DeleteFunc(entries, func(entry *core.Record) bool {
+		if len(teeth) > 0 {
+			return !slices.Contains(teeth, entry.GetString("toothNumber"))
+		}
+		return entry.GetString("status") == "healthy"
+	})
+	if len(entries) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].GetString("toothNumber") < entries[j].GetString("toothNumber")
+	})
+
+	rows := make([][]string, 0, len(entries))
+	for _, entry := range entries {
+		rows = append(rows, []string{
+			entry.GetString("toothNumber"),
+			entry.GetString("status"),
+			strings.Join(nonEmpty(jsonText(entry.Get("conditions")), jsonText(entry.Get("surfaces"))), "; "),
+			entry.GetString("notes"),
+		})
+	}
+
+	doc.Heading("Dental chart")
+	doc.Table([]documents.Column{
+		{Header: "Tooth", Width: 0.1},
+		{Header: "Status", Width: 0.15},
+		{Header: "Conditions", Width: 0.35},
+		{Header: "Notes", Width: 0.4},
+	}, rows)
+
+	return nil
+}
+
+// writeTreatments prints the treatment history of the referred teeth or the
+// most recent treatments when the referral isn't about specific teeth.
+func writeTreatments(app core.App, doc *documents.Document, patientId string, teeth []string) error {
+	limit := 0
+	if len(teeth) == 0 {
+		limit = recentTreatmentsLimit
+	}
+
+	treatments, err := app.FindRecordsByFilter(
+		"treatments",
+		"patient = {:patient}",
+		"-treatmentDate",
+		limit,
+		0,
+		dbx.Params{"patient": patientId},
+	)
+	if err != nil {
+		return err
+	}
+
+	if len(teeth) > 0 {
+		treatments = slices.DeleteFunc(treatments, func(treatment *core.Record) bool {
+			return !slices.Contains(teeth, treatment.GetString("toothNumber"))
+		})
+	}
+	if len(treatments) == 0 {
+		return nil
+	}
+
+	if errs := app.ExpandRecords(treatments, []string{"treatmentType"}, nil); len(errs) > 0 {
+		return fmt.Errorf("failed to expand treatments: %v", errs)
+	}
+
+	rows := make([][]string, 0, len(treatments))
+	for _, treatment := range treatments {
+		var name string
+		if treatmentType := treatment.ExpandedOne("treatmentType"); treatmentType != nil {
+			name = treatmentType.GetString("name")
+		}
+		rows = append(rows, []string{
+			formatDate(treatment.GetDateTime("treatmentDate")),
+			treatment.GetString("toothNumber"),
+			strings.Join(nonEmpty(name, treatment.GetString("procedure")), ": "),
+			treatment.GetString("diagnosis"),
+		})
+	}
+
+	doc.Heading("Treatment history")
+	doc.Table([]documents.Column{
+		{Header: "Date", Width: 0.15},
+		{Header: "Tooth", Width: 0.1},
+		{Header: "Treatment", Width: 0.45},
+		{Header: "Diagnosis", Width: 0.3},
+	}, rows)
+
+	return nil
+}
+
+func providerLines(app core.App, provider *core.Record) []string {
+	lines := nonEmpty(provider.GetString("name"), provider.GetString("practiceName"))
+
+	if addressId := provider.GetString("address"); addressId != "" {
+		if address, err := app.FindRecordById("addresses", addressId); err == nil {
+			lines = append(lines, nonEmpty(
+				address.GetString("street1"),
+				address.GetString("street2"),
+				strings.Join(nonEmpty(address.GetString("city"), address.GetString("state"), address.GetString("zipCode")), " "),
+				address.GetString("country"),
+			)...)
+		}
+	}
+
+	return lines
+}
+
+// jsonText renders the free form medical JSON fields (lists of strings or
+// objects, or plain objects) as a single line.
+func jsonText(value any) string {
+	raw, ok := value.(types.JSONRaw)
+	if !ok || len(raw) == 0 {
+		return ""
+	}
+
+	var decoded any
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		return string(raw)
+	}
+
+	return describe(decoded)
+}
+
+func describe(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		if v {
+			return "yes"
+		}
+		return ""
+	case []any:
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			if text := describe(item); text != "" {
+				parts = append(parts, text)
+			}
+		}
+		return strings.Join(parts, ", ")
+	case map[string]any:
+		for _, key := range []string{"name", "title", "label"} {
+			if name, ok := v[key].(string); ok && name != "" {
+				rest := make([]string, 0, len(v))
+				for _, detail := range sortedKeys(v) {
+					if detail == key {
+						continue
+					}
+					if text := describe(v[detail]); text != "" {
+						rest = append(rest, text)
+					}
+				}
+				if len(rest) == 0 {
+					return name
+				}
+				return name + " (" + strings.Join(rest, ", ") + ")"
+			}
+		}
+		parts := make([]string, 0, len(v))
+		for _, key := range sortedKeys(v) {
+			if text := describe(v[key]); text != "" {
+				parts = append(parts, key+": "+text)
+			}
+		}
+		return strings.Join(parts, ", ")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func habit(active bool, frequency string) string {
+	if !active {
+		return "No"
+	}
+	if frequency == "" {
+		return "Yes"
+	}
+	return "Yes, " + frequency
+}
+
+func formatDate(d types.DateTime) string {
+	if d.IsZero() {
+		return ""
+	}
+	return d.Time().Local().Format(time.DateOnly)
+}
+
+func fullName(record *core.Record) string {
+	return strings.TrimSpace(record.GetString("firstName") + " " + record.GetString("lastName"))
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "None reported"
+	}
+	return s
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func nonEmpty(values ...string) []string {
+	result := make([]string, 0, len(values))
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
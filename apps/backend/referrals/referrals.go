@@ -0,0 +1,79 @@
+// Package referrals manages patients referred to the clinic by outside
+// practitioners and patients the clinic refers on to specialists.
+package referrals
+
+import (
+	"strings"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// Register binds the referral hooks and routes to the app.
+func Register(app core.App) {
+	app.OnRecordValidate("referrals").BindFunc(validateReferral)
+
+	app.OnRecordCreate("referrals").BindFunc(stampReferralDate)
+
+	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
+		g := se.Router.Group("/api/clinic")
+		g.Bind(apis.RequireAuth())
+
+		g.POST("/referrals/{id}/letter", generateLetter)
+
+		return se.Next()
+	})
+}
+
+// validateReferral requires the provider matching the referral direction
+// and makes sure the attached images are the patient's.
+func validateReferral(e *core.RecordEvent) error {
+	errs := validation.Errors{}
+
+	switch e.Record.GetString("direction") {
+	case "incoming":
+		if e.Record.GetString("referringProvider") == "" {
+			errs["referringProvider"] = validation.NewError("validation_required", "Incoming referrals require the referring provider.")
+		}
+	case "outgoing":
+		if e.Record.GetString("receivingProvider") == "" {
+			errs["receivingProvider"] = validation.NewError("validation_required", "Outgoing referrals require the receiving provider.")
+		}
+	}
+
+	if ids := e.Record.GetStringSlice("images"); len(ids) > 0 {
+		images, err := e.App.FindRecordsByIds("imaging_records", ids)
+		if err != nil {
+			return err
+		}
+		for _, image := range images {
+			if image.GetString("patient") != e.Record.GetString("patient") {
+				errs["images"] = validation.NewError("validation_image_patient", "The attached images must belong to the referred patient.")
+				break
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return e.Next()
+}
+
+// stampReferralDate defaults the referral date to the creation date.
+func stampReferralDate(e *core.RecordEvent) error {
+	if e.Record.GetDateTime("referralDate").IsZero() {
+		e.Record.Set("referralDate", types.NowDateTime())
+	}
+	return e.Next()
+}
+
+// toothNumbers splits a free text tooth list ("36, 37 46") into numbers.
+func toothNumbers(raw string) []string {
+	return strings.FieldsFunc(raw, func(r rune) bool {
+		return r == ',' || r == ';' || r == ' '
+	})
+}
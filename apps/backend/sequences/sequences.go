@@ -0,0 +1,111 @@
+// Package sequences assigns gap-free document numbers (invoices, credit
+// notes...) from the counters stored in the number_sequences collection.
+package sequences
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// Register binds the number sequences validation to the app.
+func Register(app core.App) {
+	app.OnRecordValidate("number_sequences").BindFunc(validateSequence)
+}
+
+// Next increments the sequence counter and returns the formatted number of
+// a document dated on the given day, e.g. "INV-2025-00042".
+//
+// The sequences reset yearly keep a counter per year (yearValues) so that
+// a back-dated document is numbered in its own year without reusing a
+// number. currentYear and lastValue follow the latest year.
+//
+// It must run in the transaction that saves the numbered record so that a
+// failed save releases the number and no gap is left.
+func Next(app core.App, key string, on time.Time) (string, error) {
+	// touch first so that the counter row is locked before it is read
+	result, err := app.DB().NewQuery(
+		"UPDATE {{number_sequences}} SET [[updated]] = strftime('%Y-%m-%d %H:%M:%fZ') WHERE [[key]] = {:key}",
+	).Bind(dbx.Params{"key": key}).Execute()
+	if err != nil {
+		return "", err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return "", fmt.Errorf("missing %q number sequence", key)
+	}
+
+	sequence, err := app.FindFirstRecordByData("number_sequences", "key", key)
+	if err != nil {
+		return "", err
+	}
+
+	year, current := on.Year(), sequence.GetInt("currentYear")
+	value := sequence.GetInt("lastValue") + 1
+
+	if sequence.GetBool("resetYearly") {
+		values := map[string]int{}
+		if err := sequence.UnmarshalJSONField("yearValues", &values); err != nil {
+			return "", err
+		}
+
+		value = values[strconv.Itoa(year)] + 1
+		values[strconv.Itoa(year)] = value
+		sequence.Set("yearValues", values)
+	}
+
+	switch {
+	case !sequence.GetBool("resetYearly"):
+		sequence.Set("currentYear", max(year, current))
+		sequence.Set("lastValue", value)
+	case year >= current:
+		sequence.Set("currentYear", year)
+		sequence.Set("lastValue", value)
+	}
+
+	if err := app.Save(sequence); err != nil {
+		return "", err
+	}
+
+	return Format(sequence, year, value), nil
+}
+
+// Format formats a counter value with the sequence prefix, year and padding.
+func Format(sequence *core.Record, year int, value int) string {
+	parts := make([]string, 0, 3)
+
+	if prefix := sequence.GetString("prefix"); prefix != "" {
+		parts = append(parts, prefix)
+	}
+
+	if sequence.GetBool("includeYear") {
+		parts = append(parts, strconv.Itoa(year))
+	}
+
+	counter := strconv.Itoa(value)
+	if padding := sequence.GetInt("padding"); len(counter) < padding {
+		counter = strings.Repeat("0", padding-len(counter)) + counter
+	}
+	parts = append(parts, counter)
+
+	return strings.Join(parts, sequence.GetString("separator"))
+}
+
+// validateSequence rejects the sequences reset yearly whose numbers don't
+// include the year: they would number INV-0001 again every January.
+func validateSequence(e *core.RecordEvent) error {
+	if e.Record.GetBool("resetYearly") && !e.Record.GetBool("includeYear") {
+		return validation.Errors{
+			"includeYear": validation.NewError(
+				"validation_sequence_year_required",
+				"A sequence reset yearly must include the year, or it would reuse its numbers.",
+			),
+		}
+	}
+
+	return e.Next()
+}
@@ -0,0 +1,76 @@
+package statements
+
+import (
+	"fmt"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/spf13/cobra"
+	"zahrawiclinic.com/dates"
+)
+
+func newCommand(app core.App) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "statements",
+		Short: "Manages the patient statements",
+	}
+
+	command.AddCommand(newSendCommand(app))
+
+	return command
+}
+
+func newSendCommand(app core.App) *cobra.Command {
+	var month string
+	var opts RunOptions
+
+	command := &cobra.Command{
+		Use:   "send",
+		Short: "Generates and emails the monthly statements of the patients with a balance",
+		Long: `Generates the statements of a month for every patient with a balance
+due at the end of the month, stores their PDF and emails them to the
+patient email address.
+
+Statements already sent for the month are skipped, so the command can be
+run again after fixing the failed emails (e.g. missing addresses).`,
+		Example:      "  statements send --month 2025-09",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			period := PreviousMonth(dates.Today())
+			if month != "" {
+				var err error
+				if period, err = ParseMonth(month); err != nil {
+					return err
+				}
+			}
+
+			result, err := Run(app, period, opts)
+			if err != nil {
+				return err
+			}
+
+			if opts.DryRun {
+				fmt.Printf("(dry run) %s: %d patients with a balance\n", period, result.Patients)
+				return nil
+			}
+
+			fmt.Printf(
+				"%s: %d patients with a balance: %d statements generated, %d sent, %d failed, %d already sent\n",
+				period,
+				result.Patients,
+				result.Generated,
+				result.Sent,
+				result.Failed,
+				result.Skipped,
+			)
+
+			return nil
+		},
+	}
+
+	command.Flags().StringVar(&month, "month", "", "month of the statements, YYYY-MM (default: the previous month)")
+	command.Flags().BoolVar(&opts.NoEmail, "no-email", false, "generate the statements without emailing them")
+	command.Flags().BoolVar(&opts.DryRun, "dry-run", false, "count the patients with a balance without generating anything")
+
+	return command
+}
@@ -0,0 +1,149 @@
+package statements
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"zahrawiclinic.com/documents"
+	"zahrawiclinic.com/money"
+)
+
+// Render builds the statement PDF: the account summary, the ledger
+// entries of the period with the running balance and the aging of the
+// unpaid invoices.
+func Render(app core.App, patient *core.Record, period Period, summary Summary) ([]byte, error) {
+	entries, err := app.FindRecordsByFilter(
+		"ledger_entries",
+		"patient = {:patient} && date >= {:from} && date < {:to}",
+		"date,created,id",
+		0,
+		0,
+		dbx.Params{
+			"patient": patient.Id,
+			"from":    formatDateTime(period.Start),
+			"to":      formatDateTime(period.end()),
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := documents.New("Statement "+period.String(), documents.LetterheadFromApp(app))
+
+	doc.Paragraph(time.Now().Format("2 January 2006"))
+	doc.Paragraph(strings.Join(addressLines(app, patient), "\n"))
+
+	doc.Title("Statement of account")
+	doc.Field("Period", period.String())
+	doc.Field("Patient", fullName(patient))
+	doc.Field("Date of birth", formatDate(patient.GetDateTime("dateOfBirth")))
+
+	doc.Heading("Account summary")
+	lines := [][2]string{
+		{"Previous balance", summary.PreviousBalance.String()},
+		{"New charges", summary.NewCharges.String()},
+		{"Payments", (-summary.Payments).String()},
+		{"Insurance payments", (-summary.InsuranceAdjustments).String()},
+	}
+	if summary.OtherAdjustments != 0 {
+		lines = append(lines, [2]string{"Adjustments", (-summary.OtherAdjustments).String()})
+	}
+	lines = append(lines, [2]string{"Account balance", summary.ClosingBalance.String()})
+	if summary.PendingInsurance != 0 {
+		lines = append(lines, [2]string{"Pending insurance", (-summary.PendingInsurance).String()})
+	}
+	lines = append(lines, [2]string{"Amount due", summary.AmountDue.String()})
+	doc.Totals(lines)
+
+	doc.Heading("Account activity")
+	if len(entries) == 0 {
+		doc.Paragraph("No activity during the period.")
+	} else {
+		balance := summary.PreviousBalance
+		rows := make([][]string, 0, len(entries)+1)
+		rows = append(rows, []string{period.Start.Format(time.DateOnly), "Balance brought forward", "", "", balance.String()})
+		for _, entry := range entries {
+			debit, credit := money.Get(entry, "debit"), money.Get(entry, "credit")
+			balance += debit - credit
+			rows = append(rows, []string{
+				formatDate(entry.GetDateTime("date")),
+				entry.GetString("description"),
+				amount(debit),
+				amount(credit),
+				balance.String(),
+			})
+		}
+		doc.Table([]documents.Column{
+			{Header: "Date", Width: 0.15},
+			{Header: "Description", Width: 0.4},
+			{Header: "Charges", Width: 0.15, Align: "R"},
+			{Header: "Credits", Width: 0.15, Align: "R"},
+			{Header: "Balance", Width: 0.15, Align: "R"},
+		}, rows)
+	}
+
+	doc.Heading("Unpaid invoices by age")
+	doc.Table([]documents.Column{
+		{Header: "Current", Width: 0.2, Align: "R"},
+		{Header: "31-60 days", Width: 0.2, Align: "R"},
+		{Header: "61-90 days", Width: 0.2, Align: "R"},
+		{Header: "Over 90 days", Width: 0.2, Align: "R"},
+		{Header: "Total", Width: 0.2, Align: "R"},
+	}, [][]string{{
+		summary.Aging.Current.String(),
+		summary.Aging.Days30.String(),
+		summary.Aging.Days60.String(),
+		summary.Aging.Days90.String(),
+		summary.Aging.Total().String(),
+	}})
+
+	doc.Space(6)
+	if summary.AmountDue > 0 {
+		doc.Paragraph("Please settle the amount due at your earliest convenience. If you have already paid, please disregard this statement.")
+	}
+	doc.Paragraph("Please contact us with any question about your account.")
+
+	return doc.Bytes()
+}
+
+// addressLines returns the patient name and postal address.
+func addressLines(app core.App, patient *core.Record) []string {
+	lines := []string{fullName(patient)}
+
+	if addressId := patient.GetString("primaryAddress"); addressId != "" {
+		if address, err := app.FindRecordById("addresses", addressId); err == nil {
+			lines = append(lines, nonEmpty(
+				address.GetString("street1"),
+				address.GetString("street2"),
+				strings.Join(nonEmpty(address.GetString("city"), address.GetString("state"), address.GetString("zipCode")), " "),
+				address.GetString("country"),
+			)...)
+		}
+	}
+
+	return lines
+}
+
+// amount formats a ledger amount, leaving zero amounts blank.
+func amount(m money.Money) string {
+	if m == 0 {
+		return ""
+	}
+	return m.String()
+}
+
+func fullName(record *core.Record) string {
+	return strings.TrimSpace(record.GetString("firstName") + " " + record.GetString("lastName"))
+}
+
+func nonEmpty(values ...string) []string {
+	result := make([]string, 0, len(values))
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
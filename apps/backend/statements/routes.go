@@ -0,0 +1,88 @@
+package statements
+
+import (
+	"errors"
+
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"zahrawiclinic.com/dates"
+)
+
+func registerRoutes(se *core.ServeEvent) {
+	g := se.Router.Group("/api/clinic")
+	g.Bind(apis.RequireAuth())
+
+	g.POST("/patients/{id}/statements", generateStatement)
+	g.POST("/statements/{id}/send", sendStatement)
+}
+
+// generateStatement handles POST /api/clinic/patients/{id}/statements.
+//
+// It generates the statement of the patient for a month, replacing the
+// statement of that month not sent yet, and returns it.
+//
+// Body parameters:
+//   - month: the month of the statement, YYYY-MM (default: the previous month)
+//   - send: also email the statement to the patient (default: false)
+func generateStatement(e *core.RequestEvent) error {
+	patient, err := e.App.FindRecordById("patients", e.Request.PathValue("id"))
+	if err != nil {
+		return e.NotFoundError("Patient not found.", err)
+	}
+
+	var body struct {
+		Month string `json:"month"`
+		Send  bool   `json:"send"`
+	}
+	if err := e.BindBody(&body); err != nil {
+		return e.BadRequestError("Failed to read the submitted data.", err)
+	}
+
+	period := PreviousMonth(dates.Today())
+	if body.Month != "" {
+		if period, err = ParseMonth(body.Month); err != nil {
+			return e.BadRequestError("Invalid month, expected YYYY-MM.", nil)
+		}
+	}
+
+	statement, err := Generate(e.App, patient.Id, period)
+	if errors.Is(err, ErrSent) {
+		return e.BadRequestError("The statement of this month was already sent.", nil)
+	}
+	if err != nil {
+		return e.InternalServerError("Failed to generate the statement.", err)
+	}
+
+	if body.Send {
+		if err := Send(e.App, statement); err != nil {
+			e.App.Logger().Warn("Failed to send the patient statement", "statement", statement.Id, "error", err)
+		}
+	}
+
+	if err := apis.EnrichRecord(e, statement); err != nil {
+		return e.InternalServerError("", err)
+	}
+
+	return e.JSON(200, statement)
+}
+
+// sendStatement handles POST /api/clinic/statements/{id}/send.
+//
+// It emails the statement to the patient, again if it was already sent,
+// and returns it with the sending status.
+func sendStatement(e *core.RequestEvent) error {
+	statement, err := e.App.FindRecordById("patient_statements", e.Request.PathValue("id"))
+	if err != nil {
+		return e.NotFoundError("Statement not found.", err)
+	}
+
+	if err := Send(e.App, statement); err != nil {
+		e.App.Logger().Warn("Failed to send the patient statement", "statement", statement.Id, "error", err)
+	}
+
+	if err := apis.EnrichRecord(e, statement); err != nil {
+		return e.InternalServerError("", err)
+	}
+
+	return e.JSON(200, statement)
+}
@@ -0,0 +1,182 @@
+package statements
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"zahrawiclinic.com/documents"
+	"zahrawiclinic.com/money"
+	"zahrawiclinic.com/notify"
+)
+
+const (
+	emailSubject = "Your statement for {PERIOD}"
+	emailBody    = `<p>Dear {PATIENT_NAME},</p>
+<p>Please find attached your statement of account for {PERIOD}. The amount due is {AMOUNT_DUE}.</p>
+<p>Please contact us with any question about your account.</p>`
+)
+
+var errNoEmail = errors.New("the patient has no email address")
+
+// Send emails the statement PDF to the patient and records when and to
+// whom it was sent. Failures are recorded on the statement with the failed
+// status and returned.
+func Send(app core.App, statement *core.Record) error {
+	patient, err := app.FindRecordById("patients", statement.GetString("patient"))
+	if err != nil {
+		return err
+	}
+
+	to := patient.GetString("email")
+	sendErr := errNoEmail
+	if to != "" {
+		sendErr = sendEmail(app, statement, patient, to)
+	}
+
+	if sendErr != nil {
+		statement.Set("status", "failed")
+		statement.Set("error", truncate(sendErr.Error(), 1000))
+	} else {
+		statement.Set("status", "sent")
+		statement.Set("sentAt", types.NowDateTime())
+		statement.Set("sentTo", to)
+		statement.Set("error", "")
+	}
+
+	if err := app.Save(statement); err != nil {
+		return err
+	}
+
+	return sendErr
+}
+
+func sendEmail(app core.App, statement *core.Record, patient *core.Record, to string) error {
+	content, err := documents.ReadFile(app, statement, "document")
+	if err != nil {
+		return err
+	}
+
+	period := Period{
+		Start: statement.GetDateTime("periodStart").Time().Local(),
+		End:   statement.GetDateTime("periodEnd").Time().Local(),
+	}
+
+	values := map[string]string{
+		"PATIENT_NAME": fullName(patient),
+		"PERIOD":       period.String(),
+		"AMOUNT_DUE":   money.Get(statement, "amountDue").String(),
+	}
+
+	return notify.SendEmail(app, notify.Email{
+		To:      to,
+		Subject: notify.Render(emailSubject, values),
+		HTML:    notify.RenderHTML(emailBody, values),
+		Attachments: map[string]io.Reader{
+			fmt.Sprintf("statement-%s.pdf", period.Start.Format("2006-01")): bytes.NewReader(content),
+		},
+	})
+}
+
+// RunOptions configure a statements run.
+type RunOptions struct {
+	// NoEmail generates the statements without sending them.
+	NoEmail bool
+
+	// DryRun reports the patients with a balance without generating
+	// anything.
+	DryRun bool
+}
+
+// RunResult counts the statements of a run.
+type RunResult struct {
+	Patients  int
+	Generated int
+	Sent      int
+
+	// Failed counts the statements that couldn't be generated or emailed.
+	Failed int
+
+	// Skipped counts the statements of the period already sent.
+	Skipped int
+}
+
+// Run generates the statements of the period of every patient with a
+// positive balance at the end of the period and emails them. The
+// statements already sent are skipped so that the run can be repeated;
+// the failed emails are recorded on their statement, and the patients whose
+// statement fails to generate are logged and skipped.
+func Run(app core.App, period Period, opts RunOptions) (RunResult, error) {
+	var result RunResult
+
+	var balances []struct {
+		Patient string  `db:"patient"`
+		Balance float64 `db:"balance"`
+	}
+	err := app.DB().
+		Select("[[patient]]", "SUM([[debit]] - [[credit]]) AS balance").
+		From("ledger_entries").
+		Where(dbx.NewExp("[[date]] < {:to}", dbx.Params{"to": formatDateTime(period.end())})).
+		GroupBy("patient").
+		Having(dbx.NewExp("SUM([[debit]] - [[credit]]) > 0")).
+		OrderBy("patient").
+		All(&balances)
+	if err != nil {
+		return result, err
+	}
+
+	result.Patients = len(balances)
+	if opts.DryRun {
+		return result, nil
+	}
+
+	for _, balance := range balances {
+		statement, err := Generate(app, balance.Patient, period)
+		if errors.Is(err, ErrSent) {
+			result.Skipped++
+			continue
+		}
+		if err != nil {
+			// one patient must not block the statements of the others
+			app.Logger().Error(
+				"Failed to generate the patient statement",
+				"patient", balance.Patient,
+				"period", period.Start.Format(time.DateOnly),
+				"error", err,
+			)
+			result.Failed++
+			continue
+		}
+		result.Generated++
+
+		if opts.NoEmail {
+			continue
+		}
+
+		if err := Send(app, statement); err != nil {
+			app.Logger().Warn(
+				"Failed to send the patient statement",
+				"patient", balance.Patient,
+				"period", period.Start.Format(time.DateOnly),
+				"error", err,
+			)
+			result.Failed++
+			continue
+		}
+		result.Sent++
+	}
+
+	return result, nil
+}
+
+func truncate(s string, length int) string {
+	if len(s) > length {
+		return s[:length]
+	}
+	return s
+}
@@ -0,0 +1,347 @@
+// Package statements generates the monthly account statements of the
+// patients from their ledger, renders them as PDF and emails them.
+//
+// A statement shows the balance brought forward, the charges, payments,
+// insurance payments and adjustments of the period, the insurance still
+// expected and the amount due, with the unpaid invoices by age. The
+// statements are stored in the patient_statements collection, one per
+// patient and period.
+package statements
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/filesystem"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"github.com/spf13/cobra"
+	"zahrawiclinic.com/dates"
+	"zahrawiclinic.com/money"
+)
+
+// ErrSent is returned by Generate when the statement of the period was
+// already sent to the patient.
+var ErrSent = errors.New("statement already sent")
+
+// Register binds the statements routes, the monthly statements run and the
+// statements command to the app.
+func Register(app core.App, rootCmd *cobra.Command) {
+	app.Cron().MustAdd("patientStatements", "0 7 1 * *", func() {
+		if _, err := Run(app, PreviousMonth(dates.Today()), RunOptions{}); err != nil {
+			app.Logger().Error("Failed to send the patient statements", "error", err)
+		}
+	})
+
+	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
+		registerRoutes(se)
+		return se.Next()
+	})
+
+	rootCmd.AddCommand(newCommand(app))
+}
+
+// Period is the range of days covered by a statement, both included.
+type Period struct {
+	Start time.Time
+	End   time.Time
+}
+
+// Month returns the period of the calendar month of t.
+func Month(t time.Time) Period {
+	start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.Local)
+	return Period{Start: start, End: start.AddDate(0, 1, -1)}
+}
+
+// PreviousMonth returns the period of the calendar month before t.
+func PreviousMonth(t time.Time) Period {
+	return Month(time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.Local).AddDate(0, -1, 0))
+}
+
+// ParseMonth returns the period of a YYYY-MM month.
+func ParseMonth(s string) (Period, error) {
+	t, err := time.ParseInLocation("2006-01", s, time.Local)
+	if err != nil {
+		return Period{}, fmt.Errorf("invalid month %q, expected YYYY-MM", s)
+	}
+	return Month(t), nil
+}
+
+// String formats the period for the documents, e.g. "September 2026".
+func (p Period) String() string {
+	if p.Start.Day() == 1 && p.End.Equal(Month(p.Start).End) {
+		return p.Start.Format("January 2006")
+	}
+	return p.Start.Format("2 January 2006") + " - " + p.End.Format("2 January 2006")
+}
+
+// end returns the first instant after the period.
+func (p Period) end() time.Time {
+	return dates.StartOfDay(p.End).AddDate(0, 0, 1)
+}
+
+// Aging splits the unpaid invoices by days since their invoice date.
+type Aging struct {
+	Current money.Money // up to 30 days
+	Days30  money.Money // 31 to 60 days
+	Days60  money.Money // 61 to 90 days
+	Days90  money.Money // over 90 days
+}
+
+// Total returns the sum of the buckets.
+func (a Aging) Total() money.Money {
+	return a.Current + a.Days30 + a.Days60 + a.Days90
+}
+
+// Summary holds the figures of a statement. The payments and adjustments
+// are positive when they reduce the balance.
+type Summary struct {
+	PreviousBalance      money.Money
+	NewCharges           money.Money
+	Payments             money.Money
+	InsuranceAdjustments money.Money
+	OtherAdjustments     money.Money
+
+	// ClosingBalance is the ledger balance at the end of the period.
+	ClosingBalance money.Money
+
+	// PendingInsurance is the insurance amount expected on the unpaid
+	// invoices and not paid yet.
+	PendingInsurance money.Money
+
+	// AmountDue is what the patient owes, the closing balance less the
+	// pending insurance.
+	AmountDue money.Money
+
+	Aging Aging
+}
+
+// Compute computes the statement figures of the patient over the period.
+//
+// The activity comes from the ledger, the pending insurance and the aging
+// from the balance of the invoices issued until the end of the period, as
+// of the end of the period: a statement generated again later shows the
+// same figures.
+func Compute(app core.App, patientId string, period Period) (Summary, error) {
+	var summary Summary
+
+	var opening struct {
+		Balance float64 `db:"balance"`
+	}
+	err := app.DB().
+		Select("COALESCE(SUM([[debit]] - [[credit]]), 0) AS balance").
+		From("ledger_entries").
+		Where(dbx.HashExp{"patient": patientId}).
+		AndWhere(dbx.NewExp("[[date]] < {:from}", dbx.Params{"from": formatDateTime(period.Start)})).
+		One(&opening)
+	if err != nil {
+		return summary, err
+	}
+	summary.PreviousBalance = money.FromMinor(opening.Balance)
+
+	var rows []struct {
+		Type string  `db:"type"`
+		Net  float64 `db:"net"`
+	}
+	err = app.DB().
+		Select("[[type]]", "COALESCE(SUM([[debit]] - [[credit]]), 0) AS net").
+		From("ledger_entries").
+		Where(dbx.HashExp{"patient": patientId}).
+		AndWhere(dbx.NewExp("[[date]] >= {:from} AND [[date]] < {:to}", dbx.Params{
+			"from": formatDateTime(period.Start),
+			"to":   formatDateTime(period.end()),
+		})).
+		GroupBy("type").
+		All(&rows)
+	if err != nil {
+		return summary, err
+	}
+
+	summary.ClosingBalance = summary.PreviousBalance
+	for _, row := range rows {
+		net := money.FromMinor(row.Net)
+		summary.ClosingBalance += net
+
+		switch row.Type {
+		case "charge":
+			summary.NewCharges += net
+		case "payment", "refund":
+			summary.Payments -= net
+		case "insurance_payment":
+			summary.InsuranceAdjustments -= net
+		default:
+			summary.OtherAdjustments -= net
+		}
+	}
+
+	// the cancelled invoices are reversed in the ledger when cancelled,
+	// possibly after the period
+	invoices, err := app.FindRecordsByFilter(
+		"invoices",
+		"patient = {:patient} && status != 'draft' && invoiceDate < {:to}",
+		"invoiceDate",
+		0,
+		0,
+		dbx.Params{"patient": patientId, "to": formatDateTime(period.end())},
+	)
+	if err != nil {
+		return summary, err
+	}
+
+	for _, invoice := range invoices {
+		balance, pending, err := invoiceBalance(app, invoice, period.end())
+		if err != nil {
+			return summary, fmt.Errorf("invoice %s: %w", invoice.GetString("invoiceNumber"), err)
+		}
+
+		// the statement is in the clinic currency, like the ledger
+		summary.PendingInsurance += money.ToBase(invoice, pending)
+
+		due := balance - money.ToBase(invoice, pending)
+		if due <= 0 {
+			continue
+		}
+
+		switch age := dates.DaysBetween(invoice.GetDateTime("invoiceDate").Time(), period.End); {
+		case age <= 30:
+			summary.Aging.Current += due
+		case age <= 60:
+			summary.Aging.Days30 += due
+		case age <= 90:
+			summary.Aging.Days60 += due
+		default:
+			summary.Aging.Days90 += due
+		}
+	}
+
+	summary.AmountDue = summary.ClosingBalance - summary.PendingInsurance
+
+	return summary, nil
+}
+
+// invoiceBalance returns the ledger balance of the invoice before the given
+// time, in the clinic currency, and the insurance amount still expected on
+// it then, in the invoice currency, as billing.ComputeBalance does for the
+// current balance: the claims made before, at their paid amount when paid
+// before and not denied before, less the insurance payments made before.
+func invoiceBalance(app core.App, invoice *core.Record, before time.Time) (money.Money, money.Money, error) {
+	params := dbx.Params{"invoice": invoice.Id, "before": formatDateTime(before)}
+
+	var ledger struct {
+		Balance float64 `db:"balance"`
+	}
+	err := app.DB().
+		Select("COALESCE(SUM([[debit]] - [[credit]]), 0) AS balance").
+		From("ledger_entries").
+		Where(dbx.NewExp("[[invoice]] = {:invoice} AND [[date]] < {:before}", params)).
+		One(&ledger)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var insurance struct {
+		Expected float64 `db:"expected"`
+		Paid     float64 `db:"paid"`
+	}
+	err = app.DB().NewQuery(`
+		SELECT
+			(SELECT COALESCE(SUM(CASE
+				WHEN status IN ('paid', 'partial') AND paidDate != '' AND paidDate < {:before} THEN paidAmount
+				ELSE claimedAmount
+			END), 0) FROM insurance_claims
+			WHERE invoice = {:invoice} AND claimDate < {:before}
+				AND NOT (status = 'denied' AND (processedDate = '' OR processedDate < {:before}))) AS expected,
+			(SELECT COALESCE(SUM(invoiceAmount), 0) FROM payments
+			WHERE invoice = {:invoice} AND paymentMethod = 'insurance' AND paymentDate < {:before})
+			- (SELECT COALESCE(SUM(amount), 0) FROM refunds
+			WHERE invoice = {:invoice} AND refundMethod = 'insurance' AND status = 'posted' AND postedAt < {:before}) AS paid
+	`).Bind(params).One(&insurance)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	pending := max(money.FromMinor(insurance.Expected)-money.FromMinor(insurance.Paid), 0)
+
+	return money.FromMinor(ledger.Balance), pending, nil
+}
+
+// Generate computes and renders the statement of the patient for the
+// period and stores it, replacing the statement of the same period not
+// sent yet. It fails with ErrSent when the statement was already sent.
+func Generate(app core.App, patientId string, period Period) (*core.Record, error) {
+	patient, err := app.FindRecordById("patients", patientId)
+	if err != nil {
+		return nil, err
+	}
+
+	statement, err := app.FindFirstRecordByFilter(
+		"patient_statements",
+		"patient = {:patient} && periodStart = {:start}",
+		dbx.Params{"patient": patient.Id, "start": formatDateTime(period.Start)},
+	)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		collection, err := app.FindCachedCollectionByNameOrId("patient_statements")
+		if err != nil {
+			return nil, err
+		}
+		statement = core.NewRecord(collection)
+		statement.Set("patient", patient.Id)
+		statement.Set("periodStart", period.Start)
+	case err != nil:
+		return nil, err
+	case statement.GetString("status") == "sent":
+		return statement, ErrSent
+	}
+
+	summary, err := Compute(app, patient.Id, period)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := Render(app, patient, period, summary)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := filesystem.NewFileFromBytes(content, fmt.Sprintf("statement-%s.pdf", period.Start.Format("2006-01")))
+	if err != nil {
+		return nil, err
+	}
+
+	statement.Set("periodEnd", period.End)
+	money.Set(statement, "previousBalance", summary.PreviousBalance)
+	money.Set(statement, "newCharges", summary.NewCharges)
+	money.Set(statement, "payments", summary.Payments)
+	money.Set(statement, "insuranceAdjustments", summary.InsuranceAdjustments)
+	money.Set(statement, "otherAdjustments", summary.OtherAdjustments)
+	money.Set(statement, "pendingInsurance", summary.PendingInsurance)
+	money.Set(statement, "amountDue", summary.AmountDue)
+	money.Set(statement, "agingCurrent", summary.Aging.Current)
+	money.Set(statement, "aging30", summary.Aging.Days30)
+	money.Set(statement, "aging60", summary.Aging.Days60)
+	money.Set(statement, "aging90", summary.Aging.Days90)
+	statement.Set("document", file)
+	statement.Set("status", "generated")
+	statement.Set("error", "")
+
+	if err := app.Save(statement); err != nil {
+		return nil, err
+	}
+
+	return statement, nil
+}
+
+func formatDateTime(t time.Time) string {
+	return t.UTC().Format(types.DefaultDateLayout)
+}
+
+func formatDate(d types.DateTime) string {
+	if d.IsZero() {
+		return ""
+	}
+	return d.Time().Local().Format(time.DateOnly)
+}
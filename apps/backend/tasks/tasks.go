@@ -0,0 +1,62 @@
+// Package tasks creates staff tasks on behalf of hooks and background jobs.
+package tasks
+
+import (
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// Task describes a task raised automatically for the clinic staff.
+type Task struct {
+	// Source identifies the job and the subject the task was raised for
+	// (eg. "lab_case_overdue:<id>:<dueDate>"). Only one task is ever
+	// created per source.
+	Source string
+
+	Title       string
+	Description string
+	Priority    string // low, medium, high or urgent
+	Category    string // administrative, clinical, follow_up, billing or other
+	DueDate     time.Time
+	AssignedTo  string
+	Patient     string
+}
+
+// Ensure creates t unless a task with the same source already exists,
+// completed or not. It reports whether a new task was created.
+func Ensure(app core.App, t Task) (bool, error) {
+	if t.Source != "" {
+		count, err := app.CountRecords("tasks", dbx.HashExp{"source": t.Source})
+		if err != nil {
+			return false, err
+		}
+		if count > 0 {
+			return false, nil
+		}
+	}
+
+	collection, err := app.FindCachedCollectionByNameOrId("tasks")
+	if err != nil {
+		return false, err
+	}
+
+	record := core.NewRecord(collection)
+	record.Set("source", t.Source)
+	record.Set("title", t.Title)
+	record.Set("description", t.Description)
+	record.Set("priority", t.Priority)
+	record.Set("category", t.Category)
+	record.Set("assignedTo", t.AssignedTo)
+	record.Set("relatedPatient", t.Patient)
+	if !t.DueDate.IsZero() {
+		record.Set("dueDate", t.DueDate)
+	}
+
+	if err := app.Save(record); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,95 @@
+// Package taxes configures the taxes of the invoice items: the tax_rates
+// collection holds, for each tax category (medical services or retail
+// products), the rates in effect over time. Exempt rates are reported apart
+// from the zero rated ones.
+package taxes
+
+import (
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"zahrawiclinic.com/dates"
+)
+
+// The tax categories of the invoice items.
+const (
+	CategoryMedical = "medical_service"
+	CategoryRetail  = "retail_product"
+)
+
+// Register binds the tax rates validation to the app.
+func Register(app core.App) {
+	app.OnRecordValidate("tax_rates").BindFunc(validateRate)
+}
+
+// Resolve returns the tax rate of the category in effect on the given date
+// or nil when no rate is configured, i.e. the items aren't taxed.
+func Resolve(app core.App, category string, on time.Time) (*core.Record, error) {
+	date := dates.StartOfDay(on).UTC().Format(types.DefaultDateLayout)
+
+	rates, err := app.FindRecordsByFilter(
+		"tax_rates",
+		"category = {:category} && effectiveFrom <= {:date} && (effectiveTo = '' || effectiveTo >= {:date})",
+		"-effectiveFrom",
+		1,
+		0,
+		dbx.Params{"category": category, "date": date},
+	)
+	if err != nil || len(rates) == 0 {
+		return nil, err
+	}
+
+	return rates[0], nil
+}
+
+// validateRate checks the rate period and that only one rate of the
+// category is in effect on any date.
+func validateRate(e *core.RecordEvent) error {
+	from := e.Record.GetDateTime("effectiveFrom")
+	to := e.Record.GetDateTime("effectiveTo")
+
+	if !from.IsZero() && !to.IsZero() && to.Before(from) {
+		return validation.Errors{
+			"effectiveTo": validation.NewError("validation_effective_to_before_from", "The end date must be after the start date."),
+		}
+	}
+
+	if e.Record.GetBool("exempt") && e.Record.GetFloat("rate") != 0 {
+		return validation.Errors{
+			"rate": validation.NewError("validation_exempt_rate", "Exempt rates must be 0."),
+		}
+	}
+
+	if from.IsZero() {
+		return e.Next() // the required field validator reports it
+	}
+
+	filter := "id != {:id} && category = {:category} && (effectiveTo = '' || effectiveTo >= {:from})"
+	params := dbx.Params{
+		"id":       e.Record.Id,
+		"category": e.Record.GetString("category"),
+		"from":     from.String(),
+	}
+	if !to.IsZero() {
+		filter += " && effectiveFrom <= {:to}"
+		params["to"] = to.String()
+	}
+
+	overlapping, err := e.App.FindRecordsByFilter("tax_rates", filter, "effectiveFrom", 1, 0, params)
+	if err != nil {
+		return err
+	}
+	if len(overlapping) > 0 {
+		return validation.Errors{
+			"effectiveFrom": validation.NewError(
+				"validation_overlapping_tax_rate",
+				"Another rate of this category ("+overlapping[0].GetString("name")+") is in effect over this period, set its end date first.",
+			),
+		}
+	}
+
+	return e.Next()
+}
@@ -0,0 +1,511 @@
+package x12
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"zahrawiclinic.com/claims"
+	"zahrawiclinic.com/dates"
+	"zahrawiclinic.com/money"
+	"zahrawiclinic.com/sequences"
+)
+
+// version837 is the implementation guide of the 837 dental claims.
+const version837 = "005010X224A2"
+
+// ExportOptions configures an 837D export.
+type ExportOptions struct {
+	// Test flags the interchange as test data (ISA15 "T").
+	Test bool
+}
+
+// Export837 writes the claims as an 837D dental claim interchange and
+// marks the pending ones as submitted.
+//
+// The billing provider is the clinic of the clinic_settings collection.
+// Each claim lists the covered items of its invoice with their CDT code
+// and, for the secondary claims, the payment of the primary claim.
+func Export837(app core.App, w io.Writer, records []*core.Record, opts ExportOptions) error {
+	if len(records) == 0 {
+		return errors.New("no claims to export")
+	}
+
+	var buf bytes.Buffer
+
+	err := app.RunInTransaction(func(txApp core.App) error {
+		settings, err := clinicSettings(txApp)
+		if err != nil {
+			return err
+		}
+
+		control, err := sequences.Next(txApp, "x12_interchange", time.Now())
+		if err != nil {
+			return err
+		}
+
+		enc := &encoder{app: txApp, w: NewWriter(&buf), settings: settings}
+		enc.header(control, time.Now(), opts)
+		for _, claim := range records {
+			if err := enc.claim(claim); err != nil {
+				return fmt.Errorf("claim %s: %w", claim.Id, err)
+			}
+		}
+		enc.trailer(control)
+
+		if err := enc.w.Flush(); err != nil {
+			return err
+		}
+
+		for _, claim := range records {
+			if claim.GetString("status") != "pending" {
+				continue
+			}
+			claim.Set("status", "submitted")
+			claim.Set("submittedDate", dates.Today())
+			if err := txApp.Save(claim); err != nil {
+				return fmt.Errorf("claim %s: %w", claim.Id, err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// clinicSettings returns the clinic settings record, checking the billing
+// provider identifiers required by the claims.
+func clinicSettings(app core.App) (*core.Record, error) {
+	records, err := app.FindRecordsByFilter("clinic_settings", "", "created", 1, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("missing clinic settings")
+	}
+
+	settings := records[0]
+	for _, field := range []string{"npi", "taxId", "x12SenderId", "x12ReceiverId"} {
+		if settings.GetString(field) == "" {
+			return nil, fmt.Errorf("the clinic settings miss the %s", field)
+		}
+	}
+
+	return settings, nil
+}
+
+// encoder writes the 837D segments.
+type encoder struct {
+	app      core.App
+	w        *Writer
+	settings *core.Record
+
+	// hl is the last hierarchical level number.
+	hl int
+}
+
+// header writes the interchange, group and transaction headers, the
+// submitter, the receiver and the billing provider.
+func (enc *encoder) header(control string, now time.Time, opts ExportOptions) {
+	s := enc.settings
+	sender := s.GetString("x12SenderId")
+	receiver := s.GetString("x12ReceiverId")
+
+	usage := "P"
+	if opts.Test {
+		usage = "T"
+	}
+
+	enc.w.writeRaw(strings.Join([]string{
+		"ISA", "00", pad("", 10), "00", pad("", 10),
+		"ZZ", pad(sender, 15), "ZZ", pad(receiver, 15),
+		now.Format("060102"), now.Format("1504"),
+		repetitionSeparator, "00501", control, "0", usage, componentSeparator,
+	}, elementSeparator))
+
+	group := strconv.Itoa(controlNumber(control))
+	enc.w.Write("GS", "HC", sender, receiver, now.Format("20060102"), now.Format("1504"), group, "X", version837)
+	enc.w.Write("ST", "837", "0001", version837)
+	enc.w.Write("BHT", "0019", "00", control, now.Format("20060102"), now.Format("1504"), "CH")
+
+	// 1000A submitter and 1000B receiver
+	enc.w.Write("NM1", "41", "2", s.GetString("name"), "", "", "", "", "46", sender)
+	contact := []string{"IC", s.GetString("name")}
+	if phone := digits(s.GetString("phone")); phone != "" {
+		contact = append(contact, "TE", phone)
+	}
+	if email := s.GetString("email"); email != "" {
+		contact = append(contact, "EM", email)
+	}
+	enc.w.Write("PER", contact...)
+	enc.w.Write("NM1", "40", "2", s.GetString("x12ReceiverName"), "", "", "", "", "46", receiver)
+
+	// 2000A billing provider
+	enc.hl++
+	enc.w.Write("HL", strconv.Itoa(enc.hl), "", "20", "1")
+	enc.w.Write("NM1", "85", "2", s.GetString("name"), "", "", "", "", "XX", s.GetString("npi"))
+	enc.w.Write("N3", s.GetString("address"))
+	enc.w.Write("N4", s.GetString("city"), s.GetString("state"), digits(s.GetString("postalCode")))
+	enc.w.Write("REF", "EI", digits(s.GetString("taxId")))
+}
+
+// trailer closes the transaction, group and interchange.
+func (enc *encoder) trailer(control string) {
+	enc.w.Write("SE", strconv.Itoa(enc.w.Count()+1), "0001")
+	enc.w.Write("GE", "1", strconv.Itoa(controlNumber(control)))
+	enc.w.Write("IEA", "1", control)
+}
+
+// claim writes the subscriber, patient and claim loops of a claim.
+func (enc *encoder) claim(claim *core.Record) error {
+	app := enc.app
+
+	coverage, err := app.FindRecordById("patient_insurance", claim.GetString("insurance"))
+	if err != nil {
+		return errors.New("missing coverage")
+	}
+	if coverage.GetString("payerId") == "" {
+		return errors.New("the coverage has no payer id")
+	}
+
+	patient, err := app.FindRecordById("patients", claim.GetString("patient"))
+	if err != nil {
+		return errors.New("missing patient")
+	}
+
+	invoice, err := app.FindRecordById("invoices", claim.GetString("invoice"))
+	if err != nil {
+		return errors.New("the claim has no invoice")
+	}
+
+	lines, err := enc.serviceLines(invoice)
+	if err != nil {
+		return err
+	}
+	if len(lines) == 0 {
+		return errors.New("the invoice has no covered procedure")
+	}
+
+	// the claim amounts are in the currency of its invoice
+	currency := money.CurrencyOf(app, invoice)
+
+	var charge money.Money
+	for _, line := range lines {
+		charge += line.Amount
+	}
+
+	relationship := coverage.GetString("relationshipToPolicyHolder")
+	self := relationship == "" || relationship == "self"
+
+	// 2000B subscriber
+	enc.hl++
+	subscriberHL := enc.hl
+	hasChild := "0"
+	if !self {
+		hasChild = "1"
+	}
+	enc.w.Write("HL", strconv.Itoa(subscriberHL), "1", "22", hasChild)
+	enc.w.Write("SBR", payerSequence(coverage), relationshipCode(self), coverage.GetString("groupNumber"), "", "", "", "", "", "CI")
+
+	// 2010BA subscriber and 2010BB payer
+	if self {
+		enc.person("IL", patient.GetString("lastName"), patient.GetString("firstName"), "MI", coverage.GetString("policyNumber"))
+		enc.address(patient.GetString("primaryAddress"))
+		enc.demographics(patient.GetDateTime("dateOfBirth").Time(), patient.GetString("gender"))
+	} else {
+		last, first := splitName(coverage.GetString("policyHolderName"))
+		enc.person("IL", last, first, "MI", coverage.GetString("policyNumber"))
+		enc.demographics(coverage.GetDateTime("policyHolderDOB").Time(), coverage.GetString("policyHolderGender"))
+	}
+	enc.w.Write("NM1", "PR", "2", coverage.GetString("provider"), "", "", "", "", "PI", coverage.GetString("payerId"))
+	enc.address(coverage.GetString("insuranceAddress"))
+
+	// 2000C patient
+	if !self {
+		enc.hl++
+		enc.w.Write("HL", strconv.Itoa(enc.hl), strconv.Itoa(subscriberHL), "23", "0")
+		enc.w.Write("PAT", patientRelationshipCode(relationship))
+		enc.person("QC", patient.GetString("lastName"), patient.GetString("firstName"), "", "")
+		enc.address(patient.GetString("primaryAddress"))
+		enc.demographics(patient.GetDateTime("dateOfBirth").Time(), patient.GetString("gender"))
+	}
+
+	// 2300 claim
+	enc.w.Write("CLM", claim.Id, amount(currency, charge), "", "", Composite("11", "B", "1"), "Y", "A", "Y", "Y")
+
+	if err := enc.renderingProvider(lines); err != nil {
+		return err
+	}
+
+	if primaryId := claim.GetString("primaryClaim"); primaryId != "" {
+		if err := enc.otherSubscriber(primaryId); err != nil {
+			return err
+		}
+	}
+
+	// 2400 service lines
+	serviceDate := dateD8(invoice.GetDateTime("invoiceDate").Time())
+	for i, line := range lines {
+		enc.w.Write("LX", strconv.Itoa(i+1))
+		enc.w.Write("SV3", Composite("AD", line.Code), amount(currency, line.Amount), "", "", "", quantity(line.Quantity))
+		if line.Tooth != "" {
+			enc.w.Write("TOO", "JP", line.Tooth, Composite(surfaces(line.Surface)...))
+		}
+		enc.w.Write("DTP", "472", "D8", serviceDate)
+		enc.w.Write("REF", "6R", line.Item)
+	}
+
+	return nil
+}
+
+// serviceLine is a covered procedure of the claim.
+type serviceLine struct {
+	claims.Line
+
+	Code      string
+	Quantity  float64
+	Tooth     string
+	Surface   string
+	Performer string
+}
+
+// serviceLines returns the covered invoice items with their procedure
+// code and the tooth of their treatment.
+func (enc *encoder) serviceLines(invoice *core.Record) ([]serviceLine, error) {
+	covered, err := claims.CoveredLines(enc.app, invoice.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := make([]serviceLine, 0, len(covered))
+	for _, c := range covered {
+		item, err := enc.app.FindRecordById("invoice_items", c.Item)
+		if err != nil {
+			return nil, err
+		}
+
+		line := serviceLine{Line: c, Quantity: item.GetFloat("quantity")}
+
+		treatmentTypeId := item.GetString("treatmentType")
+		if treatment, err := enc.app.FindRecordById("treatments", item.GetString("treatment")); err == nil {
+			line.Tooth = treatment.GetString("toothNumber")
+			line.Surface = treatment.GetString("surface")
+			line.Performer = treatment.GetString("performedBy")
+			if treatmentTypeId == "" {
+				treatmentTypeId = treatment.GetString("treatmentType")
+			}
+		}
+
+		if treatmentType, err := enc.app.FindRecordById("treatments_catalog", treatmentTypeId); err == nil {
+			line.Code = treatmentType.GetString("code")
+		}
+		if line.Code == "" {
+			return nil, fmt.Errorf("the invoice item %q has no procedure code", item.GetString("description"))
+		}
+
+		lines = append(lines, line)
+	}
+
+	return lines, nil
+}
+
+// renderingProvider writes the 2310B loop with the dentist who performed
+// the first treatment of the claim, when they have an NPI.
+func (enc *encoder) renderingProvider(lines []serviceLine) error {
+	for _, line := range lines {
+		if line.Performer == "" {
+			continue
+		}
+
+		staff, err := enc.app.FindFirstRecordByFilter(
+			"staff",
+			"user = {:user} && npi != ''",
+			dbx.Params{"user": line.Performer},
+		)
+		if err != nil {
+			return nil // not a staff member with an NPI, the billing provider renders
+		}
+
+		user, err := enc.app.FindRecordById("users", line.Performer)
+		if err != nil {
+			return nil
+		}
+
+		last, first := splitName(user.GetString("name"))
+		enc.person("82", last, first, "XX", staff.GetString("npi"))
+		return nil
+	}
+
+	return nil
+}
+
+// otherSubscriber writes the 2320 and 2330 loops of a secondary claim with
+// the payment of the primary claim.
+func (enc *encoder) otherSubscriber(primaryId string) error {
+	primary, err := enc.app.FindRecordById("insurance_claims", primaryId)
+	if err != nil {
+		return errors.New("missing primary claim")
+	}
+
+	coverage, err := enc.app.FindRecordById("patient_insurance", primary.GetString("insurance"))
+	if err != nil {
+		return errors.New("missing primary coverage")
+	}
+
+	relationship := coverage.GetString("relationshipToPolicyHolder")
+	self := relationship == "" || relationship == "self"
+
+	enc.w.Write("SBR", payerSequence(coverage), relationshipCode(self), coverage.GetString("groupNumber"), "", "", "", "", "", "CI")
+	enc.w.Write("AMT", "D", amount(money.CurrencyOf(enc.app, primary), money.Get(primary, "paidAmount")))
+	enc.w.Write("OI", "", "", "Y", "", "", "Y")
+
+	last, first := splitName(coverage.GetString("policyHolderName"))
+	if self {
+		patient, err := enc.app.FindRecordById("patients", primary.GetString("patient"))
+		if err == nil {
+			last, first = patient.GetString("lastName"), patient.GetString("firstName")
+		}
+	}
+	enc.person("IL", last, first, "MI", coverage.GetString("policyNumber"))
+	enc.w.Write("NM1", "PR", "2", coverage.GetString("provider"), "", "", "", "", "PI", coverage.GetString("payerId"))
+
+	return nil
+}
+
+// person writes an NM1 segment of an individual.
+func (enc *encoder) person(entity string, last string, first string, idQualifier string, id string) {
+	enc.w.Write("NM1", entity, "1", last, first, "", "", "", idQualifier, id)
+}
+
+// address writes the N3 and N4 segments of an addresses record, if any.
+func (enc *encoder) address(addressId string) {
+	if addressId == "" {
+		return
+	}
+
+	address, err := enc.app.FindRecordById("addresses", addressId)
+	if err != nil {
+		return
+	}
+
+	enc.w.Write("N3", address.GetString("street1"), address.GetString("street2"))
+	enc.w.Write("N4", address.GetString("city"), address.GetString("state"), digits(address.GetString("zipCode")))
+}
+
+// demographics writes the DMG segment, if the birth date is known, with the
+// gender code U when the gender is unknown.
+func (enc *encoder) demographics(birthDate time.Time, gender string) {
+	if birthDate.IsZero() {
+		return
+	}
+
+	code := "U"
+	switch gender {
+	case "male":
+		code = "M"
+	case "female":
+		code = "F"
+	}
+
+	enc.w.Write("DMG", "D8", dateD8(birthDate), code)
+}
+
+// payerSequence returns the payer responsibility code of the coverage.
+func payerSequence(coverage *core.Record) string {
+	switch coverage.GetString("coverageType") {
+	case "secondary":
+		return "S"
+	case "tertiary":
+		return "T"
+	default:
+		return "P"
+	}
+}
+
+// relationshipCode returns the SBR02 individual relationship code, only
+// sent when the subscriber is the patient.
+func relationshipCode(self bool) string {
+	if self {
+		return "18"
+	}
+	return ""
+}
+
+// patientRelationshipCode returns the PAT01 code of the patient
+// relationship to the subscriber.
+func patientRelationshipCode(relationship string) string {
+	switch relationship {
+	case "spouse":
+		return "01"
+	case "child":
+		return "19"
+	default:
+		return "G8"
+	}
+}
+
+// splitName splits a full name into its last name and the rest.
+func splitName(name string) (string, string) {
+	fields := strings.Fields(name)
+	if len(fields) == 0 {
+		return "", ""
+	}
+	return fields[len(fields)-1], strings.Join(fields[:len(fields)-1], " ")
+}
+
+var nonDigits = regexp.MustCompile(`\D`)
+
+// digits strips anything but the digits, e.g. from a phone number.
+func digits(value string) string {
+	return nonDigits.ReplaceAllString(value, "")
+}
+
+// surfaces splits the tooth surfaces, e.g. "MOD" or "M,O,D", into codes.
+func surfaces(surface string) []string {
+	var codes []string
+	for _, r := range strings.ToUpper(surface) {
+		if strings.ContainsRune("MODBFLI5", r) {
+			codes = append(codes, string(r))
+		}
+	}
+	return codes
+}
+
+// controlNumber returns the numeric value of an interchange control number.
+func controlNumber(control string) int {
+	n, _ := strconv.Atoi(strings.TrimLeft(control, "0"))
+	return n
+}
+
+// amount formats a monetary amount of the currency, e.g. "1250.5".
+func amount(currency money.Currency, m money.Money) string {
+	return strconv.FormatFloat(currency.Decimal(m), 'f', -1, 64)
+}
+
+// quantity formats a service quantity.
+func quantity(q float64) string {
+	if q <= 0 {
+		q = 1
+	}
+	return strconv.FormatFloat(q, 'f', -1, 64)
+}
+
+// dateD8 formats a date as CCYYMMDD.
+func dateD8(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Local().Format("20060102")
+}
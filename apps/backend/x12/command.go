@@ -0,0 +1,129 @@
+package x12
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/spf13/cobra"
+)
+
+func newCommand(app core.App) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "x12",
+		Short: "Exchanges X12 claim and remittance files with the clearinghouse",
+	}
+
+	command.AddCommand(newExportCommand(app))
+	command.AddCommand(newImportCommand(app))
+
+	return command
+}
+
+func newExportCommand(app core.App) *cobra.Command {
+	var opts ExportOptions
+	var out string
+
+	command := &cobra.Command{
+		Use:   "export-837 [claim ids...]",
+		Short: "Exports insurance claims as an 837D dental claim file",
+		Long: `Exports insurance claims as an 837D dental claim file.
+
+Without claim ids, all the pending claims are exported. The exported pending
+claims are marked as submitted.`,
+		Example:      "  x12 export-837 --out claims.837",
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			var claims []*core.Record
+			var err error
+			if len(args) > 0 {
+				claims, err = app.FindRecordsByIds("insurance_claims", args)
+				if err == nil && len(claims) != len(args) {
+					err = fmt.Errorf("%d of the %d claims were not found", len(args)-len(claims), len(args))
+				}
+			} else {
+				claims, err = app.FindAllRecords("insurance_claims", dbx.HashExp{"status": "pending"})
+			}
+			if err != nil {
+				return err
+			}
+			if len(claims) == 0 {
+				fmt.Fprintln(os.Stderr, "No claims to export")
+				return nil
+			}
+
+			var w io.Writer = os.Stdout
+			if out != "" {
+				file, err := os.Create(out)
+				if err != nil {
+					return err
+				}
+				defer file.Close()
+				w = file
+			}
+
+			if err := Export837(app, w, claims, opts); err != nil {
+				return err
+			}
+
+			fmt.Fprintf(os.Stderr, "%d claims exported\n", len(claims))
+
+			return nil
+		},
+	}
+
+	command.Flags().StringVar(&out, "out", "", "output file (default: standard output)")
+	command.Flags().BoolVar(&opts.Test, "test", false, "flag the interchange as test data")
+
+	return command
+}
+
+func newImportCommand(app core.App) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "import-835 <file.835>",
+		Short: "Imports an 835 remittance file into the claims and payments",
+		Long: `Imports an 835 remittance file.
+
+The claims are matched by their id, sent in the 837D files, and updated with
+the approved, paid and denied amounts. The paid amounts are posted as
+insurance payments of the claim invoices. Importing a file again doesn't
+post the payments twice.`,
+		Example:      "  x12 import-835 era-2025-06-30.835",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(command *cobra.Command, args []string) error {
+			file, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			remittances, err := Parse835(file)
+			if err != nil {
+				return fmt.Errorf("%s: %w", args[0], err)
+			}
+
+			result, err := Import835(app, remittances)
+			if err != nil {
+				return err
+			}
+
+			for _, skipped := range result.Skipped {
+				fmt.Fprintln(os.Stderr, "skipped", skipped)
+			}
+			fmt.Printf(
+				"%d remittances read: %d claims updated, %d payments posted, %d skipped\n",
+				len(remittances),
+				result.Claims,
+				result.Payments,
+				len(result.Skipped),
+			)
+
+			return nil
+		},
+	}
+
+	return command
+}
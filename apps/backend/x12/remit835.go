@@ -0,0 +1,439 @@
+package x12
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"zahrawiclinic.com/dates"
+	"zahrawiclinic.com/money"
+)
+
+// Remittance is an 835 remittance advice: a payment of the payer and the
+// claims it settles.
+//
+// The amounts are decimals as read from the file, in the currency of the
+// invoices of the claims, and converted to minor units when applied to a
+// claim.
+type Remittance struct {
+	// Amount is the total payment (BPR02) and Method its method (BPR04,
+	// e.g. ACH or CHK).
+	Amount float64
+	Method string
+
+	// PaymentDate is the check issue or EFT effective date (BPR16).
+	PaymentDate time.Time
+
+	// Reference is the check or EFT trace number (TRN02).
+	Reference string
+
+	Payer  string
+	Claims []ClaimPayment
+}
+
+// ClaimPayment is the payment of a claim (CLP loop).
+type ClaimPayment struct {
+	// ClaimId is the submitted claim identifier (CLP01), the
+	// insurance_claims record id.
+	ClaimId string
+
+	// Status is the claim status code (CLP02), e.g. 1 processed as
+	// primary or 4 denied.
+	Status string
+
+	Charge                float64
+	Paid                  float64
+	PatientResponsibility float64
+
+	// PayerClaimNumber is the payer claim control number (CLP07).
+	PayerClaimNumber string
+
+	// Adjustments are the claim level adjustments.
+	Adjustments []Adjustment
+	Services    []ServicePayment
+}
+
+// ServicePayment is the payment of a service line (SVC loop).
+type ServicePayment struct {
+	Code   string
+	Charge float64
+	Paid   float64
+
+	// Item is the invoice item of the line (REF*6R), if returned.
+	Item        string
+	Adjustments []Adjustment
+}
+
+// Adjustment is a claim or service adjustment (CAS).
+type Adjustment struct {
+	// Group is the adjustment group code: CO contractual obligation, PR
+	// patient responsibility, OA other or PI payer initiated.
+	Group string
+
+	// Reason is the claim adjustment reason code, e.g. 1 for the
+	// deductible.
+	Reason string
+	Amount float64
+}
+
+// Code returns the adjustment group and reason, e.g. "CO-45".
+func (a Adjustment) Code() string {
+	return a.Group + "-" + a.Reason
+}
+
+// Parse835 reads the remittance advices of an 835 interchange.
+func Parse835(r io.Reader) ([]Remittance, error) {
+	file, err := Parse(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var remittances []Remittance
+	var remittance *Remittance
+	var claim *ClaimPayment
+	var service *ServicePayment
+
+	for _, s := range file.Segments {
+		switch s.ID() {
+		case "ST":
+			if s.Element(1) != "835" {
+				return nil, fmt.Errorf("not an 835 transaction: %s", s.Element(1))
+			}
+			remittances = append(remittances, Remittance{})
+			remittance = &remittances[len(remittances)-1]
+			claim, service = nil, nil
+		case "SE":
+			remittance, claim, service = nil, nil, nil
+		}
+
+		if remittance == nil {
+			continue
+		}
+
+		switch s.ID() {
+		case "BPR":
+			remittance.Amount = parseAmount(s.Element(2))
+			remittance.Method = s.Element(4)
+			remittance.PaymentDate = parseDate(s.Element(16))
+		case "TRN":
+			remittance.Reference = s.Element(2)
+		case "N1":
+			if s.Element(1) == "PR" {
+				remittance.Payer = s.Element(2)
+			}
+		case "CLP":
+			remittance.Claims = append(remittance.Claims, ClaimPayment{
+				ClaimId:               s.Element(1),
+				Status:                s.Element(2),
+				Charge:                parseAmount(s.Element(3)),
+				Paid:                  parseAmount(s.Element(4)),
+				PatientResponsibility: parseAmount(s.Element(5)),
+				PayerClaimNumber:      s.Element(7),
+			})
+			claim = &remittance.Claims[len(remittance.Claims)-1]
+			service = nil
+		case "SVC":
+			if claim == nil {
+				continue
+			}
+			code := file.Components(s.Element(1))
+			payment := ServicePayment{
+				Charge: parseAmount(s.Element(2)),
+				Paid:   parseAmount(s.Element(3)),
+			}
+			if len(code) > 1 {
+				payment.Code = code[1]
+			}
+			claim.Services = append(claim.Services, payment)
+			service = &claim.Services[len(claim.Services)-1]
+		case "CAS":
+			adjustments := parseAdjustments(s)
+			switch {
+			case service != nil:
+				service.Adjustments = append(service.Adjustments, adjustments...)
+			case claim != nil:
+				claim.Adjustments = append(claim.Adjustments, adjustments...)
+			}
+		case "REF":
+			if service != nil && s.Element(1) == "6R" {
+				service.Item = s.Element(2)
+			}
+		}
+	}
+
+	if len(remittances) == 0 {
+		return nil, errors.New("the interchange has no 835 transaction")
+	}
+
+	return remittances, nil
+}
+
+// parseAdjustments reads the reason and amount pairs of a CAS segment.
+func parseAdjustments(s Segment) []Adjustment {
+	var adjustments []Adjustment
+	// up to 6 reason, amount and quantity triplets
+	for i := 2; i < len(s); i += 3 {
+		if s.Element(i) == "" {
+			continue
+		}
+		adjustments = append(adjustments, Adjustment{
+			Group:  s.Element(1),
+			Reason: s.Element(i),
+			Amount: parseAmount(s.Element(i + 1)),
+		})
+	}
+	return adjustments
+}
+
+func parseAmount(value string) float64 {
+	amount, _ := strconv.ParseFloat(value, 64)
+	return amount
+}
+
+func parseDate(value string) time.Time {
+	t, err := time.ParseInLocation("20060102", value, time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// ImportResult summarizes an 835 import.
+type ImportResult struct {
+	// Claims is the number of updated claims.
+	Claims int
+
+	// Payments is the number of posted insurance payments.
+	Payments int
+
+	// Skipped lists the claim payments that were not imported and why.
+	Skipped []string
+}
+
+// Import835 applies the remittance advices to the claims and posts the
+// insurance payments.
+//
+// Each claim payment updates the matching claim amounts and status and
+// posts an insurance payment on the claim invoice. The import can be run
+// again: only the paid amounts not recorded as payments yet are posted.
+func Import835(app core.App, remittances []Remittance) (ImportResult, error) {
+	var result ImportResult
+
+	for _, remittance := range remittances {
+		for _, payment := range remittance.Claims {
+			var posted bool
+
+			err := app.RunInTransaction(func(txApp core.App) error {
+				var err error
+				posted, err = applyClaimPayment(txApp, remittance, payment)
+				return err
+			})
+			if err != nil {
+				result.Skipped = append(result.Skipped, fmt.Sprintf("claim %s: %v", payment.ClaimId, err))
+				continue
+			}
+
+			result.Claims++
+			if posted {
+				result.Payments++
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// applyClaimPayment updates the claim from its payment and posts the
+// insurance payment, reporting whether a payment was posted.
+func applyClaimPayment(app core.App, remittance Remittance, payment ClaimPayment) (bool, error) {
+	if payment.Status == "22" {
+		return false, errors.New("payment reversals must be handled manually")
+	}
+
+	claim, err := app.FindRecordById("insurance_claims", payment.ClaimId)
+	if err != nil {
+		return false, errors.New("unknown claim")
+	}
+
+	// the remittance amounts are in the currency of the claim invoice
+	currency := money.CurrencyOf(app, claim)
+	charge := currency.FromDecimal(payment.Charge)
+	paid := currency.FromDecimal(payment.Paid)
+
+	var contractual, deductible, denied money.Money
+	var reasons, codes []string
+	adjustments := payment.Adjustments
+	for _, service := range payment.Services {
+		adjustments = append(adjustments, service.Adjustments...)
+		if service.Paid == 0 && service.Charge > 0 && payerAdjusted(service.Adjustments) {
+			denied += currency.FromDecimal(service.Charge)
+		}
+	}
+	for _, adjustment := range adjustments {
+		switch {
+		case adjustment.Group == "CO" || adjustment.Group == "PI":
+			contractual += currency.FromDecimal(adjustment.Amount)
+		case adjustment.Group == "PR" && adjustment.Reason == "1":
+			deductible += currency.FromDecimal(adjustment.Amount)
+		}
+		if adjustment.Group != "PR" {
+			reasons = append(reasons, adjustment.Code())
+			codes = append(codes, adjustment.Reason)
+		}
+	}
+
+	status := "paid"
+	switch {
+	case payment.Status == "4":
+		status = "denied"
+		denied = charge
+	case paid < money.Get(claim, "claimedAmount"):
+		status = "partial"
+	}
+
+	approved := max(charge-contractual, 0)
+	if status == "denied" {
+		approved = 0
+	}
+
+	// posted first, with the remittance reference, so that saving the
+	// claim doesn't record its paid amount as another payment
+	posted, err := postPayment(app, claim, remittance, paid)
+	if err != nil {
+		return false, err
+	}
+
+	money.Set(claim, "approvedAmount", approved)
+	money.Set(claim, "paidAmount", paid)
+	money.Set(claim, "deniedAmount", denied)
+	money.Set(claim, "patientResponsibility", currency.FromDecimal(payment.PatientResponsibility))
+	money.Set(claim, "deductibleApplied", deductible)
+	claim.Set("status", status)
+	claim.Set("processedDate", dates.Today())
+	if paid > 0 && !remittance.PaymentDate.IsZero() {
+		claim.Set("paidDate", remittance.PaymentDate)
+	}
+	if claim.GetString("claimNumber") == "" {
+		claim.Set("claimNumber", payment.PayerClaimNumber)
+	}
+	if status == "denied" || denied > 0 {
+		claim.Set("denialReason", "Adjustment codes: "+strings.Join(reasons, ", "))
+
+		denialReasons, err := findDenialReasons(app, codes)
+		if err != nil {
+			return false, err
+		}
+		claim.Set("denialReasons", denialReasons)
+	}
+
+	if err := app.Save(claim); err != nil {
+		return false, err
+	}
+
+	return posted, nil
+}
+
+// payerAdjusted reports whether the payer adjusted the line for another
+// reason than the patient responsibility (CO, PI or OA): an unpaid line
+// fully applied to the deductible isn't denied.
+func payerAdjusted(adjustments []Adjustment) bool {
+	for _, adjustment := range adjustments {
+		if adjustment.Group != "PR" {
+			return true
+		}
+	}
+	return false
+}
+
+// findDenialReasons returns the ids of the denial reasons with the given
+// codes, in the order of the codes. The unknown codes are ignored.
+func findDenialReasons(app core.App, codes []string) ([]string, error) {
+	if len(codes) == 0 {
+		return nil, nil
+	}
+
+	values := make([]any, len(codes))
+	for i, code := range codes {
+		values[i] = code
+	}
+
+	records, err := app.FindAllRecords("denial_reasons", dbx.In("code", values...))
+	if err != nil {
+		return nil, err
+	}
+
+	byCode := make(map[string]string, len(records))
+	for _, record := range records {
+		byCode[record.GetString("code")] = record.Id
+	}
+
+	var ids []string
+	for _, code := range codes {
+		if id, ok := byCode[code]; ok && !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
+
+// postPayment posts the part of the claim payment not recorded as payments
+// yet as an insurance payment of the claim invoice: an 835 imported again,
+// or a corrected claim paid again in a later 835 with the full paid amount,
+// only posts the difference.
+func postPayment(app core.App, claim *core.Record, remittance Remittance, paid money.Money) (bool, error) {
+	if paid <= 0 || claim.GetString("invoice") == "" {
+		return false, nil
+	}
+
+	// the paid amount and the invoice amounts of the payments are both in
+	// the currency of the claim invoice
+	var recorded struct {
+		Total float64 `db:"total"`
+	}
+	err := app.DB().
+		Select("COALESCE(SUM([[invoiceAmount]]), 0) AS total").
+		From("payments").
+		Where(dbx.HashExp{"insuranceClaim": claim.Id}).
+		One(&recorded)
+	if err != nil {
+		return false, err
+	}
+
+	unrecorded := paid - money.FromMinor(recorded.Total)
+	if unrecorded <= 0 {
+		return false, nil
+	}
+
+	payments, err := app.FindCollectionByNameOrId("payments")
+	if err != nil {
+		return false, err
+	}
+
+	paymentDate := remittance.PaymentDate
+	if paymentDate.IsZero() {
+		paymentDate = dates.Today()
+	}
+
+	record := core.NewRecord(payments)
+	record.Set("invoice", claim.GetString("invoice"))
+	record.Set("patient", claim.GetString("patient"))
+	record.Set("insuranceClaim", claim.Id)
+	record.Set("paymentMethod", "insurance")
+	record.Set("paymentDate", paymentDate)
+	record.Set("reference", remittance.Reference)
+	record.Set("notes", strings.TrimSpace("835 remittance "+remittance.Payer))
+	money.Set(record, "amount", unrecorded)
+
+	if err := app.Save(record); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
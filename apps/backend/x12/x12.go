@@ -0,0 +1,178 @@
+// Package x12 reads and writes the ANSI X12 files exchanged with the
+// clearinghouse: the 837D dental claims are exported from the
+// insurance_claims collection and the 835 remittance advices are imported
+// back into the claims and the insurance payments.
+package x12
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/spf13/cobra"
+)
+
+// The delimiters of the written files.
+const (
+	elementSeparator    = "*"
+	componentSeparator  = ":"
+	repetitionSeparator = "^"
+	segmentTerminator   = "~"
+)
+
+// Register binds the x12 command to the root command.
+func Register(app core.App, rootCmd *cobra.Command) {
+	rootCmd.AddCommand(newCommand(app))
+}
+
+// Segment is an X12 segment: its identifier followed by its elements.
+type Segment []string
+
+// ID returns the segment identifier, e.g. "CLP".
+func (s Segment) ID() string {
+	if len(s) == 0 {
+		return ""
+	}
+	return s[0]
+}
+
+// Element returns the element at the given position, numbered from 1 as
+// in the implementation guides, or "" when the segment is shorter.
+func (s Segment) Element(i int) string {
+	if i < 1 || i >= len(s) {
+		return ""
+	}
+	return s[i]
+}
+
+// File is a parsed X12 interchange.
+type File struct {
+	Segments []Segment
+
+	// componentSeparator is declared by the ISA segment.
+	componentSeparator string
+}
+
+// Components splits a composite element, e.g. "AD:D2740".
+func (f *File) Components(element string) []string {
+	return strings.Split(element, f.componentSeparator)
+}
+
+// Parse reads an X12 interchange. The delimiters are the ones declared by
+// its ISA segment and the line breaks around the segments are ignored.
+func Parse(r io.Reader) (*File, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	data = bytes.TrimLeft(data, " \t\r\n\ufeff")
+	// the ISA segment has a fixed length of 106 characters
+	if len(data) < 106 || string(data[:3]) != "ISA" {
+		return nil, errors.New("not an X12 interchange, missing ISA segment")
+	}
+
+	elements := string(data[3])
+	components := string(data[104])
+	terminator := string(data[105])
+
+	file := &File{componentSeparator: components}
+	for _, raw := range strings.Split(string(data), terminator) {
+		raw = strings.Trim(raw, " \t\r\n")
+		if raw == "" {
+			continue
+		}
+		file.Segments = append(file.Segments, Segment(strings.Split(raw, elements)))
+	}
+
+	return file, nil
+}
+
+// Writer writes the segments of an X12 interchange.
+type Writer struct {
+	w *bufio.Writer
+
+	// count is the number of segments since the last ST segment.
+	count int
+	err   error
+}
+
+// NewWriter returns a writer of X12 segments to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// Write writes a segment. The delimiters found in the element values are
+// replaced with spaces and the trailing empty elements are dropped.
+func (w *Writer) Write(id string, elements ...string) {
+	for i, element := range elements {
+		elements[i] = clean(element, elementSeparator, segmentTerminator, repetitionSeparator)
+	}
+	for len(elements) > 0 && elements[len(elements)-1] == "" {
+		elements = elements[:len(elements)-1]
+	}
+
+	w.writeRaw(strings.Join(append([]string{id}, elements...), elementSeparator))
+}
+
+// writeRaw writes a segment as is.
+func (w *Writer) writeRaw(segment string) {
+	if w.err != nil {
+		return
+	}
+
+	if strings.HasPrefix(segment, "ST"+elementSeparator) {
+		w.count = 0
+	}
+	w.count++
+
+	_, w.err = w.w.WriteString(segment + segmentTerminator + "\n")
+}
+
+// Count returns the number of segments written since the last ST segment,
+// including it, as reported by the SE segment.
+func (w *Writer) Count() int {
+	return w.count
+}
+
+// Flush writes the buffered segments and returns the first write error.
+func (w *Writer) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	return w.w.Flush()
+}
+
+// Composite joins the components of a composite element, dropping the
+// trailing empty ones.
+func Composite(components ...string) string {
+	for i, component := range components {
+		components[i] = clean(component, componentSeparator)
+	}
+	for len(components) > 0 && components[len(components)-1] == "" {
+		components = components[:len(components)-1]
+	}
+
+	return strings.Join(components, componentSeparator)
+}
+
+// clean replaces the delimiters in the value with spaces.
+func clean(value string, delimiters ...string) string {
+	for _, delimiter := range delimiters {
+		value = strings.ReplaceAll(value, delimiter, " ")
+	}
+	return strings.TrimSpace(value)
+}
+
+// pad left-aligns the value in a fixed-length ISA element.
+func pad(value string, length int) string {
+	value = clean(value, elementSeparator, segmentTerminator, repetitionSeparator, componentSeparator)
+	if len(value) > length {
+		return value[:length]
+	}
+	return fmt.Sprintf("%-*s", length, value)
+}